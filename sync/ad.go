@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// adGuidAttr is Active Directory's binary objectGUID attribute, usable as a
+// stable EnvMatchAttribute for LdapDirectoryAD.
+const adGuidAttr = "objectGUID"
+
+const (
+	// adGlobalCatalogPort is the global catalog's port for EnvLdapGlobalCatalog.
+	adGlobalCatalogPort = "3268"
+
+	// adGlobalCatalogPortSsl is the global catalog's port for the ssl LDAP_METHOD.
+	adGlobalCatalogPortSsl = "3269"
+)
+
+// ldapUsesGuid checks if users are matched by their objectGUID, being
+// LdapDirectoryAD with objectGUID as EnvMatchAttribute.
+func ldapUsesGuid() bool {
+	return cfg.ldapDirectory == LdapDirectoryAD && strings.EqualFold(cfg.matchAttribute, adGuidAttr)
+}
+
+// ldapUidFilter returns the filter matching a user's EnvMatchAttribute value,
+// being substituted into the EnvLdapUserFilter, if set.
+//
+// The value is escaped as of RFC 4515, thus parentheses or asterisks of a user
+// cannot alter the filter. For ldapUsesGuid, the user is the objectGUID's
+// string form, which is converted to its escaped binary value. An unparsable
+// GUID matches no entry.
+func ldapUidFilter(uid string) string {
+	attr, value := cfg.matchAttribute, ldap.EscapeFilter(uid)
+	if ldapUsesGuid() {
+		attr = adGuidAttr
+		if guid, err := adGuidBytes(uid); err == nil {
+			var b strings.Builder
+			for _, c := range guid {
+				fmt.Fprintf(&b, "\\%02x", c)
+			}
+			value = b.String()
+		}
+	}
+
+	if cfg.ldapUserFilter != "" {
+		return strings.Replace(cfg.ldapUserFilter, ldapUserFilterVerb, value, 1)
+	}
+	return fmt.Sprintf("(%s=%s)", attr, value)
+}
+
+// ldapUidPresentFilter returns the filter matching all users having an
+// EnvMatchAttribute value, being the EnvLdapUserFilter for any value, if set.
+func ldapUidPresentFilter() string {
+	if cfg.ldapUserFilter != "" {
+		return strings.Replace(cfg.ldapUserFilter, ldapUserFilterVerb, "*", 1)
+	}
+	return fmt.Sprintf("(%s=*)", cfg.matchAttribute)
+}
+
+// ldapEntryUids returns an entry's EnvMatchAttribute values, being the
+// objectGUID's string form for ldapUsesGuid.
+func ldapEntryUids(entry *ldap.Entry) []string {
+	if ldapUsesGuid() {
+		if raw := entry.GetRawAttributeValue(adGuidAttr); len(raw) == 16 {
+			return []string{adGuidString(raw)}
+		}
+		return nil
+	}
+	return entry.GetEqualFoldAttributeValues(cfg.matchAttribute)
+}
+
+// adGuidString formats a binary objectGUID as its lowercase string form, e.g.,
+// "3f2504e0-4f89-11d3-9a0c-0305e82c3301". As Microsoft's GUID structure, its
+// first three groups are stored in little-endian byte order.
+func adGuidString(raw []byte) string {
+	return fmt.Sprintf("%02x%02x%02x%02x-%02x%02x-%02x%02x-%x-%x",
+		raw[3], raw[2], raw[1], raw[0], raw[5], raw[4], raw[7], raw[6], raw[8:10], raw[10:16])
+}
+
+// adGuidBytes parses an objectGUID's string form, optionally in braces, to
+// its binary value, reversing adGuidString.
+func adGuidBytes(guid string) (raw []byte, err error) {
+	guid = strings.Trim(guid, "{}")
+	b, err := hex.DecodeString(strings.ReplaceAll(guid, "-", ""))
+	if err != nil {
+		return
+	} else if len(b) != 16 || strings.Count(guid, "-") != 4 {
+		err = fmt.Errorf("invalid GUID %q", guid)
+		return
+	}
+
+	raw = []byte{b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6]}
+	raw = append(raw, b[8:]...)
+	return
+}
+
+// ldapRangedValues returns all values of an entry's attribute, following
+// Active Directory's range retrieval of multi-valued attributes.
+//
+// For large groups, Active Directory returns only a range of an attribute,
+// e.g., "member;range=0-1499", and the following ranges need to be requested
+// explicitly, until a range ends with "*".
+func ldapRangedValues(conn ldapSearcher, entry *ldap.Entry, attr string) (values []string, err error) {
+	for {
+		var next string
+		for _, entryAttr := range entry.Attributes {
+			name, rangeStr, ranged := strings.Cut(entryAttr.Name, ";range=")
+			if !strings.EqualFold(name, attr) {
+				continue
+			}
+
+			values = append(values, entryAttr.Values...)
+			if !ranged {
+				continue
+			}
+			if _, end, _ := strings.Cut(rangeStr, "-"); end != "*" {
+				var last int
+				if last, err = strconv.Atoi(end); err != nil {
+					err = fmt.Errorf("invalid range %q of %s", rangeStr, attr)
+					return
+				}
+				next = fmt.Sprintf("%s;range=%d-*", attr, last+1)
+			}
+		}
+		if next == "" {
+			return
+		}
+
+		searchReq := ldap.NewSearchRequest(
+			entry.DN,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0,
+			false,
+			"(objectClass=*)",
+			[]string{next},
+			nil)
+
+		var searchResp *ldap.SearchResult
+		if searchResp, err = ldapSearch(conn, searchReq); err != nil {
+			return
+		} else if len(searchResp.Entries) != 1 {
+			err = fmt.Errorf("cannot fetch %s of %s", next, entry.DN)
+			return
+		}
+		entry = searchResp.Entries[0]
+	}
+}
@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// adminSyncRequest is a sync triggered by adminSyncHandler, performed by the
+// syncInterval loop, which sends its outcome to result.
+type adminSyncRequest struct {
+	result chan<- adminSyncResult
+}
+
+// adminSyncResult is the JSON response of adminSyncHandler.
+type adminSyncResult struct {
+	Finished   time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	ExitCode   int       `json:"exit_code"`
+}
+
+// adminSyncRequests are the pending adminSyncRequests. As it is unbuffered, a
+// request waits for a running sync to finish.
+var adminSyncRequests = make(chan adminSyncRequest)
+
+// adminAuthorized checks the request's bearer token against EnvAdminToken.
+func adminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.adminToken)) == 1
+}
+
+// adminSyncHandler serves POST /sync, performing an immediate sync and
+// responding with its outcome.
+func adminSyncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	result := make(chan adminSyncResult, 1)
+	select {
+	case adminSyncRequests <- adminSyncRequest{result: result}:
+	case <-r.Context().Done():
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(<-result)
+}
+
+// adminSyncPerform performs an adminSyncRequest by syncRun.
+func adminSyncPerform(req adminSyncRequest, run func() error) {
+	start := time.Now()
+	err := run()
+
+	result := adminSyncResult{
+		Finished:   time.Now(),
+		DurationMs: time.Since(start).Milliseconds(),
+		Success:    err == nil,
+		ExitCode:   syncExitCode(err),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	req.result <- result
+}
+
+// adminPauseResult is the JSON response of adminPauseHandler.
+type adminPauseResult struct {
+	Paused bool `json:"paused"`
+}
+
+// adminPauseHandler serves POST /pause or, if not paused, POST /resume, setting
+// the syncPaused state. It responds with the resulting syncIsPaused, which
+// stays set for an existing EnvPauseFile.
+func adminPauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !adminAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if syncPaused.Swap(paused) != paused {
+			log.WithField("paused", paused).Warn("Toggled pause of scheduled syncs by the admin API")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(adminPauseResult{Paused: syncIsPaused()})
+	}
+}
+
+// adminPprofPath is the prefix of the EnvAdminPprof endpoints.
+const adminPprofPath = "/debug/pprof/"
+
+// adminPprofHandle registers net/http/pprof's endpoints on the EnvAdminAddr
+// for EnvAdminPprof, each requiring the EnvAdminToken.
+func adminPprofHandle() {
+	for path, handler := range map[string]http.HandlerFunc{
+		adminPprofPath:             pprof.Index,
+		adminPprofPath + "cmdline": pprof.Cmdline,
+		adminPprofPath + "profile": pprof.Profile,
+		adminPprofPath + "symbol":  pprof.Symbol,
+		adminPprofPath + "trace":   pprof.Trace,
+	} {
+		httpHandle(cfg.adminAddr, path, adminPprofAuthorized(handler))
+	}
+}
+
+// adminPprofAuthorized rejects unauthorized requests before the handler.
+func adminPprofAuthorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
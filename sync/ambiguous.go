@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ldapTieBreakerAttr returns the attribute of the EnvAmbiguousTieBreaker and
+// whether its highest value wins.
+func ldapTieBreakerAttr() (attr string, desc bool) {
+	attr, desc = strings.CutPrefix(cfg.ambiguousTieBreaker, "-")
+	return
+}
+
+// ldapTieCompare orders two values of the EnvAmbiguousTieBreaker, the winning
+// one first. Values are compared as integers if both are, otherwise as
+// strings, e.g., for generalized times. Missing values are ordered last.
+func ldapTieCompare(a, b string, desc bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+
+	c := strings.Compare(a, b)
+	if x, errA := strconv.ParseInt(a, 10, 64); errA == nil {
+		if y, errB := strconv.ParseInt(b, 10, 64); errB == nil {
+			c = cmp.Compare(x, y)
+		}
+	}
+	if desc {
+		c = -c
+	}
+	return c
+}
+
+// ldapTieBreak picks the entry winning by the EnvAmbiguousTieBreaker, being
+// nil if none has the attribute or the first ones have the same value.
+func ldapTieBreak(entries []*ldap.Entry) *ldap.Entry {
+	attr, desc := ldapTieBreakerAttr()
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b *ldap.Entry) int {
+		return ldapTieCompare(a.GetEqualFoldAttributeValue(attr), b.GetEqualFoldAttributeValue(attr), desc)
+	})
+
+	first, second := sorted[0].GetEqualFoldAttributeValue(attr), sorted[1].GetEqualFoldAttributeValue(attr)
+	if first == "" || ldapTieCompare(first, second, desc) == 0 {
+		return nil
+	}
+	return sorted[0]
+}
+
+// ldapDisambiguate resolves multiple entries of a user's searchReq by the
+// EnvAmbiguousPolicy, returning the single entry or an errLdapUserAmbiguous.
+//
+// For AmbiguousPolicyFilter, the search is repeated with the EnvAmbiguousFilter
+// added, subject to the EnvLdapRate. Each ambiguous user is logged with the
+// DNs of its entries, thus the directory might be cleaned up.
+func ldapDisambiguate(ctx context.Context, conn ldapSearcher, user string, searchReq *ldap.SearchRequest, entries []*ldap.Entry) (entry *ldap.Entry, err error) {
+	dns := make([]string, 0, len(entries))
+	for _, e := range entries {
+		dns = append(dns, e.DN)
+	}
+	fields := log.Fields{
+		"user":   user,
+		"dns":    dns,
+		"policy": cfg.ambiguousPolicy,
+	}
+
+	switch cfg.ambiguousPolicy {
+	case AmbiguousPolicyTieBreaker:
+		entry = ldapTieBreak(entries)
+
+	case AmbiguousPolicyFilter:
+		if err = ldapRateWait(ctx); err != nil {
+			return
+		}
+		filtered := *searchReq
+		filtered.Filter = "(&" + searchReq.Filter + cfg.ambiguousFilter + ")"
+
+		var searchResp *ldap.SearchResult
+		if searchResp, err = ldapSearchContext(ctx, conn, &filtered); err != nil {
+			return
+		}
+		if len(searchResp.Entries) == 1 {
+			entry = searchResp.Entries[0]
+		}
+	}
+
+	if entry == nil {
+		log.WithFields(fields).Warn("Multiple LDAP entries match the user, skipping it")
+		return nil, fmt.Errorf("%w, got %d", errLdapUserAmbiguous, len(entries))
+	}
+	log.WithFields(fields).WithField("dn", entry.DN).Warn("Multiple LDAP entries match the user, picked one by the policy")
+	return
+}
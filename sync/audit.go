@@ -0,0 +1,100 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sqlAuditMigrations create and migrate the EnvAuditTable. Besides sqlQuery's
+// identifiers, {table}, {table_index}, and {serial} are replaced by
+// sqlAuditQuery.
+//
+// As each statement is idempotent, all are executed before each write. Schema
+// changes must be appended as further statements, never edited in place.
+var sqlAuditMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS {table} (
+		{id}         {serial},
+		{created_at} TIMESTAMP NOT NULL,
+		{run_id}     TEXT NOT NULL,
+		{user_id}    BIGINT,
+		{social_uid} TEXT NOT NULL,
+		{attribute}  TEXT NOT NULL,
+		{old_value}  TEXT,
+		{new_value}  TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS {table_index} ON {table} ({user_id}, {created_at})`,
+}
+
+// sqlAuditQuery translates a query on the EnvAuditTable.
+func sqlAuditQuery(db *sqlDB, query string) string {
+	return db.query(strings.NewReplacer(
+		"{table}", "{"+cfg.auditTable+"}",
+		"{table_index}", "{"+cfg.auditTable+"_user_id_idx}",
+		"{serial}", db.dialect.serialKey(),
+	).Replace(query))
+}
+
+// sqlWriteAudit records applied changes of a run into the EnvAuditTable,
+// after creating or migrating it by sqlAuditMigrations.
+//
+// The ids are taken from the SQL user ids, keyed by their social_uid. Thus,
+// provisioned users are recorded without an id. All changes are written in one
+// transaction, independent of the sync's updates.
+func sqlWriteAudit(ctx context.Context, db *sqlDB, runId string, applied []attrChange, ids map[string]string) (err error) {
+	for _, migration := range sqlAuditMigrations {
+		if _, err = db.ExecContext(ctx, sqlAuditQuery(db, migration)); err != nil {
+			return
+		}
+	}
+
+	if len(applied) == 0 {
+		return
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, sqlAuditQuery(db, `
+		INSERT INTO {table} ({created_at}, {run_id}, {user_id}, {social_uid}, {attribute}, {old_value}, {new_value})
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	now := time.Now().UTC()
+	for _, change := range applied {
+		var userId *string
+		if id, ok := ids[change.user]; ok {
+			userId = &id
+		}
+
+		if _, err = stmt.ExecContext(ctx, now, runId, userId, change.user, change.attribute, change.old, change.new); err != nil {
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"table":   cfg.auditTable,
+		"changes": len(applied),
+	}).Debug("Recorded applied changes in the audit table")
+	return
+}
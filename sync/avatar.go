@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"sync"
+)
+
+// avatarJpegQuality is the JPEG quality of re-encoded avatars.
+const avatarJpegQuality = 85
+
+// avatarCache maps the SHA-256 hash of a raw LDAP photo to its data URI.
+//
+// As photos rarely change, this skips decoding and resizing unchanged photos
+// on each following sync in daemon mode.
+var avatarCache struct {
+	sync.Mutex
+	uris map[[sha256.Size]byte]string
+}
+
+// avatarDataUri converts a raw LDAP photo, either JPEG or PNG, to a JPEG data
+// URI usable as Greenlight's image column. Photos exceeding size pixels in
+// either dimension are scaled down, keeping their aspect ratio.
+func avatarDataUri(photo []byte, size int) (uri string, err error) {
+	hash := sha256.Sum256(photo)
+
+	avatarCache.Lock()
+	defer avatarCache.Unlock()
+
+	if uri, ok := avatarCache.uris[hash]; ok {
+		return uri, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(photo))
+	if err != nil {
+		err = fmt.Errorf("cannot decode photo: %w", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, avatarResize(img, size), &jpeg.Options{Quality: avatarJpegQuality})
+	if err != nil {
+		return
+	}
+
+	uri = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	if avatarCache.uris == nil {
+		avatarCache.uris = make(map[[sha256.Size]byte]string)
+	}
+	avatarCache.uris[hash] = uri
+	return
+}
+
+// avatarResize scales img down to fit into size x size pixels by averaging
+// the covered source pixels. Smaller images are returned as they are.
+func avatarResize(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	dstW, dstH := size, size
+	if w > h {
+		dstH = max(1, h*size/w)
+	} else {
+		dstW = max(1, w*size/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := bounds.Min.Y+y*h/dstH, bounds.Min.Y+(y+1)*h/dstH
+		for x := 0; x < dstW; x++ {
+			x0, x1 := bounds.Min.X+x*w/dstW, bounds.Min.X+(x+1)*w/dstW
+
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					sr, sg, sb, _ := img.At(sx, sy).RGBA()
+					r, g, b, n = r+uint64(sr), g+uint64(sg), b+uint64(sb), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), 0xffff})
+		}
+	}
+	return dst
+}
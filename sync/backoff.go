@@ -0,0 +1,193 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// permanentError marks an error which will not be resolved by retrying, e.g.,
+// a configuration error.
+type permanentError struct {
+	error
+}
+
+func (err permanentError) Unwrap() error {
+	return err.error
+}
+
+// fullJitterBackoff returns a random duration in [0, min(max, base * 2^attempt)).
+//
+// Drawing the whole delay at random, known as "full jitter", spreads reconnect
+// attempts of multiple replicas after an outage instead of synchronizing them.
+func fullJitterBackoff(base, max time.Duration, attempt int) time.Duration {
+	ceil := max
+	if attempt < 62 && base<<attempt > 0 && base<<attempt < max {
+		ceil = base << attempt
+	}
+	if ceil <= 0 {
+		return 0
+	}
+	return rand.N(ceil)
+}
+
+// retriesUsed counts the retries of the current sync for EnvRetryBudget. It is
+// reset by syncAction.
+var retriesUsed atomic.Int64
+
+// errRetryBudgetExhausted reports that the EnvRetryBudget of a sync was used.
+var errRetryBudgetExhausted = errors.New("retry budget of this sync is exhausted")
+
+// retryTake consumes a retry from the EnvRetryBudget, if any is left.
+func retryTake() bool {
+	if cfg.retryBudget == 0 {
+		retriesUsed.Add(1)
+		return true
+	}
+	if retriesUsed.Add(1) > int64(cfg.retryBudget) {
+		retriesUsed.Add(-1)
+		return false
+	}
+	return true
+}
+
+// dialRetry calls dial until it succeeds, retrying up to the configured
+// EnvDialRetries with a full jitter backoff. Permanent errors are not retried.
+//
+// Each retry consumes the sync's EnvRetryBudget. Once exhausted, the last error
+// is returned together with errRetryBudgetExhausted.
+func dialRetry(name string, dial func() error) error {
+	return retry(name, "Dial", cfg.dialRetries, dial)
+}
+
+// opRetry calls op until it succeeds, like dialRetry, but up to the configured
+// EnvOpRetries. It is meant for operations on an established connection, e.g.,
+// a search or a transaction, where op marks non-transient errors as permanent.
+func opRetry(name string, op func() error) error {
+	return retry(name, "Operation", cfg.opRetries, op)
+}
+
+// retry implements dialRetry and opRetry, logging failed attempts as what.
+func retry(name, what string, retries int, fn func() error) (err error) {
+	for attempt := 0; ; attempt++ {
+		err = fn()
+
+		var permErr permanentError
+		if err == nil || errors.As(err, &permErr) || attempt >= retries {
+			return
+		}
+
+		if !retryTake() {
+			err = errors.Join(errRetryBudgetExhausted, err)
+			return
+		}
+
+		backoff := fullJitterBackoff(cfg.dialBackoffBase, cfg.dialBackoffMax, attempt)
+		log.WithFields(log.Fields{
+			"target":  name,
+			"attempt": attempt + 1,
+			"backoff": backoff,
+		}).WithError(err).Warn(what + " failed, retrying")
+		time.Sleep(backoff)
+	}
+}
+
+// failureBreaker backs off the scheduled syncs after consecutive failed ones
+// for the EnvFailureBackoffMax, acting as a circuit breaker while the LDAP
+// server or the database is unreachable.
+//
+// After n consecutive failures, the next scheduled sync is delayed to
+// 2^(n-1) times the regular delay, capped by the EnvFailureBackoffMax. The
+// regular schedule resumes after the first successful sync.
+//
+// Instead of alerting on each failed sync, the chats and Kubernetes events are
+// notified on the first failure, on each doubling of the consecutive
+// failures, and on the recovery only.
+type failureBreaker struct {
+	failures atomic.Int64
+
+	// until is the end of the current backoff, being zero without one.
+	until atomic.Pointer[time.Time]
+}
+
+// syncBreaker is the failureBreaker of the scheduled syncs.
+var syncBreaker failureBreaker
+
+// enabled checks if failed syncs are backed off.
+func (b *failureBreaker) enabled() bool {
+	return cfg.failureBackoff > 0 && cfg.scheduled()
+}
+
+// silenced checks if a failed sync's alert is suppressed, as a previous
+// consecutive failure was alerted already.
+func (b *failureBreaker) silenced() bool {
+	return b.enabled() && b.failures.Load() > 0
+}
+
+// escalating checks if the current number of consecutive failures is alerted,
+// being the first one or a power of two.
+func (b *failureBreaker) escalating() bool {
+	n := b.failures.Load()
+	return n > 0 && n&(n-1) == 0
+}
+
+// backoffEnd returns the end of the current backoff, if any.
+func (b *failureBreaker) backoffEnd() (time.Time, bool) {
+	until := b.until.Load()
+	if until == nil || !time.Now().Before(*until) {
+		return time.Time{}, false
+	}
+	return *until, true
+}
+
+// record updates the breaker by a sync's outcome, with regular being the delay
+// until the next regular sync.
+func (b *failureBreaker) record(err error, regular time.Duration) {
+	if !b.enabled() {
+		return
+	}
+
+	if err == nil {
+		if n := b.failures.Swap(0); n > 0 {
+			b.until.Store(nil)
+			log.WithField("failures", n).Info("LDAP sync recovered, resuming the regular schedule")
+			chatPost(fmt.Sprintf("Greenlight LDAP sync recovered after %d consecutive failures", n))
+		}
+		return
+	}
+
+	n := b.failures.Add(1)
+	if n == 1 {
+		return
+	}
+
+	backoff := cfg.failureBackoff
+	if shift := n - 1; shift < 62 && regular<<shift > 0 && regular<<shift < backoff {
+		backoff = regular << shift
+	}
+	until := time.Now().Add(backoff)
+	b.until.Store(&until)
+
+	logger := log.WithFields(log.Fields{
+		"failures": n,
+		"backoff":  backoff,
+		"next":     until,
+	}).WithError(err)
+	if !b.escalating() {
+		logger.Warn("LDAP sync failed again, backing off")
+		return
+	}
+	logger.Error("LDAP sync keeps failing, backing off")
+	chatPost(fmt.Sprintf("Greenlight LDAP sync failed %d times in a row, next attempt in %v: %v", n, backoff.Round(time.Second), err))
+	if kubeEvents != nil {
+		kubeEvents.post(KubeEventWarning, "SyncFailing", fmt.Sprintf("LDAP sync failed %d times in a row: %v", n, err))
+	}
+}
@@ -0,0 +1,127 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFullJitterBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    time.Duration
+		max     time.Duration
+		attempt int
+		ceil    time.Duration
+	}{
+		{"first attempt", time.Second, time.Minute, 0, time.Second},
+		{"doubled", time.Second, time.Minute, 3, 8 * time.Second},
+		{"capped", time.Second, time.Minute, 10, time.Minute},
+		{"overflow", time.Second, time.Minute, 100, time.Minute},
+		{"disabled", time.Second, 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for range 100 {
+				backoff := fullJitterBackoff(test.base, test.max, test.attempt)
+				if backoff < 0 || (test.ceil > 0 && backoff >= test.ceil) || (test.ceil == 0 && backoff != 0) {
+					t.Fatalf("fullJitterBackoff() = %v, want within [0, %v)", backoff, test.ceil)
+				}
+				seen[backoff] = true
+			}
+			if test.ceil > 0 && len(seen) < 2 {
+				t.Errorf("fullJitterBackoff() returned %d distinct delays, want jitter", len(seen))
+			}
+		})
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	errDial := errors.New("connection refused")
+	tests := []struct {
+		name     string
+		retries  int
+		errs     []error
+		attempts int
+		wantErr  bool
+	}{
+		{"first succeeds", 3, []error{nil}, 1, false},
+		{"retried until success", 3, []error{errDial, errDial, nil}, 3, false},
+		{"retries exhausted", 2, []error{errDial, errDial, errDial, nil}, 3, true},
+		{"permanent not retried", 3, []error{permanentError{errDial}, nil}, 1, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) {
+				c.dialRetries = test.retries
+				c.dialBackoffBase = time.Microsecond
+				c.dialBackoffMax = time.Millisecond
+			})
+
+			attempts := 0
+			err := dialRetry("test", func() error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if (err != nil) != test.wantErr {
+				t.Errorf("dialRetry() error = %v, want failure %v", err, test.wantErr)
+			}
+			if attempts != test.attempts {
+				t.Errorf("dialRetry() made %d attempts, want %d", attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	errBusy := errors.New("server is busy")
+	tests := []struct {
+		name      string
+		budget    int
+		attempts  []int
+		exhausted []bool
+		retries   int64
+	}{
+		// Each operation fails until its retries are used.
+		{"unlimited", 0, []int{4, 4, 4}, []bool{false, false, false}, 9},
+		{"exhausted by the second operation", 5, []int{4, 3, 1}, []bool{false, true, true}, 5},
+		{"exhausted by the first operation", 2, []int{3, 1, 1}, []bool{true, true, true}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) {
+				c.opRetries = 3
+				c.retryBudget = test.budget
+				c.dialBackoffBase = time.Microsecond
+				c.dialBackoffMax = time.Millisecond
+			})
+			retriesUsed.Store(0)
+			t.Cleanup(func() { retriesUsed.Store(0) })
+
+			for i, want := range test.attempts {
+				attempts := 0
+				err := opRetry("test", func() error {
+					attempts++
+					return errBusy
+				})
+				if !errors.Is(err, errBusy) {
+					t.Errorf("operation %d: opRetry() error = %v, want %v", i, err, errBusy)
+				}
+				if errors.Is(err, errRetryBudgetExhausted) != test.exhausted[i] {
+					t.Errorf("operation %d: opRetry() error = %v, want exhausted budget %v", i, err, test.exhausted[i])
+				}
+				if attempts != want {
+					t.Errorf("operation %d: made %d attempts, want %d", i, attempts, want)
+				}
+			}
+			if retries := retriesUsed.Load(); retries != test.retries {
+				t.Errorf("retriesUsed = %d, want %d", retries, test.retries)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backupRow is a user's stored values before an update, written to EnvBackup.
+type backupRow struct {
+	Id        string            `json:"id"`
+	SocialUid string            `json:"social_uid"`
+	Values    map[string]string `json:"values"`
+}
+
+// backupPath resolves the placeholders "{run}" and "{time}" of the EnvBackup
+// path for a run started at start, as reportPath.
+func backupPath(runId string, start time.Time) string {
+	return strings.NewReplacer(
+		"{run}", runId,
+		"{time}", start.UTC().Format("20060102T150405Z"),
+	).Replace(cfg.backup)
+}
+
+// newBackupRows creates the backupRows of the SQL users about to be updated,
+// identified by the ids of their new attribute maps. Only the
+// sqlWritableColumns, being written by sqlUpdateUser, are recorded.
+func newBackupRows(users map[string]map[string]string, userIds map[string]string, updateUserAttrs []map[string]string) []backupRow {
+	rows := make([]backupRow, 0, len(updateUserAttrs))
+	for _, userAttr := range updateUserAttrs {
+		user := userIds[userAttr["id"]]
+		userAttrSql := users[user]
+
+		values := make(map[string]string, len(sqlWritableColumns))
+		for _, col := range sqlWritableColumns {
+			values[col] = userAttrSql[col]
+		}
+		rows = append(rows, backupRow{Id: userAttrSql["id"], SocialUid: user, Values: values})
+	}
+	return rows
+}
+
+// writeBackup writes the rows to the EnvBackup in the EnvBackupFormat, before
+// their users are updated. The file is replaced atomically, thus it might be
+// written again with further rows, e.g., for each EnvSqlBatchSize batch.
+func writeBackup(db *sqlDB, runId string, start time.Time, rows []backupRow) (err error) {
+	path := backupPath(runId, start)
+	f, err := createOutputFile(path, false)
+	if err != nil {
+		return
+	}
+
+	if cfg.backupFormat == BackupFormatSql {
+		err = writeBackupSql(f, db.dialect, rows)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rows)
+	}
+	if err != nil {
+		_ = f.Abort()
+		return
+	}
+
+	if err = f.Close(); err != nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"backup": path,
+		"users":  len(rows),
+	}).Debug("Wrote backup of SQL users")
+	return
+}
+
+// writeBackupSql writes the rows as UPDATE statements restoring their values.
+//
+// Values are inlined as string literals, as NULL values were already fetched
+// as empty strings.
+func writeBackupSql(w io.Writer, dialect sqlDialect, rows []backupRow) error {
+	for _, row := range rows {
+		assignments := make([]string, 0, len(sqlWritableColumns))
+		for _, col := range sqlWritableColumns {
+			assignments = append(assignments, dialect.quoteIdent(col)+" = "+sqlLiteral(dialect, row.Values[col]))
+		}
+
+		_, err := fmt.Fprintf(w, "-- %s\nUPDATE %s SET %s WHERE %s = %s;\n",
+			strings.ReplaceAll(row.SocialUid, "\n", " "),
+			dialect.quoteIdent("users"), strings.Join(assignments, ", "),
+			dialect.quoteIdent("id"), sqlLiteral(dialect, row.Id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlLiteral quotes a string literal. MySQL treats backslashes as escapes by
+// default, thus they are escaped as well.
+func sqlLiteral(dialect sqlDialect, s string) string {
+	if _, ok := dialect.(mysqlDialect); ok {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapUserSearchBatch performs ldapUserSearch for multiple users at once, see
+// EnvLdapSearchBatch. The results are ordered like the users.
+//
+// Each base is searched by a single OR filter for all users not found in a
+// previous base, thus the first base with a match still wins. Entries are
+// joined to the users by their EnvMatchAttribute values, compared
+// case-insensitively, see ldapEntryUids.
+// Each call is subject to the EnvLdapRate once. A failed search fails all users
+// of the batch.
+func ldapUserSearchBatch(ctx context.Context, conn ldapSearcher, users []string, withGroups bool) (results []ldapSearchResult) {
+	results = make([]ldapSearchResult, len(users))
+	fail := func(err error) []ldapSearchResult {
+		for i := range results {
+			results[i].err = err
+		}
+		return results
+	}
+
+	if err := ldapRateWait(ctx); err != nil {
+		return fail(err)
+	}
+
+	ctx, span := traceStart(ctx, "ldap.search", otlpSpanKindClient)
+	span.set("users", len(users))
+	var spanErr error
+	defer func() { span.finish(spanErr) }()
+
+	attrMap, searchAttrs, err := ldapUserSearchAttrs(withGroups)
+	if err != nil {
+		spanErr = err
+		return fail(err)
+	}
+	searchAttrs = append(searchAttrs, cfg.matchAttribute)
+
+	pending := make(map[string][]int)
+	for i, user := range users {
+		results[i].err = errLdapUserMissing
+		pending[strings.ToLower(user)] = append(pending[strings.ToLower(user)], i)
+	}
+
+	for _, base := range ldapBases() {
+		if len(pending) == 0 {
+			break
+		}
+
+		var filter strings.Builder
+		for _, indexes := range pending {
+			filter.WriteString(ldapUidFilter(users[indexes[0]]))
+		}
+		searchReq := ldap.NewSearchRequest(
+			base.dn,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+			false,
+			fmt.Sprintf("(&(|%s)%s%s)", filter.String(), ldapFilter(), base.filter),
+			searchAttrs,
+			nil)
+
+		searchResp, err := ldapSearchContext(ctx, conn, searchReq)
+		if err != nil {
+			spanErr = err
+			return fail(err)
+		}
+		if len(searchResp.Referrals) > 0 && cfg.ldapReferralHops > 0 {
+			referred, err := ldapChaseReferrals(ctx, searchReq, searchResp.Referrals, cfg.ldapReferralHops)
+			if err != nil {
+				spanErr = err
+				return fail(err)
+			}
+			searchResp.Entries = append(searchResp.Entries, referred...)
+		}
+
+		matches := make(map[string][]*ldap.Entry)
+		for _, entry := range searchResp.Entries {
+			for _, uid := range ldapEntryUids(entry) {
+				if key := strings.ToLower(uid); pending[key] != nil {
+					matches[key] = append(matches[key], entry)
+				}
+			}
+		}
+
+		for key, entries := range matches {
+			for _, i := range pending[key] {
+				if len(entries) > 1 {
+					// The user's own search is disambiguated by the EnvAmbiguousPolicy,
+					// as the batch's filter covers all users.
+					results[i].usr, results[i].err = ldapUserSearch(ctx, conn, users[i], withGroups)
+				} else {
+					results[i].usr, results[i].err = ldapEntryUser(users[i], entries[0], attrMap, withGroups), nil
+					if withGroups {
+						results[i].usr.groups, results[i].err = ldapNestedGroups(ctx, conn, results[i].usr)
+					}
+				}
+			}
+			delete(pending, key)
+		}
+	}
+
+	for i := range results {
+		if err := results[i].err; err != nil && !errors.Is(err, errLdapUserMissing) {
+			spanErr = err
+		}
+	}
+	return
+}
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// canarySelection selects the users committed first, configured by EnvCanary.
+//
+// Users are either listed by name or a percentage is selected, based on a hash
+// of their name. Thus, a percentage selects the same users on each sync.
+type canarySelection struct {
+	users   []string
+	percent int
+}
+
+// parseCanary parses a SYNC_CANARY value, either a percentage like 5% or a
+// comma separated list of users.
+func parseCanary(canaryStr string) (c canarySelection, err error) {
+	canaryStr = strings.TrimSpace(canaryStr)
+
+	if percentStr, ok := strings.CutSuffix(canaryStr, "%"); ok {
+		c.percent, err = strconv.Atoi(strings.TrimSpace(percentStr))
+		if err != nil || c.percent <= 0 || c.percent >= 100 {
+			err = fmt.Errorf("canary percentage %q is not within 1%% and 99%%", canaryStr)
+		}
+		return
+	}
+
+	for _, user := range strings.Split(canaryStr, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			c.users = append(c.users, user)
+		}
+	}
+	return
+}
+
+// enabled checks if any canary users are configured.
+func (c canarySelection) enabled() bool {
+	return len(c.users) > 0 || c.percent > 0
+}
+
+// contains checks if a user, identified by its social_uid, is a canary.
+func (c canarySelection) contains(user string) bool {
+	if c.percent > 0 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(user))
+		return int(h.Sum32()%100) < c.percent
+	}
+	return slices.Contains(c.users, user)
+}
@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestParseCanary(t *testing.T) {
+	tests := []struct {
+		canaryStr string
+		users     []string
+		percent   int
+		wantErr   bool
+	}{
+		{"", nil, 0, false},
+		{"alice, bob,,", []string{"alice", "bob"}, 0, false},
+		{"5%", nil, 5, false},
+		{" 10 % ", nil, 10, false},
+		{"0%", nil, 0, true},
+		{"100%", nil, 0, true},
+		{"some%", nil, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.canaryStr, func(t *testing.T) {
+			c, err := parseCanary(test.canaryStr)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseCanary() error = %v, want failure %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if !slices.Equal(c.users, test.users) || c.percent != test.percent {
+				t.Errorf("parseCanary() = %+v, want users %v and percent %d", c, test.users, test.percent)
+			}
+			if c.enabled() != (len(test.users) > 0 || test.percent > 0) {
+				t.Errorf("enabled() = %v", c.enabled())
+			}
+		})
+	}
+}
+
+func TestCanaryContains(t *testing.T) {
+	byName := canarySelection{users: []string{"alice"}}
+	if !byName.contains("alice") || byName.contains("bob") {
+		t.Errorf("contains() does not select the listed users only")
+	}
+
+	// A percentage deterministically selects about this share of the users.
+	percent := canarySelection{percent: 10}
+	selected := 0
+	for i := range 1000 {
+		user := fmt.Sprintf("user%d", i)
+		if percent.contains(user) != percent.contains(user) {
+			t.Fatalf("contains(%s) is not deterministic", user)
+		}
+		if percent.contains(user) {
+			selected++
+		}
+	}
+	if selected < 50 || selected > 150 {
+		t.Errorf("selected %d of 1000 users, want about 100", selected)
+	}
+}
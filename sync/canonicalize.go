@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+	log "github.com/sirupsen/logrus"
+)
+
+// canonicalizer rewrites a value into its canonical form.
+//
+// Values which cannot be canonicalized result in an error and are passed
+// through unchanged by canonicalizeAttrs.
+type canonicalizer func(value string) (string, error)
+
+// canonicalizers are all available canonicalizers by their SYNC_CANONICALIZE name.
+var canonicalizers = map[string]canonicalizer{
+	"e164":   canonicalizeE164,
+	"locale": canonicalizeLocale,
+	"lower":  func(value string) (string, error) { return strings.ToLower(value), nil },
+	"trim":   func(value string) (string, error) { return strings.TrimSpace(value), nil },
+}
+
+// canonicalizeE164 formats a phone number as E.164, e.g., +4930123456.
+//
+// Numbers without an international prefix are parsed for the configured
+// EnvPhoneRegion.
+func canonicalizeE164(value string) (string, error) {
+	num, err := phonenumbers.Parse(value, cfg.phoneRegion)
+	if err != nil {
+		return "", err
+	}
+	if !phonenumbers.IsPossibleNumber(num) {
+		return "", fmt.Errorf("impossible phone number")
+	}
+	return phonenumbers.Format(num, phonenumbers.E164), nil
+}
+
+// parseCanonicalizeMap parses SYNC_CANONICALIZE's COLUMN=CANONICALIZER pairs.
+//
+// Multiple canonicalizers for one column might be chained by commas, e.g.,
+// "email=trim,lower". They are applied in their given order.
+func parseCanonicalizeMap(mapStr string) (canonMap map[string][]string, err error) {
+	canonMap = make(map[string][]string)
+	for _, mapping := range strings.Split(mapStr, ";") {
+		if mapping == "" {
+			continue
+		}
+
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("mapping %s cannot be split", mapping)
+			return
+		}
+
+		for _, name := range strings.Split(kv[1], ",") {
+			name = strings.TrimSpace(name)
+			if _, ok := canonicalizers[name]; !ok {
+				err = fmt.Errorf("mapping %s uses the unknown canonicalizer %s", mapping, name)
+				return
+			}
+			canonMap[kv[0]] = append(canonMap[kv[0]], name)
+		}
+	}
+	return
+}
+
+// canonicalizeAttrs applies the configured canonicalizers to a user's attributes in place.
+func canonicalizeAttrs(user string, attrs map[string]string) {
+	for col, names := range cfg.canonicalize {
+		value, ok := attrs[col]
+		if !ok || value == "" {
+			continue
+		}
+
+		for _, name := range names {
+			canonical, err := canonicalizers[name](value)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"user":          user,
+					"attribute":     col,
+					"value":         value,
+					"canonicalizer": name,
+				}).WithError(err).Debug("Cannot canonicalize value, passing it through")
+				continue
+			}
+			value = canonical
+		}
+		attrs[col] = value
+	}
+}
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chatMaxUsers limits the users listed in a chat message, as messages should
+// stay short. Further users are only counted.
+const chatMaxUsers = 10
+
+// chatNotifier delivers the EnvChatWebhookUrl and EnvMatrixRoom messages, if
+// configured.
+var chatNotifier *notifier
+
+// chatDigest accumulates the syncs since the last EnvChatDigest message.
+var chatDigest struct {
+	sync.Mutex
+	next time.Time
+
+	runs        int
+	failed      int
+	updated     int
+	roles       int
+	deactivated int
+}
+
+// chatPost sends a short plain text message to the configured chats.
+//
+// The EnvChatWebhookUrl receives a Slack compatible {"text": ...} payload,
+// also understood by, e.g., Mattermost or Matrix' hookshot. An EnvMatrixRoom
+// receives an m.notice sent by the Matrix client-server API.
+func chatPost(text string) {
+	if chatNotifier == nil {
+		return
+	}
+
+	if cfg.chatWebhookUrl != "" {
+		chatNotifier.send(cfg.chatWebhookUrl, map[string]string{"text": text})
+	}
+	if cfg.matrixRoom != "" {
+		var txnId [16]byte
+		_, _ = rand.Read(txnId[:])
+
+		// The transaction id makes retried deliveries idempotent.
+		msgUrl := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+			strings.TrimSuffix(cfg.matrixHomeserver, "/"), url.PathEscape(cfg.matrixRoom), hex.EncodeToString(txnId[:]))
+		header := http.Header{"Authorization": {"Bearer " + cfg.matrixToken}}
+		chatNotifier.sendRequest(http.MethodPut, msgUrl, header, map[string]string{"msgtype": "m.notice", "body": text})
+	}
+}
+
+// chatObserveRun reports a failed sync right away, unless silenced by the
+// syncBreaker, and accumulates the sync for the next EnvChatDigest, sent by
+// the first sync after it became due.
+func chatObserveRun(runId string, status syncStatus) {
+	if status.err != nil && !syncBreaker.silenced() {
+		chatPost(fmt.Sprintf("Greenlight LDAP sync %s failed: %v", runId, status.err))
+	}
+	if cfg.chatDigest == nil {
+		return
+	}
+
+	chatDigest.Lock()
+	defer chatDigest.Unlock()
+
+	now := time.Now()
+	if chatDigest.next.IsZero() {
+		chatDigest.next = cfg.chatDigest.next(now)
+	}
+
+	chatDigest.runs++
+	if status.err != nil {
+		chatDigest.failed++
+	}
+	chatDigest.updated += status.updated
+	chatDigest.roles += status.roles
+	chatDigest.deactivated += status.deactivated
+
+	if now.Before(chatDigest.next) {
+		return
+	}
+	chatPost(fmt.Sprintf("Greenlight LDAP sync digest: %d syncs, %d failed; %d users updated, %d roles updated, %d users deactivated",
+		chatDigest.runs, chatDigest.failed, chatDigest.updated, chatDigest.roles, chatDigest.deactivated))
+	chatDigest.runs, chatDigest.failed = 0, 0
+	chatDigest.updated, chatDigest.roles, chatDigest.deactivated = 0, 0, 0
+	chatDigest.next = cfg.chatDigest.next(now)
+}
+
+// chatUserList formats users for a message, listing up to chatMaxUsers.
+func chatUserList(users []string) string {
+	if len(users) <= chatMaxUsers {
+		return strings.Join(users, ", ")
+	}
+	return fmt.Sprintf("%s, and %d more", strings.Join(users[:chatMaxUsers], ", "), len(users)-chatMaxUsers)
+}
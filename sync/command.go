@@ -0,0 +1,694 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// verifyColumns fails fast if any column used by a query is missing.
+//
+// If the database is unreachable, this check is skipped with a warning, as the
+// sync itself reports connection errors.
+func verifyColumns(ctx context.Context) {
+	db, err := sqlOpen(true)
+	if err != nil {
+		log.WithError(err).Warn("Cannot verify database columns")
+		return
+	}
+	defer db.Close()
+
+	if err := sqlVerifyColumns(ctx, db); err != nil {
+		log.WithError(err).Fatalf("Database schema does not match, set %s to skip this check", EnvSkipColumnCheck)
+	}
+}
+
+// syncLastFailed is set if the previous syncRun failed, to report recoveries.
+var syncLastFailed atomic.Bool
+
+// syncRun performs syncAction, or jobsRun for configJobs, and reports its
+// outcome.
+func syncRun(ctx context.Context) (err error) {
+	if len(configJobs) > 0 {
+		err = jobsRun(ctx)
+	} else {
+		err = syncAction(ctx)
+	}
+	sdNotifySync(err)
+	defer func() { syncBreaker.record(err, scheduleDelay()) }()
+
+	switch {
+	case err != nil:
+		syncLastFailed.Store(true)
+		if kubeEvents != nil && !syncBreaker.silenced() {
+			kubeEvents.post(KubeEventWarning, "SyncFailed", err.Error())
+		}
+
+	case syncLastFailed.Load():
+		syncLastFailed.Store(false)
+		if kubeEvents != nil {
+			kubeEvents.post(KubeEventNormal, "SyncRecovered", "LDAP sync succeeded after a previous failure")
+		}
+	}
+	return
+}
+
+// syncInterval performs scheduled syncs based on the EnvInterval environment
+// variable or, if configured, the EnvSchedule.
+//
+// Unless EnvStartup is StartupSkip, the first sync is performed right away.
+// Each scheduled sync is delayed by the EnvJitter. As syncs are performed one
+// after another, a sync becoming due during a running one is either performed
+// afterwards or, for the OverlapSkip EnvOverlap, dropped.
+//
+// A SIGUSR1 toggles the maintenanceMode, effective from the next sync on, or,
+// for the SignalUsr1Sync EnvSignalUsr1, performs a sync right away without
+// affecting the schedule. A SIGUSR2 logs the current status by statusLog, even
+// during a sync. A SIGHUP or a change found by the EnvConfigWatch reloads the
+// configuration by configReload, also restarting the schedule. Syncs requested
+// by the EnvAdminAddr API are performed in between, even while syncIsPaused or
+// the syncBreaker's backoff skips the scheduled ones.
+func syncInterval() {
+	var tick <-chan time.Time
+	rearm, disarm := func() {}, func() {}
+	arm := func() {
+		disarm()
+		if cfg.schedule != nil {
+			next := cfg.schedule.next(time.Now())
+			statusNextRun(next)
+			timer := time.NewTimer(time.Until(next))
+			tick, disarm = timer.C, func() { timer.Stop() }
+			rearm = func() {
+				next := cfg.schedule.next(time.Now())
+				statusNextRun(next)
+				log.WithField("next", next).Debug("Scheduled next sync")
+				timer.Reset(time.Until(next))
+			}
+		} else {
+			statusNextRun(time.Now().Add(cfg.interval))
+			ticker := time.NewTicker(cfg.interval)
+			tick, disarm = ticker.C, ticker.Stop
+			rearm = func() { statusNextRun(time.Now().Add(cfg.interval)) }
+		}
+	}
+	arm()
+	defer func() { disarm() }()
+
+	stopping, canceled := signalContexts()
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	defer signal.Stop(usr2)
+	go func() {
+		for range usr2 {
+			statusLog()
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ctx, cancel := context.WithCancel(stopping)
+	defer cancel()
+
+	// A changed configuration is reloaded like on a SIGHUP, while the watch
+	// itself keeps its interval of the startup.
+	configChanged := make(chan struct{}, 1)
+	if cfg.configWatch > 0 {
+		go configWatch(ctx, configSources.path, cfg.configWatch, configSources.digest, configChanged)
+	}
+
+	// Standby instances of the EnvLeaderElection skip the scheduled and
+	// triggered syncs, while a new leader syncs right away.
+	var elected chan struct{}
+	if cfg.leaderElection {
+		elected = make(chan struct{}, 1)
+		go leaderElect(ctx, elected)
+	}
+	standby := func() bool {
+		if cfg.leaderElection && !leaderElected.Load() {
+			log.Debug("Skipping sync while standing by for the leader")
+			return true
+		}
+		return false
+	}
+	paused := func() bool {
+		if syncIsPaused() {
+			log.Info("Skipping scheduled sync while paused")
+			return true
+		}
+		return false
+	}
+
+	// During the syncBreaker's backoff, scheduled syncs are skipped until the
+	// retry at its end.
+	var retry <-chan time.Time
+	backingOff := func() bool {
+		if until, ok := syncBreaker.backoffEnd(); ok {
+			statusNextRun(until)
+			log.WithField("next", until).Debug("Skipping scheduled sync while backing off after failures")
+			return true
+		}
+		return false
+	}
+	run := func() error {
+		err := syncRun(canceled)
+		retry = nil
+		if until, ok := syncBreaker.backoffEnd(); ok {
+			statusNextRun(until)
+			retry = time.After(time.Until(until))
+		}
+		return err
+	}
+
+	changes := make(chan struct{}, 1)
+	if cfg.syncrepl {
+		for _, base := range ldapBases() {
+			go func(base ldapSearchBase) {
+				if err := syncreplWatch(ctx, base, changes); err != nil {
+					log.WithError(err).WithField("base", base.dn).Warn("LDAP sync replication is unavailable, falling back to interval polling")
+				}
+			}(base)
+		}
+	}
+
+	// As the watchdog is pinged from this loop, a hung sync stops the pings.
+	var watchdog <-chan time.Time
+	if watchdogInterval, ok := sdWatchdogInterval(); ok {
+		watchdogTicker := time.NewTicker(watchdogInterval)
+		defer watchdogTicker.Stop()
+		watchdog = watchdogTicker.C
+	}
+
+	// pending is the jittered start of the next scheduled sync.
+	var pending <-chan time.Time
+	if cfg.startup == StartupImmediate {
+		pending = time.After(scheduleJitter())
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-tick:
+			rearm()
+			if pending == nil {
+				pending = time.After(scheduleJitter())
+			}
+
+		case <-pending:
+			pending = nil
+			if standby() || paused() || backingOff() {
+				continue
+			}
+			start := time.Now()
+			run()
+
+			if cfg.overlap == OverlapSkip {
+				select {
+				case <-tick:
+					rearm()
+					log.WithField("duration", time.Since(start)).Warn("Skipped a sync being due during the previous one")
+				default:
+				}
+			}
+
+		case <-watchdog:
+			sdNotify("WATCHDOG=1")
+
+		case <-changes:
+			if debounce == nil {
+				debounce = time.After(syncreplDebounce)
+			}
+
+		case <-debounce:
+			debounce = nil
+			if standby() || paused() || backingOff() {
+				continue
+			}
+			run()
+
+		case <-retry:
+			retry = nil
+			if pending == nil {
+				pending = time.After(scheduleJitter())
+			}
+
+		case <-elected:
+			if pending == nil {
+				pending = time.After(scheduleJitter())
+			}
+
+		case req := <-adminSyncRequests:
+			log.Info("Performing a sync requested by the admin API")
+			adminSyncPerform(req, run)
+
+		case <-usr1:
+			if cfg.signalUsr1 == SignalUsr1Sync {
+				if standby() {
+					continue
+				}
+				log.Info("Performing a sync requested by SIGUSR1")
+				run()
+				continue
+			}
+
+			enabled := !maintenanceMode.Load()
+			maintenanceMode.Store(enabled)
+			log.WithField("maintenance", enabled).Warn("Toggled maintenance mode")
+
+		case <-hup:
+			if configReloadSignal() {
+				arm()
+			}
+
+		case <-configChanged:
+			if configReloadSignal() {
+				arm()
+			}
+
+		case <-stopping.Done():
+			return
+		}
+	}
+}
+
+// signalContexts handles SIGINT and SIGTERM for a graceful shutdown.
+//
+// The stopping context is done on the first signal, preventing further syncs.
+// The canceled context follows after the EnvShutdownGrace or a second signal,
+// aborting a running sync.
+func signalContexts() (stopping, canceled context.Context) {
+	stopping, stop := context.WithCancel(context.Background())
+	canceled, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.WithField("grace", cfg.shutdownGrace).Info("Received shutdown signal")
+		sdNotify("STOPPING=1")
+		stop()
+
+		select {
+		case <-sig:
+			log.Warn("Received another shutdown signal, canceling a running sync")
+		case <-time.After(cfg.shutdownGrace):
+			log.Warn("Shutdown grace period expired, canceling a running sync")
+		}
+		cancel()
+	}()
+	return
+}
+
+// Main runs the greenlight-ldap-sync command with the process's arguments,
+// exiting the process on failures.
+func Main() {
+	log.SetFormatter(&log.TextFormatter{
+		DisableTimestamp:       true,
+		DisableLevelTruncation: true,
+		PadLevelText:           true,
+	})
+
+	cfgPath, args, err := configFileArg(os.Args[1:])
+	if err != nil {
+		log.WithError(err).Fatal("Invalid arguments")
+	}
+	configSourcesKeep(cfgPath, args)
+	if cfgPath != "" {
+		if configJobs, err = configFileLoad(cfgPath); err != nil {
+			log.WithError(err).Fatal("Cannot load configuration file")
+		}
+	}
+	if args, err = configFlagArgs(args); err != nil {
+		usage(os.Stderr)
+		log.WithError(err).Fatal("Invalid arguments")
+	}
+
+	logFormat, err := configChoice(EnvLogFormat, LogFormatText, LogFormatText, LogFormatJson)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	} else if logFormat == LogFormatJson {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	if logRedactMode, err = configChoice(EnvLogRedact, LogRedactOff, LogRedactOff, LogRedactMask, LogRedactHash); err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	} else if logRedactMode != LogRedactOff {
+		log.SetFormatter(&logRedactFormatter{Formatter: log.StandardLogger().Formatter})
+	}
+
+	cfgShadow, err := configLoad()
+	if err == nil {
+		cfg = cfgShadow
+		err = jobsCheck(cfg, configJobs)
+	}
+	configApply(cfg)
+	log.AddHook(jobsLogHook{})
+
+	// The log file is not reopened on a configuration reload.
+	if cfg.logFile != "" {
+		logOutput, logErr := logFileOpen(cfg.logFile, int64(cfg.logFileMaxSize)<<20, cfg.logFileRotate, cfg.logFileKeep)
+		if logErr != nil {
+			log.WithError(logErr).Fatal("Cannot open log file")
+		}
+		log.SetOutput(logOutput)
+	}
+
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	// SchemaAuto is detected for all commands accessing the database.
+	if os.Getenv(EnvSchema) == SchemaAuto && !slices.Contains([]string{"version", "help", "-h", "--help", "show-config", "healthcheck", "export-desired"}, command) {
+		if cfgShadow, err = configLoadDetect(); err == nil {
+			cfg = cfgShadow
+			configApply(cfg)
+		}
+	}
+
+	switch command {
+	case "version":
+		fmt.Println(Version)
+		return
+
+	case "help", "-h", "--help":
+		usage(os.Stdout)
+		return
+
+	case "show-config":
+		if err != nil {
+			log.WithError(err).Fatal("Invalid configuration")
+		}
+		configShow(os.Stdout, cfg)
+		return
+
+	case "status":
+		if err != nil {
+			log.WithError(err).Fatal("Invalid configuration")
+		}
+		if !statusShow(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+
+	case "healthcheck":
+		if err != nil {
+			log.WithError(err).Fatal("Invalid configuration")
+		}
+		if !healthCheck(os.Stdout) {
+			os.Exit(1)
+		}
+		return
+
+	case "check", "--validate-only":
+		cfg.dialRetries = 0
+		if !validateOnly(os.Stdout, err) {
+			os.Exit(1)
+		}
+		return
+
+	case "doctor":
+		cfg.dialRetries = 0
+		if !doctor(os.Stdout, err) {
+			os.Exit(1)
+		}
+		return
+
+	case "export":
+		if err != nil {
+			log.WithError(err).Fatal("Invalid configuration")
+		}
+		path := ""
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := exportRun(path); err != nil {
+			log.WithError(err).Fatal("Cannot export users")
+		}
+		return
+
+	case "export-desired":
+		if err != nil {
+			log.WithError(err).Fatal("Invalid configuration")
+		}
+		path := ""
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := exportDesiredRun(path); err != nil {
+			log.WithError(err).Fatal("Cannot export the desired LDAP state")
+		}
+		return
+
+	case "rollback":
+		if err != nil {
+			log.WithError(err).Fatal("Invalid configuration")
+		}
+		var runId string
+		var ok bool
+		if len(args) == 2 {
+			runId, ok = strings.CutPrefix(args[1], "--run=")
+		}
+		if !ok || runId == "" {
+			usage(os.Stderr)
+			log.Fatal("The rollback command requires --run ID")
+		} else if cfg.auditTable == "" {
+			log.Fatalf("The rollback command requires %s", EnvAuditTable)
+		}
+		if err := rollbackRun(context.Background(), runId); err != nil {
+			log.WithError(err).WithField("run", runId).Error("Cannot roll back the run")
+			os.Exit(syncExitCode(err))
+		}
+		return
+
+	case "import":
+		if len(args) != 2 {
+			usage(os.Stderr)
+			log.Fatal("The import command requires a CSV file")
+		}
+
+	case "", "sync", "daemon", "scim":
+
+	default:
+		usage(os.Stderr)
+		log.WithField("command", command).Fatal("Unknown command")
+	}
+
+	if err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	}
+	if command == "daemon" && !cfg.scheduled() {
+		log.Fatalf("The daemon command requires %s or %s", EnvInterval, EnvSchedule)
+	}
+	if command == "scim" && cfg.scimAddr == "" {
+		log.Fatalf("The scim command requires %s", EnvScimAddr)
+	}
+
+	// The SCIM endpoint is served alongside scheduled syncs or on its own.
+	if cfg.scimAddr != "" && (command == "scim" || command != "sync" && cfg.scheduled()) {
+		httpHandle(cfg.scimAddr, scimPath, http.HandlerFunc(scimHandler))
+		httpHandle(cfg.scimAddr, scimPath+"/", http.HandlerFunc(scimHandler))
+	}
+
+	setup()
+	defer sentryRecover()
+
+	switch command {
+	case "import":
+		if ldapImport, err = importLoad(args[1]); err != nil {
+			log.WithError(err).WithField("file", args[1]).Fatal("Cannot load the CSV file to import")
+		}
+		fallthrough
+
+	case "sync":
+		// A single sync, e.g., for cron jobs, ignoring EnvInterval.
+		_, canceled := signalContexts()
+		err = syncRun(canceled)
+		shutdown()
+		os.Exit(syncExitCode(err))
+
+	case "scim":
+		// Only the SCIM endpoint is served, without any sync.
+		stopping, _ := signalContexts()
+		<-stopping.Done()
+		shutdown()
+
+	case "daemon":
+		if len(cfg.users) > 0 {
+			log.Fatalf("%s requires the sync command", EnvUser)
+		}
+		syncInterval()
+		shutdown()
+
+	default:
+		// Without a command, continue for a configured EnvInterval or sync once.
+		if cfg.scheduled() && len(cfg.users) == 0 {
+			syncInterval()
+			shutdown()
+			return
+		}
+		_, canceled := signalContexts()
+		err = syncRun(canceled)
+		shutdown()
+		os.Exit(syncExitCode(err))
+	}
+}
+
+// Version is the version of the command, set by the package main at startup.
+var Version = "dev"
+
+// usage prints the available commands.
+func usage(w io.Writer) {
+	fmt.Fprintf(w, `Usage: %s [--config PATH] [--NAME VALUE]... [COMMAND]
+
+Commands:
+  sync         Perform a single sync, ignoring %s and %s
+  daemon       Perform a sync each %s or by %s
+  check        Check the configuration and connectivity, alias --validate-only
+  doctor       Diagnose the database schema and the attribute mapping
+  export       Write the synced users' database columns as CSV to PATH or stdout
+  export-desired
+               Write the LDAP users' desired state as JSON to PATH or stdout
+  import       Perform a single sync with the users of the CSV file PATH
+  rollback     Restore the values written over by the run --run ID, or last,
+               as recorded in SYNC_AUDIT_TABLE
+  scim         Serve the SCIM endpoint of SYNC_SCIM_ADDR without syncing
+  show-config  Print the resolved configuration with masked secrets
+  status       Print the last sync's state, failing if it failed or is too old
+  healthcheck  Query the daemon's health endpoint, e.g., for container probes
+  version      Print the version
+  help         Print this help
+
+Without a command, a sync is performed, repeated if %s or %s is set.
+
+Each environment variable might be passed as a flag, taking precedence over the
+environment and the configuration file: --ldap-base for LDAP_BASE, --db-host
+for DB_HOST, and, e.g., --interval for SYNC_INTERVAL. Flags of variables only
+being set, e.g., --dry-run, take no value. Furthermore, --ldap-url sets
+LDAP_SERVER and --db-url sets SYNC_DB_URL.
+`, filepath.Base(os.Args[0]), EnvInterval, EnvSchedule, EnvInterval, EnvSchedule, EnvInterval, EnvSchedule)
+}
+
+// setup prepares the shared state of the sync and daemon commands.
+func setup() {
+	if cfg.sentryDsn != "" {
+		sentryShadow, err := newSentryHook(cfg.sentryDsn)
+		if err != nil {
+			log.WithError(err).Fatalf("Invalid %s", EnvSentryDsn)
+		}
+		sentryReporter = sentryShadow
+		log.AddHook(sentryReporter)
+	}
+
+	maintenanceMode.Store(cfg.maintenance)
+	if cfg.maintenance {
+		log.Warn("Maintenance mode is enabled, no database writes are performed until toggled by SIGUSR1")
+	}
+
+	if cfg.vaultAddr != "" {
+		if err := vaultRefresh(); err != nil {
+			log.WithError(err).Fatal("Cannot fetch credentials from Vault")
+		}
+	}
+
+	if !cfg.skipColumnCheck {
+		verifyColumns(context.Background())
+	}
+
+	if cfg.sqlParallel > 1 {
+		log.WithField("connections", cfg.sqlParallel).Warn("Parallel SQL updates are enabled, a failed update might be partially committed")
+	}
+
+	if cfg.metricsAddr != "" {
+		httpHandle(cfg.metricsAddr, "/metrics", metrics)
+	}
+	if cfg.healthAddr != "" {
+		httpHandle(cfg.healthAddr, "/healthz", http.HandlerFunc(healthzHandler))
+		httpHandle(cfg.healthAddr, "/readyz", http.HandlerFunc(readyzHandler))
+		if cfg.scheduled() {
+			httpHandle(cfg.healthAddr, "/status", http.HandlerFunc(statusHandler))
+		}
+	}
+	if cfg.adminAddr != "" && cfg.scheduled() {
+		httpHandle(cfg.adminAddr, "/sync", http.HandlerFunc(adminSyncHandler))
+		httpHandle(cfg.adminAddr, "/pause", adminPauseHandler(true))
+		httpHandle(cfg.adminAddr, "/resume", adminPauseHandler(false))
+	}
+	if cfg.adminPprof {
+		adminPprofHandle()
+	}
+	if err := httpListen(); err != nil {
+		log.WithError(err).Fatal("Cannot listen for HTTP endpoints")
+	}
+
+	if cfg.webhookUrl != "" {
+		webhookNotifier = newNotifier(cfg.notifyTimeout, cfg.notifyRetries, cfg.webhookSecret)
+	}
+	if cfg.chatWebhookUrl != "" || cfg.matrixRoom != "" {
+		chatNotifier = newNotifier(cfg.notifyTimeout, cfg.notifyRetries, "")
+	}
+	if len(cfg.emailTo) > 0 {
+		emailNotifier = newNotifier(cfg.notifyTimeout, cfg.notifyRetries, "")
+	}
+
+	if cfg.eventStream != "" {
+		eventStreamShadow, err := newEventWriter(cfg.eventStream)
+		if err != nil {
+			log.WithError(err).Fatalf("Cannot open %s", EnvEventStream)
+		}
+		eventStream = eventStreamShadow
+	}
+
+	if cfg.kubeEvents {
+		kubeEventsShadow, err := newKubeEventer()
+		if err != nil {
+			log.WithError(err).Warn("Kubernetes Events are unavailable, not running in a cluster?")
+		} else {
+			kubeEvents = kubeEventsShadow
+		}
+	}
+}
+
+// shutdown flushes all buffered outputs within the configured EnvShutdownTimeout.
+func shutdown() {
+	syncPoolClose()
+	vaultRevoke()
+
+	if webhookNotifier != nil {
+		webhookNotifier.flush(cfg.shutdownTimeout)
+	}
+	if chatNotifier != nil {
+		chatNotifier.flush(cfg.shutdownTimeout)
+	}
+	if emailNotifier != nil {
+		emailNotifier.flush(cfg.shutdownTimeout)
+	}
+
+	if eventStream != nil {
+		if err := eventStream.Close(); err != nil {
+			log.WithError(err).Error("Failed to close event stream")
+		}
+	}
+
+	if sentryReporter != nil {
+		sentryReporter.flush(cfg.shutdownTimeout)
+	}
+}
@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldDiacritics removes all diacritics, e.g., "Müller" becomes "Muller".
+//
+// The value is decomposed into base characters and combining marks by NFD,
+// the marks are dropped, and the remainder is recomposed by NFC.
+func foldDiacritics(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return folded
+}
+
+// normalizeValue normalizes a username or email for comparisons.
+//
+// The value is trimmed and composed by NFC. For an email address, the domain
+// after the last "@" is converted to its lowercase ASCII form, thus an IDN
+// equals its Punycode. If foldCase is set, the whole value is case folded.
+func normalizeValue(s string, foldCase bool) string {
+	s = norm.NFC.String(strings.TrimSpace(s))
+	if i := strings.LastIndexByte(s, '@'); i >= 0 {
+		if domain, err := idna.Lookup.ToASCII(s[i+1:]); err == nil {
+			s = s[:i+1] + domain
+		}
+	}
+	if foldCase {
+		s = cases.Fold().String(s)
+	}
+	return s
+}
+
+// normalizeText applies the EnvNormalize steps to a SQL or LDAP value.
+//
+// Whitespace is trimmed and collapsed after the Unicode normalization, as NFKC
+// might result in further whitespace, e.g., for a no-break space.
+func normalizeText(s string) string {
+	if slices.Contains(cfg.normalize, NormalizeNfc) {
+		s = norm.NFC.String(s)
+	} else if slices.Contains(cfg.normalize, NormalizeNfkc) {
+		s = norm.NFKC.String(s)
+	}
+	if slices.Contains(cfg.normalize, NormalizeCollapse) {
+		s = strings.Join(strings.Fields(s), " ")
+	} else if slices.Contains(cfg.normalize, NormalizeTrim) {
+		s = strings.TrimSpace(s)
+	}
+	return s
+}
+
+// attrEqual compares a column's SQL and LDAP value for change detection.
+//
+// Both values are compared after normalizeText, as the LDAP value is written
+// normalized. For columns listed in EnvCompareNormalize, they are compared after
+// normalizeValue, folding their case for the CompareCaseIgnore EnvCompareCase.
+// For columns listed in EnvCompareFoldDiacritics, both values are compared
+// after foldDiacritics. The values themselves are never altered.
+func attrEqual(col, sqlV, ldapV string) bool {
+	if sqlV == ldapV {
+		return true
+	}
+	if len(cfg.normalize) > 0 {
+		sqlV, ldapV = normalizeText(sqlV), normalizeText(ldapV)
+	}
+	if slices.Contains(cfg.compareNormalize, col) {
+		foldCase := cfg.compareCase == CompareCaseIgnore
+		sqlV, ldapV = normalizeValue(sqlV, foldCase), normalizeValue(ldapV, foldCase)
+	}
+	if slices.Contains(cfg.compareFoldDiacritics, col) {
+		sqlV, ldapV = foldDiacritics(sqlV), foldDiacritics(ldapV)
+	}
+	return sqlV == ldapV
+}
+
+// parseAttributePolicyMap parses SYNC_ATTRIBUTE_POLICY's COLUMN=POLICY pairs.
+func parseAttributePolicyMap(mapStr string) (policyMap map[string]string, err error) {
+	policyMap = make(map[string]string)
+	for _, mapping := range strings.Split(mapStr, ";") {
+		if mapping == "" {
+			continue
+		}
+
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("mapping %s cannot be split", mapping)
+			return
+		}
+
+		col, policy := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch policy {
+		case AttributePolicyOverwrite, AttributePolicyIfEmpty, AttributePolicyNoClear:
+			policyMap[col] = policy
+		default:
+			err = fmt.Errorf("mapping %s uses the unknown policy %s", mapping, policy)
+			return
+		}
+	}
+	return
+}
+
+// parseClearedPolicyMap parses the EnvClearedPolicy's COLUMN=POLICY pairs.
+func parseClearedPolicyMap(mapStr string) (policyMap map[string]string, err error) {
+	policyMap = make(map[string]string)
+	for _, mapping := range strings.Split(mapStr, ";") {
+		if mapping == "" {
+			continue
+		}
+
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("mapping %s cannot be split", mapping)
+			return
+		}
+
+		col, policy := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch {
+		case policy == ClearedPolicyKeep, policy == ClearedPolicyClear, strings.HasPrefix(policy, ClearedPolicyDefault):
+			policyMap[col] = policy
+		default:
+			err = fmt.Errorf("mapping %s uses the unknown policy %s", mapping, policy)
+			return
+		}
+	}
+	return
+}
+
+// attrApplyCleared applies the EnvClearedPolicy to a user's LDAP values, for
+// each column whose attribute is absent or has no value.
+func attrApplyCleared(attrs map[string]string) {
+	for col, policy := range cfg.clearedPolicy {
+		if attrs[col] != "" {
+			continue
+		}
+
+		switch {
+		case policy == ClearedPolicyClear:
+			attrs[col] = ""
+		case strings.HasPrefix(policy, ClearedPolicyDefault):
+			attrs[col] = strings.TrimPrefix(policy, ClearedPolicyDefault)
+		default:
+			delete(attrs, col)
+		}
+	}
+}
+
+// attrPolicyAllows checks if a column's EnvAttributePolicy allows replacing the
+// stored SQL value by the differing LDAP value.
+func attrPolicyAllows(col, sqlV, ldapV string) bool {
+	switch cfg.attributePolicy[col] {
+	case AttributePolicyIfEmpty:
+		return sqlV == ""
+	case AttributePolicyNoClear:
+		return ldapV != "" || sqlV == ""
+	default:
+		return true
+	}
+}
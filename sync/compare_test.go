@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"testing"
+)
+
+func TestFoldDiacritics(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"Müller", "Muller"},
+		{"Mu\u0308ller", "Muller"},
+		{"José Ñúñez", "Jose Nunez"},
+		{"Łukasz", "Łukasz"},
+		{"Muller", "Muller"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.s, func(t *testing.T) {
+			if folded := foldDiacritics(test.s); folded != test.want {
+				t.Errorf("foldDiacritics(%q) = %q, want %q", test.s, folded, test.want)
+			}
+		})
+	}
+}
+
+func TestAttrEqualFoldDiacritics(t *testing.T) {
+	tests := []struct {
+		name  string
+		col   string
+		sqlV  string
+		ldapV string
+		equal bool
+	}{
+		{"diacritic in SQL", "name", "Müller", "Muller", true},
+		{"diacritic in LDAP", "name", "Muller", "Müller", true},
+		{"different diacritics", "name", "Mūller", "Müller", true},
+		{"different letters", "name", "Müller", "Miller", false},
+		{"column not folded", "email", "müller@example.org", "muller@example.org", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.compareFoldDiacritics = []string{"name"} })
+			if equal := attrEqual(test.col, test.sqlV, test.ldapV); equal != test.equal {
+				t.Errorf("attrEqual(%s, %q, %q) = %v, want %v", test.col, test.sqlV, test.ldapV, equal, test.equal)
+			}
+		})
+	}
+}
+
+func TestCompareFoldDiacriticsKeepsValue(t *testing.T) {
+	testConfig(t, func(c *config) { c.compareFoldDiacritics = []string{"name"} })
+
+	// The folded name is not a change, but the stored one is kept for the
+	// update of the changed email.
+	userAttrSql := testSqlUser("1", "false")
+	userAttrSql["name"] = "Müller"
+	ldapUsr := testLdapUser()
+	ldapUsr.attrs["name"] = "Muller"
+	ldapUsr.attrs["email"] = "mueller@example.org"
+	s, b := testCompare(t,
+		map[string]map[string]string{"alice": userAttrSql},
+		map[string]ldapSearchResult{"alice": {usr: ldapUsr}})
+
+	if len(s.changes) != 1 || s.changes[0].attribute != "email" {
+		t.Errorf("changes = %v, want the email only", s.changes)
+	}
+	if len(b.updateUserAttrs) != 1 || b.updateUserAttrs[0]["name"] != "Müller" {
+		t.Errorf("updateUserAttrs = %v, want the stored name", b.updateUserAttrs)
+	}
+}
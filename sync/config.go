@@ -0,0 +1,3441 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// EnvDebug is the SYNC_DEBUG environment variable.
+	//
+	// If SYNC_DEBUG is set, the verbose debug log level will be used. This will
+	// log sensitive data. It is superseded by EnvLogLevel.
+	EnvDebug = "SYNC_DEBUG"
+
+	// EnvLogLevel is the SYNC_LOG_LEVEL environment variable.
+	//
+	// It is the minimum level of logged entries, one of logLevels, defaulting
+	// to info or, for EnvDebug, to debug.
+	EnvLogLevel = "SYNC_LOG_LEVEL"
+
+	// EnvLogFile is the SYNC_LOG_FILE environment variable.
+	//
+	// If SYNC_LOG_FILE is set, logs are appended to this file instead of
+	// stderr, rotated by EnvLogFileMaxSize and EnvLogFileRotate, see logFile.
+	EnvLogFile = "SYNC_LOG_FILE"
+
+	// EnvLogFileMaxSize is the SYNC_LOG_FILE_MAX_SIZE environment variable.
+	//
+	// It is the size in MiB after which the EnvLogFile is rotated, defaulting
+	// to 100. A value of 0 disables size-based rotation.
+	EnvLogFileMaxSize = "SYNC_LOG_FILE_MAX_SIZE"
+
+	// EnvLogFileRotate is the SYNC_LOG_FILE_ROTATE environment variable.
+	//
+	// If set, e.g., to "24h", the EnvLogFile is rotated once it is this old.
+	EnvLogFileRotate = "SYNC_LOG_FILE_ROTATE"
+
+	// EnvLogFileKeep is the SYNC_LOG_FILE_KEEP environment variable.
+	//
+	// It is the number of rotated EnvLogFile files kept, defaulting to 7.
+	EnvLogFileKeep = "SYNC_LOG_FILE_KEEP"
+
+	// EnvLogFormat is the SYNC_LOG_FORMAT environment variable.
+	//
+	// It selects the log output, either LogFormatText (default) or LogFormatJson.
+	EnvLogFormat = "SYNC_LOG_FORMAT"
+
+	// EnvLogRedact is the SYNC_LOG_REDACT environment variable.
+	//
+	// It defines if SQL and LDAP values are logged as they are, LogRedactOff
+	// (default), or redacted by the logRedactFormatter.
+	EnvLogRedact = "SYNC_LOG_REDACT"
+
+	// EnvInterval is the SYNC_INTERVAL environment variable.
+	//
+	// If SYNC_INTERVAL is set, scheduled syncs will be performed. The variables
+	// value needs to be a valid Go time.Duration string:
+	// <https://golang.org/pkg/time/#ParseDuration>
+	EnvInterval = "SYNC_INTERVAL"
+
+	// EnvSchedule is the SYNC_SCHEDULE environment variable.
+	//
+	// If SYNC_SCHEDULE is set, scheduled syncs are performed based on its cron
+	// expressions instead of EnvInterval, see parseCronSchedule.
+	EnvSchedule = "SYNC_SCHEDULE"
+
+	// EnvIntervalMin is the SYNC_INTERVAL_MIN environment variable.
+	//
+	// It is the lowest accepted EnvInterval, defaulting to 30s, to protect the
+	// directory against an overly frequent sync. Zero disables the floor.
+	EnvIntervalMin = "SYNC_INTERVAL_MIN"
+
+	// EnvIntervalMinPolicy is the SYNC_INTERVAL_MIN_POLICY environment variable.
+	//
+	// It defines how an EnvInterval below EnvIntervalMin is handled, either
+	// IntervalMinClamp (default) or IntervalMinRefuse.
+	EnvIntervalMinPolicy = "SYNC_INTERVAL_MIN_POLICY"
+
+	// EnvStartup is the SYNC_STARTUP environment variable.
+	//
+	// It defines when scheduled syncs start, either StartupImmediate (default)
+	// or StartupSkip, waiting for the first EnvInterval or EnvSchedule.
+	EnvStartup = "SYNC_STARTUP"
+
+	// EnvJitter is the SYNC_JITTER environment variable.
+	//
+	// Each scheduled sync, including the initial one, is delayed by a random
+	// duration up to SYNC_JITTER, spreading the load of many replicas.
+	EnvJitter = "SYNC_JITTER"
+
+	// EnvOverlap is the SYNC_OVERLAP environment variable.
+	//
+	// It defines how a scheduled sync being due while the previous one is still
+	// running is handled, either OverlapQueue (default) or OverlapSkip.
+	EnvOverlap = "SYNC_OVERLAP"
+
+	// EnvFailureBackoffMax is the SYNC_FAILURE_BACKOFF_MAX environment
+	// variable.
+	//
+	// If set, e.g., to "6h", scheduled syncs back off exponentially after
+	// consecutive failed ones, up to this duration, see failureBreaker.
+	EnvFailureBackoffMax = "SYNC_FAILURE_BACKOFF_MAX"
+
+	// EnvConfigWatch is the SYNC_CONFIG_WATCH environment variable.
+	//
+	// If set, e.g., to "30s", the configuration file is polled for changes at
+	// this interval, reloading it like a SIGHUP, see configWatch.
+	EnvConfigWatch = "SYNC_CONFIG_WATCH"
+
+	// EnvSyncrepl is the SYNC_SYNCREPL environment variable.
+	//
+	// If SYNC_SYNCREPL is set for scheduled syncs, an LDAP Content
+	// Synchronization (RFC 4533) search triggers a sync within seconds after a
+	// user's entry changes. Without server support, only EnvInterval is used.
+	EnvSyncrepl = "SYNC_SYNCREPL"
+
+	// EnvShutdownTimeout is the SYNC_SHUTDOWN_TIMEOUT environment variable.
+	//
+	// It bounds the time spent flushing pending notifications before exiting,
+	// defaulting to 10s.
+	EnvShutdownTimeout = "SYNC_SHUTDOWN_TIMEOUT"
+
+	// EnvShutdownGrace is the SYNC_SHUTDOWN_GRACE environment variable.
+	//
+	// It is the time a running sync might take to finish after a shutdown
+	// signal before being canceled, defaulting to 30s.
+	EnvShutdownGrace = "SYNC_SHUTDOWN_GRACE"
+
+	// EnvRunTimeout is the SYNC_RUN_TIMEOUT environment variable.
+	//
+	// If set, it bounds the total duration of a single sync. An exceeding sync
+	// is canceled like after the EnvShutdownGrace and fails by errSyncTimeout.
+	EnvRunTimeout = "SYNC_RUN_TIMEOUT"
+
+	// EnvRunLock is the SYNC_RUN_LOCK environment variable.
+	//
+	// It defines how a sync handles another instance's sync holding the
+	// database lock of syncLock, either RunLockSkip (default), RunLockWait, or
+	// RunLockOff, not locking at all.
+	EnvRunLock = "SYNC_RUN_LOCK"
+
+	// EnvRunLockName is the SYNC_RUN_LOCK_NAME environment variable.
+	//
+	// It names the EnvRunLock, defaulting to runLockNameDefault. As MySQL's
+	// locks are server-wide, instances syncing different Greenlight databases on
+	// one MySQL server need distinct names.
+	EnvRunLockName = "SYNC_RUN_LOCK_NAME"
+
+	// EnvLeaderElection is the SYNC_LEADER_ELECTION environment variable.
+	//
+	// If SYNC_LEADER_ELECTION is set for scheduled syncs, only the instance
+	// holding a database lock performs syncs, see leaderElect.
+	EnvLeaderElection = "SYNC_LEADER_ELECTION"
+
+	// EnvDryRun is the SYNC_DRY_RUN environment variable.
+	//
+	// If SYNC_DRY_RUN is set, all changes are computed and logged, but no SQL
+	// update is performed.
+	EnvDryRun = "SYNC_DRY_RUN"
+
+	// EnvMaintenance is the SYNC_MAINTENANCE environment variable.
+	//
+	// If SYNC_MAINTENANCE is set, the maintenance mode is enabled at start. In
+	// this mode, syncs behave like EnvDryRun. It is toggled by SIGUSR1, unless
+	// EnvSignalUsr1 is SignalUsr1Sync.
+	EnvMaintenance = "SYNC_MAINTENANCE"
+
+	// EnvPauseFile is the SYNC_PAUSE_FILE environment variable.
+	//
+	// While a file exists at this path, scheduled syncs are skipped, as while
+	// paused by the EnvAdminAddr API, see syncIsPaused.
+	EnvPauseFile = "SYNC_PAUSE_FILE"
+
+	// EnvSignalUsr1 is the SYNC_SIGNAL_USR1 environment variable.
+	//
+	// It defines the action of a SIGUSR1 for scheduled syncs, either toggling
+	// the maintenance mode by SignalUsr1Maintenance (default) or performing an
+	// immediate sync by SignalUsr1Sync.
+	EnvSignalUsr1 = "SYNC_SIGNAL_USR1"
+
+	// EnvDryRunColumns is the SYNC_DRY_RUN_COLUMNS environment variable.
+	//
+	// It limits the changes reported by EnvDryRun to this comma separated list
+	// of columns.
+	EnvDryRunColumns = "SYNC_DRY_RUN_COLUMNS"
+
+	// EnvUser is the SYNC_USER environment variable.
+	//
+	// If SYNC_USER is set, the sync command only syncs this comma separated
+	// list of users, identified by their EnvMatchColumn value, and prints the
+	// outcome, e.g., by "sync --user alice".
+	EnvUser = "SYNC_USER"
+
+	// EnvMissingPolicy is the SYNC_MISSING_POLICY environment variable.
+	//
+	// It defines how Greenlight users without an LDAP entry are treated, e.g.,
+	// of departed employees. Defaults to MissingPolicyWarn.
+	EnvMissingPolicy = "SYNC_MISSING_POLICY"
+
+	// EnvOptOutAttribute is the SYNC_OPT_OUT_ATTRIBUTE environment variable.
+	//
+	// If SYNC_OPT_OUT_ATTRIBUTE is set, users whose LDAP entry has a truthy
+	// value for this attribute are skipped entirely.
+	EnvOptOutAttribute = "SYNC_OPT_OUT_ATTRIBUTE"
+
+	// EnvIncludeGroups is the SYNC_INCLUDE_GROUPS environment variable.
+	//
+	// If SYNC_INCLUDE_GROUPS is set, only members of these semicolon separated
+	// group DNs are synced.
+	EnvIncludeGroups = "SYNC_INCLUDE_GROUPS"
+
+	// EnvExcludeGroups is the SYNC_EXCLUDE_GROUPS environment variable.
+	//
+	// Members of these semicolon separated group DNs are not synced, e.g.,
+	// service accounts.
+	EnvExcludeGroups = "SYNC_EXCLUDE_GROUPS"
+
+	// EnvNestedGroups is the SYNC_NESTED_GROUPS environment variable.
+	//
+	// It defines how nested group memberships are resolved for group based
+	// scopes, roles, and shared rooms, being either NestedGroupsNone (default),
+	// NestedGroupsRecursive, or NestedGroupsChain.
+	EnvNestedGroups = "SYNC_NESTED_GROUPS"
+
+	// EnvNestedGroupsDepth is the SYNC_NESTED_GROUPS_DEPTH environment variable.
+	//
+	// It limits the levels of nested groups followed by NestedGroupsRecursive,
+	// defaulting to 5.
+	EnvNestedGroupsDepth = "SYNC_NESTED_GROUPS_DEPTH"
+
+	// EnvGroupBase is the SYNC_GROUP_BASE environment variable.
+	//
+	// It is the search base of groups for NestedGroupsChain, defaulting to
+	// LDAP_BASE.
+	EnvGroupBase = "SYNC_GROUP_BASE"
+
+	// EnvLockPolicy is the SYNC_LOCK_POLICY environment variable.
+	//
+	// It defines how temporarily locked LDAP accounts are treated. The default
+	// LockPolicyIgnore only logs the lock state, while LockPolicyDeactivate soft
+	// deletes the Greenlight user until it is unlocked.
+	EnvLockPolicy = "SYNC_LOCK_POLICY"
+
+	// EnvDisabledPolicy is the SYNC_DISABLED_POLICY environment variable.
+	//
+	// It defines how expired or disabled LDAP accounts, see ldapEntryDisabled,
+	// are treated. Defaults to DisabledPolicyIgnore.
+	EnvDisabledPolicy = "SYNC_DISABLED_POLICY"
+
+	// EnvRoomPolicy is the SYNC_ROOM_POLICY environment variable.
+	//
+	// It defines how the rooms of users deactivated by EnvMissingPolicy or
+	// EnvLockPolicy, or EnvDisabledPolicy are handled. Defaults to
+	// RoomPolicyKeep.
+	EnvRoomPolicy = "SYNC_ROOM_POLICY"
+
+	// EnvRoomOwner is the SYNC_ROOM_OWNER environment variable.
+	//
+	// It is the email address of the Greenlight account receiving the rooms for
+	// RoomPolicyTransfer, e.g., an administrator.
+	EnvRoomOwner = "SYNC_ROOM_OWNER"
+
+	// EnvLdapLdif is the SYNC_LDAP_LDIF environment variable.
+	//
+	// If SYNC_LDAP_LDIF is set, users are searched in this LDIF file instead of
+	// the configured LDAP server. Alternatively, EnvSource might be
+	// SourceLdifPrefix followed by the path.
+	EnvLdapLdif = "SYNC_LDAP_LDIF"
+
+	// EnvSource is the SYNC_SOURCE environment variable.
+	//
+	// It selects the identity source the users are looked up in, either
+	// SourceLdap (default), SourceKeycloak, or an EnvLdapLdif file by
+	// SourceLdifPrefix, e.g., "ldif:/srv/export.ldif".
+	EnvSource = "SYNC_SOURCE"
+
+	// EnvKeycloakUrl is the SYNC_KEYCLOAK_URL environment variable.
+	//
+	// It is the Keycloak server's base URL for SourceKeycloak, e.g.,
+	// https://keycloak.example.org.
+	EnvKeycloakUrl = "SYNC_KEYCLOAK_URL"
+
+	// EnvKeycloakRealm is the SYNC_KEYCLOAK_REALM environment variable.
+	//
+	// It is the realm whose users are synced for SourceKeycloak.
+	EnvKeycloakRealm = "SYNC_KEYCLOAK_REALM"
+
+	// EnvKeycloakClientId is the SYNC_KEYCLOAK_CLIENT_ID environment variable.
+	//
+	// It is the client whose service account lists the EnvKeycloakRealm's
+	// users, requiring the view-users role of realm-management.
+	EnvKeycloakClientId = "SYNC_KEYCLOAK_CLIENT_ID"
+
+	// EnvKeycloakClientSecret is the SYNC_KEYCLOAK_CLIENT_SECRET environment
+	// variable.
+	//
+	// It is the EnvKeycloakClientId's secret.
+	EnvKeycloakClientSecret = "SYNC_KEYCLOAK_CLIENT_SECRET"
+
+	// EnvKeycloakGroups is the SYNC_KEYCLOAK_GROUPS environment variable.
+	//
+	// If SYNC_KEYCLOAK_GROUPS is set, each user's group paths are fetched as
+	// its memberOf attribute, e.g., for EnvRoleMap.
+	EnvKeycloakGroups = "SYNC_KEYCLOAK_GROUPS"
+
+	// EnvClearOnEmpty is the SYNC_CLEAR_ON_EMPTY environment variable.
+	//
+	// If SYNC_CLEAR_ON_EMPTY is set, columns whose LDAP attribute is present
+	// without a value are cleared. Absent attributes never touch their column.
+	EnvClearOnEmpty = "SYNC_CLEAR_ON_EMPTY"
+
+	// EnvClearedPolicy is the SYNC_CLEARED_POLICY environment variable.
+	//
+	// It is a semicolon separated list of COLUMN=POLICY pairs, defining how a
+	// column is handled if its LDAP attribute is absent or has no value, e.g.,
+	// ClearedPolicyClear. Other columns follow EnvClearOnEmpty.
+	EnvClearedPolicy = "SYNC_CLEARED_POLICY"
+
+	// EnvSchema is the SYNC_SCHEMA environment variable.
+	//
+	// It selects the Greenlight database schema, either SchemaV2 (default),
+	// SchemaV3, or SchemaAuto.
+	EnvSchema = "SYNC_SCHEMA"
+
+	// EnvMatchColumn is the SYNC_MATCH_COLUMN environment variable.
+	//
+	// It selects the users column holding the EnvMatchAttribute value to look up
+	// each user, defaulting to social_uid for SchemaV2 and external_id for
+	// SchemaV3.
+	EnvMatchColumn = "SYNC_MATCH_COLUMN"
+
+	// EnvMatchAttribute is the SYNC_MATCH_ATTRIBUTE environment variable.
+	//
+	// It is the LDAP attribute whose value the EnvMatchColumn holds, defaulting
+	// to LDAP_UID, e.g., a stable entryUUID or objectGUID being kept when an
+	// entry is moved or renamed.
+	EnvMatchAttribute = "SYNC_MATCH_ATTRIBUTE"
+
+	// EnvProviders is the SYNC_PROVIDERS environment variable.
+	//
+	// It is the comma separated list of users' providers to be synced,
+	// defaulting to ldap for SchemaV2 and greenlight for SchemaV3. Users of
+	// other providers, e.g., local or OmniAuth accounts, are skipped.
+	EnvProviders = "SYNC_PROVIDERS"
+
+	// EnvDbDriver is the SYNC_DB_DRIVER environment variable.
+	//
+	// It selects the database driver, either DbDriverPostgres or DbDriverMysql,
+	// defaulting to one based on DB_ADAPTER.
+	EnvDbDriver = "SYNC_DB_DRIVER"
+
+	// EnvDbSslMode is the SYNC_DB_SSLMODE environment variable.
+	//
+	// It is PostgreSQL's sslmode, one of DbSslModeDisable (default),
+	// DbSslModeRequire, DbSslModeVerifyCa, or DbSslModeVerifyFull.
+	EnvDbSslMode = "SYNC_DB_SSLMODE"
+
+	// EnvDbSslRootCert is the SYNC_DB_SSLROOTCERT environment variable.
+	//
+	// It is the PEM file of CA certificates verifying PostgreSQL's certificate
+	// for DbSslModeVerifyCa and DbSslModeVerifyFull.
+	EnvDbSslRootCert = "SYNC_DB_SSLROOTCERT"
+
+	// EnvDbSslCert is the SYNC_DB_SSLCERT environment variable.
+	//
+	// If SYNC_DB_SSLCERT is set, this PEM client certificate is presented to
+	// PostgreSQL, together with EnvDbSslKey.
+	EnvDbSslCert = "SYNC_DB_SSLCERT"
+
+	// EnvDbSslKey is the SYNC_DB_SSLKEY environment variable.
+	//
+	// It is the PEM private key of EnvDbSslCert.
+	EnvDbSslKey = "SYNC_DB_SSLKEY"
+
+	// EnvDbConnectTimeout is the SYNC_DB_CONNECT_TIMEOUT environment variable.
+	//
+	// It bounds establishing a database connection, rounded up to whole
+	// seconds. It defaults to 0, waiting indefinitely.
+	EnvDbConnectTimeout = "SYNC_DB_CONNECT_TIMEOUT"
+
+	// EnvDbSearchPath is the SYNC_DB_SEARCH_PATH environment variable.
+	//
+	// If SYNC_DB_SEARCH_PATH is set, it is PostgreSQL's search_path of the
+	// session, e.g., for Greenlight's tables in another schema than public.
+	EnvDbSearchPath = "SYNC_DB_SEARCH_PATH"
+
+	// EnvDbApplicationName is the SYNC_DB_APPLICATION_NAME environment
+	// variable.
+	//
+	// It is PostgreSQL's application_name of the session, identifying the sync
+	// in pg_stat_activity, defaulting to greenlight-ldap-sync.
+	EnvDbApplicationName = "SYNC_DB_APPLICATION_NAME"
+
+	// EnvDbUrl is the SYNC_DB_URL environment variable.
+	//
+	// If SYNC_DB_URL is set, its PostgreSQL connection parameters, either as a
+	// postgres:// URI or a libpq connection string, override those of DB_HOST,
+	// PORT, DB_NAME, DB_USERNAME, DB_PASSWORD, and the EnvDbSslMode settings.
+	EnvDbUrl = "SYNC_DB_URL"
+
+	// EnvDbReplicaHost is the SYNC_DB_REPLICA_HOST environment variable.
+	//
+	// If SYNC_DB_REPLICA_HOST is set, the users are fetched from this read-only
+	// PostgreSQL replica instead of DB_HOST, which still receives all writes.
+	EnvDbReplicaHost = "SYNC_DB_REPLICA_HOST"
+
+	// EnvDbReplicaPort is the SYNC_DB_REPLICA_PORT environment variable.
+	//
+	// It is the EnvDbReplicaHost's port, defaulting to PORT.
+	EnvDbReplicaPort = "SYNC_DB_REPLICA_PORT"
+
+	// EnvUpdatedAt is the SYNC_UPDATED_AT environment variable.
+	//
+	// It defines when the updated_at column is bumped on writes: UpdatedAtChanged
+	// (default), UpdatedAtAlways, or UpdatedAtNever.
+	EnvUpdatedAt = "SYNC_UPDATED_AT"
+
+	// EnvUpdatedAtColumn is the SYNC_UPDATED_AT_COLUMN environment variable.
+	//
+	// It names the column bumped by EnvUpdatedAt, defaulting to updated_at.
+	EnvUpdatedAtColumn = "SYNC_UPDATED_AT_COLUMN"
+
+	// EnvDuplicatePolicy is the SYNC_DUPLICATE_POLICY environment variable.
+	//
+	// It defines how multiple SQL users sharing the same social_uid or username
+	// are handled, either DuplicatePolicySkip (default) or DuplicatePolicyLowestId.
+	EnvDuplicatePolicy = "SYNC_DUPLICATE_POLICY"
+
+	// EnvDuplicateAccounts is the SYNC_DUPLICATE_ACCOUNTS environment variable.
+	//
+	// It defines how other Greenlight accounts sharing the email address of a
+	// synced LDAP user, e.g., of an email sign-up, are handled. Defaults to
+	// DuplicateAccountsReport.
+	EnvDuplicateAccounts = "SYNC_DUPLICATE_ACCOUNTS"
+
+	// EnvConflictPolicy is the SYNC_CONFLICT_POLICY environment variable.
+	//
+	// It defines how a user's new value of an EnvUniqueColumns column already
+	// held by another Greenlight account is handled, defaulting to
+	// ConflictPolicyFail.
+	EnvConflictPolicy = "SYNC_CONFLICT_POLICY"
+
+	// EnvUniqueColumns is the SYNC_UNIQUE_COLUMNS environment variable.
+	//
+	// It lists the columns checked for conflicts by the EnvConflictPolicy,
+	// defaulting to email.
+	EnvUniqueColumns = "SYNC_UNIQUE_COLUMNS"
+
+	// EnvSkipColumnCheck is the SYNC_SKIP_COLUMN_CHECK environment variable.
+	//
+	// If SYNC_SKIP_COLUMN_CHECK is set, the startup verification of all used
+	// columns against the database's information_schema is skipped.
+	EnvSkipColumnCheck = "SYNC_SKIP_COLUMN_CHECK"
+
+	// EnvCanary is the SYNC_CANARY environment variable.
+	//
+	// It selects users whose updates are committed first, either as a comma
+	// separated list or a percentage. If their update fails, the remaining
+	// users are skipped.
+	EnvCanary = "SYNC_CANARY"
+
+	// EnvMaxChanges is the SYNC_MAX_CHANGES environment variable.
+	//
+	// If SYNC_MAX_CHANGES is set, either to a number of users or a percentage,
+	// a sync changing more users is aborted before applying any change, unless
+	// EnvForce is set.
+	EnvMaxChanges = "SYNC_MAX_CHANGES"
+
+	// EnvForce is the SYNC_FORCE environment variable.
+	//
+	// If SYNC_FORCE is set, the EnvMaxChanges threshold is not enforced.
+	EnvForce = "SYNC_FORCE"
+
+	// EnvForceResync is the SYNC_FORCE_RESYNC environment variable.
+	//
+	// If SYNC_FORCE_RESYNC is set, all mapped LDAP values are written, even if
+	// they do not differ from the stored ones.
+	EnvForceResync = "SYNC_FORCE_RESYNC"
+
+	// EnvVerifyUpdates is the SYNC_VERIFY_UPDATES environment variable.
+	//
+	// If SYNC_VERIFY_UPDATES is set, updated users are read back after being
+	// committed and each differing stored value is reported.
+	EnvVerifyUpdates = "SYNC_VERIFY_UPDATES"
+
+	// EnvStatusTable is the SYNC_STATUS_TABLE environment variable.
+	//
+	// If SYNC_STATUS_TABLE is set, each sync's outcome is upserted as a single
+	// row into this table, created if missing.
+	EnvStatusTable = "SYNC_STATUS_TABLE"
+
+	// EnvCursorTable is the SYNC_CURSOR_TABLE environment variable.
+	//
+	// If SYNC_CURSOR_TABLE is set, the progress of the last successful sync is
+	// kept as a single row of this table, created if missing, see syncCursor.
+	EnvCursorTable = "SYNC_CURSOR_TABLE"
+
+	// EnvAuditTable is the SYNC_AUDIT_TABLE environment variable.
+	//
+	// If SYNC_AUDIT_TABLE is set, each applied change is recorded as a row into
+	// this table, created and migrated by sqlWriteAudit.
+	EnvAuditTable = "SYNC_AUDIT_TABLE"
+
+	// EnvHistoryTable is the SYNC_HISTORY_TABLE environment variable.
+	//
+	// If SYNC_HISTORY_TABLE is set, each sync's outcome is appended as a row
+	// into this table, created and migrated by sqlWriteHistory.
+	EnvHistoryTable = "SYNC_HISTORY_TABLE"
+
+	// EnvHistoryRetention is the SYNC_HISTORY_RETENTION environment variable.
+	//
+	// SYNC_HISTORY_RETENTION is the duration runs are kept within the
+	// EnvHistoryTable, keeping all of them if unset.
+	EnvHistoryRetention = "SYNC_HISTORY_RETENTION"
+
+	// EnvStateFile is the SYNC_STATE_FILE environment variable.
+	//
+	// If SYNC_STATE_FILE is set, each sync's outcome is written as JSON to this
+	// file, replacing the previous one, e.g., for the status command.
+	EnvStateFile = "SYNC_STATE_FILE"
+
+	// EnvStatusMaxAge is the SYNC_STATUS_MAX_AGE environment variable.
+	//
+	// It is the age of the last sync after which the status command fails,
+	// defaulting to 25h for daily syncs.
+	EnvStatusMaxAge = "SYNC_STATUS_MAX_AGE"
+
+	// EnvSqlChunkSize is the SYNC_SQL_CHUNK_SIZE environment variable.
+	//
+	// If SYNC_SQL_CHUNK_SIZE is set, user updates are applied sequentially in
+	// transactions of this many users instead of a single one. It is ignored for
+	// EnvSqlParallel.
+	EnvSqlChunkSize = "SYNC_SQL_CHUNK_SIZE"
+
+	// EnvSqlChunkDelay is the SYNC_SQL_CHUNK_DELAY environment variable.
+	//
+	// If SYNC_SQL_CHUNK_DELAY is set, e.g., to "500ms", each EnvSqlChunkSize
+	// chunk after the first is delayed by this duration.
+	EnvSqlChunkDelay = "SYNC_SQL_CHUNK_DELAY"
+
+	// EnvSqlBatchSize is the SYNC_SQL_BATCH_SIZE environment variable.
+	//
+	// If SYNC_SQL_BATCH_SIZE is set, users are fetched and synced in batches of
+	// this many users instead of loading all of them at once.
+	EnvSqlBatchSize = "SYNC_SQL_BATCH_SIZE"
+
+	// EnvSqlFetchQuery is the SYNC_SQL_FETCH_QUERY environment variable.
+	//
+	// If SYNC_SQL_FETCH_QUERY is set, it replaces the SELECT of the synced users
+	// by sqlFetchUsers, returning the sqlReadColumns and their role by name.
+	EnvSqlFetchQuery = "SYNC_SQL_FETCH_QUERY"
+
+	// EnvSqlUpdateQuery is the SYNC_SQL_UPDATE_QUERY environment variable.
+	//
+	// If SYNC_SQL_UPDATE_QUERY is set, it replaces the UPDATE of a changed user
+	// by sqlUpdateUser, receiving its id and sqlWritableColumns as parameters.
+	EnvSqlUpdateQuery = "SYNC_SQL_UPDATE_QUERY"
+
+	// EnvWriter is the SYNC_WRITER environment variable.
+	//
+	// It selects how user updates are applied, being WriterSql by default or
+	// WriterRails for Greenlight v3, see railsRun.
+	EnvWriter = "SYNC_WRITER"
+
+	// EnvRailsRunner is the SYNC_RAILS_RUNNER environment variable.
+	//
+	// It is the command of WriterRails, running a Ruby script read from stdin
+	// within Greenlight, e.g., "docker exec -i greenlight-v3 bin/rails runner -".
+	EnvRailsRunner = "SYNC_RAILS_RUNNER"
+
+	// EnvRailsTimeout is the SYNC_RAILS_TIMEOUT environment variable.
+	//
+	// It bounds each EnvRailsRunner execution as a Go time.Duration string,
+	// defaulting to 5m.
+	EnvRailsTimeout = "SYNC_RAILS_TIMEOUT"
+
+	// EnvIncremental is the SYNC_INCREMENTAL environment variable.
+	//
+	// If SYNC_INCREMENTAL is set, syncs after a successful one only compare
+	// users whose LDAP entries' modifyTimestamp is younger than its start.
+	EnvIncremental = "SYNC_INCREMENTAL"
+
+	// EnvIncrementalFullInterval is the SYNC_INCREMENTAL_FULL_INTERVAL
+	// environment variable.
+	//
+	// It is the maximum duration between two full syncs for EnvIncremental,
+	// defaulting to 24h.
+	EnvIncrementalFullInterval = "SYNC_INCREMENTAL_FULL_INTERVAL"
+
+	// EnvConcurrency is the SYNC_CONCURRENCY environment variable.
+	//
+	// It sets the number of LDAP connections used for concurrent user searches,
+	// defaulting to one.
+	EnvConcurrency = "SYNC_CONCURRENCY"
+
+	// EnvReuseConnections is the SYNC_REUSE_CONNECTIONS environment variable.
+	//
+	// If SYNC_REUSE_CONNECTIONS is set, the LDAP and SQL connections are kept
+	// between scheduled syncs and only re-established if their health check
+	// fails, see syncSqlOpen and syncLdapOpenPool.
+	EnvReuseConnections = "SYNC_REUSE_CONNECTIONS"
+
+	// EnvSqlParallel is the SYNC_SQL_PARALLEL environment variable.
+	//
+	// If SYNC_SQL_PARALLEL is greater than one, user updates are split into this
+	// many chunks, applied in parallel on separate connections and transactions.
+	// This trades the atomicity of a single transaction for throughput.
+	EnvSqlParallel = "SYNC_SQL_PARALLEL"
+
+	// EnvDialRetries is the SYNC_DIAL_RETRIES environment variable.
+	//
+	// It defines how often a failed LDAP or SQL connection attempt is retried,
+	// defaulting to 3. The delay between attempts is drawn at random up to an
+	// exponentially growing ceiling, see fullJitterBackoff.
+	EnvDialRetries = "SYNC_DIAL_RETRIES"
+
+	// EnvOpRetries is the SYNC_OP_RETRIES environment variable.
+	//
+	// It defines how often an LDAP search or an SQL transaction failing with a
+	// transient error is retried, defaulting to 3. The backoff follows
+	// EnvDialRetries.
+	EnvOpRetries = "SYNC_OP_RETRIES"
+
+	// EnvRetryBudget is the SYNC_RETRY_BUDGET environment variable.
+	//
+	// It caps the cumulative retries of all operations within a single sync.
+	// Once exhausted, the sync is aborted. Defaults to 0 for no limit.
+	EnvRetryBudget = "SYNC_RETRY_BUDGET"
+
+	// EnvDialBackoffBase is the SYNC_DIAL_BACKOFF_BASE environment variable.
+	//
+	// It is the initial backoff ceiling for EnvDialRetries, defaulting to 1s.
+	EnvDialBackoffBase = "SYNC_DIAL_BACKOFF_BASE"
+
+	// EnvDialBackoffMax is the SYNC_DIAL_BACKOFF_MAX environment variable.
+	//
+	// It caps the backoff ceiling for EnvDialRetries, defaulting to 30s.
+	EnvDialBackoffMax = "SYNC_DIAL_BACKOFF_MAX"
+
+	// EnvKeepAlive is the SYNC_KEEPALIVE environment variable.
+	//
+	// It is the TCP keepalive period for both LDAP and SQL connections,
+	// defaulting to 30s, to prevent idle connections from being dropped.
+	EnvKeepAlive = "SYNC_KEEPALIVE"
+
+	// EnvLdapDialTimeout is the SYNC_LDAP_DIAL_TIMEOUT environment variable.
+	//
+	// It bounds establishing an LDAP connection, including TLS, defaulting to
+	// ldap.DefaultTimeout.
+	EnvLdapDialTimeout = "SYNC_LDAP_DIAL_TIMEOUT"
+
+	// EnvLdapBindTimeout is the SYNC_LDAP_BIND_TIMEOUT environment variable.
+	//
+	// It bounds the StartTLS and bind operations, defaulting to 30s.
+	EnvLdapBindTimeout = "SYNC_LDAP_BIND_TIMEOUT"
+
+	// EnvLdapSearchTimeout is the SYNC_LDAP_SEARCH_TIMEOUT environment variable.
+	//
+	// It bounds each LDAP search request, e.g., each page of a paged search,
+	// defaulting to 2m.
+	EnvLdapSearchTimeout = "SYNC_LDAP_SEARCH_TIMEOUT"
+
+	// EnvLdapIdleTimeout is the SYNC_LDAP_IDLE_TIMEOUT environment variable.
+	//
+	// If set, LDAP connections idle for this duration are redialed before their
+	// next search, preceding the server's idle timeout.
+	EnvLdapIdleTimeout = "SYNC_LDAP_IDLE_TIMEOUT"
+
+	// EnvLdapTLSHandshakeTimeout is the SYNC_LDAP_TLS_HANDSHAKE_TIMEOUT
+	// environment variable.
+	//
+	// It bounds the TLS handshake of LDAPS and StartTLS connections, defaulting
+	// to 10s.
+	EnvLdapTLSHandshakeTimeout = "SYNC_LDAP_TLS_HANDSHAKE_TIMEOUT"
+
+	// EnvLdapTimeLimit is the SYNC_LDAP_TIME_LIMIT environment variable.
+	//
+	// If set, it is sent as the server-side time limit of each LDAP search
+	// request, rounded up to whole seconds.
+	EnvLdapTimeLimit = "SYNC_LDAP_TIME_LIMIT"
+
+	// EnvSqlTimeout is the SYNC_SQL_TIMEOUT environment variable.
+	//
+	// It is PostgreSQL's statement_timeout for all SQL statements, defaulting
+	// to 5m.
+	EnvSqlTimeout = "SYNC_SQL_TIMEOUT"
+
+	// EnvLdapBases is the SYNC_LDAP_BASES environment variable.
+	//
+	// If SYNC_LDAP_BASES is set, this semicolon separated list of base DNs with
+	// optional filters replaces LDAP_BASE, see parseLdapBases. Users are looked
+	// up in each base in order until found.
+	EnvLdapBases = "SYNC_LDAP_BASES"
+
+	// EnvLdapServers is the SYNC_LDAP_SERVERS environment variable.
+	//
+	// If SYNC_LDAP_SERVERS is set, this comma separated list of servers in the
+	// format of LDAP_SERVER replaces it, each being tried in order. An entry of
+	// dns-srv://DOMAIN is resolved by DNS SRV records.
+	EnvLdapServers = "SYNC_LDAP_SERVERS"
+
+	// EnvLdapTLSServerName is the SYNC_LDAP_TLS_SERVER_NAME environment variable.
+	//
+	// If SYNC_LDAP_TLS_SERVER_NAME is set, it is sent as SNI and used to verify
+	// the LDAP server's certificate instead of LDAP_SERVER.
+	EnvLdapTLSServerName = "SYNC_LDAP_TLS_SERVER_NAME"
+
+	// EnvLdapTLSCAFile is the SYNC_LDAP_TLS_CA_FILE environment variable.
+	//
+	// If SYNC_LDAP_TLS_CA_FILE is set, the LDAP server's certificate is also
+	// trusted if issued by a CA of this PEM file, e.g., an internal CA.
+	EnvLdapTLSCAFile = "SYNC_LDAP_TLS_CA_FILE"
+
+	// EnvLdapTLSCertFile is the SYNC_LDAP_TLS_CERT_FILE environment variable.
+	//
+	// If SYNC_LDAP_TLS_CERT_FILE is set, this PEM client certificate is
+	// presented to the LDAP server, together with EnvLdapTLSKeyFile.
+	EnvLdapTLSCertFile = "SYNC_LDAP_TLS_CERT_FILE"
+
+	// EnvLdapTLSKeyFile is the SYNC_LDAP_TLS_KEY_FILE environment variable.
+	//
+	// It is the PEM private key of EnvLdapTLSCertFile.
+	EnvLdapTLSKeyFile = "SYNC_LDAP_TLS_KEY_FILE"
+
+	// EnvTLSMinVersion is the SYNC_TLS_MIN_VERSION environment variable.
+	//
+	// If set, e.g., to "1.2", it is the minimum TLS version of LDAP and
+	// PostgreSQL connections, see parseTLSVersion.
+	EnvTLSMinVersion = "SYNC_TLS_MIN_VERSION"
+
+	// EnvTLSCipherSuites is the SYNC_TLS_CIPHER_SUITES environment variable.
+	//
+	// If set, it is a comma separated list of the TLS 1.0 to 1.2 cipher suites
+	// allowed for LDAP and PostgreSQL connections, see parseTLSCipherSuites.
+	EnvTLSCipherSuites = "SYNC_TLS_CIPHER_SUITES"
+
+	// EnvTLSInsecureSkipVerify is the SYNC_TLS_INSECURE_SKIP_VERIFY environment
+	// variable.
+	//
+	// If SYNC_TLS_INSECURE_SKIP_VERIFY is set, the certificates of LDAP and
+	// PostgreSQL servers are not verified. Each such connection is logged as a
+	// warning by tlsApply.
+	EnvTLSInsecureSkipVerify = "SYNC_TLS_INSECURE_SKIP_VERIFY"
+
+	// EnvLdapStartTLS is the SYNC_LDAP_STARTTLS environment variable.
+	//
+	// It defines whether StartTLS for the tls LDAP_METHOD is StartTLSMandatory
+	// (default) or StartTLSOpportunistic.
+	EnvLdapStartTLS = "SYNC_LDAP_STARTTLS"
+
+	// EnvLdapSasl is the SYNC_LDAP_SASL environment variable.
+	//
+	// It selects a SASL mechanism for the LDAP bind, replacing LDAP_AUTH, being
+	// either LdapSaslNone (default), LdapSaslGssapi, or LdapSaslExternal.
+	EnvLdapSasl = "SYNC_LDAP_SASL"
+
+	// EnvLdapDirectory is the SYNC_LDAP_DIRECTORY environment variable.
+	//
+	// It selects the directory server's profile, either LdapDirectoryGeneric
+	// (default) or LdapDirectoryAD.
+	EnvLdapDirectory = "SYNC_LDAP_DIRECTORY"
+
+	// EnvLdapGlobalCatalog is the SYNC_LDAP_GLOBAL_CATALOG environment variable.
+	//
+	// If SYNC_LDAP_GLOBAL_CATALOG is set for LdapDirectoryAD, the global
+	// catalog's port replaces LDAP_PORT, searching the whole forest.
+	EnvLdapGlobalCatalog = "SYNC_LDAP_GLOBAL_CATALOG"
+
+	// EnvLdapUserFilter is the SYNC_LDAP_USER_FILTER environment variable.
+	//
+	// It replaces the (EnvMatchAttribute=value) filter of a user's search by a
+	// template, e.g., "(&(objectClass=person)(uid=%s))", see ldapUidFilter.
+	EnvLdapUserFilter = "SYNC_LDAP_USER_FILTER"
+
+	// EnvLdapExtraFilter is the SYNC_LDAP_EXTRA_FILTER environment variable.
+	//
+	// It restricts all user searches besides LDAP_FILTER, without affecting
+	// Greenlight's own logins, see ldapFilter.
+	EnvLdapExtraFilter = "SYNC_LDAP_EXTRA_FILTER"
+
+	// EnvAmbiguousPolicy is the SYNC_AMBIGUOUS_POLICY environment variable.
+	//
+	// It defines how multiple LDAP entries matching a single user are resolved,
+	// defaulting to AmbiguousPolicyFail, see ldapDisambiguate.
+	EnvAmbiguousPolicy = "SYNC_AMBIGUOUS_POLICY"
+
+	// EnvAmbiguousTieBreaker is the SYNC_AMBIGUOUS_TIE_BREAKER environment
+	// variable.
+	//
+	// It names the attribute of AmbiguousPolicyTieBreaker whose lowest value
+	// wins, or its highest one with a "-" prefix, e.g., "-modifyTimestamp".
+	EnvAmbiguousTieBreaker = "SYNC_AMBIGUOUS_TIE_BREAKER"
+
+	// EnvAmbiguousFilter is the SYNC_AMBIGUOUS_FILTER environment variable.
+	//
+	// It is the filter of AmbiguousPolicyFilter, being added to a repeated
+	// search of an ambiguous user, e.g., "(employeeType=staff)".
+	EnvAmbiguousFilter = "SYNC_AMBIGUOUS_FILTER"
+
+	// EnvLdapAnonymous is the SYNC_LDAP_ANONYMOUS environment variable.
+	//
+	// It defines the bind without any LDAP_PASSWORD, being either
+	// LdapAnonymousNone (default), LdapAnonymousUnauthenticated, or
+	// LdapAnonymousSkip.
+	EnvLdapAnonymous = "SYNC_LDAP_ANONYMOUS"
+
+	// EnvKrb5Config is the SYNC_KRB5_CONFIG environment variable.
+	//
+	// It is the Kerberos configuration file for LdapSaslGssapi, defaulting to
+	// /etc/krb5.conf.
+	EnvKrb5Config = "SYNC_KRB5_CONFIG"
+
+	// EnvKrb5Keytab is the SYNC_KRB5_KEYTAB environment variable.
+	//
+	// If SYNC_KRB5_KEYTAB is set, LdapSaslGssapi authenticates as the
+	// EnvKrb5Principal by this keytab instead of an EnvKrb5Ccache.
+	EnvKrb5Keytab = "SYNC_KRB5_KEYTAB"
+
+	// EnvKrb5Principal is the SYNC_KRB5_PRINCIPAL environment variable.
+	//
+	// It is the client principal of the EnvKrb5Keytab, e.g., sync@EXAMPLE.ORG,
+	// defaulting to the configuration's default realm without a realm.
+	EnvKrb5Principal = "SYNC_KRB5_PRINCIPAL"
+
+	// EnvKrb5Ccache is the SYNC_KRB5_CCACHE environment variable.
+	//
+	// It is the Kerberos credential cache file for LdapSaslGssapi without an
+	// EnvKrb5Keytab, defaulting to KRB5CCNAME or /tmp/krb5cc_UID.
+	EnvKrb5Ccache = "SYNC_KRB5_CCACHE"
+
+	// EnvLdapSpn is the SYNC_LDAP_SPN environment variable.
+	//
+	// It is the LDAP server's service principal for LdapSaslGssapi, defaulting
+	// to ldap/HOST of the dialed server.
+	EnvLdapSpn = "SYNC_LDAP_SPN"
+
+	// EnvLdapPageSize is the SYNC_LDAP_PAGE_SIZE environment variable.
+	//
+	// It is the page size of the Simple Paged Results control for LDAP searches,
+	// defaulting to 500. A value of 0 disables paging.
+	EnvLdapPageSize = "SYNC_LDAP_PAGE_SIZE"
+
+	// EnvLdapSearchBatch is the SYNC_LDAP_SEARCH_BATCH environment variable.
+	//
+	// If SYNC_LDAP_SEARCH_BATCH exceeds 1, this many users are searched by a
+	// single LDAP search with an OR filter instead of one search per user.
+	EnvLdapSearchBatch = "SYNC_LDAP_SEARCH_BATCH"
+
+	// EnvLdapReferralHops is the SYNC_LDAP_REFERRAL_HOPS environment variable.
+	//
+	// If SYNC_LDAP_REFERRAL_HOPS is set, user searches without any entry follow
+	// the returned referrals up to this many hops. It defaults to 0, ignoring
+	// referrals.
+	EnvLdapReferralHops = "SYNC_LDAP_REFERRAL_HOPS"
+
+	// EnvLdapReferralCredentials is the SYNC_LDAP_REFERRAL_CREDENTIALS
+	// environment variable.
+	//
+	// It is a semicolon separated list of HOST=BIND_DN|PASSWORD entries, binding
+	// to referral servers with other credentials than LDAP_BIND_DN.
+	EnvLdapReferralCredentials = "SYNC_LDAP_REFERRAL_CREDENTIALS"
+
+	// EnvLdapRate is the SYNC_LDAP_RATE environment variable.
+	//
+	// It limits the LDAP user searches to this number per second. The default
+	// value of 0 disables the limit.
+	EnvLdapRate = "SYNC_LDAP_RATE"
+
+	// EnvLdapBurst is the SYNC_LDAP_BURST environment variable.
+	//
+	// It is the number of LDAP user searches exceeding EnvLdapRate in a burst,
+	// defaulting to EnvLdapRate.
+	EnvLdapBurst = "SYNC_LDAP_BURST"
+
+	// EnvLdapRetryCodes is the SYNC_LDAP_RETRY_CODES environment variable.
+	//
+	// It is a comma separated list of LDAP result codes considered transient by
+	// EnvDialRetries and EnvOpRetries, defaulting to ldapRetryCodesDefault. The
+	// codes of ldapRetryCodesDenied are rejected.
+	EnvLdapRetryCodes = "SYNC_LDAP_RETRY_CODES"
+
+	// EnvEventStream is the SYNC_EVENT_STREAM environment variable.
+	//
+	// If SYNC_EVENT_STREAM is set, each applied change is written as a JSON line
+	// to this file, FIFO, or "-" for stdout.
+	EnvEventStream = "SYNC_EVENT_STREAM"
+
+	// EnvEventDetected is the SYNC_EVENT_DETECTED environment variable.
+	//
+	// If SYNC_EVENT_DETECTED is set, the EnvEventStream also lists each change
+	// as soon as it is detected, before any change is applied or in dry runs.
+	EnvEventDetected = "SYNC_EVENT_DETECTED"
+
+	// EnvReport is the SYNC_REPORT environment variable.
+	//
+	// If SYNC_REPORT is set, all changes of each sync are written to this file,
+	// see writeReport. The placeholders "{run}" and "{time}" are replaced by the
+	// run id and its start time.
+	EnvReport = "SYNC_REPORT"
+
+	// EnvBackup is the SYNC_BACKUP environment variable.
+	//
+	// If SYNC_BACKUP is set, the stored values of all users about to be updated
+	// are written to this file before the update. It might contain the
+	// placeholders {run} and {time}, as EnvReport.
+	EnvBackup = "SYNC_BACKUP"
+
+	// EnvBackupFormat is the SYNC_BACKUP_FORMAT environment variable.
+	//
+	// It selects the EnvBackup format, either BackupFormatJson (default) or
+	// BackupFormatSql.
+	EnvBackupFormat = "SYNC_BACKUP_FORMAT"
+
+	// EnvReportFormat is the SYNC_REPORT_FORMAT environment variable.
+	//
+	// It selects the EnvReport format, either ReportFormatJson (default) or
+	// ReportFormatCsv.
+	EnvReportFormat = "SYNC_REPORT_FORMAT"
+
+	// EnvMetricsAddr is the SYNC_METRICS_ADDR environment variable.
+	//
+	// If SYNC_METRICS_ADDR is set, Prometheus metrics are served on this
+	// address, e.g., :9100, at /metrics.
+	EnvMetricsAddr = "SYNC_METRICS_ADDR"
+
+	// EnvPushgatewayUrl is the SYNC_PUSHGATEWAY_URL environment variable.
+	//
+	// If SYNC_PUSHGATEWAY_URL is set, the metrics are pushed to this Prometheus
+	// Pushgateway after each sync, e.g., for cron jobs.
+	EnvPushgatewayUrl = "SYNC_PUSHGATEWAY_URL"
+
+	// EnvPushgatewayJob is the SYNC_PUSHGATEWAY_JOB environment variable.
+	//
+	// It is the job label of the metrics pushed to EnvPushgatewayUrl, defaulting
+	// to greenlight_ldap_sync.
+	EnvPushgatewayJob = "SYNC_PUSHGATEWAY_JOB"
+
+	// EnvOtlpEndpoint is the SYNC_OTLP_ENDPOINT environment variable.
+	//
+	// If SYNC_OTLP_ENDPOINT is set, each sync is traced and its spans are
+	// exported to this OpenTelemetry collector by OTLP/HTTP, e.g.,
+	// http://tempo:4318.
+	EnvOtlpEndpoint = "SYNC_OTLP_ENDPOINT"
+
+	// EnvOtlpHeaders is the SYNC_OTLP_HEADERS environment variable.
+	//
+	// It is a comma separated list of KEY=VALUE headers of the EnvOtlpEndpoint
+	// requests, e.g., for authentication.
+	EnvOtlpHeaders = "SYNC_OTLP_HEADERS"
+
+	// EnvSentryDsn is the SYNC_SENTRY_DSN environment variable.
+	//
+	// If SYNC_SENTRY_DSN is set, logged errors and panics are reported to
+	// this Sentry or GlitchTip project.
+	EnvSentryDsn = "SYNC_SENTRY_DSN"
+
+	// EnvSentryEnvironment is the SYNC_SENTRY_ENVIRONMENT environment variable.
+	//
+	// It is the environment of the EnvSentryDsn events, e.g., production.
+	EnvSentryEnvironment = "SYNC_SENTRY_ENVIRONMENT"
+
+	// EnvHealthAddr is the SYNC_HEALTH_ADDR environment variable.
+	//
+	// If SYNC_HEALTH_ADDR is set, the /healthz and /readyz endpoints, and the
+	// /status endpoint of scheduled syncs are served on this address. It
+	// defaults to EnvMetricsAddr.
+	EnvHealthAddr = "SYNC_HEALTH_ADDR"
+
+	// EnvAdminAddr is the SYNC_ADMIN_ADDR environment variable.
+	//
+	// If SYNC_ADMIN_ADDR is set while continuing by EnvInterval or EnvSchedule,
+	// a POST /sync endpoint triggering an immediate sync is served on this
+	// address, either a TCP address or a unix:PATH socket.
+	EnvAdminAddr = "SYNC_ADMIN_ADDR"
+
+	// EnvAdminToken is the SYNC_ADMIN_TOKEN environment variable.
+	//
+	// It is the bearer token required by the EnvAdminAddr endpoints.
+	EnvAdminToken = "SYNC_ADMIN_TOKEN"
+
+	// EnvAdminPprof is the SYNC_ADMIN_PPROF environment variable.
+	//
+	// If SYNC_ADMIN_PPROF is set, net/http/pprof's profiles are served below
+	// adminPprofPath on the EnvAdminAddr, also for a single sync.
+	EnvAdminPprof = "SYNC_ADMIN_PPROF"
+
+	// EnvScimAddr is the SYNC_SCIM_ADDR environment variable.
+	//
+	// If SYNC_SCIM_ADDR is set, a SCIM 2.0 Users endpoint is served on this
+	// address for identity providers pushing changes, see scimHandler.
+	EnvScimAddr = "SYNC_SCIM_ADDR"
+
+	// EnvScimToken is the SYNC_SCIM_TOKEN environment variable.
+	//
+	// It is the bearer token required by the EnvScimAddr endpoint.
+	EnvScimToken = "SYNC_SCIM_TOKEN"
+
+	// EnvKubeEvents is the SYNC_KUBE_EVENTS environment variable.
+	//
+	// If SYNC_KUBE_EVENTS is set, sync failures and recoveries are reported as
+	// Kubernetes Events for this pod when running within a cluster.
+	EnvKubeEvents = "SYNC_KUBE_EVENTS"
+
+	// EnvVaultAddr is the SYNC_VAULT_ADDR environment variable.
+	//
+	// If SYNC_VAULT_ADDR is set, the credentials of EnvVaultLdapPath and
+	// EnvVaultDbPath are fetched from this HashiCorp Vault server at start and
+	// before each run.
+	EnvVaultAddr = "SYNC_VAULT_ADDR"
+
+	// EnvVaultToken is the SYNC_VAULT_TOKEN environment variable.
+	//
+	// It is the token authenticating to EnvVaultAddr.
+	EnvVaultToken = "SYNC_VAULT_TOKEN"
+
+	// EnvVaultCAFile is the SYNC_VAULT_CA_FILE environment variable.
+	//
+	// If SYNC_VAULT_CA_FILE is set, the Vault server's certificate is also
+	// trusted if issued by a CA of this PEM file.
+	EnvVaultCAFile = "SYNC_VAULT_CA_FILE"
+
+	// EnvVaultLdapPath is the SYNC_VAULT_LDAP_PATH environment variable.
+	//
+	// It is the path of a Vault secret with bind_dn and password fields,
+	// replacing LDAP_BIND_DN and LDAP_PASSWORD.
+	EnvVaultLdapPath = "SYNC_VAULT_LDAP_PATH"
+
+	// EnvVaultDbPath is the SYNC_VAULT_DB_PATH environment variable.
+	//
+	// It is the path of a Vault secret with username and password fields,
+	// replacing DB_USERNAME and DB_PASSWORD, e.g., dynamic credentials of the
+	// database secrets engine.
+	EnvVaultDbPath = "SYNC_VAULT_DB_PATH"
+
+	// EnvWebhookUrl is the SYNC_WEBHOOK_URL environment variable.
+	//
+	// If SYNC_WEBHOOK_URL is set, a JSON document listing the changed users and
+	// their applied changes is POSTed to this URL after each sync which changed
+	// any user.
+	EnvWebhookUrl = "SYNC_WEBHOOK_URL"
+
+	// EnvWebhookSecret is the SYNC_WEBHOOK_SECRET environment variable.
+	//
+	// If SYNC_WEBHOOK_SECRET is set, each EnvWebhookUrl notification is signed
+	// by an HMAC-SHA256 of its body, see notifySignatureHeader.
+	EnvWebhookSecret = "SYNC_WEBHOOK_SECRET"
+
+	// EnvNotifyTimeout is the SYNC_NOTIFY_TIMEOUT environment variable.
+	//
+	// It bounds each notification delivery attempt as a Go time.Duration string,
+	// defaulting to 10s.
+	EnvNotifyTimeout = "SYNC_NOTIFY_TIMEOUT"
+
+	// EnvNotifyRetries is the SYNC_NOTIFY_RETRIES environment variable.
+	//
+	// It defines how often a failed notification delivery is retried with an
+	// exponential backoff, starting at one second. Defaults to 3.
+	EnvNotifyRetries = "SYNC_NOTIFY_RETRIES"
+
+	// EnvHookPre is the SYNC_HOOK_PRE environment variable.
+	//
+	// If SYNC_HOOK_PRE is set, this command is executed before each sync,
+	// aborting the sync if it fails, see hookRun.
+	EnvHookPre = "SYNC_HOOK_PRE"
+
+	// EnvHookSuccess is the SYNC_HOOK_SUCCESS environment variable.
+	//
+	// If SYNC_HOOK_SUCCESS is set, this command is executed after each
+	// successful sync, receiving the applied changes on stdin.
+	EnvHookSuccess = "SYNC_HOOK_SUCCESS"
+
+	// EnvHookFailure is the SYNC_HOOK_FAILURE environment variable.
+	//
+	// If SYNC_HOOK_FAILURE is set, this command is executed after each failed
+	// sync, receiving the error on stdin.
+	EnvHookFailure = "SYNC_HOOK_FAILURE"
+
+	// EnvHookTimeout is the SYNC_HOOK_TIMEOUT environment variable.
+	//
+	// It bounds each hook command's execution as a Go time.Duration string,
+	// defaulting to 1m.
+	EnvHookTimeout = "SYNC_HOOK_TIMEOUT"
+
+	// EnvChatWebhookUrl is the SYNC_CHAT_WEBHOOK_URL environment variable.
+	//
+	// If SYNC_CHAT_WEBHOOK_URL is set, short messages about failed syncs,
+	// deactivated users, and the EnvChatDigest are POSTed to this Slack
+	// compatible incoming webhook.
+	EnvChatWebhookUrl = "SYNC_CHAT_WEBHOOK_URL"
+
+	// EnvMatrixHomeserver is the SYNC_MATRIX_HOMESERVER environment variable.
+	//
+	// It is the Matrix homeserver's URL for EnvMatrixRoom messages.
+	EnvMatrixHomeserver = "SYNC_MATRIX_HOMESERVER"
+
+	// EnvMatrixRoom is the SYNC_MATRIX_ROOM environment variable.
+	//
+	// If SYNC_MATRIX_ROOM is set, the EnvChatWebhookUrl messages are also sent
+	// to this Matrix room id, e.g., !abc:example.org.
+	EnvMatrixRoom = "SYNC_MATRIX_ROOM"
+
+	// EnvMatrixToken is the SYNC_MATRIX_TOKEN environment variable.
+	//
+	// It is the access token of the Matrix user sending EnvMatrixRoom messages.
+	EnvMatrixToken = "SYNC_MATRIX_TOKEN"
+
+	// EnvChatDigest is the SYNC_CHAT_DIGEST environment variable.
+	//
+	// If SYNC_CHAT_DIGEST is set, a digest of the syncs' changes is sent to the
+	// chats by the first sync after each time of these cron expressions, in the
+	// format of EnvSchedule.
+	EnvChatDigest = "SYNC_CHAT_DIGEST"
+
+	// EnvEmailTo is the SYNC_EMAIL_TO environment variable.
+	//
+	// If SYNC_EMAIL_TO is set, sync reports are emailed to this comma separated
+	// list of addresses following EnvEmailReport.
+	EnvEmailTo = "SYNC_EMAIL_TO"
+
+	// EnvEmailFrom is the SYNC_EMAIL_FROM environment variable.
+	//
+	// It is the sender address of EnvEmailTo reports.
+	EnvEmailFrom = "SYNC_EMAIL_FROM"
+
+	// EnvEmailReport is the SYNC_EMAIL_REPORT environment variable.
+	//
+	// It selects the emailed reports, either EmailReportChanges (default),
+	// EmailReportFailures, or EmailReportDigest.
+	EnvEmailReport = "SYNC_EMAIL_REPORT"
+
+	// EnvEmailDigest is the SYNC_EMAIL_DIGEST environment variable.
+	//
+	// It lists the cron expressions of the EmailReportDigest in the format of
+	// EnvSchedule, defaulting to each Monday at 08:00.
+	EnvEmailDigest = "SYNC_EMAIL_DIGEST"
+
+	// EnvSmtpAddr is the SYNC_SMTP_ADDR environment variable.
+	//
+	// It is the SMTP server's HOST:PORT for EnvEmailTo reports.
+	EnvSmtpAddr = "SYNC_SMTP_ADDR"
+
+	// EnvSmtpTls is the SYNC_SMTP_TLS environment variable.
+	//
+	// It selects the SMTP connection's security, either SmtpTlsStarttls
+	// (default), SmtpTlsImplicit, or SmtpTlsNone.
+	EnvSmtpTls = "SYNC_SMTP_TLS"
+
+	// EnvSmtpUsername is the SYNC_SMTP_USERNAME environment variable.
+	//
+	// If SYNC_SMTP_USERNAME is set, the SMTP client authenticates by PLAIN
+	// using this username and EnvSmtpPassword.
+	EnvSmtpUsername = "SYNC_SMTP_USERNAME"
+
+	// EnvSmtpPassword is the SYNC_SMTP_PASSWORD environment variable.
+	EnvSmtpPassword = "SYNC_SMTP_PASSWORD"
+
+	// EnvAttributeMap is the SYNC_ATTRIBUTE_MAP environment variable.
+	//
+	// If SYNC_ATTRIBUTE_MAP is set, its semicolon separated COLUMN=ATTRIBUTE
+	// pairs replace Greenlight's LDAP_ATTRIBUTE_MAPPING logic and define the
+	// written columns.
+	EnvAttributeMap = "SYNC_ATTRIBUTE_MAP"
+
+	// EnvAttributeTemplate is the SYNC_ATTRIBUTE_TEMPLATE environment variable.
+	//
+	// It is a semicolon separated list of COLUMN=TEMPLATE pairs, deriving a
+	// column from the LDAP entry by a text/template, replacing its attribute
+	// mapping. See attrTemplateFuncs for the available functions.
+	EnvAttributeTemplate = "SYNC_ATTRIBUTE_TEMPLATE"
+
+	// EnvCanonicalize is the SYNC_CANONICALIZE environment variable.
+	//
+	// It is a semicolon separated list of COLUMN=CANONICALIZER pairs, applied to
+	// LDAP values before comparing them. See canonicalizers for their names.
+	EnvCanonicalize = "SYNC_CANONICALIZE"
+
+	// EnvAttributePolicy is the SYNC_ATTRIBUTE_POLICY environment variable.
+	//
+	// It is a semicolon separated list of COLUMN=POLICY pairs, restricting when
+	// a column is updated, e.g., AttributePolicyIfEmpty. Other columns default
+	// to AttributePolicyOverwrite.
+	EnvAttributePolicy = "SYNC_ATTRIBUTE_POLICY"
+
+	// EnvCompareFoldDiacritics is the SYNC_COMPARE_FOLD_DIACRITICS environment variable.
+	//
+	// It is a comma separated list of columns whose values are compared ignoring
+	// their diacritics, e.g., "Muller" equals "Müller", to suppress changes.
+	EnvCompareFoldDiacritics = "SYNC_COMPARE_FOLD_DIACRITICS"
+
+	// EnvCompareNormalize is the SYNC_COMPARE_NORMALIZE environment variable.
+	//
+	// It is a comma separated list of columns, e.g., "username,email", whose
+	// values are compared after normalizeValue to suppress changes.
+	EnvCompareNormalize = "SYNC_COMPARE_NORMALIZE"
+
+	// EnvCompareCase is the SYNC_COMPARE_CASE environment variable.
+	//
+	// It defines if case-only differences of EnvCompareNormalize columns are
+	// ignored or updated, e.g., CompareCaseIgnore.
+	EnvCompareCase = "SYNC_COMPARE_CASE"
+
+	// EnvNormalize is the SYNC_NORMALIZE environment variable.
+	//
+	// It is a comma separated list of normalizations, e.g., "nfc,trim", applied
+	// by normalizeText to all SQL and LDAP values before comparing and writing
+	// them, see NormalizeNfc, NormalizeNfkc, NormalizeTrim, and
+	// NormalizeCollapse.
+	EnvNormalize = "SYNC_NORMALIZE"
+
+	// EnvAvatarAttributes is the SYNC_AVATAR_ATTRIBUTES environment variable.
+	//
+	// If SYNC_AVATAR_ATTRIBUTES is set, e.g., to "thumbnailPhoto,jpegPhoto", the
+	// first present LDAP photo is resized and stored as a data URI in the image
+	// column, replacing its attribute mapping.
+	EnvAvatarAttributes = "SYNC_AVATAR_ATTRIBUTES"
+
+	// EnvAvatarSize is the SYNC_AVATAR_SIZE environment variable.
+	//
+	// It limits the avatars' width and height in pixels, defaulting to 128.
+	EnvAvatarSize = "SYNC_AVATAR_SIZE"
+
+	// EnvPhoneRegion is the SYNC_PHONE_REGION environment variable.
+	//
+	// It is the ISO 3166-1 region code used by the e164 canonicalizer for
+	// phone numbers without an international prefix, defaulting to US.
+	EnvPhoneRegion = "SYNC_PHONE_REGION"
+
+	// EnvLocales is the SYNC_LOCALES environment variable.
+	//
+	// It is the comma separated list of Greenlight's locale identifiers for the
+	// locale canonicalizer, defaulting to those of the EnvSchema's version.
+	EnvLocales = "SYNC_LOCALES"
+
+	// EnvDepartmentColumn is the SYNC_DEPARTMENT_COLUMN environment variable.
+	//
+	// If SYNC_DEPARTMENT_COLUMN is set, this custom users column is synced with
+	// the department, extracted based on EnvDepartmentSource.
+	EnvDepartmentColumn = "SYNC_DEPARTMENT_COLUMN"
+
+	// EnvDepartmentSource is the SYNC_DEPARTMENT_SOURCE environment variable.
+	//
+	// It names the LDAP attribute holding the department for EnvDepartmentColumn
+	// or DepartmentSourceDN, which is the default.
+	EnvDepartmentSource = "SYNC_DEPARTMENT_SOURCE"
+
+	// EnvProvisionBase is the SYNC_PROVISION_BASE environment variable.
+	//
+	// If SYNC_PROVISION_BASE is set, LDAP users within this base DN, but missing
+	// in Greenlight, are created together with their home room.
+	EnvProvisionBase = "SYNC_PROVISION_BASE"
+
+	// EnvProvisionFilter is the SYNC_PROVISION_FILTER environment variable.
+	//
+	// It is an additional LDAP filter for EnvProvisionBase, e.g., to limit the
+	// provisioning to members of a group.
+	EnvProvisionFilter = "SYNC_PROVISION_FILTER"
+
+	// EnvProvisionRole is the SYNC_PROVISION_ROLE environment variable.
+	//
+	// It names the role of provisioned users matching no group of EnvRoleMap,
+	// defaulting to user.
+	EnvProvisionRole = "SYNC_PROVISION_ROLE"
+
+	// EnvProvisionRoomName is the SYNC_PROVISION_ROOM_NAME environment variable.
+	//
+	// It names the home room of provisioned users, defaulting to Home Room.
+	EnvProvisionRoomName = "SYNC_PROVISION_ROOM_NAME"
+
+	// EnvRoleMap is the SYNC_ROLE_MAP environment variable.
+	//
+	// If SYNC_ROLE_MAP is set, users' Greenlight roles are derived from their
+	// LDAP group memberships. The value is a semicolon separated list of
+	// GROUP_DN=ROLE_NAME pairs, ordered by descending priority.
+	EnvRoleMap = "SYNC_ROLE_MAP"
+
+	// EnvRoleDefault is the SYNC_ROLE_DEFAULT environment variable.
+	//
+	// It names the role for users matching no group of EnvRoleMap. If unset,
+	// those users' roles are left unchanged.
+	EnvRoleDefault = "SYNC_ROLE_DEFAULT"
+
+	// EnvRoleCacheTTL is the SYNC_ROLE_CACHE_TTL environment variable.
+	//
+	// It defines how long the role ids resolved for EnvRoleMap are cached before
+	// being refetched from the roles table, defaulting to 10m.
+	EnvRoleCacheTTL = "SYNC_ROLE_CACHE_TTL"
+
+	// EnvAdminGroup is the SYNC_ADMIN_GROUP environment variable.
+	//
+	// If SYNC_ADMIN_GROUP is set to an LDAP group DN, its members get the
+	// EnvAdminRole, overriding EnvRoleMap.
+	EnvAdminGroup = "SYNC_ADMIN_GROUP"
+
+	// EnvAdminRole is the SYNC_ADMIN_ROLE environment variable.
+	//
+	// It names the role of EnvAdminGroup members, defaulting to the schema's
+	// administrator role.
+	EnvAdminRole = "SYNC_ADMIN_ROLE"
+
+	// EnvAdminDemote is the SYNC_ADMIN_DEMOTE environment variable.
+	//
+	// If SYNC_ADMIN_DEMOTE is set, users with the EnvAdminRole not being a
+	// member of the EnvAdminGroup are demoted to the schema's user role.
+	EnvAdminDemote = "SYNC_ADMIN_DEMOTE"
+
+	// EnvSharedRooms is the SYNC_SHARED_ROOMS environment variable.
+	//
+	// If SYNC_SHARED_ROOMS is set, Greenlight rooms are shared with the members
+	// of LDAP groups. The value is a semicolon separated list of
+	// GROUP_DN=ROOM_UID pairs.
+	EnvSharedRooms = "SYNC_SHARED_ROOMS"
+
+	// EnvSharedRoomsPrune is the SYNC_SHARED_ROOMS_PRUNE environment variable.
+	//
+	// If SYNC_SHARED_ROOMS_PRUNE is set, synced users who are no member of any
+	// group mapped to an EnvSharedRooms room lose their shared access to it.
+	EnvSharedRoomsPrune = "SYNC_SHARED_ROOMS_PRUNE"
+)
+
+const (
+	// LogFormatText logs human readable lines with padded levels.
+	LogFormatText = "text"
+
+	// LogFormatJson logs one JSON object per line, e.g., for Loki or ELK.
+	LogFormatJson = "json"
+)
+
+// logLevels are the EnvLogLevel values.
+var logLevels = map[string]log.Level{
+	"trace": log.TraceLevel,
+	"debug": log.DebugLevel,
+	"info":  log.InfoLevel,
+	"warn":  log.WarnLevel,
+	"error": log.ErrorLevel,
+}
+
+const (
+	// LogRedactOff logs SQL and LDAP values as they are.
+	LogRedactOff = "off"
+
+	// LogRedactMask replaces SQL and LDAP values by asterisks.
+	LogRedactMask = "mask"
+
+	// LogRedactHash replaces SQL and LDAP values by a truncated hash.
+	LogRedactHash = "hash"
+)
+
+const (
+	// LdapSaslNone binds by LDAP_AUTH.
+	LdapSaslNone = "none"
+
+	// LdapSaslGssapi binds by SASL GSSAPI, i.e., Kerberos.
+	LdapSaslGssapi = "gssapi"
+
+	// LdapSaslExternal binds by SASL EXTERNAL, i.e., the identity of the TLS
+	// client certificate of EnvLdapTLSCertFile.
+	LdapSaslExternal = "external"
+)
+
+const (
+	// LdapDirectoryGeneric makes no assumptions on the directory server.
+	LdapDirectoryGeneric = "generic"
+
+	// LdapDirectoryAD supports Active Directory's objectGUID as LDAP_UID and
+	// its global catalog.
+	LdapDirectoryAD = "ad"
+)
+
+const (
+	// SourceLdap looks up users in the LDAP server or the EnvLdapLdif file.
+	SourceLdap = "ldap"
+
+	// SourceKeycloak looks up users in a Keycloak realm by its Admin REST API,
+	// see keycloakLoad.
+	SourceKeycloak = "keycloak"
+
+	// SourceLdifPrefix prefixes the path of an EnvLdapLdif file, looking up
+	// users like SourceLdap.
+	SourceLdifPrefix = "ldif:"
+)
+
+const (
+	// WriterSql updates users by SQL statements.
+	WriterSql = "sql"
+
+	// WriterRails updates users by Greenlight v3's models within the
+	// EnvRailsRunner, applying their validations and callbacks.
+	WriterRails = "rails"
+)
+
+const (
+	// LdapAnonymousNone requires an LDAP_PASSWORD for the simple LDAP_AUTH,
+	// while the anonymous LDAP_AUTH performs an anonymous bind.
+	LdapAnonymousNone = "none"
+
+	// LdapAnonymousUnauthenticated performs an unauthenticated bind by
+	// LDAP_BIND_DN without an LDAP_PASSWORD, or an anonymous one without both.
+	LdapAnonymousUnauthenticated = "unauthenticated"
+
+	// LdapAnonymousSkip skips the bind without an LDAP_PASSWORD, searching
+	// within an anonymous session.
+	LdapAnonymousSkip = "skip"
+)
+
+const (
+	// StartTLSMandatory fails the LDAP connection if StartTLS fails.
+	StartTLSMandatory = "mandatory"
+
+	// StartTLSOpportunistic falls back to an unencrypted LDAP connection if
+	// StartTLS fails.
+	StartTLSOpportunistic = "opportunistic"
+)
+
+const (
+	// LockPolicyIgnore keeps locked accounts untouched.
+	LockPolicyIgnore = "ignore"
+
+	// LockPolicyDeactivate soft deletes locked accounts in Greenlight, and
+	// reactivates them once unlocked.
+	LockPolicyDeactivate = "deactivate"
+)
+
+const (
+	// NestedGroupsNone only considers direct group memberships.
+	NestedGroupsNone = "none"
+
+	// NestedGroupsRecursive follows the memberOf attributes of groups.
+	NestedGroupsRecursive = "recursive"
+
+	// NestedGroupsChain searches groups by Active Directory's
+	// LDAP_MATCHING_RULE_IN_CHAIN.
+	NestedGroupsChain = "chain"
+)
+
+const (
+	// DisabledPolicyIgnore keeps expired or disabled accounts untouched.
+	DisabledPolicyIgnore = "ignore"
+
+	// DisabledPolicyBan bans expired or disabled accounts, being Greenlight
+	// 2.x's denied role or Greenlight 3.x's banned status.
+	DisabledPolicyBan = "ban"
+
+	// DisabledPolicyDeactivate soft deletes expired or disabled accounts in
+	// Greenlight.
+	DisabledPolicyDeactivate = "deactivate"
+)
+
+const (
+	// MissingPolicyIgnore only logs missing users on the debug level.
+	MissingPolicyIgnore = "ignore"
+
+	// MissingPolicyWarn logs a warning for each missing user.
+	MissingPolicyWarn = "warn"
+
+	// MissingPolicyBan bans missing users, being Greenlight 2.x's denied role
+	// or Greenlight 3.x's banned status.
+	MissingPolicyBan = "ban"
+
+	// MissingPolicyDeactivate soft deletes missing users in Greenlight.
+	MissingPolicyDeactivate = "deactivate"
+)
+
+const (
+	// RoomPolicyKeep leaves the rooms of deactivated users untouched.
+	RoomPolicyKeep = "keep"
+
+	// RoomPolicyTransfer transfers the rooms of deactivated users to the
+	// EnvRoomOwner, keeping their recordings accessible.
+	RoomPolicyTransfer = "transfer"
+
+	// RoomPolicyArchive soft deletes the rooms of deactivated users, as
+	// Greenlight 2.x's room deletion does.
+	RoomPolicyArchive = "archive"
+)
+
+const (
+	// UpdatedAtChanged bumps updated_at only if a written value differs from
+	// the stored one.
+	UpdatedAtChanged = "changed"
+
+	// UpdatedAtAlways bumps updated_at on every write.
+	UpdatedAtAlways = "always"
+
+	// UpdatedAtNever leaves updated_at untouched.
+	UpdatedAtNever = "never"
+)
+
+const (
+	// DbDriverPostgres connects to PostgreSQL, Greenlight's default database.
+	DbDriverPostgres = "postgres"
+
+	// DbDriverMysql connects to MySQL or MariaDB. It requires a build with the
+	// mysql build tag, see mysqldriver.go.
+	DbDriverMysql = "mysql"
+)
+
+const (
+	// DbSslModeDisable connects to PostgreSQL without TLS, fitting Greenlight's
+	// PostgreSQL within a container network.
+	DbSslModeDisable = "disable"
+
+	// DbSslModeRequire connects with TLS, without verifying the certificate.
+	DbSslModeRequire = "require"
+
+	// DbSslModeVerifyCa connects with TLS, verifying the certificate's CA.
+	DbSslModeVerifyCa = "verify-ca"
+
+	// DbSslModeVerifyFull connects with TLS, verifying the certificate's CA
+	// and that its name matches DB_HOST.
+	DbSslModeVerifyFull = "verify-full"
+)
+
+const (
+	// IntervalMinClamp raises a too short interval to the minimum with a warning.
+	IntervalMinClamp = "clamp"
+
+	// IntervalMinRefuse refuses to start with a too short interval.
+	IntervalMinRefuse = "refuse"
+)
+
+const (
+	// StartupImmediate performs the first scheduled sync at start.
+	StartupImmediate = "immediate"
+
+	// StartupSkip performs the first scheduled sync after the first interval.
+	StartupSkip = "skip"
+)
+
+const (
+	// OverlapQueue performs a sync that became due while the previous one was
+	// running right after it.
+	OverlapQueue = "queue"
+
+	// OverlapSkip drops a sync that became due while the previous one was
+	// running, waiting for the next regular one.
+	OverlapSkip = "skip"
+)
+
+const (
+	// BackupFormatJson writes an EnvBackup as a JSON array of users.
+	BackupFormatJson = "json"
+
+	// BackupFormatSql writes an EnvBackup as UPDATE statements restoring the
+	// stored values.
+	BackupFormatSql = "sql"
+)
+
+const (
+	// ReportFormatJson writes an EnvReport as a JSON array.
+	ReportFormatJson = "json"
+
+	// ReportFormatCsv writes an EnvReport as CSV with a header line.
+	ReportFormatCsv = "csv"
+)
+
+const (
+	// EmailReportChanges emails a report after each sync with changes or a
+	// failure.
+	EmailReportChanges = "changes"
+
+	// EmailReportFailures emails a report only after failed syncs.
+	EmailReportFailures = "failures"
+
+	// EmailReportDigest emails a digest of all syncs at the EnvEmailDigest.
+	EmailReportDigest = "digest"
+)
+
+const (
+	// SmtpTlsStarttls upgrades the SMTP connection by STARTTLS.
+	SmtpTlsStarttls = "starttls"
+
+	// SmtpTlsImplicit connects by TLS, usually to port 465.
+	SmtpTlsImplicit = "tls"
+
+	// SmtpTlsNone uses an unencrypted SMTP connection, e.g., to a local relay.
+	SmtpTlsNone = "none"
+)
+
+const (
+	// AttributePolicyOverwrite always writes the LDAP value.
+	AttributePolicyOverwrite = "overwrite"
+
+	// AttributePolicyIfEmpty only writes the LDAP value if the stored one is
+	// empty, e.g., to let users keep a self-chosen name.
+	AttributePolicyIfEmpty = "if-empty"
+
+	// AttributePolicyNoClear writes the LDAP value, unless it would clear a
+	// stored value.
+	AttributePolicyNoClear = "no-clear"
+)
+
+const (
+	// ClearedPolicyKeep keeps the stored value of a cleared LDAP attribute,
+	// even for EnvClearOnEmpty.
+	ClearedPolicyKeep = "keep"
+
+	// ClearedPolicyClear clears the column of a cleared LDAP attribute.
+	ClearedPolicyClear = "clear"
+
+	// ClearedPolicyDefault prefixes a value written instead of a cleared LDAP
+	// attribute, e.g., "default:unknown".
+	ClearedPolicyDefault = "default:"
+)
+
+const (
+	// CompareCaseIgnore treats case-only differences as equal, keeping the
+	// stored value.
+	CompareCaseIgnore = "ignore"
+
+	// CompareCaseUpdate writes the LDAP value on case-only differences.
+	CompareCaseUpdate = "update"
+)
+
+const (
+	// SignalUsr1Maintenance toggles the maintenance mode on SIGUSR1.
+	SignalUsr1Maintenance = "maintenance"
+
+	// SignalUsr1Sync performs an immediate sync on SIGUSR1.
+	SignalUsr1Sync = "sync"
+)
+
+const (
+	// RunLockSkip skips a sync while another instance's sync holds the lock.
+	RunLockSkip = "skip"
+
+	// RunLockWait delays a sync until another instance's sync released the lock.
+	RunLockWait = "wait"
+
+	// RunLockOff performs syncs without the lock.
+	RunLockOff = "off"
+)
+
+const (
+	// NormalizeNfc composes values by the Unicode normalization form C.
+	NormalizeNfc = "nfc"
+
+	// NormalizeNfkc composes values by the Unicode normalization form KC,
+	// also replacing compatibility characters, e.g., ligatures.
+	NormalizeNfkc = "nfkc"
+
+	// NormalizeTrim removes leading and trailing whitespace.
+	NormalizeTrim = "trim"
+
+	// NormalizeCollapse replaces each whitespace sequence by a single space.
+	NormalizeCollapse = "collapse"
+)
+
+const (
+	// DuplicatePolicySkip skips all SQL users sharing a social_uid or username.
+	DuplicatePolicySkip = "skip"
+
+	// DuplicatePolicyLowestId syncs only the SQL user with the lowest id.
+	DuplicatePolicyLowestId = "lowest-id"
+)
+
+const (
+	// DuplicateAccountsIgnore skips the search for duplicate accounts.
+	DuplicateAccountsIgnore = "ignore"
+
+	// DuplicateAccountsReport logs a warning for each duplicate account.
+	DuplicateAccountsReport = "report"
+
+	// DuplicateAccountsDeactivate soft deletes duplicate accounts, flagging them
+	// for an administrator.
+	DuplicateAccountsDeactivate = "deactivate"
+
+	// DuplicateAccountsMerge transfers the rooms of duplicate accounts to the
+	// synced LDAP account and soft deletes them.
+	DuplicateAccountsMerge = "merge"
+)
+
+const (
+	// ConflictPolicyFail does not check for conflicts, thus a unique constraint
+	// fails the update.
+	ConflictPolicyFail = "fail"
+
+	// ConflictPolicySkip skips the conflicting user's update, reporting it as
+	// a failed user.
+	ConflictPolicySkip = "skip"
+
+	// ConflictPolicySuffix writes the conflicting value with a numeric suffix,
+	// e.g., "alice-2@example.org".
+	ConflictPolicySuffix = "suffix"
+
+	// ConflictPolicyPreferLdap writes the value for the synced user, renaming
+	// the other account's value by a suffix and flagging it for review. Other
+	// accounts within the sync's scope are skipped as for ConflictPolicySkip.
+	ConflictPolicyPreferLdap = "prefer-ldap"
+)
+
+const (
+	// AmbiguousPolicyFail skips an ambiguous user, reporting it as a failed
+	// user of the kind FailureLdapAmbiguous.
+	AmbiguousPolicyFail = "fail"
+
+	// AmbiguousPolicyTieBreaker picks the entry by the EnvAmbiguousTieBreaker.
+	AmbiguousPolicyTieBreaker = "tie-breaker"
+
+	// AmbiguousPolicyFilter picks the single entry also matching the
+	// EnvAmbiguousFilter.
+	AmbiguousPolicyFilter = "filter"
+)
+
+// config is the validated configuration based on the SYNC_* environment variables.
+//
+// The LDAP_* and DB_* variables from Greenlight's .env file are read directly
+// where needed.
+type config struct {
+	logLevel       log.Level
+	logFile        string
+	logFileMaxSize int
+	logFileRotate  time.Duration
+	logFileKeep    int
+
+	interval        time.Duration
+	schedule        *cronSchedule
+	startup         string
+	jitter          time.Duration
+	overlap         string
+	failureBackoff  time.Duration
+	configWatch     time.Duration
+	syncrepl        bool
+	shutdownTimeout time.Duration
+	shutdownGrace   time.Duration
+	runTimeout      time.Duration
+	runLock         string
+	runLockName     string
+	leaderElection  bool
+
+	dryRun        bool
+	dryRunColumns []string
+	users         []string
+	maintenance   bool
+	pauseFile     string
+	signalUsr1    string
+
+	lockPolicy      string
+	disabledPolicy  string
+	missingPolicy   string
+	roomPolicy      string
+	roomOwner       string
+	optOutAttribute string
+	includeGroups   []string
+	excludeGroups   []string
+
+	nestedGroups      string
+	nestedGroupsDepth int
+	groupBase         string
+
+	clearOnEmpty bool
+
+	schema         string
+	schemaAuto     bool
+	schemaDetected bool
+	matchColumn    string
+	matchAttribute string
+	providers      []string
+	dbDriver       string
+
+	dbSslMode         string
+	dbSslRootCert     string
+	dbSslCert         string
+	dbSslKey          string
+	dbConnectTimeout  time.Duration
+	dbSearchPath      string
+	dbApplicationName string
+	dbReplicaHost     string
+	dbReplicaPort     string
+
+	updatedAtPolicy string
+	updatedAtColumn string
+
+	duplicatePolicy string
+
+	duplicateAccounts string
+	conflictPolicy    string
+	uniqueColumns     []string
+	sqlParallel       int
+	sqlChunkSize      int
+	sqlChunkDelay     time.Duration
+	sqlBatchSize      int
+	sqlFetchQuery     string
+	sqlUpdateQuery    string
+	writer            string
+	railsRunner       string
+	railsTimeout      time.Duration
+	concurrency       int
+	reuseConnections  bool
+	skipColumnCheck   bool
+	statusTable       string
+	cursorTable       string
+	auditTable        string
+	historyTable      string
+	historyRetention  time.Duration
+	stateFile         string
+	statusMaxAge      time.Duration
+	canary            canarySelection
+	maxChanges        changeThreshold
+	force             bool
+	forceResync       bool
+	verifyUpdates     bool
+
+	incremental             bool
+	incrementalFullInterval time.Duration
+
+	dialRetries     int
+	opRetries       int
+	retryBudget     int
+	dialBackoffBase time.Duration
+	dialBackoffMax  time.Duration
+	ldapRetryCodes  []uint16
+	keepAlive       time.Duration
+
+	ldapDialTimeout   time.Duration
+	ldapBindTimeout   time.Duration
+	ldapSearchTimeout time.Duration
+	ldapIdleTimeout   time.Duration
+
+	ldapTLSHandshakeTimeout time.Duration
+	ldapTimeLimit           time.Duration
+	sqlTimeout              time.Duration
+
+	ldapBases         []ldapSearchBase
+	ldapServers       []string
+	ldapTLSServerName string
+	ldapTLSCAFile     string
+	ldapTLSCertFile   string
+	ldapTLSKeyFile    string
+
+	tlsMinVersion         uint16
+	tlsCipherSuites       []uint16
+	tlsInsecureSkipVerify bool
+
+	ldapStartTLS        string
+	ldapSasl            string
+	ldapDirectory       string
+	ldapGlobalCatalog   bool
+	ldapUserFilter      string
+	ldapExtraFilter     string
+	ambiguousPolicy     string
+	ambiguousTieBreaker string
+	ambiguousFilter     string
+	ldapAnonymous       string
+
+	source               string
+	ldapLdif             string
+	keycloakUrl          string
+	keycloakRealm        string
+	keycloakClientId     string
+	keycloakClientSecret string
+	keycloakGroups       bool
+
+	krb5Config              string
+	krb5Keytab              string
+	krb5Principal           string
+	krb5Ccache              string
+	ldapSpn                 string
+	ldapPageSize            int
+	ldapSearchBatch         int
+	ldapReferralHops        int
+	ldapReferralCredentials map[string]ldapCredentials
+	ldapRate                int
+	ldapBurst               int
+
+	attributeMap          map[string][]string
+	canonicalize          map[string][]string
+	attributePolicy       map[string]string
+	clearedPolicy         map[string]string
+	attributeTemplate     map[string]attrTemplate
+	phoneRegion           string
+	locales               []string
+	avatarAttributes      []string
+	avatarSize            int
+	compareFoldDiacritics []string
+	normalize             []string
+	compareNormalize      []string
+	compareCase           string
+
+	departmentColumn string
+	departmentSource string
+
+	provisionBase     string
+	provisionFilter   string
+	provisionRole     string
+	provisionRoomName string
+
+	roleMap      []roleMapping
+	roleDefault  string
+	roleCacheTTL time.Duration
+
+	adminGroup  string
+	adminRole   string
+	adminDemote bool
+
+	sharedRooms      []sharedRoomMapping
+	sharedRoomsPrune bool
+
+	webhookUrl    string
+	webhookSecret string
+	notifyTimeout time.Duration
+	notifyRetries int
+
+	hookPre     string
+	hookSuccess string
+	hookFailure string
+	hookTimeout time.Duration
+
+	chatWebhookUrl   string
+	matrixHomeserver string
+	matrixRoom       string
+	matrixToken      string
+	chatDigest       *cronSchedule
+
+	emailTo      []string
+	emailFrom    *mail.Address
+	emailReport  string
+	emailDigest  *cronSchedule
+	smtpAddr     string
+	smtpTls      string
+	smtpUsername string
+
+	eventStream   string
+	eventDetected bool
+	report        string
+	reportFormat  string
+	backup        string
+	backupFormat  string
+
+	metricsAddr    string
+	pushgatewayUrl string
+	pushgatewayJob string
+	otlpEndpoint   string
+	otlpHeaders    map[string]string
+
+	sentryDsn         string
+	sentryEnvironment string
+	healthAddr        string
+	adminAddr         string
+	adminPprof        bool
+	adminToken        string
+	scimAddr          string
+	scimToken         string
+
+	kubeEvents bool
+
+	vaultAddr     string
+	vaultCAFile   string
+	vaultLdapPath string
+	vaultDbPath   string
+}
+
+// cfg is the active configuration, set by Main or a Syncer.Run.
+var cfg = &config{
+	logLevel:        log.InfoLevel,
+	lockPolicy:      LockPolicyIgnore,
+	disabledPolicy:  DisabledPolicyIgnore,
+	missingPolicy:   MissingPolicyWarn,
+	duplicatePolicy: DuplicatePolicySkip,
+	dialBackoffBase: time.Second,
+	dialBackoffMax:  30 * time.Second,
+	keepAlive:       30 * time.Second,
+
+	ldapDialTimeout:   ldap.DefaultTimeout,
+	ldapBindTimeout:   30 * time.Second,
+	ldapSearchTimeout: 2 * time.Minute,
+	sqlTimeout:        5 * time.Minute,
+
+	ldapRetryCodes:  ldapRetryCodesDefault,
+	phoneRegion:     "US",
+	schema:          SchemaV2,
+	updatedAtPolicy: UpdatedAtChanged,
+	updatedAtColumn: "updated_at",
+}
+
+// configLdapFilter returns the environment variable key as an LDAP filter,
+// being empty if unset. As the filter is appended within an AND of a search,
+// it must be a single parenthesized filter, e.g., (employeeType=staff).
+func configLdapFilter(key string) (filter string, err error) {
+	filter = strings.TrimSpace(os.Getenv(key))
+	if filter == "" {
+		return
+	}
+	if _, err = ldap.CompileFilter(filter); err != nil {
+		err = fmt.Errorf("invalid %s %q: %w", key, filter, err)
+	}
+	return
+}
+
+// configDuration parses the environment variable key as a positive time.Duration.
+func configDuration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s as a Go time.Duration: %w", key, err)
+	} else if d <= 0 {
+		return 0, fmt.Errorf("non-positive %s value %q", key, v)
+	}
+	return d, nil
+}
+
+// configIntervalClamped is the last EnvInterval clamped by configIntervalFloor,
+// thus its warning is not repeated by each configLoad, e.g., on a reload.
+var configIntervalClamped atomic.Int64
+
+// configIntervalFloor enforces the EnvIntervalMin on the interval by the
+// EnvIntervalMinPolicy, returning the interval to use.
+func configIntervalFloor(interval time.Duration) (time.Duration, error) {
+	intervalMin := 30 * time.Second
+	if v, ok := os.LookupEnv(EnvIntervalMin); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("cannot parse %s as a Go time.Duration: %w", EnvIntervalMin, err)
+		} else if d < 0 {
+			return 0, fmt.Errorf("negative %s value %q", EnvIntervalMin, v)
+		}
+		intervalMin = d
+	}
+	policy, err := configChoice(EnvIntervalMinPolicy, IntervalMinClamp,
+		IntervalMinClamp, IntervalMinRefuse)
+	if err != nil {
+		return 0, err
+	}
+
+	if interval == 0 || interval >= intervalMin {
+		configIntervalClamped.Store(0)
+		return interval, nil
+	} else if policy == IntervalMinRefuse {
+		return 0, fmt.Errorf("%s %v is below %s %v", EnvInterval, interval, EnvIntervalMin, intervalMin)
+	}
+
+	if configIntervalClamped.Swap(int64(interval)) != int64(interval) {
+		log.WithFields(log.Fields{
+			"interval": interval,
+			"minimum":  intervalMin,
+		}).Warnf("%s is below %s, using the minimum", EnvInterval, EnvIntervalMin)
+	}
+	return intervalMin, nil
+}
+
+// configInt parses the environment variable key as a non-negative integer.
+func configInt(key string, def int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %s as an integer: %w", key, err)
+	} else if i < 0 {
+		return 0, fmt.Errorf("negative %s value %q", key, v)
+	}
+	return i, nil
+}
+
+// configChoice reads the environment variable key, which must be one of choices.
+func configChoice(key, def string, choices ...string) (string, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def, nil
+	}
+
+	for _, choice := range choices {
+		if v == choice {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported %s value %q, expected one of %s", key, v, strings.Join(choices, ", "))
+}
+
+// configList splits the environment variable key into its comma separated values.
+func configList(key string) (values []string) {
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return
+}
+
+// scheduled checks if syncs are repeated, either by EnvInterval or EnvSchedule.
+func (c *config) scheduled() bool {
+	return c.interval > 0 || c.schedule != nil
+}
+
+// sqlDriver returns the EnvDbDriver, defaulting to one based on DB_ADAPTER.
+func (c *config) sqlDriver() (string, error) {
+	if c.dbDriver != "" {
+		return c.dbDriver, nil
+	}
+
+	switch adapter := os.Getenv("DB_ADAPTER"); adapter {
+	case "postgresql":
+		return DbDriverPostgres, nil
+	case "mysql2", "mysql":
+		return DbDriverMysql, nil
+	default:
+		return "", fmt.Errorf("unsupported DB_ADAPTER %q, set %s", adapter, EnvDbDriver)
+	}
+}
+
+// configLoad creates a config from the environment.
+func configLoad() (c *config, err error) {
+	c = &config{}
+
+	if err = configSecretsCheck(); err != nil {
+		return
+	}
+
+	for _, load := range configLoaders {
+		if err = load(c); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// configLoaders load the config by feature, in order. Later loaders may depend
+// on the fields set by earlier ones, e.g., on the EnvSchema.
+var configLoaders = []func(c *config) error{
+	configLoadLog,
+	configLoadSchedule,
+	configLoadRun,
+	configLoadPolicies,
+	configLoadSchema,
+	configLoadDb,
+	configLoadUpdates,
+	configLoadSource,
+	configLoadWriter,
+	configLoadSafety,
+	configLoadTables,
+	configLoadTimeouts,
+	configLoadLdap,
+	configLoadAttributes,
+	configLoadProvision,
+	configLoadMysql,
+	configLoadRoles,
+	configLoadNotify,
+	configLoadOutput,
+	configLoadObservability,
+	configLoadEndpoints,
+	configLoadVault,
+}
+
+// configLoadLog loads the log level and the EnvLogFile.
+func configLoadLog(c *config) (err error) {
+	c.logLevel = log.InfoLevel
+	if _, debug := os.LookupEnv(EnvDebug); debug {
+		c.logLevel = log.DebugLevel
+	}
+	if v, ok := os.LookupEnv(EnvLogLevel); ok {
+		if c.logLevel, ok = logLevels[v]; !ok {
+			err = fmt.Errorf("unsupported %s value %q, expected one of trace, debug, info, warn, error", EnvLogLevel, v)
+			return
+		}
+	}
+	c.logFile = os.Getenv(EnvLogFile)
+	if c.logFileMaxSize, err = configInt(EnvLogFileMaxSize, 100); err != nil {
+		return
+	}
+	if c.logFileRotate, err = configDuration(EnvLogFileRotate, 0); err != nil {
+		return
+	}
+	if c.logFileKeep, err = configInt(EnvLogFileKeep, 7); err != nil {
+		return
+	}
+	return
+}
+
+// configLoadSchedule loads the EnvInterval or EnvSchedule and the lifecycle of
+// repeated syncs, e.g., their run lock and leader election.
+func configLoadSchedule(c *config) (err error) {
+	if c.interval, err = configDuration(EnvInterval, 0); err != nil {
+		return
+	}
+
+	if c.interval, err = configIntervalFloor(c.interval); err != nil {
+		return
+	}
+
+	if v, ok := os.LookupEnv(EnvSchedule); ok {
+		if c.interval > 0 {
+			err = fmt.Errorf("%s and %s are mutually exclusive", EnvInterval, EnvSchedule)
+			return
+		}
+		if c.schedule, err = parseCronSchedule(v); err != nil {
+			err = fmt.Errorf("cannot parse %s: %w", EnvSchedule, err)
+			return
+		}
+	}
+
+	if c.startup, err = configChoice(EnvStartup, StartupImmediate, StartupImmediate, StartupSkip); err != nil {
+		return
+	}
+	if c.jitter, err = configDuration(EnvJitter, 0); err != nil {
+		return
+	}
+	if c.overlap, err = configChoice(EnvOverlap, OverlapQueue, OverlapQueue, OverlapSkip); err != nil {
+		return
+	}
+	if c.failureBackoff, err = configDuration(EnvFailureBackoffMax, 0); err != nil {
+		return
+	}
+	if c.configWatch, err = configDuration(EnvConfigWatch, 0); err != nil {
+		return
+	} else if c.configWatch > 0 && configSources.path == "" {
+		err = fmt.Errorf("%s requires --config", EnvConfigWatch)
+		return
+	}
+
+	_, c.syncrepl = os.LookupEnv(EnvSyncrepl)
+
+	if c.shutdownTimeout, err = configDuration(EnvShutdownTimeout, 10*time.Second); err != nil {
+		return
+	}
+	if c.shutdownGrace, err = configDuration(EnvShutdownGrace, 30*time.Second); err != nil {
+		return
+	}
+	if c.runTimeout, err = configDuration(EnvRunTimeout, 0); err != nil {
+		return
+	}
+	if c.runLock, err = configChoice(EnvRunLock, RunLockSkip, RunLockSkip, RunLockWait, RunLockOff); err != nil {
+		return
+	}
+	c.runLockName = runLockNameDefault
+	if v := os.Getenv(EnvRunLockName); v != "" {
+		c.runLockName = v
+	}
+	_, c.leaderElection = os.LookupEnv(EnvLeaderElection)
+	if c.leaderElection && !c.scheduled() {
+		err = fmt.Errorf("%s requires %s or %s", EnvLeaderElection, EnvInterval, EnvSchedule)
+		return
+	}
+	return
+}
+
+// configLoadRun loads the modes of a single run, e.g., EnvDryRun.
+func configLoadRun(c *config) (err error) {
+	_, c.dryRun = os.LookupEnv(EnvDryRun)
+	c.dryRunColumns = configList(EnvDryRunColumns)
+	c.users = configList(EnvUser)
+	_, c.maintenance = os.LookupEnv(EnvMaintenance)
+	c.pauseFile = os.Getenv(EnvPauseFile)
+
+	c.signalUsr1, err = configChoice(EnvSignalUsr1, SignalUsr1Maintenance,
+		SignalUsr1Maintenance, SignalUsr1Sync)
+	return
+}
+
+// configLoadPolicies loads the policies for locked, missing, and opted out users
+// and the groups they are synced by.
+func configLoadPolicies(c *config) (err error) {
+	c.lockPolicy, err = configChoice(EnvLockPolicy, LockPolicyIgnore,
+		LockPolicyIgnore, LockPolicyDeactivate)
+	if err != nil {
+		return
+	}
+
+	c.disabledPolicy, err = configChoice(EnvDisabledPolicy, DisabledPolicyIgnore,
+		DisabledPolicyIgnore, DisabledPolicyBan, DisabledPolicyDeactivate)
+	if err != nil {
+		return
+	}
+
+	c.missingPolicy, err = configChoice(EnvMissingPolicy, MissingPolicyWarn,
+		MissingPolicyIgnore, MissingPolicyWarn, MissingPolicyBan, MissingPolicyDeactivate)
+	if err != nil {
+		return
+	}
+
+	_, c.clearOnEmpty = os.LookupEnv(EnvClearOnEmpty)
+
+	c.optOutAttribute = os.Getenv(EnvOptOutAttribute)
+	if c.includeGroups, err = parseGroupList(EnvIncludeGroups); err != nil {
+		return
+	}
+	if c.excludeGroups, err = parseGroupList(EnvExcludeGroups); err != nil {
+		return
+	}
+	c.nestedGroups, err = configChoice(EnvNestedGroups, NestedGroupsNone,
+		NestedGroupsNone, NestedGroupsRecursive, NestedGroupsChain)
+	if err != nil {
+		return
+	}
+	if c.nestedGroupsDepth, err = configInt(EnvNestedGroupsDepth, 5); err != nil {
+		return
+	}
+	c.groupBase = os.Getenv(EnvGroupBase)
+	return
+}
+
+// configLoadSchema loads the EnvSchema and how its users are matched.
+func configLoadSchema(c *config) (err error) {
+	if c.schema, err = configChoice(EnvSchema, SchemaV2, SchemaV2, SchemaV3, SchemaAuto); err != nil {
+		return
+	} else if c.schema == SchemaAuto {
+		// Until detected by configLoadDetect, SchemaV2 is assumed.
+		c.schema, c.schemaAuto = SchemaV2, true
+	}
+	matchColumns := sqlSchemas[c.schema].matchColumns
+	if c.matchColumn, err = configChoice(EnvMatchColumn, matchColumns[0], matchColumns...); err != nil {
+		return
+	}
+	c.matchAttribute = cmp.Or(strings.TrimSpace(os.Getenv(EnvMatchAttribute)), os.Getenv("LDAP_UID"))
+	if _, ok := os.LookupEnv(EnvProviders); ok {
+		if c.providers = configList(EnvProviders); len(c.providers) == 0 {
+			err = fmt.Errorf("%s must not be empty", EnvProviders)
+			return
+		}
+	}
+	return
+}
+
+// configLoadDb loads the database connection.
+func configLoadDb(c *config) (err error) {
+	if c.dbDriver, err = configChoice(EnvDbDriver, "", DbDriverPostgres, DbDriverMysql); err != nil {
+		return
+	}
+	c.dbSslMode, err = configChoice(EnvDbSslMode, DbSslModeDisable,
+		DbSslModeDisable, DbSslModeRequire, DbSslModeVerifyCa, DbSslModeVerifyFull)
+	if err != nil {
+		return
+	}
+	c.dbSslRootCert = os.Getenv(EnvDbSslRootCert)
+	c.dbSslCert = os.Getenv(EnvDbSslCert)
+	c.dbSslKey = os.Getenv(EnvDbSslKey)
+	if (c.dbSslCert == "") != (c.dbSslKey == "") {
+		err = fmt.Errorf("%s and %s must be set together", EnvDbSslCert, EnvDbSslKey)
+		return
+	}
+	if c.dbConnectTimeout, err = configDuration(EnvDbConnectTimeout, 0); err != nil {
+		return
+	}
+	c.dbSearchPath = os.Getenv(EnvDbSearchPath)
+	c.dbApplicationName = "greenlight-ldap-sync"
+	if v, ok := os.LookupEnv(EnvDbApplicationName); ok {
+		c.dbApplicationName = v
+	}
+	if dbUrl, urlErr := configSecret(EnvDbUrl); urlErr != nil {
+		err = urlErr
+		return
+	} else if _, urlErr = sqlParseConnInfo(dbUrl); urlErr != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvDbUrl, urlErr)
+		return
+	}
+	c.dbReplicaHost = os.Getenv(EnvDbReplicaHost)
+	c.dbReplicaPort = os.Getenv(EnvDbReplicaPort)
+	if c.dbReplicaPort != "" && c.dbReplicaHost == "" {
+		err = fmt.Errorf("%s requires %s", EnvDbReplicaPort, EnvDbReplicaHost)
+		return
+	}
+	return
+}
+
+// configLoadUpdates loads how users are updated, e.g., the EnvUpdatedAt and the
+// policy for duplicates.
+func configLoadUpdates(c *config) (err error) {
+	c.updatedAtPolicy, err = configChoice(EnvUpdatedAt, UpdatedAtChanged,
+		UpdatedAtChanged, UpdatedAtAlways, UpdatedAtNever)
+	if err != nil {
+		return
+	}
+
+	c.updatedAtColumn = "updated_at"
+	if v, ok := os.LookupEnv(EnvUpdatedAtColumn); ok {
+		if v == "" || strings.ContainsAny(v, "{}.?") {
+			err = fmt.Errorf("invalid %s value %q", EnvUpdatedAtColumn, v)
+			return
+		}
+		c.updatedAtColumn = v
+	}
+
+	c.duplicatePolicy, err = configChoice(EnvDuplicatePolicy, DuplicatePolicySkip,
+		DuplicatePolicySkip, DuplicatePolicyLowestId)
+	if err != nil {
+		return
+	}
+	c.duplicateAccounts, err = configChoice(EnvDuplicateAccounts, DuplicateAccountsReport,
+		DuplicateAccountsIgnore, DuplicateAccountsReport, DuplicateAccountsDeactivate, DuplicateAccountsMerge)
+	if err != nil {
+		return
+	}
+	c.conflictPolicy, err = configChoice(EnvConflictPolicy, ConflictPolicyFail,
+		ConflictPolicyFail, ConflictPolicySkip, ConflictPolicySuffix, ConflictPolicyPreferLdap)
+	if err != nil {
+		return
+	}
+	if c.uniqueColumns = configList(EnvUniqueColumns); len(c.uniqueColumns) == 0 {
+		c.uniqueColumns = []string{"email"}
+	}
+
+	if c.sqlParallel, err = configInt(EnvSqlParallel, 1); err != nil {
+		return
+	}
+	return
+}
+
+// configLoadSource loads the EnvSource and whether it is read incrementally.
+func configLoadSource(c *config) (err error) {
+	_, c.incremental = os.LookupEnv(EnvIncremental)
+	if c.incrementalFullInterval, err = configDuration(EnvIncrementalFullInterval, 24*time.Hour); err != nil {
+		return
+	}
+
+	c.ldapLdif = os.Getenv(EnvLdapLdif)
+	if path, ok := strings.CutPrefix(os.Getenv(EnvSource), SourceLdifPrefix); ok {
+		if path == "" {
+			err = fmt.Errorf("%s %sPATH requires a path", EnvSource, SourceLdifPrefix)
+			return
+		} else if c.ldapLdif != "" && c.ldapLdif != path {
+			err = fmt.Errorf("%s %s cannot be used with %s", EnvSource, os.Getenv(EnvSource), EnvLdapLdif)
+			return
+		}
+		c.source, c.ldapLdif = SourceLdap, path
+	} else if c.source, err = configChoice(EnvSource, SourceLdap, SourceLdap, SourceKeycloak); err != nil {
+		return
+	}
+	if c.syncrepl && c.ldapLdif != "" {
+		err = fmt.Errorf("%s cannot be used with %s", EnvSyncrepl, EnvLdapLdif)
+		return
+	}
+	c.keycloakUrl = os.Getenv(EnvKeycloakUrl)
+	c.keycloakRealm = os.Getenv(EnvKeycloakRealm)
+	c.keycloakClientId = os.Getenv(EnvKeycloakClientId)
+	if c.keycloakClientSecret, err = configSecret(EnvKeycloakClientSecret); err != nil {
+		return
+	}
+	_, c.keycloakGroups = os.LookupEnv(EnvKeycloakGroups)
+	if c.source == SourceKeycloak {
+		if c.keycloakUrl == "" || c.keycloakRealm == "" || c.keycloakClientId == "" || c.keycloakClientSecret == "" {
+			err = fmt.Errorf("%s %s requires %s, %s, %s, and %s", EnvSource, SourceKeycloak,
+				EnvKeycloakUrl, EnvKeycloakRealm, EnvKeycloakClientId, EnvKeycloakClientSecret)
+			return
+		}
+		if c.incremental || c.syncrepl {
+			err = fmt.Errorf("%s %s cannot be used with %s or %s", EnvSource, SourceKeycloak, EnvIncremental, EnvSyncrepl)
+			return
+		}
+	}
+	return
+}
+
+// configLoadWriter loads the EnvWriter and how its SQL statements are batched.
+func configLoadWriter(c *config) (err error) {
+	if c.sqlChunkSize, err = configInt(EnvSqlChunkSize, 0); err != nil {
+		return
+	}
+	if c.sqlChunkDelay, err = configDuration(EnvSqlChunkDelay, 0); err != nil {
+		return
+	}
+	if c.sqlBatchSize, err = configInt(EnvSqlBatchSize, 0); err != nil {
+		return
+	}
+	c.sqlFetchQuery = strings.TrimSpace(os.Getenv(EnvSqlFetchQuery))
+	if _, _, err = sqlNamedQuery(c.sqlFetchQuery, sqlFetchQueryParams()); err != nil {
+		err = fmt.Errorf("invalid %s: %w", EnvSqlFetchQuery, err)
+		return
+	}
+	c.sqlUpdateQuery = strings.TrimSpace(os.Getenv(EnvSqlUpdateQuery))
+	if c.writer, err = configChoice(EnvWriter, WriterSql, WriterSql, WriterRails); err != nil {
+		return
+	}
+	c.railsRunner = strings.TrimSpace(os.Getenv(EnvRailsRunner))
+	if c.railsTimeout, err = configDuration(EnvRailsTimeout, 5*time.Minute); err != nil {
+		return
+	}
+	if c.writer == WriterRails {
+		switch {
+		case c.schema != SchemaV3:
+			err = fmt.Errorf("%s %s requires %s %s", EnvWriter, WriterRails, EnvSchema, SchemaV3)
+		case c.railsRunner == "":
+			err = fmt.Errorf("%s %s requires %s", EnvWriter, WriterRails, EnvRailsRunner)
+		case c.sqlUpdateQuery != "":
+			err = fmt.Errorf("%s %s cannot be used with %s", EnvWriter, WriterRails, EnvSqlUpdateQuery)
+		case c.sqlParallel > 1 || c.sqlChunkSize > 0:
+			err = fmt.Errorf("%s %s cannot be used with %s or %s", EnvWriter, WriterRails, EnvSqlParallel, EnvSqlChunkSize)
+		}
+		if err != nil {
+			return
+		}
+	}
+	if c.concurrency, err = configInt(EnvConcurrency, 1); err != nil {
+		return
+	} else if c.concurrency == 0 {
+		err = fmt.Errorf("%s must be positive", EnvConcurrency)
+		return
+	}
+	_, c.reuseConnections = os.LookupEnv(EnvReuseConnections)
+	_, c.skipColumnCheck = os.LookupEnv(EnvSkipColumnCheck)
+
+	_, c.verifyUpdates = os.LookupEnv(EnvVerifyUpdates)
+	return
+}
+
+// configLoadSafety loads the safeguards against mass changes, e.g., EnvMaxChanges.
+func configLoadSafety(c *config) (err error) {
+	if c.maxChanges, err = parseChangeThreshold(os.Getenv(EnvMaxChanges)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvMaxChanges, err)
+		return
+	} else if c.maxChanges != (changeThreshold{}) && c.sqlBatchSize > 0 {
+		// The threshold must be checked before any batch is applied, based on all users.
+		err = fmt.Errorf("%s cannot be used with %s", EnvMaxChanges, EnvSqlBatchSize)
+		return
+	}
+	_, c.force = os.LookupEnv(EnvForce)
+	_, c.forceResync = os.LookupEnv(EnvForceResync)
+
+	if c.canary, err = parseCanary(os.Getenv(EnvCanary)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvCanary, err)
+		return
+	}
+	return
+}
+
+// configLoadTables loads the bookkeeping tables, e.g., EnvStatusTable.
+func configLoadTables(c *config) (err error) {
+	if v, ok := os.LookupEnv(EnvStatusTable); ok {
+		if v == "" || strings.ContainsAny(v, "{}.?") {
+			err = fmt.Errorf("invalid %s value %q", EnvStatusTable, v)
+			return
+		}
+		c.statusTable = v
+	}
+	if v, ok := os.LookupEnv(EnvCursorTable); ok {
+		if v == "" || strings.ContainsAny(v, "{}.?") {
+			err = fmt.Errorf("invalid %s value %q", EnvCursorTable, v)
+			return
+		}
+		c.cursorTable = v
+	}
+	if v, ok := os.LookupEnv(EnvAuditTable); ok {
+		if v == "" || strings.ContainsAny(v, "{}.?") {
+			err = fmt.Errorf("invalid %s value %q", EnvAuditTable, v)
+			return
+		}
+		c.auditTable = v
+	}
+	if v, ok := os.LookupEnv(EnvHistoryTable); ok {
+		if v == "" || strings.ContainsAny(v, "{}.?") {
+			err = fmt.Errorf("invalid %s value %q", EnvHistoryTable, v)
+			return
+		}
+		c.historyTable = v
+	}
+	if c.historyRetention, err = configDuration(EnvHistoryRetention, 0); err != nil {
+		return
+	} else if c.historyRetention > 0 && c.historyTable == "" {
+		err = fmt.Errorf("%s requires %s", EnvHistoryRetention, EnvHistoryTable)
+		return
+	}
+	c.stateFile = os.Getenv(EnvStateFile)
+	if c.statusMaxAge, err = configDuration(EnvStatusMaxAge, 25*time.Hour); err != nil {
+		return
+	}
+	return
+}
+
+// configLoadTimeouts loads the retries, backoffs, and timeouts of connections.
+func configLoadTimeouts(c *config) (err error) {
+	if c.dialRetries, err = configInt(EnvDialRetries, 3); err != nil {
+		return
+	}
+	if c.opRetries, err = configInt(EnvOpRetries, 3); err != nil {
+		return
+	}
+	if c.retryBudget, err = configInt(EnvRetryBudget, 0); err != nil {
+		return
+	}
+	if c.dialBackoffBase, err = configDuration(EnvDialBackoffBase, time.Second); err != nil {
+		return
+	}
+	if c.dialBackoffMax, err = configDuration(EnvDialBackoffMax, 30*time.Second); err != nil {
+		return
+	}
+	if c.dialBackoffMax < c.dialBackoffBase {
+		err = fmt.Errorf("%s must not be less than %s", EnvDialBackoffMax, EnvDialBackoffBase)
+		return
+	}
+	if c.keepAlive, err = configDuration(EnvKeepAlive, 30*time.Second); err != nil {
+		return
+	}
+	if c.ldapDialTimeout, err = configDuration(EnvLdapDialTimeout, ldap.DefaultTimeout); err != nil {
+		return
+	}
+	if c.ldapBindTimeout, err = configDuration(EnvLdapBindTimeout, 30*time.Second); err != nil {
+		return
+	}
+	if c.ldapSearchTimeout, err = configDuration(EnvLdapSearchTimeout, 2*time.Minute); err != nil {
+		return
+	}
+	if c.ldapIdleTimeout, err = configDuration(EnvLdapIdleTimeout, 0); err != nil {
+		return
+	}
+	if c.ldapTLSHandshakeTimeout, err = configDuration(EnvLdapTLSHandshakeTimeout, 10*time.Second); err != nil {
+		return
+	}
+	if c.ldapTimeLimit, err = configDuration(EnvLdapTimeLimit, 0); err != nil {
+		return
+	}
+	if c.sqlTimeout, err = configDuration(EnvSqlTimeout, 5*time.Minute); err != nil {
+		return
+	}
+	return
+}
+
+// configLoadLdap loads the LDAP connection and its retries.
+func configLoadLdap(c *config) (err error) {
+	if c.ldapBases, err = parseLdapBases(os.Getenv(EnvLdapBases)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvLdapBases, err)
+		return
+	}
+	c.ldapServers = configList(EnvLdapServers)
+	c.ldapTLSServerName = os.Getenv(EnvLdapTLSServerName)
+	c.ldapTLSCAFile = os.Getenv(EnvLdapTLSCAFile)
+	c.ldapTLSCertFile = os.Getenv(EnvLdapTLSCertFile)
+	c.ldapTLSKeyFile = os.Getenv(EnvLdapTLSKeyFile)
+	if (c.ldapTLSCertFile == "") != (c.ldapTLSKeyFile == "") {
+		err = fmt.Errorf("%s and %s must be set together", EnvLdapTLSCertFile, EnvLdapTLSKeyFile)
+		return
+	}
+	if v := os.Getenv(EnvTLSMinVersion); v != "" {
+		if c.tlsMinVersion, err = parseTLSVersion(v); err != nil {
+			err = fmt.Errorf("%s: %w", EnvTLSMinVersion, err)
+			return
+		}
+	}
+	if c.tlsCipherSuites, err = parseTLSCipherSuites(configList(EnvTLSCipherSuites)); err != nil {
+		err = fmt.Errorf("%s: %w", EnvTLSCipherSuites, err)
+		return
+	}
+	_, c.tlsInsecureSkipVerify = os.LookupEnv(EnvTLSInsecureSkipVerify)
+	if c.ldapSasl, err = configChoice(EnvLdapSasl, LdapSaslNone, LdapSaslNone, LdapSaslGssapi, LdapSaslExternal); err != nil {
+		return
+	} else if c.ldapSasl == LdapSaslExternal && c.ldapTLSCertFile == "" {
+		err = fmt.Errorf("%s %s requires %s", EnvLdapSasl, LdapSaslExternal, EnvLdapTLSCertFile)
+		return
+	}
+	if c.ldapDirectory, err = configChoice(EnvLdapDirectory, LdapDirectoryGeneric, LdapDirectoryGeneric, LdapDirectoryAD); err != nil {
+		return
+	}
+	_, c.ldapGlobalCatalog = os.LookupEnv(EnvLdapGlobalCatalog)
+	if c.ldapGlobalCatalog && c.ldapDirectory != LdapDirectoryAD {
+		err = fmt.Errorf("%s requires the %s %s", EnvLdapGlobalCatalog, EnvLdapDirectory, LdapDirectoryAD)
+		return
+	}
+	if c.ldapUserFilter, err = parseLdapUserFilter(strings.TrimSpace(os.Getenv(EnvLdapUserFilter))); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvLdapUserFilter, err)
+		return
+	}
+	if _, err = configLdapFilter("LDAP_FILTER"); err != nil {
+		return
+	}
+	if c.ldapExtraFilter, err = configLdapFilter(EnvLdapExtraFilter); err != nil {
+		return
+	}
+
+	c.ambiguousPolicy, err = configChoice(EnvAmbiguousPolicy, AmbiguousPolicyFail,
+		AmbiguousPolicyFail, AmbiguousPolicyTieBreaker, AmbiguousPolicyFilter)
+	if err != nil {
+		return
+	}
+	c.ambiguousTieBreaker = strings.TrimSpace(os.Getenv(EnvAmbiguousTieBreaker))
+	if c.ambiguousFilter, err = configLdapFilter(EnvAmbiguousFilter); err != nil {
+		return
+	}
+	switch {
+	case c.ambiguousPolicy == AmbiguousPolicyTieBreaker && strings.TrimPrefix(c.ambiguousTieBreaker, "-") == "":
+		err = fmt.Errorf("%s %s requires %s", EnvAmbiguousPolicy, AmbiguousPolicyTieBreaker, EnvAmbiguousTieBreaker)
+		return
+	case c.ambiguousPolicy == AmbiguousPolicyFilter && c.ambiguousFilter == "":
+		err = fmt.Errorf("%s %s requires %s", EnvAmbiguousPolicy, AmbiguousPolicyFilter, EnvAmbiguousFilter)
+		return
+	case c.ambiguousTieBreaker != "" && c.ambiguousPolicy != AmbiguousPolicyTieBreaker:
+		err = fmt.Errorf("%s requires the %s %s", EnvAmbiguousTieBreaker, EnvAmbiguousPolicy, AmbiguousPolicyTieBreaker)
+		return
+	case c.ambiguousFilter != "" && c.ambiguousPolicy != AmbiguousPolicyFilter:
+		err = fmt.Errorf("%s requires the %s %s", EnvAmbiguousFilter, EnvAmbiguousPolicy, AmbiguousPolicyFilter)
+		return
+	}
+	c.ldapAnonymous, err = configChoice(EnvLdapAnonymous, LdapAnonymousNone,
+		LdapAnonymousNone, LdapAnonymousUnauthenticated, LdapAnonymousSkip)
+	if err != nil {
+		return
+	}
+	c.krb5Config = "/etc/krb5.conf"
+	if v, ok := os.LookupEnv(EnvKrb5Config); ok {
+		c.krb5Config = v
+	}
+	c.krb5Keytab = os.Getenv(EnvKrb5Keytab)
+	c.krb5Principal = os.Getenv(EnvKrb5Principal)
+	c.krb5Ccache = krb5CcacheDefault()
+	if v, ok := os.LookupEnv(EnvKrb5Ccache); ok {
+		c.krb5Ccache = v
+	}
+	c.ldapSpn = os.Getenv(EnvLdapSpn)
+	if c.krb5Keytab != "" && c.krb5Principal == "" {
+		err = fmt.Errorf("%s requires %s", EnvKrb5Keytab, EnvKrb5Principal)
+		return
+	}
+	if c.ldapPageSize, err = configInt(EnvLdapPageSize, 500); err != nil {
+		return
+	}
+	if c.ldapSearchBatch, err = configInt(EnvLdapSearchBatch, 0); err != nil {
+		return
+	}
+	if c.ldapReferralHops, err = configInt(EnvLdapReferralHops, 0); err != nil {
+		return
+	}
+	referralCredentials, err := configSecret(EnvLdapReferralCredentials)
+	if err != nil {
+		return
+	}
+	if c.ldapReferralCredentials, err = parseReferralCredentials(referralCredentials); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvLdapReferralCredentials, err)
+		return
+	}
+	if c.ldapRate, err = configInt(EnvLdapRate, 0); err != nil {
+		return
+	}
+	if c.ldapBurst, err = configInt(EnvLdapBurst, max(1, c.ldapRate)); err != nil {
+		return
+	} else if c.ldapBurst == 0 {
+		err = fmt.Errorf("%s must be positive", EnvLdapBurst)
+		return
+	}
+	c.ldapStartTLS, err = configChoice(EnvLdapStartTLS, StartTLSMandatory,
+		StartTLSMandatory, StartTLSOpportunistic)
+	if err != nil {
+		return
+	}
+
+	c.ldapRetryCodes = ldapRetryCodesDefault
+	if _, ok := os.LookupEnv(EnvLdapRetryCodes); ok {
+		if c.ldapRetryCodes, err = parseLdapRetryCodes(configList(EnvLdapRetryCodes)); err != nil {
+			err = fmt.Errorf("cannot parse %s: %w", EnvLdapRetryCodes, err)
+			return
+		}
+	}
+	return
+}
+
+// configLoadAttributes loads how attributes are mapped, normalized, and compared.
+func configLoadAttributes(c *config) (err error) {
+	if c.attributeMap, err = parseAttributeMap(os.Getenv(EnvAttributeMap)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvAttributeMap, err)
+		return
+	}
+
+	if c.attributeTemplate, err = parseAttributeTemplateMap(os.Getenv(EnvAttributeTemplate)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvAttributeTemplate, err)
+		return
+	}
+
+	if c.canonicalize, err = parseCanonicalizeMap(os.Getenv(EnvCanonicalize)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvCanonicalize, err)
+		return
+	}
+	if c.attributePolicy, err = parseAttributePolicyMap(os.Getenv(EnvAttributePolicy)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvAttributePolicy, err)
+		return
+	}
+	if c.clearedPolicy, err = parseClearedPolicyMap(os.Getenv(EnvClearedPolicy)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvClearedPolicy, err)
+		return
+	}
+	c.phoneRegion = "US"
+	if v, ok := os.LookupEnv(EnvPhoneRegion); ok {
+		c.phoneRegion = strings.ToUpper(v)
+	}
+	c.locales = greenlightLocales[c.schema]
+	if _, ok := os.LookupEnv(EnvLocales); ok {
+		c.locales = configList(EnvLocales)
+	}
+	if len(c.locales) == 0 {
+		err = fmt.Errorf("%s must not be empty", EnvLocales)
+		return
+	} else if _, err = parseLocales(c.locales); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvLocales, err)
+		return
+	}
+	c.compareFoldDiacritics = configList(EnvCompareFoldDiacritics)
+	c.compareNormalize = configList(EnvCompareNormalize)
+	if c.compareCase, err = configChoice(EnvCompareCase, CompareCaseIgnore, CompareCaseIgnore, CompareCaseUpdate); err != nil {
+		return
+	}
+	c.normalize = configList(EnvNormalize)
+	for _, step := range c.normalize {
+		switch step {
+		case NormalizeNfc, NormalizeNfkc, NormalizeTrim, NormalizeCollapse:
+		default:
+			err = fmt.Errorf("unsupported %s value %q, expected %s, %s, %s, or %s",
+				EnvNormalize, step, NormalizeNfc, NormalizeNfkc, NormalizeTrim, NormalizeCollapse)
+			return
+		}
+	}
+	if slices.Contains(c.normalize, NormalizeNfc) && slices.Contains(c.normalize, NormalizeNfkc) {
+		err = fmt.Errorf("%s cannot contain both %s and %s", EnvNormalize, NormalizeNfc, NormalizeNfkc)
+		return
+	}
+
+	c.avatarAttributes = configList(EnvAvatarAttributes)
+	if c.avatarSize, err = configInt(EnvAvatarSize, 128); err != nil {
+		return
+	} else if c.avatarSize == 0 {
+		err = fmt.Errorf("%s must be positive", EnvAvatarSize)
+		return
+	}
+	if len(c.avatarAttributes) > 0 && c.schema != SchemaV2 {
+		err = fmt.Errorf("%s is only supported for the %s %s", EnvAvatarAttributes, EnvSchema, SchemaV2)
+		return
+	}
+
+	if v, ok := os.LookupEnv(EnvDepartmentColumn); ok {
+		if v == "" || strings.ContainsAny(v, "{}.?") {
+			err = fmt.Errorf("invalid %s value %q", EnvDepartmentColumn, v)
+			return
+		}
+		c.departmentColumn = v
+	}
+	c.departmentSource = DepartmentSourceDN
+	if v := strings.TrimSpace(os.Getenv(EnvDepartmentSource)); v != "" {
+		if v != DepartmentSourceDN && strings.ContainsAny(v, "()=*,: ") {
+			err = fmt.Errorf("invalid %s value %q", EnvDepartmentSource, v)
+			return
+		}
+		c.departmentSource = v
+	}
+	return
+}
+
+// configLoadProvision loads the EnvProvisionBase.
+func configLoadProvision(c *config) (err error) {
+	c.provisionBase = os.Getenv(EnvProvisionBase)
+	c.provisionFilter = os.Getenv(EnvProvisionFilter)
+	c.provisionRole = "user"
+	if v := os.Getenv(EnvProvisionRole); v != "" {
+		c.provisionRole = v
+	}
+	c.provisionRoomName = "Home Room"
+	if v := os.Getenv(EnvProvisionRoomName); v != "" {
+		c.provisionRoomName = v
+	}
+	if c.provisionBase != "" && c.schema != SchemaV2 {
+		err = fmt.Errorf("%s is only supported for the %s %s", EnvProvisionBase, EnvSchema, SchemaV2)
+		return
+	} else if c.provisionBase != "" && c.matchColumn != sqlSchemas[c.schema].matchColumns[0] {
+		err = fmt.Errorf("%s is only supported for the %s %s", EnvProvisionBase, EnvMatchColumn, sqlSchemas[c.schema].matchColumns[0])
+		return
+	} else if c.provisionBase != "" && !strings.EqualFold(c.matchAttribute, os.Getenv("LDAP_UID")) {
+		// Greenlight looks up its LDAP users by their LDAP_UID value.
+		err = fmt.Errorf("%s cannot be used with %s", EnvProvisionBase, EnvMatchAttribute)
+		return
+	}
+
+	if c.roomPolicy, err = configChoice(EnvRoomPolicy, RoomPolicyKeep, RoomPolicyKeep, RoomPolicyTransfer, RoomPolicyArchive); err != nil {
+		return
+	}
+	c.roomOwner = os.Getenv(EnvRoomOwner)
+	if c.roomPolicy == RoomPolicyTransfer && c.roomOwner == "" {
+		err = fmt.Errorf("%s %s requires %s", EnvRoomPolicy, RoomPolicyTransfer, EnvRoomOwner)
+		return
+	} else if c.roomPolicy == RoomPolicyArchive && c.schema != SchemaV2 {
+		err = fmt.Errorf("%s %s is only supported for the %s %s", EnvRoomPolicy, RoomPolicyArchive, EnvSchema, SchemaV2)
+		return
+	}
+	return
+}
+
+// configLoadMysql rejects the features unsupported by the DbDriverMysql.
+// MySQL lacks RETURNING and CREATE INDEX IF NOT EXISTS. Connection URLs and
+// replicas are only supported for PostgreSQL.
+func configLoadMysql(c *config) (err error) {
+	if driver, _ := c.sqlDriver(); driver == DbDriverMysql {
+		for _, key := range []string{EnvProvisionBase, EnvAuditTable, EnvHistoryTable, EnvDbUrl, EnvDbReplicaHost} {
+			if os.Getenv(key) != "" {
+				err = fmt.Errorf("%s is not supported by the %s %s", key, EnvDbDriver, DbDriverMysql)
+				return
+			}
+		}
+	}
+	return
+}
+
+// configLoadRoles loads the role mapping, shared rooms, and the EnvAdminGroup.
+func configLoadRoles(c *config) (err error) {
+	if c.roleMap, err = parseRoleMap(os.Getenv(EnvRoleMap)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvRoleMap, err)
+		return
+	}
+	c.roleDefault = os.Getenv(EnvRoleDefault)
+	if c.sharedRooms, err = parseSharedRoomMap(os.Getenv(EnvSharedRooms)); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvSharedRooms, err)
+		return
+	}
+	_, c.sharedRoomsPrune = os.LookupEnv(EnvSharedRoomsPrune)
+	if c.roleCacheTTL, err = configDuration(EnvRoleCacheTTL, 10*time.Minute); err != nil {
+		return
+	}
+
+	if c.adminGroup = strings.TrimSpace(os.Getenv(EnvAdminGroup)); c.adminGroup != "" {
+		if _, err = ldap.ParseDN(c.adminGroup); err != nil {
+			err = fmt.Errorf("invalid %s group DN %q: %w", EnvAdminGroup, c.adminGroup, err)
+			return
+		}
+	}
+	c.adminRole = greenlightRoles[c.schema].admin
+	if v := os.Getenv(EnvAdminRole); v != "" {
+		c.adminRole = v
+	}
+	_, c.adminDemote = os.LookupEnv(EnvAdminDemote)
+	if c.adminDemote && c.adminGroup == "" {
+		err = fmt.Errorf("%s requires %s", EnvAdminDemote, EnvAdminGroup)
+		return
+	}
+	return
+}
+
+// configLoadNotify loads the webhooks, hooks, chat, email, and Kubernetes event
+// notifications.
+func configLoadNotify(c *config) (err error) {
+	if c.webhookUrl, err = configSecret(EnvWebhookUrl); err != nil {
+		return
+	}
+	if c.webhookSecret, err = configSecret(EnvWebhookSecret); err != nil {
+		return
+	}
+	if c.notifyTimeout, err = configDuration(EnvNotifyTimeout, 10*time.Second); err != nil {
+		return
+	}
+	if c.notifyRetries, err = configInt(EnvNotifyRetries, 3); err != nil {
+		return
+	}
+
+	c.hookPre = os.Getenv(EnvHookPre)
+	c.hookSuccess = os.Getenv(EnvHookSuccess)
+	c.hookFailure = os.Getenv(EnvHookFailure)
+	if c.hookTimeout, err = configDuration(EnvHookTimeout, time.Minute); err != nil {
+		return
+	}
+
+	if c.chatWebhookUrl, err = configSecret(EnvChatWebhookUrl); err != nil {
+		return
+	}
+	c.matrixHomeserver = os.Getenv(EnvMatrixHomeserver)
+	c.matrixRoom = os.Getenv(EnvMatrixRoom)
+	if c.matrixToken, err = configSecret(EnvMatrixToken); err != nil {
+		return
+	}
+	if c.matrixRoom != "" && (c.matrixHomeserver == "" || c.matrixToken == "") {
+		err = fmt.Errorf("%s requires %s and %s", EnvMatrixRoom, EnvMatrixHomeserver, EnvMatrixToken)
+		return
+	}
+	if v, ok := os.LookupEnv(EnvChatDigest); ok {
+		if c.chatWebhookUrl == "" && c.matrixRoom == "" {
+			err = fmt.Errorf("%s requires %s or %s", EnvChatDigest, EnvChatWebhookUrl, EnvMatrixRoom)
+			return
+		}
+		if c.chatDigest, err = parseCronSchedule(v); err != nil {
+			err = fmt.Errorf("cannot parse %s: %w", EnvChatDigest, err)
+			return
+		}
+	}
+
+	for _, to := range configList(EnvEmailTo) {
+		var addr *mail.Address
+		if addr, err = mail.ParseAddress(to); err != nil {
+			err = fmt.Errorf("invalid %s address %q: %w", EnvEmailTo, to, err)
+			return
+		}
+		c.emailTo = append(c.emailTo, addr.Address)
+	}
+	if len(c.emailTo) > 0 {
+		if c.emailFrom, err = mail.ParseAddress(os.Getenv(EnvEmailFrom)); err != nil {
+			err = fmt.Errorf("invalid %s: %w", EnvEmailFrom, err)
+			return
+		}
+		if c.smtpAddr = os.Getenv(EnvSmtpAddr); c.smtpAddr == "" {
+			err = fmt.Errorf("%s requires %s", EnvEmailTo, EnvSmtpAddr)
+			return
+		} else if _, _, err = net.SplitHostPort(c.smtpAddr); err != nil {
+			err = fmt.Errorf("invalid %s: %w", EnvSmtpAddr, err)
+			return
+		}
+	}
+	if c.emailReport, err = configChoice(EnvEmailReport, EmailReportChanges, EmailReportChanges, EmailReportFailures, EmailReportDigest); err != nil {
+		return
+	}
+	emailDigest := "0 8 * * 1"
+	if v, ok := os.LookupEnv(EnvEmailDigest); ok {
+		emailDigest = v
+	}
+	if c.emailDigest, err = parseCronSchedule(emailDigest); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvEmailDigest, err)
+		return
+	}
+	if c.smtpTls, err = configChoice(EnvSmtpTls, SmtpTlsStarttls, SmtpTlsStarttls, SmtpTlsImplicit, SmtpTlsNone); err != nil {
+		return
+	}
+	c.smtpUsername = os.Getenv(EnvSmtpUsername)
+	if c.smtpUsername != "" && c.smtpTls == SmtpTlsNone {
+		err = fmt.Errorf("%s requires a %s other than %s", EnvSmtpUsername, EnvSmtpTls, SmtpTlsNone)
+		return
+	}
+
+	_, c.kubeEvents = os.LookupEnv(EnvKubeEvents)
+	return
+}
+
+// configLoadOutput loads the event stream, backups, and reports.
+func configLoadOutput(c *config) (err error) {
+	c.eventStream = os.Getenv(EnvEventStream)
+	_, c.eventDetected = os.LookupEnv(EnvEventDetected)
+	c.backup = os.Getenv(EnvBackup)
+	if c.backupFormat, err = configChoice(EnvBackupFormat, BackupFormatJson, BackupFormatJson, BackupFormatSql); err != nil {
+		return
+	}
+	c.report = os.Getenv(EnvReport)
+	c.reportFormat, err = configChoice(EnvReportFormat, ReportFormatJson, ReportFormatJson, ReportFormatCsv)
+	return
+}
+
+// configLoadObservability loads the metrics and health endpoints.
+func configLoadObservability(c *config) (err error) {
+	c.metricsAddr = os.Getenv(EnvMetricsAddr)
+	if c.pushgatewayUrl, err = configSecret(EnvPushgatewayUrl); err != nil {
+		return
+	}
+	c.pushgatewayJob = "greenlight_ldap_sync"
+	if v := os.Getenv(EnvPushgatewayJob); v != "" {
+		c.pushgatewayJob = v
+	}
+	c.otlpEndpoint = os.Getenv(EnvOtlpEndpoint)
+	otlpHeaders, err := configSecret(EnvOtlpHeaders)
+	if err != nil {
+		return
+	}
+	if c.otlpHeaders, err = parseOtlpHeaders(otlpHeaders); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvOtlpHeaders, err)
+		return
+	}
+	if c.sentryDsn, err = configSecret(EnvSentryDsn); err != nil {
+		return
+	}
+	c.sentryEnvironment = os.Getenv(EnvSentryEnvironment)
+	c.healthAddr = c.metricsAddr
+	if v, ok := os.LookupEnv(EnvHealthAddr); ok {
+		c.healthAddr = v
+	}
+	return
+}
+
+// configLoadEndpoints loads the admin endpoint.
+func configLoadEndpoints(c *config) (err error) {
+	c.adminAddr = os.Getenv(EnvAdminAddr)
+	if c.adminToken, err = configSecret(EnvAdminToken); err != nil {
+		return
+	}
+	if c.adminAddr != "" && c.adminToken == "" {
+		err = fmt.Errorf("%s requires %s", EnvAdminAddr, EnvAdminToken)
+		return
+	}
+	_, c.adminPprof = os.LookupEnv(EnvAdminPprof)
+	if c.adminPprof && c.adminAddr == "" {
+		err = fmt.Errorf("%s requires %s", EnvAdminPprof, EnvAdminAddr)
+		return
+	}
+
+	c.scimAddr = os.Getenv(EnvScimAddr)
+	if c.scimToken, err = configSecret(EnvScimToken); err != nil {
+		return
+	}
+	if c.scimAddr != "" && c.scimToken == "" {
+		err = fmt.Errorf("%s requires %s", EnvScimAddr, EnvScimToken)
+		return
+	}
+	return
+}
+
+// configLoadVault loads the Vault secrets engine.
+func configLoadVault(c *config) (err error) {
+	c.vaultAddr = os.Getenv(EnvVaultAddr)
+	c.vaultCAFile = os.Getenv(EnvVaultCAFile)
+	c.vaultLdapPath = os.Getenv(EnvVaultLdapPath)
+	c.vaultDbPath = os.Getenv(EnvVaultDbPath)
+	if c.vaultAddr == "" && (c.vaultLdapPath != "" || c.vaultDbPath != "") {
+		err = fmt.Errorf("%s and %s require %s", EnvVaultLdapPath, EnvVaultDbPath, EnvVaultAddr)
+		return
+	} else if c.vaultAddr != "" && c.vaultLdapPath == "" && c.vaultDbPath == "" {
+		err = fmt.Errorf("%s requires %s or %s", EnvVaultAddr, EnvVaultLdapPath, EnvVaultDbPath)
+		return
+	}
+	if _, ok := os.LookupEnv(EnvVaultToken + configSecretFileSuffix); c.vaultAddr != "" && !ok && os.Getenv(EnvVaultToken) == "" {
+		err = fmt.Errorf("%s requires %s", EnvVaultAddr, EnvVaultToken)
+		return
+	}
+	return
+}
+
+// configShow prints the resolved configuration with masked secrets.
+func configShow(w io.Writer, c *config) {
+	section := func(name string) {
+		fmt.Fprintf(w, "\n[%s]\n", name)
+	}
+	value := func(key string, v any) {
+		fmt.Fprintf(w, "%-24s %v\n", key, v)
+	}
+	env := func(key string) {
+		if path, ok := os.LookupEnv(key + configSecretFileSuffix); ok && configIsSecret(key) {
+			value(key, "(file "+path+")")
+			return
+		}
+		v, ok := os.LookupEnv(key)
+		switch {
+		case !ok:
+			v = "(unset)"
+		case v != "" && configIsSecret(key):
+			v = "********"
+		}
+		value(key, v)
+	}
+
+	section("LDAP")
+	for _, key := range []string{"LDAP_SERVER", "LDAP_PORT", "LDAP_METHOD", "LDAP_TLS_NO_VERIFY",
+		"LDAP_AUTH", "LDAP_BIND_DN", "LDAP_PASSWORD", "LDAP_BASE", "LDAP_UID", "LDAP_FILTER", EnvLdapLdif} {
+		env(key)
+	}
+	value(EnvMatchAttribute, c.matchAttribute)
+	value("search filter", fmt.Sprintf("(&%s%s%s)",
+		strings.Replace(cmp.Or(c.ldapUserFilter, "("+c.matchAttribute+"=%s)"), ldapUserFilterVerb, "<user>", 1),
+		os.Getenv("LDAP_FILTER"), c.ldapExtraFilter))
+
+	section("Attribute mapping")
+	if attrMap, err := ldapAttrMapping(); err != nil {
+		value("error", err)
+	} else {
+		keys := make([]string, 0, len(attrMap))
+		for k := range attrMap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value(k, strings.Join(attrMap[k], ", "))
+		}
+	}
+	env(EnvAttributeMap)
+	value("written columns", strings.Join(sqlWritableColumns, ", "))
+
+	value(EnvDialRetries, c.dialRetries)
+	value(EnvOpRetries, c.opRetries)
+	value(EnvRetryBudget, c.retryBudget)
+	value(EnvDialBackoffBase, c.dialBackoffBase)
+	value(EnvDialBackoffMax, c.dialBackoffMax)
+	value(EnvLdapRetryCodes, c.ldapRetryCodes)
+	value(EnvKeepAlive, c.keepAlive)
+	value(EnvLdapDialTimeout, c.ldapDialTimeout)
+	value(EnvLdapBindTimeout, c.ldapBindTimeout)
+	value(EnvLdapSearchTimeout, c.ldapSearchTimeout)
+	value(EnvLdapIdleTimeout, c.ldapIdleTimeout)
+	value(EnvLdapTLSHandshakeTimeout, c.ldapTLSHandshakeTimeout)
+	value(EnvLdapTimeLimit, c.ldapTimeLimit)
+	value(EnvSqlTimeout, c.sqlTimeout)
+	for i, base := range c.ldapBases {
+		value(fmt.Sprintf("%s[%d]", EnvLdapBases, i), strings.TrimSpace(base.dn+" "+base.filter))
+	}
+	value(EnvLdapServers, c.ldapServers)
+	value(EnvLdapTLSServerName, c.ldapTLSServerName)
+	value(EnvLdapTLSCAFile, c.ldapTLSCAFile)
+	value(EnvLdapTLSCertFile, c.ldapTLSCertFile)
+	value(EnvLdapTLSKeyFile, c.ldapTLSKeyFile)
+	env(EnvTLSMinVersion)
+	value(EnvTLSCipherSuites, strings.Join(configList(EnvTLSCipherSuites), ","))
+	value(EnvTLSInsecureSkipVerify, c.tlsInsecureSkipVerify)
+	value(EnvLdapStartTLS, c.ldapStartTLS)
+	value(EnvLdapSasl, c.ldapSasl)
+	value(EnvLdapAnonymous, c.ldapAnonymous)
+	value(EnvLdapDirectory, c.ldapDirectory)
+	value(EnvLdapGlobalCatalog, c.ldapGlobalCatalog)
+	value(EnvLdapUserFilter, c.ldapUserFilter)
+	value(EnvLdapExtraFilter, c.ldapExtraFilter)
+	value(EnvAmbiguousPolicy, c.ambiguousPolicy)
+	value(EnvAmbiguousTieBreaker, c.ambiguousTieBreaker)
+	value(EnvAmbiguousFilter, c.ambiguousFilter)
+	value(EnvSource, c.source)
+	if c.ldapLdif != os.Getenv(EnvLdapLdif) {
+		value(EnvLdapLdif, c.ldapLdif)
+	}
+	if c.source == SourceKeycloak {
+		value(EnvKeycloakUrl, c.keycloakUrl)
+		value(EnvKeycloakRealm, c.keycloakRealm)
+		value(EnvKeycloakClientId, c.keycloakClientId)
+		env(EnvKeycloakClientSecret)
+		value(EnvKeycloakGroups, c.keycloakGroups)
+	}
+	if c.ldapSasl == LdapSaslGssapi {
+		value(EnvKrb5Config, c.krb5Config)
+		if c.krb5Keytab != "" {
+			value(EnvKrb5Keytab, c.krb5Keytab)
+			value(EnvKrb5Principal, c.krb5Principal)
+		} else {
+			value(EnvKrb5Ccache, c.krb5Ccache)
+		}
+		env(EnvLdapSpn)
+	}
+	value(EnvLdapPageSize, c.ldapPageSize)
+	value(EnvLdapSearchBatch, c.ldapSearchBatch)
+	value(EnvLdapReferralHops, c.ldapReferralHops)
+	env(EnvLdapReferralCredentials)
+	value(EnvLdapRate, c.ldapRate)
+	value(EnvLdapBurst, c.ldapBurst)
+
+	for col, tmpl := range c.attributeTemplate {
+		value(EnvAttributeTemplate+"["+col+"]", tmpl.tmpl.Root.String())
+	}
+	for col, names := range c.canonicalize {
+		value(EnvCanonicalize+"["+col+"]", strings.Join(names, ", "))
+	}
+	for col, policy := range c.attributePolicy {
+		value(EnvAttributePolicy+"["+col+"]", policy)
+	}
+	for col, policy := range c.clearedPolicy {
+		value(EnvClearedPolicy+"["+col+"]", policy)
+	}
+	value(EnvPhoneRegion, c.phoneRegion)
+	value(EnvLocales, strings.Join(c.locales, ", "))
+	value(EnvAvatarAttributes, c.avatarAttributes)
+	value(EnvAvatarSize, c.avatarSize)
+	value(EnvCompareFoldDiacritics, strings.Join(c.compareFoldDiacritics, ","))
+	value(EnvCompareNormalize, strings.Join(c.compareNormalize, ","))
+	value(EnvCompareCase, c.compareCase)
+	value(EnvNormalize, strings.Join(c.normalize, ","))
+	value(EnvDepartmentColumn, c.departmentColumn)
+	value(EnvDepartmentSource, c.departmentSource)
+
+	section("Database")
+	for _, key := range []string{"DB_ADAPTER", "DB_HOST", "PORT", "DB_NAME", "DB_USERNAME", "DB_PASSWORD"} {
+		env(key)
+	}
+	driver, _ := c.sqlDriver()
+	value(EnvDbDriver, driver)
+	if driver == DbDriverPostgres {
+		env(EnvDbUrl)
+		value(EnvDbSslMode, c.dbSslMode)
+		value(EnvDbSslRootCert, c.dbSslRootCert)
+		value(EnvDbSslCert, c.dbSslCert)
+		value(EnvDbSslKey, c.dbSslKey)
+		value(EnvDbSearchPath, c.dbSearchPath)
+		value(EnvDbApplicationName, c.dbApplicationName)
+		value(EnvDbReplicaHost, c.dbReplicaHost)
+		value(EnvDbReplicaPort, c.dbReplicaPort)
+	}
+	value(EnvDbConnectTimeout, c.dbConnectTimeout)
+	value("dialect", sqlDialectFor(driver).name())
+	switch {
+	case c.schemaDetected:
+		value(EnvSchema, fmt.Sprintf("%s (detected %s)", SchemaAuto, c.schema))
+	case c.schemaAuto:
+		value(EnvSchema, SchemaAuto)
+	default:
+		value(EnvSchema, c.schema)
+	}
+	value(EnvMatchColumn, c.matchColumn)
+	providers := c.providers
+	if len(providers) == 0 {
+		providers = sqlSchemas[c.schema].providers
+	}
+	value(EnvProviders, strings.Join(providers, ", "))
+	value(EnvUpdatedAt, c.updatedAtPolicy)
+	value(EnvUpdatedAtColumn, c.updatedAtColumn)
+	value(EnvDuplicatePolicy, c.duplicatePolicy)
+	value(EnvDuplicateAccounts, c.duplicateAccounts)
+	value(EnvConflictPolicy, c.conflictPolicy)
+	value(EnvUniqueColumns, strings.Join(c.uniqueColumns, ", "))
+	value(EnvSqlParallel, c.sqlParallel)
+	value(EnvSqlChunkSize, c.sqlChunkSize)
+	value(EnvSqlChunkDelay, c.sqlChunkDelay)
+	value(EnvSqlBatchSize, c.sqlBatchSize)
+	value(EnvSqlFetchQuery, c.sqlFetchQuery)
+	value(EnvSqlUpdateQuery, c.sqlUpdateQuery)
+	value(EnvWriter, c.writer)
+	value(EnvRailsRunner, c.railsRunner)
+	value(EnvRailsTimeout, c.railsTimeout)
+	value(EnvConcurrency, c.concurrency)
+	value(EnvReuseConnections, c.reuseConnections)
+	value(EnvIncremental, c.incremental)
+	value(EnvIncrementalFullInterval, c.incrementalFullInterval)
+	value(EnvSkipColumnCheck, c.skipColumnCheck)
+	value(EnvStatusTable, c.statusTable)
+	value(EnvCursorTable, c.cursorTable)
+	value(EnvAuditTable, c.auditTable)
+	value(EnvHistoryTable, c.historyTable)
+	value(EnvHistoryRetention, c.historyRetention)
+	value(EnvStateFile, c.stateFile)
+	value(EnvStatusMaxAge, c.statusMaxAge)
+	env(EnvCanary)
+	env(EnvMaxChanges)
+	value(EnvForce, c.force)
+	value(EnvForceResync, c.forceResync)
+	value(EnvVerifyUpdates, c.verifyUpdates)
+
+	section("Sync")
+	env(EnvLogFormat)
+	value(EnvLogLevel, c.logLevel)
+	value(EnvLogFile, c.logFile)
+	value(EnvLogFileMaxSize, c.logFileMaxSize)
+	value(EnvLogFileRotate, c.logFileRotate)
+	value(EnvLogFileKeep, c.logFileKeep)
+	env(EnvLogRedact)
+	value(EnvInterval, c.interval)
+	env(EnvSchedule)
+	value(EnvStartup, c.startup)
+	value(EnvJitter, c.jitter)
+	value(EnvOverlap, c.overlap)
+	value(EnvFailureBackoffMax, c.failureBackoff)
+	value(EnvConfigWatch, c.configWatch)
+	value(EnvSyncrepl, c.syncrepl)
+	value(EnvShutdownTimeout, c.shutdownTimeout)
+	value(EnvShutdownGrace, c.shutdownGrace)
+	value(EnvRunTimeout, c.runTimeout)
+	value(EnvRunLock, c.runLock)
+	value(EnvRunLockName, c.runLockName)
+	value(EnvLeaderElection, c.leaderElection)
+	value(EnvDryRun, c.dryRun)
+	value(EnvDryRunColumns, strings.Join(c.dryRunColumns, ","))
+	value(EnvUser, strings.Join(c.users, ","))
+	value(EnvMaintenance, c.maintenance)
+	value(EnvPauseFile, c.pauseFile)
+	value(EnvSignalUsr1, c.signalUsr1)
+	value(EnvLockPolicy, c.lockPolicy)
+	value(EnvDisabledPolicy, c.disabledPolicy)
+	value(EnvMissingPolicy, c.missingPolicy)
+	value(EnvRoomPolicy, c.roomPolicy)
+	value(EnvRoomOwner, c.roomOwner)
+	value(EnvOptOutAttribute, c.optOutAttribute)
+	value(EnvIncludeGroups, c.includeGroups)
+	value(EnvExcludeGroups, c.excludeGroups)
+	value(EnvNestedGroups, c.nestedGroups)
+	if c.nestedGroups == NestedGroupsRecursive {
+		value(EnvNestedGroupsDepth, c.nestedGroupsDepth)
+	} else if c.nestedGroups == NestedGroupsChain {
+		value(EnvGroupBase, c.groupBase)
+	}
+	value(EnvClearOnEmpty, c.clearOnEmpty)
+	value(EnvProvisionBase, c.provisionBase)
+	value(EnvProvisionFilter, c.provisionFilter)
+	value(EnvProvisionRole, c.provisionRole)
+	value(EnvProvisionRoomName, c.provisionRoomName)
+	value(EnvRoleDefault, c.roleDefault)
+	value(EnvRoleCacheTTL, c.roleCacheTTL)
+	value(EnvAdminGroup, c.adminGroup)
+	value(EnvAdminRole, c.adminRole)
+	value(EnvAdminDemote, c.adminDemote)
+	for i, mapping := range c.roleMap {
+		value(fmt.Sprintf("%s[%d]", EnvRoleMap, i), fmt.Sprintf("%s -> %s", mapping.group, mapping.role))
+	}
+	for i, mapping := range c.sharedRooms {
+		value(fmt.Sprintf("%s[%d]", EnvSharedRooms, i), fmt.Sprintf("%s -> %s", mapping.group, mapping.room))
+	}
+	value(EnvSharedRoomsPrune, c.sharedRoomsPrune)
+
+	section("Notifications")
+	env(EnvWebhookUrl)
+	env(EnvWebhookSecret)
+	value(EnvNotifyTimeout, c.notifyTimeout)
+	value(EnvNotifyRetries, c.notifyRetries)
+	value(EnvHookPre, c.hookPre)
+	value(EnvHookSuccess, c.hookSuccess)
+	value(EnvHookFailure, c.hookFailure)
+	value(EnvHookTimeout, c.hookTimeout)
+	env(EnvChatWebhookUrl)
+	value(EnvMatrixHomeserver, c.matrixHomeserver)
+	value(EnvMatrixRoom, c.matrixRoom)
+	env(EnvMatrixToken)
+	env(EnvChatDigest)
+	value(EnvEmailTo, strings.Join(c.emailTo, ", "))
+	value(EnvEmailFrom, os.Getenv(EnvEmailFrom))
+	value(EnvEmailReport, c.emailReport)
+	env(EnvEmailDigest)
+	value(EnvSmtpAddr, c.smtpAddr)
+	value(EnvSmtpTls, c.smtpTls)
+	value(EnvSmtpUsername, c.smtpUsername)
+	env(EnvSmtpPassword)
+	value(EnvEventStream, c.eventStream)
+	value(EnvEventDetected, c.eventDetected)
+	value(EnvReport, c.report)
+	value(EnvReportFormat, c.reportFormat)
+	value(EnvBackup, c.backup)
+	value(EnvBackupFormat, c.backupFormat)
+	value(EnvMetricsAddr, c.metricsAddr)
+	env(EnvPushgatewayUrl)
+	value(EnvPushgatewayJob, c.pushgatewayJob)
+	value(EnvOtlpEndpoint, c.otlpEndpoint)
+	env(EnvOtlpHeaders)
+	env(EnvSentryDsn)
+	value(EnvSentryEnvironment, c.sentryEnvironment)
+	value(EnvHealthAddr, c.healthAddr)
+	value(EnvAdminAddr, c.adminAddr)
+	value(EnvAdminPprof, c.adminPprof)
+	env(EnvAdminToken)
+	value(EnvScimAddr, c.scimAddr)
+	env(EnvScimToken)
+	value(EnvKubeEvents, c.kubeEvents)
+
+	value(EnvVaultAddr, c.vaultAddr)
+	if c.vaultAddr != "" {
+		env(EnvVaultToken)
+		value(EnvVaultCAFile, c.vaultCAFile)
+		value(EnvVaultLdapPath, c.vaultLdapPath)
+		value(EnvVaultDbPath, c.vaultDbPath)
+	}
+}
+
+// configIsSecret checks if an environment variable contains a secret.
+func configIsSecret(key string) bool {
+	for _, secretKey := range configSecretKeys {
+		if key == secretKey {
+			return true
+		}
+	}
+	return false
+}
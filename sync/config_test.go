@@ -0,0 +1,79 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigLoadDepartmentSource(t *testing.T) {
+	tests := []struct {
+		value   string
+		source  string
+		wantErr bool
+	}{
+		{"", DepartmentSourceDN, false},
+		{DepartmentSourceDN, DepartmentSourceDN, false},
+		{" department ", "department", false},
+		{"dn", "dn", false},
+		{"(department)", "", true},
+		{"department=*", "", true},
+		{"ou,department", "", true},
+		{":ou", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			t.Setenv(EnvDepartmentSource, test.value)
+
+			c, err := configLoad()
+			if (err != nil) != test.wantErr {
+				t.Fatalf("configLoad() error = %v, want failure %v", err, test.wantErr)
+			}
+			if !test.wantErr && c.departmentSource != test.source {
+				t.Errorf("departmentSource = %q, want %q", c.departmentSource, test.source)
+			}
+		})
+	}
+}
+
+func TestConfigShowMasksSecrets(t *testing.T) {
+	// Some secrets are parsed, thus each value embeds its mark "secret-<key>".
+	secrets := map[string]string{
+		EnvDbUrl:                   "postgres://greenlight:secret-" + EnvDbUrl + "@localhost/greenlight",
+		EnvLdapReferralCredentials: "dc1.example.org=cn=sync,dc=example,dc=org|secret-" + EnvLdapReferralCredentials,
+		EnvWebhookUrl:              "https://hooks.example.org/secret-" + EnvWebhookUrl,
+		EnvChatWebhookUrl:          "https://chat.example.org/secret-" + EnvChatWebhookUrl,
+		EnvPushgatewayUrl:          "https://push.example.org/secret-" + EnvPushgatewayUrl,
+		EnvOtlpHeaders:             "Authorization=secret-" + EnvOtlpHeaders,
+		EnvSentryDsn:               "https://secret-" + EnvSentryDsn + "@sentry.example.org/1",
+	}
+	for _, key := range configSecretKeys {
+		if _, ok := secrets[key]; !ok {
+			secrets[key] = "secret-" + key
+		}
+		t.Setenv(key, secrets[key])
+	}
+	t.Setenv(EnvSource, SourceKeycloak)
+	t.Setenv(EnvKeycloakUrl, "https://keycloak.example.org")
+	t.Setenv(EnvKeycloakRealm, "greenlight")
+	t.Setenv(EnvKeycloakClientId, "greenlight-ldap-sync")
+	t.Setenv(EnvVaultAddr, "https://vault.example.org")
+	t.Setenv(EnvVaultDbPath, "database/creds/greenlight")
+
+	// configLoad fails on a configSecret not being one of the configSecretKeys.
+	c, err := configLoad()
+	if err != nil {
+		t.Fatalf("configLoad() failed: %v", err)
+	}
+
+	var out strings.Builder
+	configShow(&out, c)
+	for _, key := range configSecretKeys {
+		if strings.Contains(out.String(), "secret-"+key) {
+			t.Errorf("configShow() prints the value of %s", key)
+		}
+	}
+}
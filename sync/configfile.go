@@ -0,0 +1,147 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileSections maps the sections of a configuration file to the prefix
+// of their environment variables.
+var configFileSections = map[string]string{
+	"ldap":     "LDAP_",
+	"database": "DB_",
+	"sync":     "SYNC_",
+}
+
+// configFileKey returns the environment variable for a configuration file key.
+//
+// Greenlight's .env names the database port PORT instead of DB_PORT.
+func configFileKey(section, key string) string {
+	if section == "database" && key == "port" {
+		return "PORT"
+	}
+	return configFileSections[section] + strings.ToUpper(key)
+}
+
+// configFileValue formats a configuration file value like its environment
+// variable. Lists are comma separated, maps are semicolon separated KEY=VALUE
+// pairs, as for LDAP_ATTRIBUTE_MAPPING. A false boolean unsets the variable.
+func configFileValue(v any) (value string, set bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+
+	case bool:
+		return "true", v
+
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, elem := range v {
+			values = append(values, fmt.Sprint(elem))
+		}
+		return strings.Join(values, ","), true
+
+	case map[string]any:
+		pairs := make([]string, 0, len(v))
+		for k, elem := range v {
+			pairs = append(pairs, k+"="+fmt.Sprint(elem))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ";"), true
+
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+// configFileUnmarshal parses the data of the configuration file at path into v,
+// being TOML for a .toml extension and YAML otherwise.
+func configFileUnmarshal(path string, data []byte, v any) error {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return toml.Unmarshal(data, v)
+	}
+	return yaml.Unmarshal(data, v)
+}
+
+// configFileLoad reads a YAML or TOML configuration file by configFileRead into
+// the environment, returning the jobs of its jobs section, see configFileJobs.
+//
+// Each value is only applied if its environment variable is unset. Thus,
+// environment variables override the configuration file.
+func configFileLoad(path string) (jobs []configJob, err error) {
+	data, err := configFileRead(path)
+	if err != nil {
+		return
+	}
+	configSources.digest = sha256.Sum256(data)
+
+	var file map[string]map[string]any
+	if err = configFileUnmarshal(path, data, &file); err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", path, err)
+		return
+	}
+
+	if jobs, err = configFileJobs(path, file["jobs"]); err != nil {
+		return
+	}
+	delete(file, "jobs")
+
+	for section, values := range file {
+		if _, ok := configFileSections[section]; !ok {
+			err = fmt.Errorf("unknown section %q in %s", section, path)
+			return
+		}
+
+		for k, v := range values {
+			key := configFileKey(section, k)
+			if _, ok := os.LookupEnv(key); ok {
+				log.WithField("key", key).Debug("Environment variable overrides configuration file")
+				continue
+			}
+
+			value, set := configFileValue(v)
+			if !set {
+				continue
+			}
+			if err = os.Setenv(key, value); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// configFileArg removes a --config PATH or --config=PATH argument from args,
+// returning the path and the remaining arguments.
+func configFileArg(args []string) (path string, rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--config":
+			if i+1 >= len(args) {
+				err = fmt.Errorf("--config requires a path")
+				return
+			}
+			path = args[i+1]
+			i++
+
+		case strings.HasPrefix(args[i], "--config="):
+			path = strings.TrimPrefix(args[i], "--config=")
+
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return
+}
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configRemoteTimeout bounds each request of configFileRead to Consul or etcd.
+const configRemoteTimeout = 10 * time.Second
+
+// configFileRead reads the configuration file at path, being either a local
+// file, e.g., a mounted Kubernetes ConfigMap, or a key of a key-value store:
+//
+//   - consul://HOST:PORT/KEY reads KEY of Consul's KV store, authenticated by
+//     the CONSUL_HTTP_TOKEN, if set.
+//   - etcd://HOST:PORT/KEY reads KEY of etcd's v3 API by its JSON gateway.
+//
+// Both schemes use HTTP, while consul+https:// and etcd+https:// use HTTPS.
+func configFileRead(path string) ([]byte, error) {
+	scheme, _, ok := strings.Cut(path, "://")
+	if !ok {
+		return os.ReadFile(path)
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("configuration source %s requires a host and a key", path)
+	}
+
+	backend, tls := strings.CutSuffix(scheme, "+https")
+	endpoint := "http://" + u.Host
+	if tls {
+		endpoint = "https://" + u.Host
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), configRemoteTimeout)
+	defer cancel()
+
+	switch backend {
+	case "consul":
+		return configConsulRead(ctx, endpoint, key)
+	case "etcd":
+		return configEtcdRead(ctx, endpoint, key)
+	default:
+		return nil, fmt.Errorf("unsupported configuration source scheme %q, expected consul or etcd", scheme)
+	}
+}
+
+// configConsulRead reads the raw value of a key of Consul's KV store.
+func configConsulRead(ctx context.Context, endpoint, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/v1/kv/"+key+"?raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	return configRemoteDo(req, "Consul key "+key)
+}
+
+// configEtcdRead reads the value of a key by etcd's v3 JSON gateway, whose
+// keys and values are base64 encoded.
+func configEtcdRead(ctx context.Context, endpoint, key string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	data, err := configRemoteDo(req, "etcd key "+key)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("cannot parse etcd response: %w", err)
+	} else if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("etcd key %s does not exist", key)
+	}
+	return base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+}
+
+// configRemoteDo performs a request of configFileRead, returning its body.
+func configRemoteDo(req *http.Request, what string) ([]byte, error) {
+	client := &http.Client{Timeout: configRemoteTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s does not exist", what)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot read %s: unexpected HTTP status %s", what, resp.Status)
+	}
+	return data, nil
+}
+
+// configWatch polls the configuration file every EnvConfigWatch, notifying
+// changed once its content differs from the one read last, starting with the
+// last digest, until ctx is done. Failed reads are logged, keeping the current
+// configuration.
+func configWatch(ctx context.Context, path string, interval time.Duration, last [sha256.Size]byte, changed chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		data, err := configFileRead(path)
+		if err != nil {
+			log.WithError(err).WithField("config", path).Warn("Cannot read configuration for changes")
+			continue
+		}
+		if digest := sha256.Sum256(data); digest != last {
+			last = digest
+			log.WithField("config", path).Info("Configuration has changed")
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// conflictSuffixTries bounds the suffixes tried by sqlUniqueValue.
+const conflictSuffixTries = 100
+
+// uniqueConflict is a user's new value of an EnvUniqueColumns column already
+// held by another Greenlight account, as found by sqlFindConflicts.
+type uniqueConflict struct {
+	userId  string
+	otherId string
+	column  string
+	value   string
+
+	// synced accounts are within the sync's scope, e.g., another LDAP user, or
+	// another user of the same updates.
+	synced bool
+
+	// renamed is the suffixed value written instead, either for the user by
+	// ConflictPolicySuffix or for the other account by ConflictPolicyPreferLdap.
+	renamed string
+}
+
+// conflictSuffix inserts the numeric suffix into the value, being before the
+// domain of an email address, e.g., "alice-2@example.org".
+func conflictSuffix(value string, n int) string {
+	suffix := "-" + strconv.Itoa(n)
+	if i := strings.LastIndex(value, "@"); i > 0 {
+		return value[:i] + suffix + value[i:]
+	}
+	return value + suffix
+}
+
+// sqlFindConflicts finds the conflicts of the updates' changed values of the
+// EnvUniqueColumns, compared case insensitively. The stored values are mapped
+// by the users' ids.
+//
+// If multiple updates write the same value, all but the first one conflict
+// with the first user, as a synced account.
+func sqlFindConflicts(ctx context.Context, db *sqlDB, updates []map[string]string, stored map[string]map[string]string) (conflicts []uniqueConflict, err error) {
+	for _, col := range cfg.uniqueColumns {
+		if !slices.Contains(sqlWritableColumns, col) {
+			continue
+		}
+
+		writers := make(map[string]string)
+		byId := make(map[string]map[string]string, len(updates))
+		var values []any
+		for _, userAttr := range updates {
+			byId[userAttr["id"]] = userAttr
+			id, value := userAttr["id"], strings.ToLower(userAttr[col])
+			if value == "" || value == strings.ToLower(stored[id][col]) {
+				continue
+			}
+			if first, ok := writers[value]; ok {
+				conflicts = append(conflicts, uniqueConflict{userId: id, otherId: first, column: col, value: userAttr[col], synced: true})
+				continue
+			}
+			writers[value] = id
+			values = append(values, value)
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		var found []uniqueConflict
+		if found, err = sqlFetchConflicts(ctx, db, col, values, writers); err != nil {
+			return
+		}
+		for _, conflict := range found {
+			conflict.value = byId[conflict.userId][col]
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	return
+}
+
+// sqlFetchConflicts looks up the accounts holding any of the lowercase values
+// of the column, besides the users writing them.
+func sqlFetchConflicts(ctx context.Context, db *sqlDB, col string, values []any, writers map[string]string) (conflicts []uniqueConflict, err error) {
+	rows, err := db.QueryContext(ctx, db.query(`
+		SELECT
+			{users.id}, LOWER({users.`+col+`}), COALESCE((`+sqlActiveSchema.filter+`), FALSE)
+		FROM
+			{users}
+		WHERE
+			LOWER({users.`+col+`}) IN (?`+strings.Repeat(", ?", len(values)-1)+`)
+		ORDER BY
+			{users.id}
+	`), values...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var otherId, value string
+		var synced bool
+		if err = rows.Scan(&otherId, &value, &synced); err != nil {
+			return
+		}
+		if userId := writers[value]; userId != otherId {
+			conflicts = append(conflicts, uniqueConflict{userId: userId, otherId: otherId, column: col, synced: synced})
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+// sqlUniqueValue finds the first conflictSuffix of the value neither held by
+// any account nor within the taken lowercase values, adding it to the latter.
+//
+// The account's own value is reused if it is such a suffix, e.g., as written
+// by a previous sync, thus a conflict does not lead to a new suffix each time.
+func sqlUniqueValue(ctx context.Context, db *sqlDB, col, value, own string, taken map[string]bool) (string, error) {
+	for n := 2; n < 2+conflictSuffixTries; n++ {
+		candidate := conflictSuffix(value, n)
+		if taken[strings.ToLower(candidate)] {
+			continue
+		} else if strings.EqualFold(candidate, own) {
+			taken[strings.ToLower(candidate)] = true
+			return own, nil
+		}
+
+		var count int
+		err := db.QueryRowContext(ctx, db.query(`
+			SELECT
+				COUNT(*)
+			FROM
+				{users}
+			WHERE
+				LOWER({users.`+col+`}) = LOWER(?)
+		`), candidate).Scan(&count)
+		if err != nil {
+			return "", err
+		} else if count == 0 {
+			taken[strings.ToLower(candidate)] = true
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no unique %s found for %q within %d suffixes", col, value, conflictSuffixTries)
+}
+
+// resolveConflicts applies the EnvConflictPolicy to the conflicts of the
+// updates, returning those skipped and those renamed.
+//
+// For ConflictPolicySuffix, the updates' values are replaced in place by
+// their renamed values. For ConflictPolicyPreferLdap, the other accounts'
+// renamed values have to be written by sqlRenameConflicts before the updates.
+func resolveConflicts(ctx context.Context, db *sqlDB, updates []map[string]string, stored map[string]map[string]string) (skipped, renamed []uniqueConflict, err error) {
+	conflicts, err := sqlFindConflicts(ctx, db, updates, stored)
+	if err != nil || len(conflicts) == 0 {
+		return
+	}
+
+	// The updates' new values are taken, besides those held by other accounts.
+	taken := make(map[string]bool)
+	for _, userAttr := range updates {
+		for _, col := range cfg.uniqueColumns {
+			taken[strings.ToLower(userAttr[col])] = true
+		}
+	}
+
+	// A skipped user does not rename any other account, thus these are decided
+	// first.
+	skippedIds := make(map[string]bool)
+	for _, conflict := range conflicts {
+		if cfg.conflictPolicy == ConflictPolicySkip || cfg.conflictPolicy == ConflictPolicyPreferLdap && conflict.synced {
+			if !skippedIds[conflict.userId] {
+				skipped = append(skipped, conflict)
+			}
+			skippedIds[conflict.userId] = true
+		}
+	}
+
+	for _, conflict := range conflicts {
+		if skippedIds[conflict.userId] {
+			continue
+		}
+
+		var own string
+		if cfg.conflictPolicy == ConflictPolicySuffix {
+			own = stored[conflict.userId][conflict.column]
+		}
+		if conflict.renamed, err = sqlUniqueValue(ctx, db, conflict.column, conflict.value, own, taken); err != nil {
+			return
+		}
+		if cfg.conflictPolicy == ConflictPolicySuffix {
+			for _, userAttr := range updates {
+				if userAttr["id"] == conflict.userId {
+					userAttr[conflict.column] = conflict.renamed
+				}
+			}
+		}
+		renamed = append(renamed, conflict)
+	}
+	return
+}
+
+// sqlRenameConflicts writes the renamed values of the other accounts for
+// ConflictPolicyPreferLdap within a single transaction.
+func sqlRenameConflicts(ctx context.Context, db *sqlDB, conflicts []uniqueConflict) (err error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	for _, conflict := range conflicts {
+		args := []any{conflict.renamed}
+		if cfg.updatedAtPolicy == UpdatedAtChanged {
+			args = append(args, conflict.renamed)
+		}
+		args = append(args, conflict.otherId)
+
+		if _, err = tx.ExecContext(ctx, db.query(`
+			UPDATE
+				{users}
+			SET
+				`+db.setClause([2]string{conflict.column, "?"})+`
+			WHERE
+				{id} = ?
+		`), args...); err != nil {
+			err = fmt.Errorf("cannot rename %s of account %s: %w", conflict.column, conflict.otherId, err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// sqlPgService and sqlPgServiceFile are libpq's PGSERVICE and PGSERVICEFILE
+// environment variables. They are unset at startup, as lib/pq refuses to
+// connect while either is set, and resolved by sqlConnInfo instead.
+var (
+	sqlPgService     = sqlTakeEnv("PGSERVICE")
+	sqlPgServiceFile = sqlTakeEnv("PGSERVICEFILE")
+)
+
+// sqlTakeEnv returns and unsets the environment variable key.
+func sqlTakeEnv(key string) string {
+	v := os.Getenv(key)
+	_ = os.Unsetenv(key)
+	return v
+}
+
+// sqlParseConnInfo parses the EnvDbUrl, being either a postgres:// URI or a
+// libpq connection string, e.g., "host=db dbname=greenlight".
+func sqlParseConnInfo(s string) (opts map[string]string, err error) {
+	if strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://") {
+		if s, err = pq.ParseURL(s); err != nil {
+			return
+		}
+	}
+
+	opts = make(map[string]string)
+	r := []rune(s)
+	for i := 0; ; {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		if i == len(r) {
+			return
+		}
+
+		start := i
+		for i < len(r) && r[i] != '=' && !unicode.IsSpace(r[i]) {
+			i++
+		}
+		key := string(r[start:i])
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		if key == "" || i == len(r) || r[i] != '=' {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", key)
+		}
+		i++
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+
+		// A value is either single-quoted or ends at the next space, with
+		// backslashes escaping the following character.
+		var value strings.Builder
+		quoted := i < len(r) && r[i] == '\''
+		if quoted {
+			i++
+		}
+		for ; i < len(r); i++ {
+			if quoted && r[i] == '\'' || !quoted && unicode.IsSpace(r[i]) {
+				break
+			}
+			if r[i] == '\\' && i+1 < len(r) {
+				i++
+			}
+			value.WriteRune(r[i])
+		}
+		if quoted {
+			if i == len(r) {
+				return nil, fmt.Errorf("unterminated quoted value of %q in connection string", key)
+			}
+			i++
+		}
+		opts[key] = value.String()
+	}
+}
+
+// sqlServiceFiles are the pg_service.conf files searched for a service, being
+// the PGSERVICEFILE or ~/.pg_service.conf, followed by the system-wide file of
+// PGSYSCONFDIR.
+func sqlServiceFiles() (paths []string) {
+	if sqlPgServiceFile != "" {
+		paths = append(paths, sqlPgServiceFile)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".pg_service.conf"))
+	}
+	if dir := os.Getenv("PGSYSCONFDIR"); dir != "" {
+		paths = append(paths, filepath.Join(dir, "pg_service.conf"))
+	}
+	return
+}
+
+// sqlLoadService reads the parameters of the named service from the first
+// sqlServiceFiles defining it.
+func sqlLoadService(name string) (map[string]string, error) {
+	for _, path := range sqlServiceFiles() {
+		opts, ok, err := sqlServiceSection(path, name)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			return opts, nil
+		}
+	}
+	return nil, fmt.Errorf("definition of service %q not found", name)
+}
+
+// sqlServiceSection reads the name's INI section of a pg_service.conf file. A
+// missing file is skipped.
+func sqlServiceSection(path, name string) (opts map[string]string, ok bool, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || text[0] == '#':
+			continue
+
+		case text[0] == '[':
+			if ok {
+				return
+			}
+			if ok = text == "["+name+"]"; ok {
+				opts = make(map[string]string)
+			}
+
+		case ok:
+			key, value, found := strings.Cut(text, "=")
+			if !found {
+				err = fmt.Errorf("%s:%d: syntax error in service file", path, line)
+				return
+			}
+			opts[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// sqlConnOpts merges the defaults and the EnvDbUrl's PostgreSQL connection
+// parameters, the latter taking precedence. A service named by the EnvDbUrl's
+// service parameter or PGSERVICE is resolved in between, as by libpq.
+func sqlConnOpts(defaults, dbUrl map[string]string) (opts map[string]string, err error) {
+	opts = make(map[string]string)
+	for k, v := range defaults {
+		opts[k] = v
+	}
+
+	if service := cmp.Or(dbUrl["service"], sqlPgService); service != "" {
+		var serviceOpts map[string]string
+		if serviceOpts, err = sqlLoadService(service); err != nil {
+			return
+		}
+		for k, v := range serviceOpts {
+			opts[k] = v
+		}
+	}
+	for k, v := range dbUrl {
+		opts[k] = v
+	}
+	delete(opts, "service")
+	return
+}
+
+// sqlConnString encodes the parameters as a libpq connection string, omitting
+// empty values.
+func sqlConnString(opts map[string]string) string {
+	keys := make([]string, 0, len(opts))
+	for k, v := range opts {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, k+"='"+quote.Replace(opts[k])+"'")
+	}
+	return strings.Join(params, " ")
+}
@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// syncCursor is the progress of the last successful sync, persisted in the
+// EnvCursorTable.
+type syncCursor struct {
+	runId    string
+	lastSync time.Time
+	lastFull time.Time
+
+	// modifyTimestamp is the latest modifyTimestamp of the users' LDAP entries
+	// compared by the last incremental sync, empty after a full sync.
+	modifyTimestamp string
+}
+
+// sqlCreateCursorTable creates the EnvCursorTable if missing.
+func sqlCreateCursorTable(ctx context.Context, db *sqlDB) error {
+	_, err := db.ExecContext(ctx, db.query(`
+		CREATE TABLE IF NOT EXISTS {`+cfg.cursorTable+`} (
+			{id}               INTEGER PRIMARY KEY,
+			{run_id}           TEXT NOT NULL,
+			{last_sync_at}     TIMESTAMP NOT NULL,
+			{last_full_at}     TIMESTAMP NULL,
+			{modify_timestamp} TEXT,
+			{updated_at}       TIMESTAMP NOT NULL
+		)
+	`))
+	return err
+}
+
+// sqlReadCursor reads the single row of the EnvCursorTable. For a missing
+// row, ok is false. Unless readOnly, the table is created if missing.
+func sqlReadCursor(ctx context.Context, db *sqlDB, readOnly bool) (cursor syncCursor, ok bool, err error) {
+	if !readOnly {
+		if err = sqlCreateCursorTable(ctx, db); err != nil {
+			return
+		}
+	}
+
+	var lastFull sql.NullTime
+	var modifyTimestamp sql.NullString
+	err = db.QueryRowContext(ctx, db.query(`
+		SELECT {run_id}, {last_sync_at}, {last_full_at}, {modify_timestamp}
+		FROM {`+cfg.cursorTable+`}
+		WHERE {id} = 1
+	`)).Scan(&cursor.runId, &cursor.lastSync, &lastFull, &modifyTimestamp)
+	if err == sql.ErrNoRows {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	cursor.lastFull = lastFull.Time
+	cursor.modifyTimestamp = modifyTimestamp.String
+	ok = true
+	return
+}
+
+// sqlWriteCursor upserts the single row of the EnvCursorTable, creating it if
+// missing. As for the EnvStatusTable, it is written in its own transaction.
+func sqlWriteCursor(ctx context.Context, db *sqlDB, cursor syncCursor) (err error) {
+	if err = sqlCreateCursorTable(ctx, db); err != nil {
+		return
+	}
+
+	var lastFull *time.Time
+	if !cursor.lastFull.IsZero() {
+		t := cursor.lastFull.UTC()
+		lastFull = &t
+	}
+	var modifyTimestamp *string
+	if cursor.modifyTimestamp != "" {
+		modifyTimestamp = &cursor.modifyTimestamp
+	}
+
+	_, err = db.ExecContext(ctx, db.query(`
+		INSERT INTO {`+cfg.cursorTable+`} ({id}, {run_id}, {last_sync_at}, {last_full_at}, {modify_timestamp}, {updated_at})
+		VALUES (1, ?, ?, ?, ?, ?)
+		`+db.dialect.upsertClause("id", []string{"run_id", "last_sync_at", "last_full_at", "modify_timestamp", "updated_at"})),
+		cursor.runId, cursor.lastSync.UTC(), lastFull, modifyTimestamp, time.Now().UTC())
+	return
+}
@@ -0,0 +1,1398 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// sqlDialect abstracts the SQL syntax differences between database backends.
+type sqlDialect interface {
+	// name identifies the dialect for humans.
+	name() string
+
+	// quoteIdent quotes a single table or column name.
+	quoteIdent(name string) string
+
+	// placeholder returns the n-th positional parameter, starting at 1.
+	placeholder(n int) string
+
+	// isDistinct compares two expressions, treating NULL as a comparable value.
+	isDistinct(a, b string) string
+
+	// setsInOrder reports if the assignments of an UPDATE are evaluated from
+	// left to right, each seeing the new values of the preceding ones.
+	setsInOrder() bool
+
+	// currentSchema is the expression of the connection's schema, restricting
+	// information_schema queries to the connected database.
+	currentSchema() string
+
+	// upsertClause follows an INSERT, overwriting cols of a row with the same key.
+	upsertClause(key string, cols []string) string
+
+	// serialKey is the column definition of an auto-incremented primary key.
+	serialKey() string
+
+	// tryLock queries if the session acquired the named lock, without waiting.
+	tryLock() string
+
+	// unlock releases the session's named lock.
+	unlock() string
+}
+
+// postgresDialect quotes identifiers in double quotes and numbers parameters.
+type postgresDialect struct{}
+
+func (postgresDialect) name() string {
+	return "postgresql"
+}
+
+func (postgresDialect) quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (postgresDialect) placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (postgresDialect) isDistinct(a, b string) string {
+	return a + " IS DISTINCT FROM " + b
+}
+
+func (postgresDialect) setsInOrder() bool {
+	return false
+}
+
+func (postgresDialect) currentSchema() string {
+	return "current_schema()"
+}
+
+func (d postgresDialect) upsertClause(key string, cols []string) string {
+	sets := make([]string, 0, len(cols))
+	for _, col := range cols {
+		sets = append(sets, d.quoteIdent(col)+" = EXCLUDED."+d.quoteIdent(col))
+	}
+	return "ON CONFLICT (" + d.quoteIdent(key) + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+func (postgresDialect) serialKey() string {
+	return "BIGSERIAL PRIMARY KEY"
+}
+
+func (postgresDialect) tryLock() string {
+	return "SELECT pg_try_advisory_lock(hashtext(?))"
+}
+
+func (postgresDialect) unlock() string {
+	return "SELECT pg_advisory_unlock(hashtext(?))"
+}
+
+// mysqlDialect quotes identifiers in backticks and uses anonymous parameters.
+type mysqlDialect struct{}
+
+func (mysqlDialect) name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (mysqlDialect) placeholder(int) string {
+	return "?"
+}
+
+func (mysqlDialect) isDistinct(a, b string) string {
+	return "NOT (" + a + " <=> " + b + ")"
+}
+
+func (mysqlDialect) setsInOrder() bool {
+	return true
+}
+
+func (mysqlDialect) currentSchema() string {
+	return "DATABASE()"
+}
+
+func (d mysqlDialect) upsertClause(_ string, cols []string) string {
+	sets := make([]string, 0, len(cols))
+	for _, col := range cols {
+		sets = append(sets, d.quoteIdent(col)+" = VALUES("+d.quoteIdent(col)+")")
+	}
+	return "ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+func (mysqlDialect) serialKey() string {
+	return "BIGINT AUTO_INCREMENT PRIMARY KEY"
+}
+
+func (mysqlDialect) tryLock() string {
+	return "SELECT COALESCE(GET_LOCK(?, 0), 0) = 1"
+}
+
+func (mysqlDialect) unlock() string {
+	return "SELECT RELEASE_LOCK(?)"
+}
+
+// sqlQueryIdentRe matches {table} and {table.column} identifiers in a query.
+var sqlQueryIdentRe = regexp.MustCompile(`\{([^{}.]+)(?:\.([^{}.]+))?\}`)
+
+// sqlQuery translates a query into the dialect's syntax.
+//
+// Within the query, identifiers are written in braces, e.g., {users} or
+// {users.name}, and replaced by their quoted form. Each ? is replaced by the
+// dialect's placeholder. Thus, queries must not contain ? within literals.
+func sqlQuery(dialect sqlDialect, query string) string {
+	query = sqlQueryIdentRe.ReplaceAllStringFunc(query, func(ident string) string {
+		parts := sqlQueryIdentRe.FindStringSubmatch(ident)
+		if parts[2] == "" {
+			return dialect.quoteIdent(parts[1])
+		}
+		return dialect.quoteIdent(parts[1]) + "." + dialect.quoteIdent(parts[2])
+	})
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(dialect.placeholder(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// sqlDB is a database connection together with its SQL dialect.
+type sqlDB struct {
+	*sql.DB
+	dialect sqlDialect
+
+	// readOnly connections are enforced to be read-only by the database itself.
+	readOnly bool
+}
+
+// begin starts a transaction, being read-only for readOnly connections.
+//
+// Once ctx is done, the transaction is rolled back.
+func (db *sqlDB) begin(ctx context.Context) (*sql.Tx, error) {
+	return db.BeginTx(ctx, &sql.TxOptions{ReadOnly: db.readOnly})
+}
+
+// query translates a query by sqlQuery for this database's dialect.
+func (db *sqlDB) query(query string) string {
+	return sqlQuery(db.dialect, query)
+}
+
+// setClause returns the SET clause of the assignments, also setting the
+// updated_at column as configured by the EnvUpdatedAt policy.
+//
+// Each assignment is a column and its new value expression. For the
+// UpdatedAtChanged policy, these are compared against the stored values,
+// requiring the caller to pass each ? argument of the assignments twice.
+func (db *sqlDB) setClause(assignments ...[2]string) string {
+	sets := make([]string, 0, len(assignments)+1)
+	for _, assignment := range assignments {
+		sets = append(sets, "{"+assignment[0]+"} = "+assignment[1])
+	}
+
+	col := "{" + cfg.updatedAtColumn + "}"
+	switch cfg.updatedAtPolicy {
+	case UpdatedAtAlways:
+		sets = append(sets, col+" = NOW()")
+
+	case UpdatedAtChanged:
+		conds := make([]string, 0, len(assignments))
+		for _, assignment := range assignments {
+			conds = append(conds, db.dialect.isDistinct("{"+assignment[0]+"}", assignment[1]))
+		}
+		touch := fmt.Sprintf("%s = CASE WHEN %s THEN NOW() ELSE %s END", col, strings.Join(conds, " OR "), col)
+
+		// The comparison must see the stored values, thus precede the assignments if these are applied in order.
+		if db.dialect.setsInOrder() {
+			sets = slices.Insert(sets, 0, touch)
+		} else {
+			sets = append(sets, touch)
+		}
+	}
+	return strings.Join(sets, ", ")
+}
+
+// sqlDialectFor returns the sqlDialect for an EnvDbDriver, defaulting to PostgreSQL.
+func sqlDialectFor(driver string) sqlDialect {
+	switch driver {
+	case DbDriverMysql:
+		return mysqlDialect{}
+	default:
+		return postgresDialect{}
+	}
+}
+
+// sqlDialer is a pq.Dialer based on a net.Dialer, e.g., to set its KeepAlive.
+type sqlDialer struct {
+	net.Dialer
+
+	// tlsConfig, if set, is negotiated by sqlStartTLS, see sqlTLSCustom.
+	tlsConfig *tls.Config
+}
+
+func (d *sqlDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, address)
+	return d.startTLS(conn, err, 0)
+}
+
+func (d *sqlDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, network, address)
+	return d.startTLS(conn, err, timeout)
+}
+
+// startTLS performs sqlStartTLS on a successfully dialed connection, if the
+// dialer has a tlsConfig.
+func (d *sqlDialer) startTLS(conn net.Conn, err error, timeout time.Duration) (net.Conn, error) {
+	if err != nil || d.tlsConfig == nil {
+		return conn, err
+	}
+
+	tlsConn, err := sqlStartTLS(conn, d.tlsConfig, timeout)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// sqlOpen establishes a connection to the configured database.
+//
+// The connection is verified by a ping, retried by dialRetry. For a readOnly
+// PostgreSQL connection, e.g., for a dry run, the session's
+// default_transaction_read_only is set. Thus, each accidental write fails
+// within the database, independent of this program's logic. For MySQL, only
+// the transactions are started read-only.
+func sqlOpen(readOnly bool) (db *sqlDB, err error) {
+	driver, err := cfg.sqlDriver()
+	if err != nil {
+		return
+	}
+	conn, err := sqlConnect(readOnly)
+	if err != nil {
+		return
+	}
+
+	if err = dialRetry("SQL", conn.Ping); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	db = &sqlDB{
+		DB:       conn,
+		dialect:  sqlDialectFor(driver),
+		readOnly: readOnly,
+	}
+	return
+}
+
+// sqlConnect creates the database handle for sqlOpen without connecting yet,
+// using the configured EnvDbDriver.
+func sqlConnect(readOnly bool) (conn *sql.DB, err error) {
+	driver, err := cfg.sqlDriver()
+	if err != nil {
+		return
+	}
+
+	switch driver {
+	case DbDriverMysql:
+		return sqlConnectMysql()
+	default:
+		return sqlConnectPostgres(readOnly, false)
+	}
+}
+
+// sqlOpenReplica establishes a read-only connection to the EnvDbReplicaHost
+// like sqlOpen, sharing all other settings of the primary database.
+func sqlOpenReplica() (db *sqlDB, err error) {
+	conn, err := sqlConnectPostgres(true, true)
+	if err != nil {
+		return
+	}
+
+	if err = dialRetry("SQL replica", conn.Ping); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	db = &sqlDB{
+		DB:       conn,
+		dialect:  sqlDialectFor(DbDriverPostgres),
+		readOnly: true,
+	}
+	return
+}
+
+// sqlConnectPostgres creates a PostgreSQL database handle for sqlConnect or,
+// for the replica, of the EnvDbReplicaHost.
+//
+// The connection parameters of the environment variables, e.g., DB_HOST, are
+// overridden by those of the EnvDbUrl and its service. A host starting with a
+// slash is the directory of a unix socket, as for libpq. The credentials are
+// the DB_USERNAME and DB_PASSWORD, if set, or those of the EnvVaultDbPath,
+// taking precedence. Without a password, lib/pq looks it up in the PGPASSFILE.
+func sqlConnectPostgres(readOnly, replica bool) (conn *sql.DB, err error) {
+	// Greenlight's PostgreSQL has no SSL enabled as it runs within a container
+	// network, thus EnvDbSslMode defaults to disable.
+	defaults := map[string]string{
+		"host":             os.Getenv("DB_HOST"),
+		"port":             os.Getenv("PORT"),
+		"dbname":           os.Getenv("DB_NAME"),
+		"sslmode":          cfg.dbSslMode,
+		"sslrootcert":      cfg.dbSslRootCert,
+		"sslcert":          cfg.dbSslCert,
+		"sslkey":           cfg.dbSslKey,
+		"search_path":      cfg.dbSearchPath,
+		"application_name": cfg.dbApplicationName,
+	}
+	dbUrl, err := configSecret(EnvDbUrl)
+	if err != nil {
+		return
+	}
+	urlOpts, err := sqlParseConnInfo(dbUrl)
+	if err != nil {
+		err = fmt.Errorf("cannot parse %s: %w", EnvDbUrl, err)
+		return
+	}
+	opts, err := sqlConnOpts(defaults, urlOpts)
+	if err != nil {
+		return
+	}
+	if replica {
+		opts["host"] = cfg.dbReplicaHost
+		opts["port"] = cmp.Or(cfg.dbReplicaPort, opts["port"])
+	}
+
+	// The driver cannot restrict its TLS, thus it is negotiated by the dialer.
+	var tlsConfig *tls.Config
+	if sqlTLSCustom() {
+		if tlsConfig, err = sqlTLSConfig(opts["host"]); err != nil {
+			return
+		}
+		opts["sslmode"] = DbSslModeDisable
+	}
+	if cfg.dbConnectTimeout > 0 {
+		opts["connect_timeout"] = strconv.Itoa(sqlConnectTimeoutSeconds())
+	}
+	opts["statement_timeout"] = strconv.FormatInt(cfg.sqlTimeout.Milliseconds(), 10)
+	if readOnly {
+		opts["default_transaction_read_only"] = "on"
+	}
+
+	connector := func(username, password string) (driver.Connector, error) {
+		connOpts := map[string]string{"user": username, "password": password}
+		for k, v := range opts {
+			connOpts[k] = v
+		}
+		if cfg.vaultDbPath != "" {
+			connOpts["user"], connOpts["password"] = username, password
+		}
+
+		connector, err := pq.NewConnector(sqlConnString(connOpts))
+		if err != nil {
+			return nil, err
+		}
+		connector.Dialer(&sqlDialer{Dialer: net.Dialer{KeepAlive: cfg.keepAlive}, tlsConfig: tlsConfig})
+		return connector, nil
+	}
+
+	// Verify the settings once, as sql.OpenDB only connects lazily.
+	username, password, err := sqlCredentials()
+	if err != nil {
+		return
+	}
+	if _, err = connector(username, password); err != nil {
+		return
+	}
+
+	conn = sql.OpenDB(&sqlSecretConnector{driver: &pq.Driver{}, connector: connector})
+	return
+}
+
+// sqlConnectTimeoutSeconds returns the EnvDbConnectTimeout in whole seconds,
+// rounded up, as PostgreSQL's connect_timeout.
+func sqlConnectTimeoutSeconds() int {
+	return int((cfg.dbConnectTimeout + time.Second - 1) / time.Second)
+}
+
+// sqlMysqlDriverName is the database/sql name of the MySQL driver, being
+// registered in builds with the mysql build tag.
+const sqlMysqlDriverName = "mysql"
+
+// sqlConnectMysql creates a MySQL or MariaDB database handle for sqlConnect.
+//
+// The statements are bounded by the EnvSqlTimeout as the driver's read and
+// write timeouts. PORT defaults to 3306.
+func sqlConnectMysql() (conn *sql.DB, err error) {
+	if !slices.Contains(sql.Drivers(), sqlMysqlDriverName) {
+		err = fmt.Errorf("this build lacks the %s %s, rebuild with -tags mysql", EnvDbDriver, DbDriverMysql)
+		return
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3306"
+	}
+
+	// sql.Open neither connects nor parses the DSN, only looking up the driver.
+	db, err := sql.Open(sqlMysqlDriverName, "")
+	if err != nil {
+		return
+	}
+	drv := db.Driver()
+	_ = db.Close()
+
+	connector := func(username, password string) (driver.Connector, error) {
+		dsn := fmt.Sprintf("%s:%s@tcp(%s)/%s?readTimeout=%s&writeTimeout=%s",
+			username, password,
+			net.JoinHostPort(os.Getenv("DB_HOST"), port), os.Getenv("DB_NAME"),
+			cfg.sqlTimeout, cfg.sqlTimeout)
+		if cfg.dbConnectTimeout > 0 {
+			dsn += fmt.Sprintf("&timeout=%ds", sqlConnectTimeoutSeconds())
+		}
+		if drvCtx, ok := drv.(driver.DriverContext); ok {
+			return drvCtx.OpenConnector(dsn)
+		}
+		return sqlDsnConnector{driver: drv, dsn: dsn}, nil
+	}
+	conn = sql.OpenDB(&sqlSecretConnector{driver: drv, connector: connector})
+	return
+}
+
+// sqlReadColumns are the users columns fetched by sqlFetchUsers.
+//
+// Besides the sqlWritableColumns, these include columns read as context only,
+// e.g., for comparisons or logging. Fetching a column never implies writing it.
+// The defaults are set by sqlUseSchema.
+var sqlReadColumns = sqlActiveSchema.readColumns
+
+// sqlWritableColumns are the only users columns sqlUpdateUser writes.
+//
+// https://docs.bigbluebutton.org/greenlight/gl-config.html#ldap-auth LDAP_ATTRIBUTE_MAPPING table
+var sqlWritableColumns = sqlActiveSchema.writableColumns
+
+// sqlSetWritableColumns replaces the sqlWritableColumns, e.g., by the columns
+// of EnvAttributeMap. All of them are added to the sqlReadColumns as well.
+func sqlSetWritableColumns(cols []string) {
+	sqlWritableColumns = nil
+	for _, col := range cols {
+		sqlAddWritableColumn(col)
+	}
+}
+
+// sqlAddWritableColumn adds a custom users column to both the sqlReadColumns
+// and the sqlWritableColumns, e.g., for EnvDepartmentColumn.
+func sqlAddWritableColumn(col string) {
+	if !slices.Contains(sqlReadColumns, col) {
+		sqlReadColumns = append(sqlReadColumns, col)
+	}
+	if !slices.Contains(sqlWritableColumns, col) {
+		sqlWritableColumns = append(sqlWritableColumns, col)
+	}
+}
+
+// sqlFetchUsers lists all LDAP users with their sqlReadColumns from the PostgreSQL database.
+//
+// Users are identified by their social_uid. As multiple rows might share the
+// same social_uid or username in a corrupted database, those are detected by
+// sqlFetchDuplicates and handled based on the configured EnvDuplicatePolicy.
+// NULL values are treated as empty.
+func sqlFetchUsers(ctx context.Context, db *sqlDB) (users map[string]map[string]string, err error) {
+	skipIds, err := sqlFetchDuplicates(ctx, db, cfg.users)
+	if err != nil {
+		return
+	}
+	users, _, err = sqlFetchUserBatch(ctx, db, cfg.users, "", 0, skipIds)
+	return
+}
+
+// sqlUserBatch is a batch of users sent by sqlFetchStream, or its error.
+type sqlUserBatch struct {
+	users map[string]map[string]string
+	err   error
+}
+
+// sqlFetchStream pages through the users of sqlFetchUserBatch in the
+// background, each batch retried by sqlRetry. While a batch is processed, the
+// next one is already fetched, but at most one is kept waiting, thus bounding
+// the memory use to two batches of the limit.
+//
+// Duplicates are detected by sqlFetchDuplicates before the first batch, thus
+// the EnvDuplicatePolicy applies to users of different batches as well.
+//
+// The channel is closed after the last batch or a failed one. Once ctx is
+// done, no further batch is fetched.
+func sqlFetchStream(ctx context.Context, db *sqlDB, uids []string, limit int) <-chan sqlUserBatch {
+	batches := make(chan sqlUserBatch, 1)
+	go func() {
+		defer close(batches)
+
+		var skipIds map[string]bool
+		if err := sqlRetry(ctx, func() (err error) {
+			skipIds, err = sqlFetchDuplicates(ctx, db, uids)
+			return
+		}); err != nil {
+			select {
+			case batches <- sqlUserBatch{err: err}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		for after := ""; ; {
+			var batch sqlUserBatch
+			var last string
+			batch.err = sqlRetry(ctx, func() (err error) {
+				batch.users, last, err = sqlFetchUserBatch(ctx, db, uids, after, limit, skipIds)
+				return
+			})
+
+			select {
+			case batches <- batch:
+			case <-ctx.Done():
+				return
+			}
+			if batch.err != nil || limit == 0 || last == "" {
+				return
+			}
+			after = last
+		}
+	}()
+	return batches
+}
+
+// sqlFetchUserBatch lists up to limit LDAP users like sqlFetchUsers, all for a
+// zero limit, being only the users of the uids, if set, e.g., the EnvUser
+// users. Rows are ordered by their id, starting after the passed one, if not
+// empty. The id of the batch's last row is returned as the next start,
+// being empty after the last batch.
+//
+// Users of the skipIds, e.g., by sqlFetchDuplicates, are left out. A user
+// sharing its social_uid with a previous row nonetheless, e.g., created since,
+// is logged and left out as well.
+//
+// Thus, the rows are paged through by their id, using the primary key's index
+// instead of an OFFSET rescanning the previous rows.
+func sqlFetchUserBatch(ctx context.Context, db *sqlDB, uids []string, after string, limit int, skipIds map[string]bool) (users map[string]map[string]string, last string, err error) {
+	ctx, span := traceStart(ctx, "sql.fetch", otlpSpanKindClient)
+	defer func() {
+		span.set("users", len(users))
+		span.finish(err)
+	}()
+
+	src, err := sqlFetchSource(uids)
+	if err != nil {
+		return
+	}
+	idExpr := src.colExpr("id")
+
+	selectCols := make([]string, 0, len(sqlReadColumns))
+	for _, col := range sqlReadColumns {
+		selectCols = append(selectCols, src.colExpr(col))
+	}
+
+	filter, args := src.filter, src.args
+	if after != "" {
+		filter += " AND " + idExpr + " > ?"
+		args = append(args, after)
+	}
+	limitClause := ""
+	if limit > 0 {
+		limitClause = "LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := db.QueryContext(ctx, db.query(`
+		SELECT
+			`+strings.Join(selectCols, ", ")+`,
+			COALESCE(`+src.roleExpr+`, '')
+		FROM
+			`+src.from+`
+		WHERE
+			`+filter+`
+		ORDER BY
+			`+idExpr+`
+		`+limitClause+`
+	`), args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	users = make(map[string]map[string]string)
+
+	for rows.Next() {
+		values := make([]sql.NullString, len(sqlReadColumns))
+		var role string
+
+		dest := make([]any, 0, len(values)+1)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		dest = append(dest, &role)
+
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+
+		userMap := make(map[string]string, len(values)+1)
+		for i, col := range sqlReadColumns {
+			userMap[col] = values[i].String
+		}
+		userMap["role"] = role
+		last = userMap["id"]
+
+		if skipIds[userMap["id"]] {
+			continue
+		}
+		socialUid := userMap["social_uid"]
+		if other, ok := users[socialUid]; ok {
+			log.WithFields(log.Fields{
+				"user": socialUid,
+				"ids":  []string{other["id"], userMap["id"]},
+			}).Error("Multiple SQL users share the same social_uid, skipping the later one")
+			continue
+		}
+
+		users[socialUid] = userMap
+	}
+	err = rows.Err()
+	return
+}
+
+// sqlUserSource is the selection of users fetched by sqlFetchUserBatch, being
+// either the users table or the wrapped EnvSqlFetchQuery.
+type sqlUserSource struct {
+	// colExpr returns the SQL expression of a logical users column.
+	colExpr func(string) string
+
+	roleExpr string
+	from     string
+	filter   string
+	args     []any
+}
+
+// sqlFetchSource returns the sqlUserSource of the synced users, being only the
+// users of the uids, if set.
+func sqlFetchSource(uids []string) (src sqlUserSource, err error) {
+	src = sqlUserSource{
+		colExpr:  sqlColumnExpr,
+		roleExpr: "{roles.name}",
+		from:     "{users} LEFT JOIN {roles} ON {roles.id} = {users.role_id}",
+		filter:   sqlActiveSchema.filter,
+	}
+
+	if cfg.sqlFetchQuery != "" {
+		// The operator-defined query is wrapped to apply the paging and EnvUser.
+		var fetchQuery string
+		if fetchQuery, src.args, err = sqlNamedQuery(cfg.sqlFetchQuery, sqlFetchQueryParams()); err != nil {
+			return
+		}
+		src.colExpr = func(col string) string { return "{" + sqlFetchQueryAlias + "." + col + "}" }
+		src.roleExpr = src.colExpr("role")
+		src.from = "(" + fetchQuery + ") AS {" + sqlFetchQueryAlias + "}"
+		src.filter = "1 = 1"
+	}
+
+	if len(uids) > 0 {
+		src.filter += " AND " + src.colExpr("social_uid") + " IN (?" + strings.Repeat(", ?", len(uids)-1) + ")"
+		for _, user := range uids {
+			src.args = append(src.args, user)
+		}
+	}
+	return
+}
+
+// sqlDuplicateColumns returns the logical users columns whose values must be
+// unique among the synced users: the social_uid and, if read and not the
+// EnvMatchColumn, the username.
+func sqlDuplicateColumns() []string {
+	cols := []string{"social_uid"}
+	if slices.Contains(sqlReadColumns, "username") && sqlColumnExpr("username") != sqlColumnExpr("social_uid") {
+		cols = append(cols, "username")
+	}
+	return cols
+}
+
+// sqlFetchDuplicates detects users of sqlFetchSource sharing the value of any
+// sqlDuplicateColumns, returning the ids of those not to be synced by the
+// EnvDuplicatePolicy: all of them for DuplicatePolicySkip, all but the lowest
+// id for DuplicatePolicyLowestId. Each duplicate value is logged as an error.
+func sqlFetchDuplicates(ctx context.Context, db *sqlDB, uids []string) (skipIds map[string]bool, err error) {
+	src, err := sqlFetchSource(uids)
+	if err != nil {
+		return
+	}
+	idExpr := src.colExpr("id")
+
+	skipIds = make(map[string]bool)
+	for _, col := range sqlDuplicateColumns() {
+		expr := src.colExpr(col)
+
+		var rows *sql.Rows
+		rows, err = db.QueryContext(ctx, db.query(`
+			SELECT
+				`+idExpr+`, `+expr+`
+			FROM
+				`+src.from+`
+			WHERE
+				`+src.filter+` AND `+expr+` IN (
+					SELECT `+expr+`
+					FROM `+src.from+`
+					WHERE `+src.filter+`
+					GROUP BY `+expr+`
+					HAVING COUNT(*) > 1
+				)
+			ORDER BY
+				`+expr+`, `+idExpr+`
+		`), slices.Concat(src.args, src.args)...)
+		if err != nil {
+			return
+		}
+
+		duplicates := make(map[string][]string)
+		var values []string
+		for rows.Next() {
+			var id, value string
+			if err = rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return
+			}
+			if _, ok := duplicates[value]; !ok {
+				values = append(values, value)
+			}
+			duplicates[value] = append(duplicates[value], id)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return
+		}
+
+		for _, value := range values {
+			ids := duplicates[value]
+			log.WithFields(log.Fields{
+				"column": col,
+				"user":   value,
+				"ids":    ids,
+				"policy": cfg.duplicatePolicy,
+			}).Error("Multiple SQL users share the same " + col)
+
+			// As rows are ordered by id, the first one is kept for DuplicatePolicyLowestId.
+			if cfg.duplicatePolicy == DuplicatePolicyLowestId {
+				ids = ids[1:]
+			}
+			for _, id := range ids {
+				skipIds[id] = true
+			}
+		}
+	}
+	return
+}
+
+// sqlUpdateUser updates the users table for all passed user attribute maps.
+//
+// Each map identifies its row by the id key, as fetched by sqlFetchUsers. Once
+// ctx is done, the transaction is aborted and rolled back.
+func sqlUpdateUser(ctx context.Context, db *sqlDB, userAttrs []map[string]string) (err error) {
+	defer func(start time.Time) { metrics.observeSqlUpdate(time.Since(start)) }(time.Now())
+
+	ctx, span := traceStart(ctx, "sql.update", otlpSpanKindClient)
+	span.set("users", len(userAttrs))
+	defer func() { span.finish(err) }()
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if cfg.sqlUpdateQuery != "" {
+		err = sqlUpdateUserQuery(ctx, db, tx, userAttrs)
+		return
+	}
+
+	cols := sqlWritableColumns
+	assignments := make([][2]string, 0, len(cols))
+	for _, col := range cols {
+		assignments = append(assignments, [2]string{col, "?"})
+	}
+
+	stmt, err := tx.PrepareContext(ctx, db.query(`
+		UPDATE
+			{users}
+		SET
+			`+db.setClause(assignments...)+`
+		WHERE
+			{id} = ?
+	`))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for _, userAttr := range userAttrs {
+		args := make([]any, 0, 2*len(cols)+1)
+		for _, col := range cols {
+			args = append(args, userAttr[col])
+		}
+		if cfg.updatedAtPolicy == UpdatedAtChanged {
+			args = append(args, args...)
+		}
+		args = append(args, userAttr["id"])
+
+		if _, err = stmt.ExecContext(ctx, args...); err != nil {
+			err = fmt.Errorf("cannot update user %s: %w", userAttr["id"], err)
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// sqlUpdateUserQuery updates the users within tx by the EnvSqlUpdateQuery for
+// sqlUpdateUser and commits it.
+//
+// As the parameters are fixed, the statement is prepared once, based on the
+// first user. EnvUpdatedAt is up to the query.
+func sqlUpdateUserQuery(ctx context.Context, db *sqlDB, tx *sql.Tx, userAttrs []map[string]string) (err error) {
+	if len(userAttrs) == 0 {
+		return tx.Commit()
+	}
+
+	query, _, err := sqlNamedQuery(cfg.sqlUpdateQuery, sqlUpdateQueryParams(userAttrs[0]))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", EnvSqlUpdateQuery, err)
+	}
+	stmt, err := tx.PrepareContext(ctx, db.query(query))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for _, userAttr := range userAttrs {
+		_, args, _ := sqlNamedQuery(cfg.sqlUpdateQuery, sqlUpdateQueryParams(userAttr))
+		if _, err = stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("cannot update user %s: %w", userAttr["id"], err)
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlUpdateUserChunked applies sqlUpdateUser sequentially in chunks of up to
+// size users, each being committed in its own transaction. Between two chunks,
+// the EnvSqlChunkDelay leaves the database to Greenlight's own traffic.
+//
+// The first failing chunk is rolled back and stops the update. The users of
+// all previously committed chunks are returned.
+func sqlUpdateUserChunked(ctx context.Context, db *sqlDB, userAttrs []map[string]string, size int) (committed []map[string]string, err error) {
+	for start := 0; start < len(userAttrs); start += size {
+		chunk := userAttrs[start:min(start+size, len(userAttrs))]
+
+		if start > 0 && cfg.sqlChunkDelay > 0 {
+			select {
+			case <-ctx.Done():
+				err = ctx.Err()
+				return
+			case <-time.After(cfg.sqlChunkDelay):
+			}
+		}
+
+		if err = sqlRetry(ctx, func() error { return sqlUpdateUser(ctx, db, chunk) }); err != nil {
+			return
+		}
+		committed = append(committed, chunk...)
+	}
+	return
+}
+
+// sqlRetriableCodeClasses are the PostgreSQL error classes considered
+// transient: connection exceptions, transaction rollbacks like serialization
+// failures or deadlocks, and operator interventions like a server restart.
+//
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+var sqlRetriableCodeClasses = []pq.ErrorClass{"08", "40", "57"}
+
+// sqlRetriable checks if an SQL error is transient and might succeed on retry.
+func sqlRetriable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return slices.Contains(sqlRetriableCodeClasses, pqErr.Code.Class()) &&
+			pqErr.Code != "57014" // query_canceled
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
+}
+
+// sqlRetry calls op, being a whole transaction, until it succeeds or fails
+// permanently, see sqlRetriable and opRetry. Once ctx is done, no further
+// attempt is made.
+func sqlRetry(ctx context.Context, op func() error) error {
+	err := opRetry("SQL", func() error {
+		if err := ctx.Err(); err != nil {
+			return permanentError{err}
+		}
+
+		err := op()
+		if err != nil && (ctx.Err() != nil || !sqlRetriable(err)) {
+			return permanentError{err}
+		}
+		return err
+	})
+
+	var permErr permanentError
+	if errors.As(err, &permErr) {
+		return permErr.error
+	}
+	return err
+}
+
+// sqlUpdateUserParallel applies sqlUpdateUser in parallel on up to workers connections.
+//
+// The userAttrs are split into one chunk per worker, each being applied in its
+// own transaction. Thus, unlike sqlUpdateUser, a failure only rolls back the
+// affected chunk while others might already be committed. The users of all
+// committed chunks are returned, together with all errors.
+func sqlUpdateUserParallel(ctx context.Context, db *sqlDB, userAttrs []map[string]string, workers int) (committed []map[string]string, err error) {
+	chunkSize := (len(userAttrs) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	for start := 0; start < len(userAttrs); start += chunkSize {
+		chunk := userAttrs[start:min(start+chunkSize, len(userAttrs))]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			chunkErr := sqlRetry(ctx, func() error {
+				return sqlUpdateUser(ctx, db, chunk)
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+			if chunkErr != nil {
+				errs = append(errs, chunkErr)
+			} else {
+				committed = append(committed, chunk...)
+			}
+		}()
+	}
+	wg.Wait()
+
+	err = errors.Join(errs...)
+	return
+}
+
+// sqlVerifyUsers reads the sqlWritableColumns of all passed users back and
+// returns each column whose stored value differs from the intended one.
+//
+// Such discrepancies indicate silently truncated values or triggers rewriting
+// them. In the returned attrChange, old is the intended and new the stored
+// value, while user is the id. NULL values are treated as empty.
+func sqlVerifyUsers(ctx context.Context, db *sqlDB, userAttrs []map[string]string) (mismatches []attrChange, err error) {
+	selectCols := make([]string, 0, len(sqlWritableColumns))
+	for _, col := range sqlWritableColumns {
+		selectCols = append(selectCols, "{"+col+"}")
+	}
+
+	stmt, err := db.PrepareContext(ctx, db.query(`
+		SELECT
+			`+strings.Join(selectCols, ", ")+`
+		FROM
+			{users}
+		WHERE
+			{id} = ?
+	`))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for _, userAttr := range userAttrs {
+		values := make([]sql.NullString, len(sqlWritableColumns))
+		dest := make([]any, 0, len(values))
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err = stmt.QueryRowContext(ctx, userAttr["id"]).Scan(dest...); err != nil {
+			return
+		}
+
+		for i, col := range sqlWritableColumns {
+			if values[i].String != userAttr[col] {
+				mismatches = append(mismatches, attrChange{userAttr["id"], col, userAttr[col], values[i].String})
+			}
+		}
+	}
+	return
+}
+
+// sqlDeactivateUsers soft deletes all users identified by the passed ids.
+//
+// This is the same flag Greenlight's admin panel sets when deleting a user, so
+// an administrator is able to restore those accounts later. Within the same
+// transaction, their rooms are handled following the EnvRoomPolicy and the
+// number of affected rooms is returned.
+func sqlDeactivateUsers(ctx context.Context, db *sqlDB, ids []string) (rooms int64, err error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	deactivate := sqlActiveSchema.deactivate
+	stmt, err := tx.PrepareContext(ctx, db.query(`
+		UPDATE
+			{users}
+		SET
+			`+db.setClause(deactivate)+`
+		WHERE
+			{id} = ?
+	`))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	var roomQuery string
+	var roomArgs []any
+	switch cfg.roomPolicy {
+	case RoomPolicyTransfer:
+		var ownerId string
+		if ownerId, err = sqlRoomOwnerId(ctx, tx, db); err != nil {
+			return
+		}
+		roomQuery, roomArgs = `UPDATE {rooms} SET {user_id} = ? WHERE {user_id} = ?`, []any{ownerId}
+
+	case RoomPolicyArchive:
+		roomQuery = `UPDATE {rooms} SET {deleted} = true WHERE {user_id} = ? AND NOT {deleted}`
+	}
+
+	var roomStmt *sql.Stmt
+	if roomQuery != "" {
+		if roomStmt, err = tx.PrepareContext(ctx, db.query(roomQuery)); err != nil {
+			return
+		}
+		defer roomStmt.Close()
+	}
+
+	for _, id := range ids {
+		if _, err = stmt.ExecContext(ctx, id); err != nil {
+			return
+		}
+
+		if roomStmt != nil {
+			var res sql.Result
+			if res, err = roomStmt.ExecContext(ctx, append(roomArgs, id)...); err != nil {
+				return
+			}
+			if n, nErr := res.RowsAffected(); nErr == nil {
+				rooms += n
+			}
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// sqlReactivateUsers reverts the soft deletion of all users identified by the
+// passed ids, e.g., of unlocked accounts deactivated for the
+// LockPolicyDeactivate. Rooms handled by the EnvRoomPolicy are not restored.
+func sqlReactivateUsers(ctx context.Context, db *sqlDB, ids []string) (err error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	reactivate := sqlActiveSchema.reactivate
+	stmt, err := tx.PrepareContext(ctx, db.query(`
+		UPDATE
+			{users}
+		SET
+			`+db.setClause(reactivate)+`
+		WHERE
+			{id} = ?
+	`))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		if _, err = stmt.ExecContext(ctx, id); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// sqlRoomOwnerId returns the id of the active EnvRoomOwner account, queried
+// by q, being either the database or a transaction.
+func sqlRoomOwnerId(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}, db *sqlDB) (ownerId string, err error) {
+	err = q.QueryRowContext(ctx, db.query(`
+		SELECT
+			{users.id}
+		FROM
+			{users}
+		WHERE
+			{users.email} = ? AND NOT `+sqlColumnExpr("deleted")+`
+	`), cfg.roomOwner).Scan(&ownerId)
+	if err != nil {
+		err = fmt.Errorf("cannot find the %s %s: %w", EnvRoomOwner, cfg.roomOwner, err)
+	}
+	return
+}
+
+// sqlRoleCache caches the roles table's ids by name, see sqlRoleIds.
+var sqlRoleCache struct {
+	sync.Mutex
+	ids     map[string]string
+	fetched time.Time
+}
+
+// sqlRoleIds returns the ids of all roles by their name.
+//
+// The roles are cached for the configured EnvRoleCacheTTL, as they rarely
+// change, but are refetched afterwards to pick up newly added roles. If
+// multiple roles share a name, the lowest id is used.
+func sqlRoleIds(ctx context.Context, db *sqlDB) (ids map[string]string, err error) {
+	sqlRoleCache.Lock()
+	defer sqlRoleCache.Unlock()
+
+	if sqlRoleCache.ids != nil && time.Since(sqlRoleCache.fetched) < cfg.roleCacheTTL {
+		ids = sqlRoleCache.ids
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, db.query(`
+		SELECT
+			{id}, {name}
+		FROM
+			{roles}
+		ORDER BY
+			{id}
+	`))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	ids = make(map[string]string)
+	for rows.Next() {
+		var id, name string
+		if err = rows.Scan(&id, &name); err != nil {
+			return
+		}
+		if _, ok := ids[name]; !ok {
+			ids[name] = id
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	log.WithField("roles", len(ids)).Debug("Fetched SQL roles")
+	sqlRoleCache.ids = ids
+	sqlRoleCache.fetched = time.Now()
+	return
+}
+
+// sqlUpdateUserRoles sets the role for all passed user ids to the mapped role name.
+//
+// Role names are resolved to their role_id by sqlRoleIds. Names unknown to
+// Greenlight's roles table are skipped rather than writing an invalid role_id.
+// Those users are returned in unknownRoles.
+func sqlUpdateUserRoles(ctx context.Context, db *sqlDB, userRoles map[string]string) (unknownRoles map[string]string, err error) {
+	roleIds, err := sqlRoleIds(ctx, db)
+	if err != nil {
+		return
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	stmt, err := tx.PrepareContext(ctx, db.query(`
+		UPDATE
+			{users}
+		SET
+			`+db.setClause([2]string{"role_id", "?"})+`
+		WHERE
+			{id} = ?
+	`))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	for id, role := range userRoles {
+		roleId, ok := roleIds[role]
+		if !ok {
+			if unknownRoles == nil {
+				unknownRoles = make(map[string]string)
+			}
+			unknownRoles[id] = role
+			continue
+		}
+
+		args := []any{roleId}
+		if cfg.updatedAtPolicy == UpdatedAtChanged {
+			args = append(args, roleId)
+		}
+		args = append(args, id)
+
+		if _, err = stmt.ExecContext(ctx, args...); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+// sqlMissingColumns returns those columns which do not exist in the table,
+// based on the information_schema. Only the connection's current schema is
+// considered, as other schemas or databases, e.g., of another Greenlight
+// instance, might contain a table of the same name.
+func sqlMissingColumns(ctx context.Context, db *sqlDB, table string, cols []string) (missing []string, err error) {
+	rows, err := db.QueryContext(ctx, db.query(`
+		SELECT
+			{column_name}
+		FROM
+			{information_schema.columns}
+		WHERE
+			{table_schema} = `+db.dialect.currentSchema()+` AND
+			{table_name} = ?
+	`), table)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var col string
+		if err = rows.Scan(&col); err != nil {
+			return
+		}
+		existing[col] = true
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	for _, col := range cols {
+		if !existing[col] {
+			missing = append(missing, col)
+		}
+	}
+	return
+}
+
+// sqlRequiredColumns are the columns per table used by any query.
+func sqlRequiredColumns() map[string][]string {
+	userCols := append(slices.Clone(sqlActiveSchema.requiredColumns), cfg.updatedAtColumn)
+	for _, col := range sqlReadColumns {
+		if _, ok := sqlActiveSchema.exprs[col]; !ok {
+			userCols = append(userCols, col)
+		}
+	}
+	tables := map[string][]string{
+		"users": userCols,
+		"roles": {"id", "name"},
+	}
+
+	// Rooms are only used for the EnvRoomPolicy, EnvDuplicateAccounts, and
+	// EnvSharedRooms.
+	roomCols := []string{"id", "user_id"}
+	if cfg.roomPolicy == RoomPolicyArchive {
+		roomCols = append(roomCols, "deleted")
+	}
+	if len(cfg.sharedRooms) > 0 {
+		roomCols = append(roomCols, sqlActiveSchema.roomUidColumn)
+		tables["shared_accesses"] = []string{"room_id", "user_id", "created_at", "updated_at"}
+	}
+	if cfg.roomPolicy != RoomPolicyKeep || cfg.duplicateAccounts == DuplicateAccountsMerge || len(cfg.sharedRooms) > 0 {
+		tables["rooms"] = roomCols
+	}
+	return tables
+}
+
+// sqlVerifyColumns checks that all sqlRequiredColumns exist, listing missing ones.
+func sqlVerifyColumns(ctx context.Context, db *sqlDB) error {
+	var missing []string
+	for table, cols := range sqlRequiredColumns() {
+		tableMissing, err := sqlMissingColumns(ctx, db, table, cols)
+		if err != nil {
+			return err
+		}
+		for _, col := range tableMissing {
+			missing = append(missing, table+"."+col)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSqlQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		postgres string
+		mysql    string
+	}{
+		{
+			"reserved word",
+			"SELECT {order} FROM {users} WHERE {id} = ?",
+			`SELECT "order" FROM "users" WHERE "id" = $1`,
+			"SELECT `order` FROM `users` WHERE `id` = ?",
+		},
+		{
+			"mixed case",
+			"UPDATE {users} SET {DisplayName} = ? WHERE {users.socialUid} = ?",
+			`UPDATE "users" SET "DisplayName" = $1 WHERE "users"."socialUid" = $2`,
+			"UPDATE `users` SET `DisplayName` = ? WHERE `users`.`socialUid` = ?",
+		},
+		{
+			"quote within identifier",
+			`SELECT {na"me}, {na` + "`" + `me} FROM {users}`,
+			`SELECT "na""me", "na` + "`" + `me" FROM "users"`,
+			"SELECT `na\"me`, `na``me` FROM `users`",
+		},
+		{
+			"no identifiers",
+			"SELECT 1",
+			"SELECT 1",
+			"SELECT 1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if query := sqlQuery(postgresDialect{}, test.query); query != test.postgres {
+				t.Errorf("postgres: sqlQuery() = %q, want %q", query, test.postgres)
+			}
+			if query := sqlQuery(mysqlDialect{}, test.query); query != test.mysql {
+				t.Errorf("mysql: sqlQuery() = %q, want %q", query, test.mysql)
+			}
+		})
+	}
+}
+
+func TestSqlSetClause(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect sqlDialect
+		policy  string
+		want    string
+	}{
+		{"postgres never", postgresDialect{}, UpdatedAtNever, `"name" = $1, "email" = $2`},
+		{"postgres always", postgresDialect{}, UpdatedAtAlways, `"name" = $1, "email" = $2, "updated_at" = NOW()`},
+		{
+			"postgres changed", postgresDialect{}, UpdatedAtChanged,
+			`"name" = $1, "email" = $2, "updated_at" = CASE WHEN "name" IS DISTINCT FROM $3 OR "email" IS DISTINCT FROM $4 THEN NOW() ELSE "updated_at" END`,
+		},
+		{"mysql always", mysqlDialect{}, UpdatedAtAlways, "`name` = ?, `email` = ?, `updated_at` = NOW()"},
+		{
+			// MySQL assigns from left to right, thus the stored values are only compared before.
+			"mysql changed", mysqlDialect{}, UpdatedAtChanged,
+			"`updated_at` = CASE WHEN NOT (`name` <=> ?) OR NOT (`email` <=> ?) THEN NOW() ELSE `updated_at` END, `name` = ?, `email` = ?",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) {
+				c.updatedAtPolicy = test.policy
+				c.updatedAtColumn = "updated_at"
+			})
+			db := &sqlDB{dialect: test.dialect}
+
+			clause := db.query(db.setClause([2]string{"name", "?"}, [2]string{"email", "?"}))
+			if clause != test.want {
+				t.Errorf("setClause() = %s, want %s", clause, test.want)
+			}
+		})
+	}
+}
+
+func TestSqlUpdateUserQuoting(t *testing.T) {
+	tests := []struct {
+		name    string
+		dialect sqlDialect
+		want    string
+	}{
+		{"postgres", postgresDialect{}, `UPDATE "users" SET "name" = $1, "username" = $2, "email" = $3, "image" = $4 WHERE "id" = $5`},
+		{"mysql", mysqlDialect{}, "UPDATE `users` SET `name` = ?, `username` = ?, `email` = ?, `image` = ? WHERE `id` = ?"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.updatedAtPolicy = UpdatedAtNever })
+			db, fake := newTestDB(t, test.dialect, nil)
+
+			err := sqlUpdateUser(context.Background(), db, []map[string]string{
+				{"id": "1", "social_uid": "alice", "name": "Alice", "username": "alice", "email": "alice@example.org", "image": ""},
+			})
+			if err != nil {
+				t.Fatalf("sqlUpdateUser() failed: %v", err)
+			}
+
+			queries := fake.executed()
+			if len(queries) != 1 {
+				t.Fatalf("executed %d statements, want 1", len(queries))
+			}
+			if query := strings.Join(strings.Fields(queries[0]), " "); query != test.want {
+				t.Errorf("query = %q, want %q", query, test.want)
+			}
+			if args := fake.statements[0].args; len(args) != 5 || args[0] != "Alice" || args[4] != "1" {
+				t.Errorf("args = %v, want the values followed by the id", args)
+			}
+			if fake.commits != 1 {
+				t.Errorf("commits = %d, want 1", fake.commits)
+			}
+		})
+	}
+}
+
+// testUserAttrs creates n synthetic users with all updated columns.
+func testUserAttrs(n int) []map[string]string {
+	users := make([]map[string]string, 0, n)
+	for i := range n {
+		id := strconv.Itoa(i + 1)
+		users = append(users, map[string]string{"id": id, "name": "User " + id, "username": "user" + id, "email": "user" + id + "@example.org", "image": ""})
+	}
+	return users
+}
+
+func TestSqlUpdateUserParallel(t *testing.T) {
+	tests := []struct {
+		name      string
+		users     int
+		workers   int
+		failId    string
+		committed int
+	}{
+		{"all committed", 10, 4, "", 10},
+		{"fewer users than workers", 2, 4, "", 2},
+		{"failed chunk", 12, 3, "6", 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.updatedAtPolicy = UpdatedAtNever })
+			db, fake := newTestDB(t, postgresDialect{}, func(_ string, args []driver.Value) (fakeRows, error) {
+				if len(args) > 0 && args[len(args)-1] == test.failId {
+					return fakeRows{}, errors.New("violates check constraint")
+				}
+				return fakeRows{}, nil
+			})
+
+			committed, err := sqlUpdateUserParallel(context.Background(), db, testUserAttrs(test.users), test.workers)
+			if (err != nil) != (test.failId != "") {
+				t.Errorf("sqlUpdateUserParallel() error = %v, want failure %v", err, test.failId != "")
+			}
+			if len(committed) != test.committed {
+				t.Errorf("committed %d users, want %d", len(committed), test.committed)
+			}
+			for _, userAttr := range committed {
+				if userAttr["id"] == test.failId {
+					t.Errorf("committed the failed user %s", test.failId)
+				}
+			}
+			if test.failId != "" && fake.rollbacks != 1 {
+				t.Errorf("rollbacks = %d, want 1 for the failed chunk", fake.rollbacks)
+			}
+		})
+	}
+}
+
+// BenchmarkSqlUpdateUser compares the serial single-transaction update with
+// the parallel one for a large synthetic dataset. Each statement takes a
+// simulated round trip to the database.
+func BenchmarkSqlUpdateUser(b *testing.B) {
+	const roundTrip = 20 * time.Microsecond
+	users := testUserAttrs(5000)
+
+	testConfig(b, func(c *config) { c.updatedAtPolicy = UpdatedAtNever })
+	db, fake := newTestDB(b, postgresDialect{}, func(string, []driver.Value) (fakeRows, error) {
+		time.Sleep(roundTrip)
+		return fakeRows{}, nil
+	})
+	fake.discard = true
+
+	b.Run("serial", func(b *testing.B) {
+		for range b.N {
+			if err := sqlUpdateUser(context.Background(), db, users); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, workers := range []int{2, 4, 8} {
+		b.Run(fmt.Sprintf("parallel-%d", workers), func(b *testing.B) {
+			for range b.N {
+				if _, err := sqlUpdateUserParallel(context.Background(), db, users, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// testDuplicateRows are the users rows of TestSqlFetchUsersDuplicates by id:
+// alice shares her social_uid, bob his username, and eve's second row is
+// created after the duplicates were detected.
+var testDuplicateRows = [][2]string{
+	{"1", "alice"}, {"2", "alice"},
+	{"3", "bob"}, {"4", "carol"},
+	{"5", "dave"},
+	{"6", "eve"}, {"7", "eve"},
+}
+
+// testDuplicateHandler answers the queries of sqlFetchDuplicates and
+// sqlFetchUsers with the testDuplicateRows.
+func testDuplicateHandler(query string, _ []driver.Value) (fakeRows, error) {
+	switch {
+	case strings.Contains(query, "HAVING") && strings.Contains(query, `"users"."social_uid" IN (`):
+		return fakeRows{[]string{"id", "social_uid"}, [][]driver.Value{{"1", "alice"}, {"2", "alice"}}}, nil
+	case strings.Contains(query, "HAVING") && strings.Contains(query, `"users"."username" IN (`):
+		return fakeRows{[]string{"id", "username"}, [][]driver.Value{{"3", "bob"}, {"4", "bob"}}}, nil
+	case strings.Contains(query, "HAVING"):
+		return fakeRows{}, fmt.Errorf("unexpected duplicates query %q", query)
+	}
+
+	rows := fakeRows{columns: append(slices.Clone(sqlReadColumns), "role")}
+	for _, row := range testDuplicateRows {
+		id, uid := row[0], row[1]
+		username := uid
+		if id == "4" {
+			username = "bob"
+		}
+		values := make([]driver.Value, 0, len(rows.columns))
+		for _, col := range sqlReadColumns {
+			switch col {
+			case "id":
+				values = append(values, id)
+			case "social_uid":
+				values = append(values, uid)
+			case "username":
+				values = append(values, username)
+			default:
+				values = append(values, nil)
+			}
+		}
+		rows.rows = append(rows.rows, append(values, "user"))
+	}
+	return rows, nil
+}
+
+func TestSqlFetchUsersDuplicates(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   map[string]string
+	}{
+		{DuplicatePolicySkip, map[string]string{"dave": "5", "eve": "6"}},
+		{DuplicatePolicyLowestId, map[string]string{"alice": "1", "bob": "3", "dave": "5", "eve": "6"}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.duplicatePolicy = test.policy })
+			db, _ := newTestDB(t, postgresDialect{}, testDuplicateHandler)
+
+			users, err := sqlFetchUsers(context.Background(), db)
+			if err != nil {
+				t.Fatalf("sqlFetchUsers() failed: %v", err)
+			}
+
+			ids := make(map[string]string, len(users))
+			for uid, user := range users {
+				ids[uid] = user["id"]
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(test.want) {
+				t.Errorf("sqlFetchUsers() = %v, want %v", ids, test.want)
+			}
+		})
+	}
+}
+
+func TestSqlUpdateUserReadOnlyColumns(t *testing.T) {
+	tests := []struct {
+		name     string
+		readOnly []string
+		want     []string
+	}{
+		{"default columns", nil, []string{"name", "username", "email", "image"}},
+		{"activity counter", []string{"signin_count"}, []string{"name", "username", "email", "image"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.updatedAtPolicy = UpdatedAtNever })
+			readColumns := sqlReadColumns
+			sqlReadColumns = append(slices.Clone(sqlReadColumns), test.readOnly...)
+			t.Cleanup(func() { sqlReadColumns = readColumns })
+			db, fake := newTestDB(t, postgresDialect{}, nil)
+
+			// The user is updated with all of its fetched columns.
+			userAttr := make(map[string]string, len(sqlReadColumns))
+			for _, col := range sqlReadColumns {
+				userAttr[col] = col + " value"
+			}
+			userAttr["id"] = "1"
+			if err := sqlUpdateUser(context.Background(), db, []map[string]string{userAttr}); err != nil {
+				t.Fatalf("sqlUpdateUser() failed: %v", err)
+			}
+
+			query := strings.Join(strings.Fields(fake.executed()[0]), " ")
+			set, _, _ := strings.Cut(strings.TrimPrefix(query, `UPDATE "users" SET `), " WHERE ")
+			var cols []string
+			for _, assignment := range strings.Split(set, ", ") {
+				col, _, _ := strings.Cut(assignment, " = ")
+				cols = append(cols, strings.Trim(col, `"`))
+			}
+			if !slices.Equal(cols, test.want) {
+				t.Errorf("query %q updates %v, want only %v", query, cols, test.want)
+			}
+		})
+	}
+}
+
+func TestSqlVerifyColumns(t *testing.T) {
+	tests := []struct {
+		name    string
+		missing []string
+		want    string
+	}{
+		{"all columns exist", nil, ""},
+		{"renamed column", []string{"users.username"}, "missing columns: users.username"},
+		{"multiple tables", []string{"users.image", "roles.name", "users.email"},
+			"missing columns: roles.name, users.email, users.image"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The introspection lists all required columns but the missing ones.
+			required := sqlRequiredColumns()
+			db, _ := newTestDB(t, postgresDialect{}, func(query string, args []driver.Value) (fakeRows, error) {
+				if !strings.Contains(query, `"information_schema"."columns"`) || len(args) != 1 {
+					return fakeRows{}, fmt.Errorf("unexpected query %q", query)
+				}
+				table := args[0].(string)
+				rows := fakeRows{columns: []string{"column_name"}}
+				for _, col := range required[table] {
+					if !slices.Contains(test.missing, table+"."+col) {
+						rows.rows = append(rows.rows, []driver.Value{col})
+					}
+				}
+				return rows, nil
+			})
+
+			err := sqlVerifyColumns(context.Background(), db)
+			if test.want == "" && err != nil {
+				t.Errorf("sqlVerifyColumns() failed: %v", err)
+			} else if test.want != "" && (err == nil || err.Error() != test.want) {
+				t.Errorf("sqlVerifyColumns() error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestSqlReadOnlyWrites(t *testing.T) {
+	writes := []struct {
+		name  string
+		write func(db *sqlDB) error
+	}{
+		{"update", func(db *sqlDB) error {
+			return sqlUpdateUser(context.Background(), db, testUserAttrs(1))
+		}},
+		{"deactivate", func(db *sqlDB) error {
+			_, err := sqlDeactivateUsers(context.Background(), db, []string{"1"})
+			return err
+		}},
+		{"reactivate", func(db *sqlDB) error {
+			return sqlReactivateUsers(context.Background(), db, []string{"1"})
+		}},
+	}
+	for _, write := range writes {
+		for _, readOnly := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/read-only %v", write.name, readOnly), func(t *testing.T) {
+				testConfig(t, func(c *config) { c.updatedAtPolicy = UpdatedAtNever })
+				db, fake := newTestDB(t, postgresDialect{}, nil)
+				db.readOnly = readOnly
+
+				err := write.write(db)
+				if failed := err != nil; failed != readOnly {
+					t.Fatalf("%s error = %v, want failure %v", write.name, err, readOnly)
+				}
+				if readOnly && !strings.Contains(err.Error(), "read-only transaction") {
+					t.Errorf("%s error = %v, want a read-only transaction error", write.name, err)
+				}
+				for _, txReadOnly := range fake.readOnly {
+					if txReadOnly != readOnly {
+						t.Errorf("transactions read-only = %v, want %v", fake.readOnly, readOnly)
+						break
+					}
+				}
+				if readOnly && fake.commits != 0 {
+					t.Errorf("commits = %d, want none", fake.commits)
+				}
+			})
+		}
+	}
+}
+
+// testRoles answers the roles query of sqlRoleIds, with two roles sharing the
+// name user.
+func testRoles(query string, _ []driver.Value) (fakeRows, error) {
+	if !strings.Contains(strings.Join(strings.Fields(query), " "), `FROM "roles"`) {
+		return fakeRows{}, nil
+	}
+	return fakeRows{[]string{"id", "name"}, [][]driver.Value{
+		{"1", "admin"}, {"2", "user"}, {"3", "user"}, {"4", "denied"},
+	}}, nil
+}
+
+// testRoleCache resets the sqlRoleCache before and after a test.
+func testRoleCache(t testing.TB) {
+	t.Helper()
+	sqlRoleCache.ids = nil
+	t.Cleanup(func() { sqlRoleCache.ids = nil })
+}
+
+func TestSqlUpdateUserRoles(t *testing.T) {
+	tests := []struct {
+		name      string
+		userRoles map[string]string
+		updates   map[string]string
+		unknown   map[string]string
+	}{
+		{"known roles", map[string]string{"10": "admin", "11": "user"}, map[string]string{"10": "1", "11": "2"}, nil},
+		{"unknown role", map[string]string{"10": "moderator"}, map[string]string{}, map[string]string{"10": "moderator"}},
+		{"mixed roles", map[string]string{"10": "moderator", "11": "denied"}, map[string]string{"11": "4"}, map[string]string{"10": "moderator"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.updatedAtPolicy = UpdatedAtNever })
+			testRoleCache(t)
+			db, fake := newTestDB(t, postgresDialect{}, testRoles)
+
+			unknown, err := sqlUpdateUserRoles(context.Background(), db, test.userRoles)
+			if err != nil {
+				t.Fatalf("sqlUpdateUserRoles() failed: %v", err)
+			}
+			if !maps.Equal(unknown, test.unknown) {
+				t.Errorf("unknownRoles = %v, want %v", unknown, test.unknown)
+			}
+
+			updates := make(map[string]string)
+			for _, statement := range fake.statements {
+				if strings.Contains(statement.query, "UPDATE") {
+					updates[statement.args[1].(string)] = statement.args[0].(string)
+				}
+			}
+			if !maps.Equal(updates, test.updates) {
+				t.Errorf("written role_ids = %v, want %v", updates, test.updates)
+			}
+		})
+	}
+}
+
+func TestSqlRoleIdsCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		fetches int
+	}{
+		{"cached", time.Hour, 1},
+		{"expired", 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.roleCacheTTL = test.ttl })
+			testRoleCache(t)
+			db, fake := newTestDB(t, postgresDialect{}, testRoles)
+
+			for range 2 {
+				ids, err := sqlRoleIds(context.Background(), db)
+				if err != nil {
+					t.Fatalf("sqlRoleIds() failed: %v", err)
+				}
+				if want := map[string]string{"admin": "1", "user": "2", "denied": "4"}; !maps.Equal(ids, want) {
+					t.Errorf("sqlRoleIds() = %v, want %v", ids, want)
+				}
+			}
+			if fetches := len(fake.executed()); fetches != test.fetches {
+				t.Errorf("fetched the roles %d times, want %d", fetches, test.fetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DepartmentSourceDN derives the department from the organizational units of
+// the user's DN instead of an attribute. Its colon cannot be part of an
+// attribute name, thus an attribute named dn remains usable.
+const DepartmentSourceDN = ":dn"
+
+// ldapDNDepartment returns the path of all ou RDNs of a DN, from the top down.
+//
+// For example, "uid=alice,ou=Backend,ou=Engineering,dc=example,dc=org" results
+// in "Engineering/Backend". Escaped characters, e.g., a comma within an RDN
+// value, are unescaped by ldap.ParseDN.
+func ldapDNDepartment(dn string) (department string, err error) {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return
+	}
+
+	var ous []string
+	for _, rdn := range parsed.RDNs {
+		for _, attr := range rdn.Attributes {
+			if strings.EqualFold(attr.Type, "ou") {
+				ous = append(ous, attr.Value)
+			}
+		}
+	}
+	slices.Reverse(ous)
+
+	department = strings.Join(ous, "/")
+	return
+}
+
+// ldapDepartment extracts the department of an entry based on the configured
+// EnvDepartmentSource, either as an attribute or from the DN.
+func ldapDepartment(entry *ldap.Entry) (string, error) {
+	if cfg.departmentSource == DepartmentSourceDN {
+		return ldapDNDepartment(entry.DN)
+	}
+	return entry.GetAttributeValue(cfg.departmentSource), nil
+}
@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestLdapDNDepartment(t *testing.T) {
+	tests := []struct {
+		dn         string
+		department string
+		wantErr    bool
+	}{
+		{"uid=alice,ou=Backend,ou=Engineering,dc=example,dc=org", "Engineering/Backend", false},
+		{`uid=alice,ou=Sales\, Marketing,dc=example,dc=org`, "Sales, Marketing", false},
+		{`uid=alice,ou=R\2CD,ou=Labs,dc=example,dc=org`, "Labs/R,D", false},
+		{"uid=alice,OU=People,dc=example,dc=org", "People", false},
+		{"uid=alice,dc=example,dc=org", "", false},
+		{"uid=alice,ou", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.dn, func(t *testing.T) {
+			department, err := ldapDNDepartment(test.dn)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ldapDNDepartment() error = %v, want failure %v", err, test.wantErr)
+			}
+			if department != test.department {
+				t.Errorf("ldapDNDepartment() = %q, want %q", department, test.department)
+			}
+		})
+	}
+}
+
+func TestLdapUserSearchDepartment(t *testing.T) {
+	const dn = `uid=alice,ou=Sales\, Marketing,ou=Europe,dc=example,dc=org`
+	tests := []struct {
+		name       string
+		source     string
+		attrs      map[string]string
+		department string
+	}{
+		{"attribute", "department", map[string]string{"department": "Research"}, "Research"},
+		{"absent attribute", "department", map[string]string{"cn": "Alice"}, ""},
+		{"DN", DepartmentSourceDN, map[string]string{"department": "Research"}, "Europe/Sales, Marketing"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", "")
+			t.Setenv("LDAP_FILTER", "")
+			testConfig(t, func(c *config) {
+				c.matchAttribute = "uid"
+				c.departmentColumn = "department"
+				c.departmentSource = test.source
+			})
+
+			conn := fakeLdap{func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+				return &ldap.SearchResult{Entries: []*ldap.Entry{testEntry(dn, test.attrs)}}, nil
+			}}
+
+			ldapUsr, err := ldapUserSearch(context.Background(), conn, "alice", false)
+			if err != nil {
+				t.Fatalf("ldapUserSearch() failed: %v", err)
+			}
+			if department, ok := ldapUsr.attrs["department"]; department != test.department || ok != (test.department != "") {
+				t.Errorf("department = %q, want %q", department, test.department)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// desiredUser is a user's desired state in the export-desired snapshot.
+type desiredUser struct {
+	Uid        string            `json:"uid"`
+	Dn         string            `json:"dn"`
+	Attributes map[string]string `json:"attributes"`
+	Role       string            `json:"role,omitempty"`
+	Disabled   bool              `json:"disabled,omitempty"`
+	Locked     bool              `json:"locked,omitempty"`
+}
+
+// ldapListUids lists the EnvMatchAttribute values of all users within the
+// bases and the LDAP_FILTER, sorted and without duplicates.
+func ldapListUids(conn ldapSearcher) (uids []string, err error) {
+	uidAttr := cfg.matchAttribute
+
+	for _, base := range ldapBases() {
+		searchReq := ldap.NewSearchRequest(
+			base.dn,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+			false,
+			fmt.Sprintf("(&%s%s%s)", ldapUidPresentFilter(), ldapFilter(), base.filter),
+			[]string{uidAttr},
+			nil)
+
+		var searchResp *ldap.SearchResult
+		if searchResp, err = ldapSearch(conn, searchReq); err != nil {
+			return
+		}
+		for _, entry := range searchResp.Entries {
+			if entryUids := ldapEntryUids(entry); len(entryUids) > 0 && entryUids[0] != "" {
+				uids = append(uids, entryUids[0])
+			}
+		}
+	}
+
+	sort.Strings(uids)
+	return slices.Compact(uids), nil
+}
+
+// exportDesired writes the desired state of all LDAP users within the synced
+// scope as JSON, ordered by their uid, for the export-desired command. The
+// database is not accessed.
+//
+// Each user's attributes are the mapped and canonicalized values of the
+// sqlWritableColumns, as compared by a sync. Its role is resolved by the
+// EnvRoleMap and EnvAdminGroup, if configured, but without a current role,
+// thus EnvAdminDemote is not reflected. Opted out users are omitted. A failed
+// lookup of any user fails the whole export, as a partial snapshot would show
+// spurious differences.
+func exportDesired(ctx context.Context, w io.Writer) error {
+	conns, err := ldapOpenPool(cfg.concurrency)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	defer ldapReferralClose()
+
+	var scope syncScope
+	if len(cfg.includeGroups)+len(cfg.excludeGroups) > 0 {
+		if scope, err = ldapLoadScope(conns[0]); err != nil {
+			return fmt.Errorf("cannot fetch LDAP groups limiting the sync: %w", err)
+		}
+	}
+
+	uids, err := ldapListUids(conns[0])
+	if err != nil {
+		return fmt.Errorf("cannot list LDAP users: %w", err)
+	}
+
+	withGroups := ldapWithGroups()
+	users := make([]desiredUser, 0, len(uids))
+	for i, result := range ldapUserSearchAll(ctx, conns, uids, withGroups) {
+		uid, ldapUsr := uids[i], result.usr
+		if errors.Is(result.err, errLdapUserMissing) {
+			// The entry was removed since listing the users.
+			continue
+		} else if result.err != nil {
+			return fmt.Errorf("cannot look up LDAP user %s: %w", uid, result.err)
+		}
+		if ldapUsr.optOut || !scope.allows(uid, ldapUsr) {
+			continue
+		}
+
+		canonicalizeAttrs(uid, ldapUsr.attrs)
+		if cfg.clearOnEmpty {
+			for col := range ldapUsr.empty {
+				ldapUsr.attrs[col] = ""
+			}
+		}
+		attrApplyCleared(ldapUsr.attrs)
+		attrs := make(map[string]string)
+		for col, v := range ldapUsr.attrs {
+			if slices.Contains(sqlWritableColumns, col) {
+				attrs[col] = v
+			}
+		}
+
+		var role string
+		if len(cfg.roleMap) > 0 {
+			role = resolveRole(cfg.roleMap, cfg.roleDefault, ldapUsr.groups)
+		}
+		if cfg.adminGroup != "" {
+			role = adminGroupRole(ldapUsr.groups, "", role)
+		}
+
+		users = append(users, desiredUser{
+			Uid:        uid,
+			Dn:         ldapUsr.dn,
+			Attributes: attrs,
+			Role:       role,
+			Disabled:   ldapUsr.disabled,
+			Locked:     ldapUsr.locked,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(users)
+}
+
+// exportDesiredRun performs the export-desired command, writing to path or,
+// if empty or "-", to stdout.
+func exportDesiredRun(path string) error {
+	if path == "" || path == "-" {
+		return exportDesired(context.Background(), os.Stdout)
+	}
+
+	f, err := createOutputFile(path, false)
+	if err != nil {
+		return err
+	}
+	if err = exportDesired(context.Background(), f); err != nil {
+		_ = f.Abort()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,260 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// doctorSampleSize is the number of users whose LDAP entries are inspected.
+const doctorSampleSize = 20
+
+// doctor diagnoses the database schema and the attribute mapping, printing a
+// report like validateOnly with actionable hints.
+//
+// Besides the connectivity, it detects the Greenlight version of the schema,
+// the providers of the stored users, and inspects the LDAP entries of up to
+// doctorSampleSize users for values of each written column. True is returned
+// if no check failed.
+func doctor(w io.Writer, cfgErr error) bool {
+	var db *sqlDB
+	var conn ldapSearcher
+	defer func() {
+		if db != nil {
+			db.Close()
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	checks := []validateCheck{
+		{"configuration", func() (string, error) {
+			return "", cfgErr
+		}},
+		{"database connection", func() (_ string, err error) {
+			db, err = sqlOpen(true)
+			return
+		}},
+		{"Greenlight version", func() (string, error) {
+			if db == nil {
+				return "", fmt.Errorf("no database connection")
+			}
+			return doctorSchemaVersion(db)
+		}},
+		{"database tables and columns", func() (string, error) {
+			if db == nil {
+				return "", fmt.Errorf("no database connection")
+			}
+			if err := sqlVerifyColumns(context.Background(), db); err != nil {
+				return "", fmt.Errorf("%w; check %s, %s, and %s", err, EnvSchema, EnvAttributeMap, EnvUpdatedAtColumn)
+			}
+			return "", nil
+		}},
+		{"user providers", func() (string, error) {
+			if db == nil {
+				return "", fmt.Errorf("no database connection")
+			}
+			return doctorProviders(db)
+		}},
+		{"mapped columns", func() (string, error) {
+			return doctorMappedColumns(), nil
+		}},
+		{"LDAP connection and bind", func() (_ string, err error) {
+			conn, err = ldapOpen()
+			return
+		}},
+		{fmt.Sprintf("LDAP attributes of up to %d sample users", doctorSampleSize), func() (string, error) {
+			if db == nil || conn == nil {
+				return "", fmt.Errorf("no database or LDAP connection")
+			}
+			return doctorSampleUsers(db, conn)
+		}},
+	}
+
+	passed := validateReport(w, checks)
+	if passed {
+		fmt.Fprintln(w, "Diagnostics passed")
+	} else {
+		fmt.Fprintln(w, "Diagnostics found problems")
+	}
+	return passed
+}
+
+// doctorSchemaVersion compares the configured EnvSchema to the Greenlight
+// version detected by sqlDetectSchemas.
+func doctorSchemaVersion(db *sqlDB) (warning string, err error) {
+	detected, err := sqlDetectSchemas(context.Background(), db)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case len(detected) == 0:
+		err = fmt.Errorf("the users table matches no Greenlight version; check the DB_* settings and SYNC_DB_SEARCH_PATH")
+	case !slices.Contains(detected, cfg.schema):
+		err = fmt.Errorf("the users table looks like Greenlight %s, but %s is %s; set %s=%s",
+			detected[0], EnvSchema, cfg.schema, EnvSchema, detected[0])
+	case len(detected) > 1:
+		warning = fmt.Sprintf("the users table has columns of multiple Greenlight versions, using %s=%s", EnvSchema, cfg.schema)
+	}
+	return
+}
+
+// doctorProviders counts the users per provider, warning if none of them is
+// of the EnvProviders.
+func doctorProviders(db *sqlDB) (warning string, err error) {
+	rows, err := db.Query(db.query(`
+		SELECT
+			COALESCE({provider}, ''), COUNT(*)
+		FROM
+			{users}
+		GROUP BY
+			{provider}
+		ORDER BY
+			{provider}
+	`))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	var counts []string
+	synced := 0
+	for rows.Next() {
+		var provider string
+		var count int
+		if err = rows.Scan(&provider, &count); err != nil {
+			return
+		}
+		counts = append(counts, fmt.Sprintf("%q (%d)", provider, count))
+		if slices.Contains(sqlActiveSchema.providers, provider) {
+			synced += count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if synced == 0 {
+		warning = fmt.Sprintf("no users of the providers %s, but of %s; check %s",
+			strings.Join(sqlActiveSchema.providers, ", "), strings.Join(counts, ", "), EnvProviders)
+	}
+	return
+}
+
+// doctorMappedColumns warns about columns configured for canonicalizers,
+// policies, or templates, but not being written.
+func doctorMappedColumns() string {
+	settings := map[string][]string{}
+	for col := range cfg.canonicalize {
+		settings[EnvCanonicalize] = append(settings[EnvCanonicalize], col)
+	}
+	for col := range cfg.attributePolicy {
+		settings[EnvAttributePolicy] = append(settings[EnvAttributePolicy], col)
+	}
+	for col := range cfg.clearedPolicy {
+		settings[EnvClearedPolicy] = append(settings[EnvClearedPolicy], col)
+	}
+	for col := range cfg.attributeTemplate {
+		settings[EnvAttributeTemplate] = append(settings[EnvAttributeTemplate], col)
+	}
+
+	var warnings []string
+	for _, key := range []string{EnvCanonicalize, EnvAttributePolicy, EnvClearedPolicy, EnvAttributeTemplate} {
+		cols := settings[key]
+		sort.Strings(cols)
+		for _, col := range cols {
+			if !slices.Contains(sqlWritableColumns, col) {
+				warnings = append(warnings, fmt.Sprintf("%s configures the column %s, which is not written; add it to %s", key, col, EnvAttributeMap))
+			}
+		}
+	}
+	return strings.Join(warnings, "; ")
+}
+
+// doctorSampleUsers searches the first doctorSampleSize users in LDAP,
+// checking that each written column's LDAP attributes are returned.
+func doctorSampleUsers(db *sqlDB, conn ldapSearcher) (warning string, err error) {
+	ctx := context.Background()
+	users, _, err := sqlFetchUserBatch(ctx, db, cfg.users, "", doctorSampleSize, nil)
+	if err != nil {
+		return
+	} else if len(users) == 0 {
+		warning = fmt.Sprintf("no users to sample; check %s and %s", EnvProviders, EnvMatchColumn)
+		return
+	}
+
+	attrMap, err := ldapAttrMapping()
+	if err != nil {
+		return
+	}
+	sources := make(map[string][]string)
+	for intermediate, attrs := range attrMap {
+		if col, ok := ldapColumn(intermediate); ok {
+			sources[col] = append(sources[col], attrs...)
+		}
+	}
+
+	withGroups := len(cfg.roleMap)+len(cfg.sharedRooms) > 0 || len(cfg.includeGroups)+len(cfg.excludeGroups) > 0 || cfg.adminGroup != ""
+	var found, missing, withGroupsFound int
+	values := make(map[string]int)
+	var searchErrs []error
+	for user := range users {
+		ldapUsr, searchErr := ldapUserSearch(ctx, conn, user, withGroups)
+		if errors.Is(searchErr, errLdapUserMissing) {
+			missing++
+			continue
+		} else if searchErr != nil {
+			searchErrs = append(searchErrs, fmt.Errorf("user %s: %w", user, searchErr))
+			continue
+		}
+
+		found++
+		if len(ldapUsr.groups) > 0 {
+			withGroupsFound++
+		}
+		for _, col := range sqlWritableColumns {
+			if ldapUsr.attrs[col] != "" {
+				values[col]++
+			}
+		}
+	}
+
+	if len(searchErrs) > 0 {
+		err = errors.Join(searchErrs...)
+		return
+	} else if found == 0 {
+		err = fmt.Errorf("none of the %d sampled users exist in LDAP; check LDAP_BASE, LDAP_FILTER, %s, and %s", missing, EnvMatchAttribute, EnvMatchColumn)
+		return
+	}
+
+	var warnings []string
+	if missing > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d of %d sampled users do not exist in LDAP, see %s", missing, len(users), EnvMissingPolicy))
+	}
+	for _, col := range sqlWritableColumns {
+		switch {
+		case values[col] == 0 && len(sources[col]) == 0:
+			warnings = append(warnings, fmt.Sprintf("the column %s has no LDAP attribute; check %s", col, EnvAttributeMap))
+		case values[col] == 0:
+			warnings = append(warnings, fmt.Sprintf("none of the %d found users has a value for the column %s from %s; check the mapping and the bind DN's read permissions",
+				found, col, strings.Join(sources[col], ", ")))
+		case values[col] < found:
+			warnings = append(warnings, fmt.Sprintf("%d of %d found users have no value for the column %s", found-values[col], found, col))
+		}
+	}
+	if withGroups && withGroupsFound == 0 {
+		warnings = append(warnings, "none of the found users has a memberOf group; check the LDAP server's memberOf overlay or attribute")
+	}
+	warning = strings.Join(warnings, "; ")
+	return
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// accountDuplicate is another Greenlight account of a synced LDAP user, e.g.,
+// created by an email sign-up, as found by the EnvDuplicateAccounts pass.
+type accountDuplicate struct {
+	userId      string
+	duplicateId string
+}
+
+// duplicateAccounts are all active Greenlight accounts not synced from LDAP,
+// mapped by their lowercase email addresses to their ids.
+//
+// As each account is reported once per sync, found ones are removed.
+type duplicateAccounts map[string]string
+
+// find returns the ids of accounts sharing any of the email addresses.
+func (accounts duplicateAccounts) find(emails ...string) (ids []string) {
+	for _, email := range emails {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if id, ok := accounts[email]; ok && email != "" {
+			ids = append(ids, id)
+			delete(accounts, email)
+		}
+	}
+	return
+}
+
+// sqlFetchDuplicateAccounts lists the active users outside of the
+// sqlActiveSchema's filter with an email address, e.g., local or OmniAuth
+// accounts, as candidates for EnvDuplicateAccounts.
+func sqlFetchDuplicateAccounts(ctx context.Context, db *sqlDB) (accounts duplicateAccounts, err error) {
+	rows, err := db.QueryContext(ctx, db.query(`
+		SELECT
+			{users.id}, LOWER({users.email})
+		FROM
+			{users}
+		WHERE
+			NOT COALESCE((`+sqlActiveSchema.filter+`), FALSE)
+			AND NOT COALESCE(`+sqlColumnExpr("deleted")+`, FALSE)
+			AND {users.email} IS NOT NULL AND {users.email} <> ''
+		ORDER BY
+			{users.id}
+	`))
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	accounts = make(duplicateAccounts)
+	for rows.Next() {
+		var id, email string
+		if err = rows.Scan(&id, &email); err != nil {
+			return
+		}
+
+		if other, ok := accounts[email]; ok {
+			log.WithFields(log.Fields{
+				"email": email,
+				"ids":   []string{other, id},
+			}).Debug("Multiple Greenlight accounts not synced from LDAP share an email address")
+			continue
+		}
+		accounts[email] = id
+	}
+	err = rows.Err()
+	return
+}
+
+// sqlResolveDuplicates applies the EnvDuplicateAccounts action to all passed
+// duplicates in a single transaction.
+//
+// Both DuplicateAccountsDeactivate and DuplicateAccountsMerge soft delete the
+// duplicate, flagging it for an administrator. The latter transfers its rooms
+// to the synced LDAP account first.
+func sqlResolveDuplicates(ctx context.Context, db *sqlDB, duplicates []accountDuplicate) (err error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	deactivate := sqlActiveSchema.deactivate
+	stmt, err := tx.PrepareContext(ctx, db.query(`
+		UPDATE
+			{users}
+		SET
+			`+db.setClause(deactivate)+`
+		WHERE
+			{id} = ?
+	`))
+	if err != nil {
+		return
+	}
+	defer stmt.Close()
+
+	mergeStmt, err := tx.PrepareContext(ctx, db.query(`UPDATE {rooms} SET {user_id} = ? WHERE {user_id} = ?`))
+	if err != nil {
+		return
+	}
+	defer mergeStmt.Close()
+
+	for _, duplicate := range duplicates {
+		if cfg.duplicateAccounts == DuplicateAccountsMerge {
+			if _, err = mergeStmt.ExecContext(ctx, duplicate.userId, duplicate.duplicateId); err != nil {
+				return
+			}
+		}
+		if _, err = stmt.ExecContext(ctx, duplicate.duplicateId); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
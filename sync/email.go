@@ -0,0 +1,243 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// emailNotifier delivers EnvEmailTo reports in the background, if configured.
+var emailNotifier *notifier
+
+// emailDigest accumulates the syncs since the last EmailReportDigest.
+var emailDigest struct {
+	sync.Mutex
+	next time.Time
+
+	runs   int
+	failed []string
+	rows   []reportRow
+}
+
+// emailObserveRun emails a sync's report following the EnvEmailReport mode.
+//
+// The rows are the sync's changes as reported by writeReport, attached as CSV.
+func emailObserveRun(runId string, status syncStatus, rows []reportRow) {
+	if emailNotifier == nil {
+		return
+	}
+
+	switch cfg.emailReport {
+	case EmailReportChanges:
+		if status.err == nil && len(rows) == 0 {
+			return
+		}
+	case EmailReportFailures:
+		if status.err == nil {
+			return
+		}
+	case EmailReportDigest:
+		emailObserveDigest(runId, status, rows)
+		return
+	}
+
+	subject := fmt.Sprintf("Greenlight LDAP sync %s: %d changes", runId, len(rows))
+	if status.err != nil {
+		subject = fmt.Sprintf("Greenlight LDAP sync %s failed", runId)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "The Greenlight LDAP sync %s finished at %s after %s.\n\n",
+		runId, status.finished.Format(time.RFC1123Z), status.duration.Round(time.Millisecond))
+	fmt.Fprintf(&body, "Users:             %d\n", status.users)
+	fmt.Fprintf(&body, "Users updated:     %d\n", status.updated)
+	fmt.Fprintf(&body, "Roles updated:     %d\n", status.roles)
+	fmt.Fprintf(&body, "Users deactivated: %d\n", status.deactivated)
+	if status.err != nil {
+		fmt.Fprintf(&body, "\nThe sync failed: %v\n", status.err)
+	}
+
+	emailSend(subject, body.String(), rows)
+}
+
+// emailObserveDigest accumulates a sync for the EmailReportDigest, sent by the
+// first sync after the EnvEmailDigest became due.
+func emailObserveDigest(runId string, status syncStatus, rows []reportRow) {
+	emailDigest.Lock()
+	defer emailDigest.Unlock()
+
+	now := time.Now()
+	if emailDigest.next.IsZero() {
+		emailDigest.next = cfg.emailDigest.next(now)
+	}
+
+	emailDigest.runs++
+	if status.err != nil {
+		emailDigest.failed = append(emailDigest.failed, fmt.Sprintf("%s at %s: %v", runId, status.finished.Format(time.RFC1123Z), status.err))
+	}
+	emailDigest.rows = append(emailDigest.rows, rows...)
+
+	if now.Before(emailDigest.next) {
+		return
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "The Greenlight LDAP sync performed %d syncs with %d changes since the last digest.\n",
+		emailDigest.runs, len(emailDigest.rows))
+	if len(emailDigest.failed) > 0 {
+		fmt.Fprintf(&body, "\n%d syncs failed:\n", len(emailDigest.failed))
+		for _, failure := range emailDigest.failed {
+			fmt.Fprintf(&body, "- %s\n", failure)
+		}
+	}
+
+	emailSend(fmt.Sprintf("Greenlight LDAP sync digest: %d changes", len(emailDigest.rows)), body.String(), emailDigest.rows)
+
+	emailDigest.runs, emailDigest.failed, emailDigest.rows = 0, nil, nil
+	emailDigest.next = cfg.emailDigest.next(now)
+}
+
+// emailSend enqueues an email to all EnvEmailTo recipients. Rows, if any, are
+// attached as a CSV file in the format of ReportFormatCsv.
+func emailSend(subject, body string, rows []reportRow) {
+	msg, err := emailMessage(subject, body, rows)
+	if err != nil {
+		emailNotifier.failures.Add(1)
+		log.WithError(err).Error("Cannot compose email report")
+		return
+	}
+
+	emailNotifier.sendFunc("smtp://"+cfg.smtpAddr, func() error {
+		return emailDeliver(msg)
+	})
+}
+
+// emailMessage composes a MIME message of a plain text body and an optional
+// CSV attachment.
+func emailMessage(subject, body string, rows []reportRow) ([]byte, error) {
+	var msgId [16]byte
+	_, _ = rand.Read(msgId[:])
+	_, domain, _ := strings.Cut(cfg.emailFrom.Address, "@")
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", cfg.emailFrom)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(cfg.emailTo, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(msgId[:]), domain)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+
+	if len(rows) > 0 {
+		part, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {"text/csv; charset=utf-8"},
+			"Content-Disposition": {`attachment; filename="changes.csv"`},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = writeReportCsv(part, rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// emailDeliver performs a single SMTP delivery attempt of a composed message
+// following the EnvSmtpTls mode, authenticating if EnvSmtpUsername is set.
+func emailDeliver(msg []byte) (err error) {
+	host, _, err := net.SplitHostPort(cfg.smtpAddr)
+	if err != nil {
+		return
+	}
+	tlsConfig := &tls.Config{ServerName: host}
+
+	dialer := &net.Dialer{Timeout: cfg.notifyTimeout}
+	var conn net.Conn
+	if cfg.smtpTls == SmtpTlsImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", cfg.smtpAddr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", cfg.smtpAddr)
+	}
+	if err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Now().Add(cfg.notifyTimeout))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer client.Close()
+
+	if cfg.smtpTls == SmtpTlsStarttls {
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return
+		}
+	}
+
+	if cfg.smtpUsername != "" {
+		var password string
+		if password, err = configSecret(EnvSmtpPassword); err != nil {
+			return
+		}
+		if err = client.Auth(smtp.PlainAuth("", cfg.smtpUsername, password, host)); err != nil {
+			return
+		}
+	}
+
+	if err = client.Mail(cfg.emailFrom.Address); err != nil {
+		return
+	}
+	for _, to := range cfg.emailTo {
+		if err = client.Rcpt(to); err != nil {
+			return
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(msg); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return client.Quit()
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newRunId creates a random identifier for a single sync run.
+func newRunId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return time.Now().UTC().Format("20060102T150405.000000000")
+	}
+	return hex.EncodeToString(buf)
+}
+
+const (
+	// EventActionDetected marks a changeEvent computed by a sync, being written
+	// for EnvEventDetected before any change is applied.
+	EventActionDetected = "detected"
+
+	// EventActionApplied marks a changeEvent of a change written to the database.
+	EventActionApplied = "applied"
+)
+
+// changeEvent is a single detected or applied change, written as one JSON line.
+type changeEvent struct {
+	Time      time.Time `json:"time"`
+	RunId     string    `json:"run_id"`
+	Action    string    `json:"action"`
+	User      string    `json:"user"`
+	Attribute string    `json:"attribute"`
+	Old       string    `json:"old"`
+	New       string    `json:"new"`
+}
+
+// eventStream writes applied changes for EnvEventStream, if configured.
+var eventStream *eventWriter
+
+// eventWriter writes changeEvents as line-delimited JSON.
+type eventWriter struct {
+	mu  sync.Mutex
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+// newEventWriter opens the destination, either "-" for stdout or a file path.
+//
+// Files are opened in append mode and are not truncated. As no seeking is
+// performed, the path might also name a FIFO, e.g., read by a sidecar.
+func newEventWriter(dest string) (*eventWriter, error) {
+	var out io.WriteCloser
+	if dest == "-" {
+		out = os.Stdout
+	} else {
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+
+	return &eventWriter{out: out, enc: json.NewEncoder(out)}, nil
+}
+
+// appliedChanges filters the changes of users within the applied lists.
+//
+// Role, deleted, shared_access, and duplicate_account changes are matched
+// against the roleUpdated, deactivated, sharedUpdated, and duplicateResolved
+// users, the deactivated ones including reactivated users, provisioned ones
+// against the provisioned users, and all others against the updated users.
+func appliedChanges(changes []attrChange, updated, roleUpdated, deactivated, provisioned, sharedUpdated, duplicateResolved []string) (applied []attrChange) {
+	toSet := func(users []string) map[string]bool {
+		set := make(map[string]bool, len(users))
+		for _, user := range users {
+			set[user] = true
+		}
+		return set
+	}
+	updatedSet, roleUpdatedSet, deactivatedSet := toSet(updated), toSet(roleUpdated), toSet(deactivated)
+	provisionedSet, sharedUpdatedSet, duplicateResolvedSet := toSet(provisioned), toSet(sharedUpdated), toSet(duplicateResolved)
+
+	for _, change := range changes {
+		var ok bool
+		switch change.attribute {
+		case "role":
+			ok = roleUpdatedSet[change.user]
+		case "deleted":
+			ok = deactivatedSet[change.user]
+		case "provisioned":
+			ok = provisionedSet[change.user]
+		case "shared_access":
+			ok = sharedUpdatedSet[change.user]
+		case "duplicate_account":
+			ok = duplicateResolvedSet[change.user]
+		default:
+			ok = updatedSet[change.user]
+		}
+		if ok {
+			applied = append(applied, change)
+		}
+	}
+	return
+}
+
+// changeEvents converts changes of a run to changeEvents of the action, one of
+// EventActionDetected and EventActionApplied.
+func changeEvents(runId, action string, changes []attrChange) []changeEvent {
+	now := time.Now().UTC()
+	events := make([]changeEvent, 0, len(changes))
+	for _, change := range changes {
+		events = append(events, changeEvent{
+			Time:      now,
+			RunId:     runId,
+			Action:    action,
+			User:      change.user,
+			Attribute: change.attribute,
+			Old:       change.old,
+			New:       change.new,
+		})
+	}
+	return events
+}
+
+// write writes an event of the action for each change, e.g., for each applied
+// change of appliedChanges.
+//
+// The changes are expected to be sorted by sortChanges, resulting in a
+// deterministic order.
+func (w *eventWriter) write(runId, action string, changes []attrChange) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, event := range changeEvents(runId, action, changes) {
+		if err := w.enc.Encode(event); err != nil {
+			log.WithError(err).Error("Failed to write change event")
+			return
+		}
+	}
+}
+
+// Close closes the underlying destination, unless it is stdout.
+func (w *eventWriter) Close() error {
+	if w.out == os.Stdout {
+		return nil
+	}
+	return w.out.Close()
+}
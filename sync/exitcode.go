@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"errors"
+)
+
+// Exit codes of a single sync, e.g., by the sync command, see syncExitCode.
+const (
+	// ExitSuccess signals a sync without any failure.
+	ExitSuccess = 0
+
+	// ExitFailure signals an invalid configuration or another failure.
+	ExitFailure = 1
+
+	// ExitConnection signals that the LDAP server or the database was not
+	// reachable or refused access.
+	ExitConnection = 2
+
+	// ExitPartial signals that some users could not be looked up in LDAP,
+	// while all other users were synced.
+	ExitPartial = 3
+
+	// ExitUpdate signals that applying changes to the database failed.
+	ExitUpdate = 4
+
+	// ExitThreshold signals that the sync was aborted before applying any
+	// change, as these exceeded the EnvMaxChanges.
+	ExitThreshold = 5
+)
+
+var (
+	// errSyncConnection wraps errors of syncAction establishing or using a
+	// connection as a whole.
+	errSyncConnection = errors.New("connection failed")
+
+	// errSyncPartial is returned by syncAction if some users failed.
+	errSyncPartial = errors.New("syncing some users failed")
+
+	// errSyncUpdate wraps errors of syncAction applying changes.
+	errSyncUpdate = errors.New("SQL update failed")
+
+	// errSyncThreshold is returned by syncAction if the changes exceeded the
+	// EnvMaxChanges.
+	errSyncThreshold = errors.New("change threshold exceeded")
+
+	// errSyncTimeout is the cause of syncAction's context being canceled after
+	// the EnvRunTimeout.
+	errSyncTimeout = errors.New("run timeout exceeded")
+)
+
+// syncExitCode maps an error of syncAction to its exit code.
+func syncExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitSuccess
+	case errors.Is(err, errSyncConnection):
+		return ExitConnection
+	case errors.Is(err, errSyncUpdate):
+		return ExitUpdate
+	case errors.Is(err, errSyncPartial):
+		return ExitPartial
+	case errors.Is(err, errSyncThreshold):
+		return ExitThreshold
+	default:
+		return ExitFailure
+	}
+}
+
+// ExitCode maps an error of Syncer.Run to its exit code, e.g., ExitPartial.
+func ExitCode(err error) int {
+	return syncExitCode(err)
+}
@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapImport replaces the LDAP source by the CSV file of the import command,
+// see importLoad.
+var ldapImport *ldifDirectory
+
+// exportUsers writes the sqlReadColumns and role of all synced users as CSV,
+// ordered by their social_uid, for the export command.
+func exportUsers(ctx context.Context, w io.Writer) error {
+	db, err := sqlOpen(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	users, err := sqlFetchUsers(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	uids := make([]string, 0, len(users))
+	for uid := range users {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	header := append(slices.Clone(sqlReadColumns), "role")
+	csvW := csv.NewWriter(w)
+	if err = csvW.Write(header); err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		record := make([]string, 0, len(header))
+		for _, col := range header {
+			record = append(record, users[uid][col])
+		}
+		if err = csvW.Write(record); err != nil {
+			return err
+		}
+	}
+	csvW.Flush()
+	return csvW.Error()
+}
+
+// exportRun performs the export command, writing to path or, if empty or "-",
+// to stdout.
+func exportRun(path string) error {
+	if path == "" || path == "-" {
+		return exportUsers(context.Background(), os.Stdout)
+	}
+
+	f, err := createOutputFile(path, false)
+	if err != nil {
+		return err
+	}
+	if err = exportUsers(context.Background(), f); err != nil {
+		_ = f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// importLoad reads a CSV file for the import command as an in-memory LDAP
+// directory, used by ldapOpen instead of the LDAP server.
+//
+// The header names the LDAP attributes, one of which must be LDAP_UID. Each
+// row becomes an entry below the first LDAP_BASE, named by its LDAP_UID value.
+// Empty cells are omitted and repeated columns result in multiple values.
+func importLoad(path string) (dir *ldifDirectory, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	csvR := csv.NewReader(f)
+	header, err := csvR.Read()
+	if err != nil {
+		err = fmt.Errorf("cannot read CSV header: %w", err)
+		return
+	}
+
+	uidAttr := os.Getenv("LDAP_UID")
+	uidCol := slices.IndexFunc(header, func(name string) bool { return strings.EqualFold(name, uidAttr) })
+	if uidCol < 0 {
+		err = fmt.Errorf("CSV header lacks the LDAP_UID attribute %s", uidAttr)
+		return
+	}
+
+	base := ldapBases()[0].dn
+	dir = &ldifDirectory{}
+	for line := 2; ; line++ {
+		var record []string
+		if record, err = csvR.Read(); err == io.EOF {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+
+		uid := record[uidCol]
+		if uid == "" {
+			err = fmt.Errorf("line %d: empty %s", line, uidAttr)
+			return
+		}
+
+		entry := &ldap.Entry{DN: uidAttr + "=" + ldap.EscapeDN(uid)}
+		if base != "" {
+			entry.DN += "," + base
+		}
+		for i, value := range record {
+			if value == "" {
+				continue
+			}
+			if j := slices.IndexFunc(entry.Attributes, func(attr *ldap.EntryAttribute) bool {
+				return strings.EqualFold(attr.Name, header[i])
+			}); j >= 0 {
+				entry.Attributes[j].Values = append(entry.Attributes[j].Values, value)
+			} else {
+				entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(header[i], []string{value}))
+			}
+		}
+		dir.entries = append(dir.entries, entry)
+	}
+}
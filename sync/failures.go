@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FailureLdapSearch is a failed LDAP search of a user.
+	FailureLdapSearch = "ldap_search"
+
+	// FailureLdapAmbiguous is an LDAP search of a user with multiple entries.
+	FailureLdapAmbiguous = "ldap_ambiguous"
+
+	// FailureSqlUpdate is a user update not written due to a failed SQL
+	// transaction, also skipping other users of the same transaction.
+	FailureSqlUpdate = "sql_update"
+
+	// FailureSqlProvision is a user failed to be provisioned.
+	FailureSqlProvision = "sql_provision"
+
+	// FailureUniqueConflict is a user update skipped by the EnvConflictPolicy,
+	// as another account holds a new value of a unique column.
+	FailureUniqueConflict = "unique_conflict"
+)
+
+// userFailure is a single failed user of a sync.
+type userFailure struct {
+	user string
+	kind string
+	err  error
+}
+
+// ambiguousUser is a user matched by multiple LDAP entries, see
+// EnvAmbiguousPolicy.
+type ambiguousUser struct {
+	user string
+
+	// dn is the entry picked by the EnvAmbiguousPolicy, being empty if the user
+	// was skipped.
+	dn string
+
+	// dns are all matching entries.
+	dns []string
+}
+
+// failureSummary collects the failed users of a sync, being logged as a
+// single summary at its end instead of individual errors.
+type failureSummary struct {
+	failures  []userFailure
+	ambiguous []ambiguousUser
+}
+
+// add records a failed user with its kind, e.g., FailureLdapSearch.
+func (s *failureSummary) add(kind, user string, err error) {
+	log.WithFields(log.Fields{
+		"user": user,
+		"kind": kind,
+	}).WithError(err).Debug("User failed")
+	s.failures = append(s.failures, userFailure{user, kind, err})
+}
+
+// addAmbiguous records a user matched by multiple LDAP entries, as returned by
+// ldapUserSearch. Only if the EnvAmbiguousPolicy did not resolve it, indicated
+// by err, the user is added as a FailureLdapAmbiguous failure.
+func (s *failureSummary) addAmbiguous(user string, ldapUsr ldapUser, err error) {
+	ambiguous := ambiguousUser{user: user, dns: ldapUsr.ambiguous}
+	if err != nil {
+		s.add(FailureLdapAmbiguous, user, err)
+	} else {
+		ambiguous.dn = ldapUsr.dn
+	}
+	s.ambiguous = append(s.ambiguous, ambiguous)
+}
+
+// addUpdates records the users of attempted updates not being committed.
+func (s *failureSummary) addUpdates(attempted, committed []map[string]string, ids map[string]string, err error) {
+	committedIds := make(map[string]bool, len(committed))
+	for _, userAttr := range committed {
+		committedIds[userAttr["id"]] = true
+	}
+	for _, userAttr := range attempted {
+		if !committedIds[userAttr["id"]] {
+			s.add(FailureSqlUpdate, ids[userAttr["id"]], err)
+		}
+	}
+}
+
+// users returns the number of distinct failed users.
+func (s *failureSummary) users() int {
+	users := make(map[string]bool, len(s.failures))
+	for _, failure := range s.failures {
+		users[failure.user] = true
+	}
+	return len(users)
+}
+
+// log logs the summary, listing the counts and the sorted users per kind, as
+// well as the counts per distinct error message. Ambiguous users are listed
+// with their picked DN, being empty for skipped ones, and logged as a warning
+// if no user failed.
+func (s *failureSummary) log(runId string) {
+	if len(s.failures)+len(s.ambiguous) == 0 {
+		return
+	}
+
+	fields := log.Fields{"run": runId}
+	if len(s.ambiguous) > 0 {
+		ambiguous := make(map[string]string, len(s.ambiguous))
+		for _, user := range s.ambiguous {
+			ambiguous[user.user] = user.dn
+		}
+		fields["ambiguous"] = ambiguous
+	}
+	if len(s.failures) == 0 {
+		log.WithFields(fields).Warn("Users matched multiple LDAP entries during the LDAP sync")
+		return
+	}
+
+	counts := make(map[string]int)
+	users := make(map[string][]string)
+	errs := make(map[string]int)
+	for _, failure := range s.failures {
+		counts[failure.kind]++
+		users[failure.kind] = append(users[failure.kind], failure.user)
+		if failure.err != nil {
+			errs[failure.err.Error()]++
+		}
+	}
+	for _, kindUsers := range users {
+		sort.Strings(kindUsers)
+	}
+
+	log.WithFields(fields).WithFields(log.Fields{
+		"failed_users": len(s.failures),
+		"counts":       counts,
+		"users":        users,
+		"errors":       errs,
+	}).Error("Users failed during the LDAP sync")
+}
@@ -0,0 +1,213 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// configFlagSwitches are the environment variables enabled by being set. Their
+// flags do not take a value, but might be disabled by, e.g., --dry-run=false.
+var configFlagSwitches = []string{
+	EnvDebug, EnvSyncrepl, EnvDryRun, EnvMaintenance, EnvClearOnEmpty,
+	EnvIncremental, EnvReuseConnections, EnvSkipColumnCheck, EnvVerifyUpdates,
+	EnvKubeEvents, EnvForce, EnvForceResync,
+}
+
+// configFlagCommands are arguments starting with "--" being commands instead
+// of flags.
+var configFlagCommands = []string{"--help", "--validate-only"}
+
+// configFlagOptions are flags of commands instead of environment variables,
+// e.g., --run of the rollback command. They are kept within the remaining
+// arguments as --NAME=VALUE.
+var configFlagOptions = []string{"run"}
+
+// configFlagAliases map flag names to environment variables not following
+// configFlagKey, e.g., --ldap-url for LDAP_SERVER accepting an ldap:// URL.
+var configFlagAliases = map[string]string{
+	"ldap-url": "LDAP_SERVER",
+	"db-url":   EnvDbUrl,
+}
+
+// configGreenlightKeys are the variables of Greenlight's .env being read.
+var configGreenlightKeys = []string{
+	"LDAP_SERVER", "LDAP_PORT", "LDAP_METHOD", "LDAP_TLS_NO_VERIFY", "LDAP_AUTH",
+	"LDAP_BIND_DN", "LDAP_PASSWORD", "LDAP_BASE", "LDAP_UID", "LDAP_FILTER",
+	"LDAP_ATTRIBUTE_MAPPING", "DB_ADAPTER", "DB_HOST", "PORT", "DB_NAME",
+	"DB_USERNAME", "DB_PASSWORD",
+}
+
+// configSyncKeys are all SYNC_ variables.
+var configSyncKeys = []string{
+	EnvDebug, EnvLogLevel, EnvLogFile, EnvLogFileMaxSize, EnvLogFileRotate,
+	EnvLogFileKeep, EnvLogFormat, EnvLogRedact, EnvInterval, EnvSchedule,
+	EnvIntervalMin,
+	EnvIntervalMinPolicy, EnvStartup, EnvJitter, EnvOverlap,
+	EnvFailureBackoffMax, EnvConfigWatch, EnvSyncrepl,
+	EnvShutdownTimeout, EnvShutdownGrace, EnvRunTimeout, EnvRunLock,
+	EnvRunLockName, EnvLeaderElection, EnvDryRun,
+	EnvMaintenance, EnvPauseFile, EnvSignalUsr1,
+	EnvDryRunColumns, EnvUser,
+	EnvMissingPolicy, EnvOptOutAttribute, EnvIncludeGroups,
+	EnvExcludeGroups, EnvNestedGroups, EnvNestedGroupsDepth, EnvGroupBase,
+	EnvLockPolicy, EnvDisabledPolicy, EnvRoomPolicy, EnvRoomOwner,
+	EnvLdapLdif, EnvSource, EnvKeycloakUrl, EnvKeycloakRealm,
+	EnvKeycloakClientId, EnvKeycloakClientSecret, EnvKeycloakGroups,
+	EnvClearOnEmpty, EnvClearedPolicy, EnvSchema, EnvMatchColumn,
+	EnvMatchAttribute, EnvProviders, EnvDbDriver, EnvDbSslMode,
+	EnvDbSslRootCert,
+	EnvDbSslCert, EnvDbSslKey, EnvDbConnectTimeout, EnvDbSearchPath,
+	EnvDbApplicationName, EnvDbUrl, EnvDbReplicaHost, EnvDbReplicaPort,
+	EnvUpdatedAt, EnvUpdatedAtColumn, EnvDuplicatePolicy,
+	EnvDuplicateAccounts, EnvConflictPolicy, EnvUniqueColumns,
+	EnvSkipColumnCheck,
+	EnvCanary, EnvMaxChanges, EnvForce, EnvForceResync, EnvVerifyUpdates,
+	EnvStatusTable, EnvCursorTable,
+	EnvAuditTable, EnvHistoryTable, EnvHistoryRetention,
+	EnvStateFile, EnvStatusMaxAge, EnvSqlChunkSize, EnvSqlChunkDelay,
+	EnvSqlBatchSize,
+	EnvSqlFetchQuery, EnvSqlUpdateQuery, EnvWriter, EnvRailsRunner,
+	EnvRailsTimeout,
+	EnvIncremental, EnvIncrementalFullInterval, EnvConcurrency,
+	EnvReuseConnections, EnvSqlParallel, EnvDialRetries, EnvOpRetries,
+	EnvRetryBudget, EnvDialBackoffBase, EnvDialBackoffMax, EnvKeepAlive,
+	EnvLdapDialTimeout, EnvLdapBindTimeout, EnvLdapSearchTimeout,
+	EnvLdapIdleTimeout, EnvLdapTLSHandshakeTimeout, EnvLdapTimeLimit,
+	EnvSqlTimeout,
+	EnvLdapBases, EnvLdapServers, EnvLdapTLSServerName, EnvLdapTLSCAFile,
+	EnvLdapTLSCertFile, EnvLdapTLSKeyFile, EnvTLSMinVersion,
+	EnvTLSCipherSuites, EnvTLSInsecureSkipVerify, EnvLdapStartTLS,
+	EnvLdapSasl,
+	EnvLdapDirectory, EnvLdapGlobalCatalog, EnvLdapUserFilter,
+	EnvLdapExtraFilter, EnvAmbiguousPolicy, EnvAmbiguousTieBreaker,
+	EnvAmbiguousFilter,
+	EnvLdapAnonymous,
+	EnvKrb5Config, EnvKrb5Keytab, EnvKrb5Principal, EnvKrb5Ccache,
+	EnvLdapSpn, EnvLdapPageSize, EnvLdapSearchBatch,
+	EnvLdapReferralHops, EnvLdapReferralCredentials,
+	EnvLdapRate, EnvLdapBurst, EnvLdapRetryCodes, EnvEventStream,
+	EnvEventDetected, EnvReport,
+	EnvReportFormat, EnvBackup, EnvBackupFormat, EnvMetricsAddr,
+	EnvPushgatewayUrl, EnvPushgatewayJob, EnvOtlpEndpoint, EnvOtlpHeaders,
+	EnvSentryDsn, EnvSentryEnvironment,
+	EnvHealthAddr, EnvAdminAddr, EnvAdminToken, EnvAdminPprof, EnvScimAddr,
+	EnvScimToken,
+	EnvKubeEvents, EnvVaultAddr,
+	EnvVaultToken, EnvVaultCAFile, EnvVaultLdapPath, EnvVaultDbPath,
+	EnvWebhookUrl, EnvWebhookSecret, EnvNotifyTimeout, EnvNotifyRetries,
+	EnvHookPre, EnvHookSuccess, EnvHookFailure, EnvHookTimeout,
+	EnvChatWebhookUrl, EnvMatrixHomeserver, EnvMatrixRoom, EnvMatrixToken,
+	EnvChatDigest, EnvEmailTo, EnvEmailFrom, EnvEmailReport, EnvEmailDigest,
+	EnvSmtpAddr, EnvSmtpTls, EnvSmtpUsername, EnvSmtpPassword,
+	EnvAttributeMap, EnvAttributeTemplate, EnvCanonicalize,
+	EnvAttributePolicy,
+	EnvCompareFoldDiacritics,
+	EnvCompareNormalize, EnvCompareCase, EnvNormalize,
+	EnvAvatarAttributes, EnvAvatarSize, EnvPhoneRegion, EnvLocales,
+	EnvDepartmentColumn,
+	EnvDepartmentSource, EnvProvisionBase, EnvProvisionFilter, EnvProvisionRole,
+	EnvProvisionRoomName, EnvRoleMap, EnvRoleDefault, EnvRoleCacheTTL,
+	EnvAdminGroup, EnvAdminRole, EnvAdminDemote,
+	EnvSharedRooms, EnvSharedRoomsPrune,
+}
+
+// configKnownKey reports whether key is a variable being read, including the
+// configSecretFileSuffix variants of the configSecretKeys.
+func configKnownKey(key string) bool {
+	if secretKey, ok := strings.CutSuffix(key, configSecretFileSuffix); ok && slices.Contains(configSecretKeys, secretKey) {
+		return true
+	}
+	return slices.Contains(configGreenlightKeys, key) || slices.Contains(configSyncKeys, key)
+}
+
+// configFlagKey returns the environment variable for a flag name, following
+// the sections of configFileKey: --ldap-base is LDAP_BASE, --db-host is
+// DB_HOST, and all others are SYNC_ variables, e.g., --interval. As SYNC_
+// variables lose their prefix, --ldap-page-size is SYNC_LDAP_PAGE_SIZE, being
+// no Greenlight variable.
+func configFlagKey(name string) string {
+	key := strings.ReplaceAll(name, "-", "_")
+	syncKey := configFileKey("sync", key)
+	for prefix, section := range map[string]string{"ldap_": "ldap", "db_": "database"} {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			if sectionKey := configFileKey(section, rest); configKnownKey(sectionKey) || !configKnownKey(syncKey) {
+				return sectionKey
+			}
+		}
+	}
+	return syncKey
+}
+
+// configFlagArgs applies all --NAME VALUE or --NAME=VALUE flags of args to
+// the environment, returning the remaining arguments. A flag of an unknown
+// variable is rejected.
+//
+// As flags overwrite environment variables, they take precedence over both
+// the environment and a configuration file, which must be loaded before.
+func configFlagArgs(args []string) (rest []string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "--") || slices.Contains(configFlagCommands, arg) {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+		if name == "" {
+			err = fmt.Errorf("invalid flag %q", arg)
+			return
+		}
+		key, ok := configFlagAliases[name]
+		if !ok {
+			key = configFlagKey(name)
+		}
+		if !configKnownKey(key) && !slices.Contains(configFlagOptions, name) {
+			err = fmt.Errorf("unknown flag --%s", name)
+			return
+		}
+
+		if slices.Contains(configFlagSwitches, key) {
+			enabled := true
+			if hasValue {
+				if enabled, err = strconv.ParseBool(value); err != nil {
+					err = fmt.Errorf("flag --%s expects a boolean: %w", name, err)
+					return
+				}
+			}
+
+			if enabled {
+				err = os.Setenv(key, "true")
+			} else {
+				err = os.Unsetenv(key)
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		if !hasValue {
+			if i+1 >= len(args) {
+				err = fmt.Errorf("flag --%s requires a value", name)
+				return
+			}
+			value = args[i+1]
+			i++
+		}
+		if slices.Contains(configFlagOptions, name) {
+			rest = append(rest, "--"+name+"="+value)
+			continue
+		}
+		if err = os.Setenv(key, value); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestConfigFlagKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"ldap-base", "LDAP_BASE"},
+		{"ldap-bind-dn", "LDAP_BIND_DN"},
+		{"db-host", "DB_HOST"},
+		{"db-port", "PORT"},
+		{"interval", EnvInterval},
+		{"dry-run", EnvDryRun},
+		{"ldap-page-size", EnvLdapPageSize},
+		{"db-driver", EnvDbDriver},
+		{"ldap-unknown", "LDAP_UNKNOWN"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if key := configFlagKey(test.name); key != test.key {
+				t.Errorf("configFlagKey(%q) = %s, want %s", test.name, key, test.key)
+			}
+		})
+	}
+}
+
+func TestConfigFlagArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		rest    []string
+		wantErr bool
+	}{
+		{"separate value", []string{"--interval", "15m", "daemon"}, map[string]string{EnvInterval: "15m"}, []string{"daemon"}, false},
+		{"inline value", []string{"--ldap-base=dc=example,dc=org"}, map[string]string{"LDAP_BASE": "dc=example,dc=org"}, nil, false},
+		{"alias", []string{"--ldap-url", "ldaps://ldap.example.org"}, map[string]string{"LDAP_SERVER": "ldaps://ldap.example.org"}, nil, false},
+		{"url alias", []string{"--db-url", "postgres://db.example.org/greenlight"}, map[string]string{EnvDbUrl: "postgres://db.example.org/greenlight"}, nil, false},
+		{"secret file", []string{"--ldap-password-file", "/run/secrets/ldap"}, map[string]string{"LDAP_PASSWORD_FILE": "/run/secrets/ldap"}, nil, false},
+		{"switch", []string{"--dry-run", "sync"}, map[string]string{EnvDryRun: "true"}, []string{"sync"}, false},
+		{"disabled switch", []string{"--debug=false"}, map[string]string{EnvDebug: ""}, nil, false},
+		{"command option", []string{"rollback", "--run", "42"}, nil, []string{"rollback", "--run=42"}, false},
+		{"command", []string{"--help"}, nil, []string{"--help"}, false},
+		{"unknown flag", []string{"--colour", "blue"}, nil, nil, true},
+		{"missing value", []string{"--interval"}, nil, nil, true},
+		{"invalid switch", []string{"--dry-run=maybe"}, nil, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, key := range []string{EnvInterval, "LDAP_BASE", "LDAP_SERVER", "LDAP_PASSWORD_FILE", EnvDryRun} {
+				t.Setenv(key, "")
+			}
+			t.Setenv(EnvDebug, "true")
+
+			rest, err := configFlagArgs(test.args)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("configFlagArgs() error = %v, want failure %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if !slices.Equal(rest, test.rest) {
+				t.Errorf("configFlagArgs() = %q, want %q", rest, test.rest)
+			}
+			for key, value := range test.env {
+				if v := os.Getenv(key); v != value {
+					t.Errorf("%s = %q, want %q", key, v, value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// healthCheckTimeout bounds each connectivity check of readyzHandler.
+const healthCheckTimeout = 5 * time.Second
+
+// healthzHandler serves /healthz, failing if the last sync failed.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	status, msg := http.StatusOK, "ok"
+	if syncLastFailed.Load() {
+		status, msg = http.StatusServiceUnavailable, "last sync failed"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\nmaintenance: %t\npaused: %t\n", msg, maintenanceMode.Load(), syncIsPaused())
+}
+
+// readyzHandler serves /readyz, failing if either the LDAP directory or the
+// database is currently unreachable. The connections are checked without
+// retries on each request.
+func readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	checks := []struct {
+		name string
+		err  error
+	}{
+		{"ldap", healthCheckLdap()},
+		{"sql", healthCheckSql()},
+	}
+
+	status := http.StatusOK
+	for _, check := range checks {
+		if check.err != nil {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	for _, check := range checks {
+		if check.err != nil {
+			fmt.Fprintf(w, "%s: %v\n", check.name, check.err)
+		} else {
+			fmt.Fprintf(w, "%s: ok\n", check.name)
+		}
+	}
+	fmt.Fprintf(w, "maintenance: %t\n", maintenanceMode.Load())
+	fmt.Fprintf(w, "paused: %t\n", syncIsPaused())
+}
+
+// statusHandler serves GET /status, returning the syncRunStatus as JSON with
+// the last sync's details and the next scheduled one.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	syncRunStatus.Lock()
+	status := syncRunStatus.runStatus
+	syncRunStatus.Unlock()
+	status.Paused = syncIsPaused()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// healthCheckLdap establishes and binds a single LDAP connection.
+func healthCheckLdap() error {
+	if cfg.ldapLdif != "" {
+		_, err := os.Stat(cfg.ldapLdif)
+		return err
+	}
+
+	conn, err := ldapDialOnce()
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// healthCheckSql pings the database once.
+func healthCheckSql() error {
+	conn, err := sqlConnect(true)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	return conn.PingContext(ctx)
+}
+
+// healthCheck queries the daemon's /healthz endpoint of the EnvHealthAddr for
+// the healthcheck command, e.g., as a Docker HEALTHCHECK without curl. Without
+// an EnvHealthAddr, the last sync's state is checked by statusShow instead.
+//
+// False is returned if the endpoint is unreachable or reports a failure.
+func healthCheck(w io.Writer) bool {
+	if cfg.healthAddr == "" {
+		return statusShow(w)
+	}
+
+	client := &http.Client{Timeout: healthCheckTimeout}
+	reqUrl := "http://localhost/healthz"
+	if path, ok := strings.CutPrefix(cfg.healthAddr, "unix:"); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+	} else {
+		// A listener on all interfaces is queried on the loopback interface.
+		host, port, err := net.SplitHostPort(cfg.healthAddr)
+		if err != nil {
+			fmt.Fprintf(w, "[FAIL] invalid %s: %v\n", EnvHealthAddr, err)
+			return false
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "localhost"
+		}
+		reqUrl = "http://" + net.JoinHostPort(host, port) + "/healthz"
+	}
+
+	resp, err := client.Get(reqUrl)
+	if err != nil {
+		fmt.Fprintf(w, "[FAIL] cannot query the health endpoint: %v\n", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(w, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(w, "[FAIL] the health endpoint reported %s\n", resp.Status)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HistoryModeFull is the mode of a full sync within the EnvHistoryTable.
+	HistoryModeFull = "full"
+
+	// HistoryModeIncremental is the mode of an incremental sync within the
+	// EnvHistoryTable, see EnvIncremental.
+	HistoryModeIncremental = "incremental"
+)
+
+// syncHistory is a single sync run's row of the EnvHistoryTable.
+type syncHistory struct {
+	runId   string
+	started time.Time
+	mode    string
+	status  syncStatus
+	changed int
+	failed  int
+}
+
+// sqlHistoryMigrations create and migrate the EnvHistoryTable. Besides
+// sqlQuery's identifiers, {table}, {table_index}, and {serial} are replaced by
+// sqlHistoryQuery.
+//
+// As with sqlAuditMigrations, schema changes must be appended as further
+// statements, never edited in place.
+var sqlHistoryMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS {table} (
+		{id}          {serial},
+		{run_id}      TEXT NOT NULL,
+		{started_at}  TIMESTAMP NOT NULL,
+		{finished_at} TIMESTAMP NOT NULL,
+		{duration_ms} BIGINT NOT NULL,
+		{mode}        TEXT NOT NULL,
+		{users}       INTEGER NOT NULL,
+		{changed}     INTEGER NOT NULL,
+		{failed}      INTEGER NOT NULL,
+		{success}     BOOLEAN NOT NULL,
+		{error}       TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS {table_index} ON {table} ({started_at})`,
+}
+
+// sqlHistoryQuery translates a query on the EnvHistoryTable.
+func sqlHistoryQuery(db *sqlDB, query string) string {
+	return db.query(strings.NewReplacer(
+		"{table}", "{"+cfg.historyTable+"}",
+		"{table_index}", "{"+cfg.historyTable+"_started_at_idx}",
+		"{serial}", db.dialect.serialKey(),
+	).Replace(query))
+}
+
+// sqlWriteHistory appends the run to the EnvHistoryTable, after creating or
+// migrating it by sqlHistoryMigrations. Afterwards, runs started before the
+// EnvHistoryRetention are pruned, if set.
+//
+// Like sqlWriteStatus, the row is committed on its own, independent of the
+// sync's updates.
+func sqlWriteHistory(ctx context.Context, db *sqlDB, run syncHistory) (err error) {
+	for _, migration := range sqlHistoryMigrations {
+		if _, err = db.ExecContext(ctx, sqlHistoryQuery(db, migration)); err != nil {
+			return
+		}
+	}
+
+	var errMsg *string
+	if run.status.err != nil {
+		msg := run.status.err.Error()
+		errMsg = &msg
+	}
+
+	if _, err = db.ExecContext(ctx, sqlHistoryQuery(db, `
+		INSERT INTO {table} ({run_id}, {started_at}, {finished_at}, {duration_ms}, {mode}, {users}, {changed}, {failed}, {success}, {error})
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`), run.runId, run.started.UTC(), run.status.finished.UTC(), run.status.duration.Milliseconds(),
+		run.mode, run.status.users, run.changed, run.failed, run.status.err == nil, errMsg); err != nil {
+		return
+	}
+
+	if cfg.historyRetention == 0 {
+		return
+	}
+	res, err := db.ExecContext(ctx, sqlHistoryQuery(db, `
+		DELETE FROM {table}
+		WHERE {started_at} < ?
+	`), time.Now().Add(-cfg.historyRetention).UTC())
+	if err != nil {
+		return
+	}
+	if pruned, _ := res.RowsAffected(); pruned > 0 {
+		log.WithFields(log.Fields{
+			"table":  cfg.historyTable,
+			"pruned": pruned,
+		}).Debug("Pruned expired runs from the history table")
+	}
+	return
+}
@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hookOutputLimit bounds the logged output of a failed hook command.
+const hookOutputLimit = 4096
+
+// hookRun executes a hook command of EnvHookPre, EnvHookSuccess, or
+// EnvHookFailure for the sync runId, bounded by the EnvHookTimeout.
+//
+// The command is split into its executable and arguments by whitespace
+// without any quoting, thus shell syntax requires a script. The input, if not
+// nil, is passed JSON encoded on stdin. Besides the inherited environment, the
+// hook receives SYNC_HOOK_RUN_ID, SYNC_HOOK_READ_ONLY, and the env values.
+func hookRun(ctx context.Context, command, runId string, readOnly bool, input any, env ...string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"SYNC_HOOK_RUN_ID="+runId,
+		"SYNC_HOOK_READ_ONLY="+strconv.FormatBool(readOnly))
+	cmd.Env = append(cmd.Env, env...)
+
+	if input != nil {
+		stdin, err := json.Marshal(input)
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+
+	if err := cmd.Run(); err != nil {
+		out := output.String()
+		if len(out) > hookOutputLimit {
+			out = out[:hookOutputLimit]
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %v", cfg.hookTimeout)
+		}
+		return fmt.Errorf("hook %s failed: %w: %s", args[0], err, strings.TrimSpace(out))
+	}
+	log.WithFields(log.Fields{
+		"run":  runId,
+		"hook": args[0],
+	}).Debug("Executed hook")
+	return nil
+}
+
+// hookRunFinished executes the EnvHookSuccess or EnvHookFailure hook after a
+// sync finished with err. Failing hooks are logged only.
+//
+// The success hook receives the changes payload, as sent to EnvWebhookUrl. The
+// failure hook receives the error and exit code, also as SYNC_HOOK_EXIT_CODE.
+func hookRunFinished(ctx context.Context, runId string, readOnly bool, changes map[string]any, err error) {
+	// The sync's context might be canceled already, e.g., by a shutdown.
+	ctx = context.WithoutCancel(ctx)
+
+	var hookErr error
+	if err == nil {
+		hookErr = hookRun(ctx, cfg.hookSuccess, runId, readOnly, changes)
+	} else {
+		exitCode := syncExitCode(err)
+		hookErr = hookRun(ctx, cfg.hookFailure, runId, readOnly, map[string]any{
+			"run_id":    runId,
+			"error":     err.Error(),
+			"exit_code": exitCode,
+		}, "SYNC_HOOK_EXIT_CODE="+strconv.Itoa(exitCode))
+	}
+	if hookErr != nil {
+		log.WithError(hookErr).WithField("run", runId).Error("Post-sync hook failed")
+	}
+}
@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// httpMuxes are the HTTP endpoints by their listening address, registered by
+// httpHandle. Endpoints configured for the same address share a listener.
+var httpMuxes = make(map[string]*http.ServeMux)
+
+// httpHandle registers a handler for the pattern on the listening address.
+func httpHandle(addr, pattern string, handler http.Handler) {
+	mux, ok := httpMuxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		httpMuxes[addr] = mux
+	}
+	mux.Handle(pattern, handler)
+}
+
+// httpListen serves all httpMuxes in the background.
+//
+// The addresses are bound synchronously to report errors, e.g., an address
+// already in use, at startup. An address of the form unix:PATH is a unix
+// socket, replacing a stale socket file.
+func httpListen() error {
+	for addr, mux := range httpMuxes {
+		network, address := "tcp", addr
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, address = "unix", path
+			_ = os.Remove(path)
+		}
+
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+			if err := server.Serve(ln); err != nil {
+				log.WithError(err).WithField("address", addr).Error("HTTP server failed")
+			}
+		}()
+		log.WithField("address", addr).Info("Serving HTTP endpoints")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapGeneralizedTime is the layout of LDAP's GeneralizedTime syntax in UTC,
+// used by the modifyTimestamp operational attribute.
+const ldapGeneralizedTime = "20060102150405Z"
+
+// incrementalState records the start of the last successful syncs for
+// EnvIncremental. Unless restored from the EnvCursorTable by
+// incrementalRestore, each restart begins with a full sync.
+var incrementalState struct {
+	sync.Mutex
+	lastSync time.Time
+	lastFull time.Time
+}
+
+// incrementalSince returns the time since which changed LDAP entries must be
+// compared for an incremental sync starting now. If a full sync is due, only
+// the EnvUser users are synced, or EnvForceResync is set, ok is false.
+func incrementalSince(now time.Time) (since time.Time, ok bool) {
+	incrementalState.Lock()
+	defer incrementalState.Unlock()
+
+	if !cfg.incremental || len(cfg.users) > 0 || cfg.forceResync || incrementalState.lastSync.IsZero() {
+		return
+	}
+	if now.Sub(incrementalState.lastFull) >= cfg.incrementalFullInterval {
+		return
+	}
+	return incrementalState.lastSync, true
+}
+
+// incrementalDone records a successful sync started at start.
+//
+// As the start time is recorded, changes made during a sync are picked up by
+// the next one.
+func incrementalDone(start time.Time, full bool) {
+	incrementalState.Lock()
+	defer incrementalState.Unlock()
+
+	incrementalState.lastSync = start
+	if full {
+		incrementalState.lastFull = start
+	}
+}
+
+// incrementalRestore replaces the incrementalState by a syncCursor, e.g., as
+// written by another instance or before a restart.
+func incrementalRestore(cursor syncCursor) {
+	incrementalState.Lock()
+	defer incrementalState.Unlock()
+
+	incrementalState.lastSync = cursor.lastSync
+	incrementalState.lastFull = cursor.lastFull
+}
+
+// incrementalCursor returns the incrementalState as a syncCursor.
+func incrementalCursor() syncCursor {
+	incrementalState.Lock()
+	defer incrementalState.Unlock()
+
+	return syncCursor{
+		lastSync: incrementalState.lastSync,
+		lastFull: incrementalState.lastFull,
+	}
+}
+
+// ldapModifiedUids lists the EnvMatchAttribute values of all users within the
+// ldapBases and LDAP_FILTER whose entries were modified since the given time,
+// together with their latest modifyTimestamp.
+func ldapModifiedUids(conn ldapSearcher, since time.Time) (uids map[string]bool, latest string, err error) {
+	uidAttr := cfg.matchAttribute
+
+	uids = make(map[string]bool)
+	for _, base := range ldapBases() {
+		searchReq := ldap.NewSearchRequest(
+			base.dn,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+			false,
+			fmt.Sprintf("(&%s(modifyTimestamp>=%s)%s%s)",
+				ldapUidPresentFilter(), since.UTC().Format(ldapGeneralizedTime), ldapFilter(), base.filter),
+			[]string{uidAttr, "modifyTimestamp"},
+			nil)
+
+		var searchResp *ldap.SearchResult
+		if searchResp, err = ldapSearch(conn, searchReq); err != nil {
+			return
+		}
+
+		for _, entry := range searchResp.Entries {
+			for _, uid := range ldapEntryUids(entry) {
+				uids[uid] = true
+			}
+			// The GeneralizedTime in UTC is ordered lexicographically.
+			if ts := entry.GetAttributeValue("modifyTimestamp"); ts > latest {
+				latest = ts
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,173 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configJob is a named sync job of the configuration file's jobs section. Its
+// variables override the common configuration while it runs, see jobsRun.
+type configJob struct {
+	name string
+
+	// env are the job's variables, while unset ones are disabled by false.
+	env   map[string]string
+	unset []string
+}
+
+// configJobs are the jobs of the configuration file, if any.
+var configJobs []configJob
+
+// jobsSharedKeys are the variables only configurable for all jobs, as they
+// are shared or kept in process-wide state.
+var jobsSharedKeys = []string{EnvInterval, EnvSchedule, EnvIncremental, EnvSyncrepl, EnvCursorTable, EnvLeaderElection}
+
+// configFileJobs parses the jobs section of a configuration file, mapping each
+// job's name to its sections like the top-level ones.
+func configFileJobs(path string, jobs map[string]any) (parsed []configJob, err error) {
+	names := make([]string, 0, len(jobs))
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		job := configJob{name: name, env: make(map[string]string)}
+		sections, ok := jobs[name].(map[string]any)
+		if !ok && jobs[name] != nil {
+			return nil, fmt.Errorf("job %q in %s is no mapping", name, path)
+		}
+
+		for section, values := range sections {
+			if _, ok := configFileSections[section]; !ok {
+				return nil, fmt.Errorf("unknown section %q of job %q in %s", section, name, path)
+			}
+			valueMap, ok := values.(map[string]any)
+			if !ok && values != nil {
+				return nil, fmt.Errorf("section %q of job %q in %s is no mapping", section, name, path)
+			}
+
+			for k, v := range valueMap {
+				key := configFileKey(section, k)
+				for _, shared := range jobsSharedKeys {
+					if key == shared {
+						return nil, fmt.Errorf("%s cannot be configured for job %q, only for all jobs", key, name)
+					}
+				}
+
+				if value, set := configFileValue(v); set {
+					job.env[key] = value
+				} else {
+					job.unset = append(job.unset, key)
+				}
+			}
+		}
+		parsed = append(parsed, job)
+	}
+	return
+}
+
+// apply sets the job's variables in the environment.
+func (job configJob) apply() {
+	for key, value := range job.env {
+		_ = os.Setenv(key, value)
+	}
+	for _, key := range job.unset {
+		_ = os.Unsetenv(key)
+	}
+}
+
+// jobsCheck verifies the configuration of each job based on the common
+// configuration c, failing early at start or on a configuration reload.
+func jobsCheck(c *config, jobs []configJob) error {
+	if len(jobs) > 0 && (c.incremental || c.syncrepl || c.cursorTable != "") {
+		return fmt.Errorf("%s, %s, and %s cannot be used with jobs", EnvIncremental, EnvSyncrepl, EnvCursorTable)
+	}
+
+	environ := os.Environ()
+	defer configEnvironRestore(environ)
+
+	for _, job := range jobs {
+		job.apply()
+		if _, err := configLoad(); err != nil {
+			return fmt.Errorf("invalid configuration of job %q: %w", job.name, err)
+		}
+		configEnvironRestore(environ)
+	}
+	return nil
+}
+
+// jobsCurrent is the name of the currently running job, added to each log
+// entry by jobsLogHook.
+var jobsCurrent atomic.Pointer[string]
+
+// jobsLogHook adds the name of the running job as the job log field.
+type jobsLogHook struct{}
+
+func (jobsLogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (jobsLogHook) Fire(entry *log.Entry) error {
+	if name := jobsCurrent.Load(); name != nil {
+		entry.Data["job"] = *name
+	}
+	return nil
+}
+
+// jobsRun performs syncAction for each of the configJobs, one after another.
+//
+// While a job runs, its variables are set in the environment and the global
+// configuration is loaded from it, as the sync engine keeps process-wide
+// state. Thus, jobs cannot run in parallel. Kept connections are closed in
+// between, as each job might target another LDAP server or database. A failed
+// job does not stop the following ones; the errors of all failed jobs are
+// returned.
+func jobsRun(ctx context.Context) (err error) {
+	environ, common := os.Environ(), cfg
+	defer func() {
+		jobsCurrent.Store(nil)
+		syncPoolClose()
+		configEnvironRestore(environ)
+		cfg = common
+		configApply(cfg)
+	}()
+
+	var errs []error
+	for _, job := range configJobs {
+		if ctx.Err() != nil {
+			errs = append(errs, context.Cause(ctx))
+			break
+		}
+
+		configEnvironRestore(environ)
+		job.apply()
+		name := job.name
+		jobsCurrent.Store(&name)
+
+		jobCfg, loadErr := configLoadDetect()
+		if loadErr != nil {
+			log.WithError(loadErr).Error("Invalid job configuration")
+			errs = append(errs, fmt.Errorf("job %s: %w", job.name, loadErr))
+			continue
+		}
+		syncPoolClose()
+		cfg = jobCfg
+		configApply(cfg)
+
+		if jobErr := syncAction(ctx); jobErr != nil {
+			errs = append(errs, fmt.Errorf("job %s: %w", job.name, jobErr))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// keycloakTimeout bounds each request to the Keycloak Admin REST API.
+	keycloakTimeout = 10 * time.Second
+
+	// keycloakPageSize is the number of users fetched per request.
+	keycloakPageSize = 100
+)
+
+// keycloakUser is a Keycloak Admin REST API UserRepresentation.
+type keycloakUser struct {
+	Id               string              `json:"id"`
+	Username         string              `json:"username"`
+	Email            string              `json:"email"`
+	EmailVerified    bool                `json:"emailVerified"`
+	FirstName        string              `json:"firstName"`
+	LastName         string              `json:"lastName"`
+	Enabled          bool                `json:"enabled"`
+	CreatedTimestamp int64               `json:"createdTimestamp"`
+	Attributes       map[string][]string `json:"attributes"`
+}
+
+// keycloakGroup is a Keycloak Admin REST API GroupRepresentation.
+type keycloakGroup struct {
+	Path string `json:"path"`
+}
+
+// keycloakClient performs requests to the EnvKeycloakUrl's Admin REST API,
+// authenticated by an access token of the EnvKeycloakClientId's service account.
+type keycloakClient struct {
+	client *http.Client
+	token  string
+}
+
+// keycloakLoad fetches all users of the EnvKeycloakRealm for the EnvSource
+// SourceKeycloak as an in-memory directory, used by ldapOpen instead of the
+// LDAP server.
+//
+// Each user becomes an entry named by its username, below LDAP_BASE, if set.
+// Its attributes are the representation's fields, e.g., username, email,
+// firstName, and lastName, cn as the full name, and all custom attributes.
+// Disabled users are marked by userAccountControl's ACCOUNTDISABLE flag for
+// EnvDisabledPolicy. For EnvKeycloakGroups, memberOf lists the group paths.
+func keycloakLoad() (dir *ldifDirectory, err error) {
+	kc := &keycloakClient{client: &http.Client{Timeout: keycloakTimeout}}
+	if err = kc.authenticate(); err != nil {
+		err = fmt.Errorf("cannot authenticate to Keycloak: %w", err)
+		return
+	}
+
+	base := os.Getenv("LDAP_BASE")
+	dir = &ldifDirectory{}
+	for first := 0; ; first += keycloakPageSize {
+		var users []keycloakUser
+		query := url.Values{
+			"first":               {strconv.Itoa(first)},
+			"max":                 {strconv.Itoa(keycloakPageSize)},
+			"briefRepresentation": {"false"},
+		}
+		if err = kc.get("users?"+query.Encode(), &users); err != nil {
+			err = fmt.Errorf("cannot list Keycloak users: %w", err)
+			return
+		}
+
+		for _, user := range users {
+			var groups []keycloakGroup
+			if cfg.keycloakGroups {
+				if err = kc.get("users/"+url.PathEscape(user.Id)+"/groups", &groups); err != nil {
+					err = fmt.Errorf("cannot list groups of Keycloak user %s: %w", user.Username, err)
+					return
+				}
+			}
+			dir.entries = append(dir.entries, keycloakEntry(user, groups, base))
+		}
+		if len(users) < keycloakPageSize {
+			break
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"realm": cfg.keycloakRealm,
+		"users": len(dir.entries),
+	}).Debug("Fetched Keycloak users")
+	return
+}
+
+// keycloakEntry converts a Keycloak user and its groups to an LDAP entry for
+// keycloakLoad.
+func keycloakEntry(user keycloakUser, groups []keycloakGroup, base string) *ldap.Entry {
+	entry := &ldap.Entry{DN: "uid=" + ldap.EscapeDN(user.Username)}
+	if base != "" {
+		entry.DN += "," + base
+	}
+
+	add := func(name string, values ...string) {
+		var nonEmpty []string
+		for _, value := range values {
+			if value != "" {
+				nonEmpty = append(nonEmpty, value)
+			}
+		}
+		if len(nonEmpty) > 0 {
+			entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(name, nonEmpty))
+		}
+	}
+
+	add("id", user.Id)
+	add("username", user.Username)
+	add("email", user.Email)
+	add("emailVerified", strconv.FormatBool(user.EmailVerified))
+	add("firstName", user.FirstName)
+	add("lastName", user.LastName)
+	add("cn", strings.TrimSpace(user.FirstName+" "+user.LastName))
+	if user.CreatedTimestamp > 0 {
+		add("createTimestamp", time.UnixMilli(user.CreatedTimestamp).UTC().Format(ldapGeneralizedTime))
+	}
+
+	// 0x200 is NORMAL_ACCOUNT, 0x2 marks it as disabled, see ldapEntryDisabled.
+	userAccountControl := 0x200
+	if !user.Enabled {
+		userAccountControl |= 0x2
+	}
+	add("userAccountControl", strconv.Itoa(userAccountControl))
+
+	names := make([]string, 0, len(user.Attributes))
+	for name := range user.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name, user.Attributes[name]...)
+	}
+	for _, group := range groups {
+		add("memberOf", group.Path)
+	}
+	return entry
+}
+
+// authenticate requests an access token by the OAuth 2.0 client credentials
+// grant of the EnvKeycloakClientId's service account.
+func (kc *keycloakClient) authenticate() error {
+	tokenUrl := strings.TrimSuffix(cfg.keycloakUrl, "/") +
+		"/realms/" + url.PathEscape(cfg.keycloakRealm) + "/protocol/openid-connect/token"
+	resp, err := kc.client.PostForm(tokenUrl, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {cfg.keycloakClientId},
+		"client_secret": {cfg.keycloakClientSecret},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("cannot decode token response: %w", err)
+	} else if token.AccessToken == "" {
+		return fmt.Errorf("token response lacks an access token")
+	}
+	kc.token = token.AccessToken
+	return nil
+}
+
+// get decodes the JSON response of the realm's Admin REST API path into v.
+func (kc *keycloakClient) get(path string, v any) error {
+	reqUrl := strings.TrimSuffix(cfg.keycloakUrl, "/") +
+		"/admin/realms/" + url.PathEscape(cfg.keycloakRealm) + "/" + path
+	req, err := http.NewRequest(http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+kc.token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
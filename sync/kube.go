@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// kubeServiceAccountDir contains the pod's mounted service account credentials.
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+const (
+	// KubeEventNormal is a Kubernetes Event type for informational events.
+	KubeEventNormal = "Normal"
+
+	// KubeEventWarning is a Kubernetes Event type for failures.
+	KubeEventWarning = "Warning"
+)
+
+// kubeEvents posts Kubernetes Events, if enabled by EnvKubeEvents.
+var kubeEvents *kubeEventer
+
+// kubeEventer creates Kubernetes Events for this pod via the in-cluster API.
+//
+// Instead of depending on client-go, the API is called directly with the
+// pod's service account, which needs permission to create events.
+type kubeEventer struct {
+	client    *http.Client
+	apiUrl    string
+	token     string
+	namespace string
+	pod       string
+}
+
+// newKubeEventer creates a kubeEventer based on the in-cluster environment.
+func newKubeEventer() (*kubeEventer, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are unset")
+	}
+
+	token, err := os.ReadFile(kubeServiceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := os.ReadFile(kubeServiceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	caPem, err := os.ReadFile(kubeServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("cannot parse Kubernetes CA certificate")
+	}
+
+	pod := os.Getenv("POD_NAME")
+	if pod == "" {
+		if pod, err = os.Hostname(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &kubeEventer{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: caPool}},
+		},
+		apiUrl:    "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(namespace)),
+		pod:       pod,
+	}, nil
+}
+
+// post creates an Event for this pod in the background.
+//
+// Failures are only logged, as Events are a best effort addition to the log.
+func (k *kubeEventer) post(eventType, reason, message string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	event := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Event",
+		"metadata": map[string]any{
+			"generateName": k.pod + ".",
+			"namespace":    k.namespace,
+		},
+		"involvedObject": map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"name":       k.pod,
+			"namespace":  k.namespace,
+		},
+		"type":           eventType,
+		"reason":         reason,
+		"message":        message,
+		"source":         map[string]any{"component": "greenlight-ldap-sync"},
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+	}
+
+	go func() {
+		if err := k.create(event); err != nil {
+			log.WithField("reason", reason).WithError(err).Warn("Failed to create Kubernetes Event")
+		}
+	}()
+}
+
+// create POSTs an Event object to the Kubernetes API.
+func (k *kubeEventer) create(event map[string]any) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost,
+		fmt.Sprintf("%s/api/v1/namespaces/%s/events", k.apiUrl, k.namespace),
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
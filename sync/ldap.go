@@ -0,0 +1,1254 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapUser is a user's LDAP entry, mapped to Greenlight's SQL columns.
+type ldapUser struct {
+	// dn is the DN of the user's LDAP entry.
+	dn string
+
+	// attrs maps Greenlight's SQL columns to their LDAP values.
+	attrs map[string]string
+
+	// empty lists Greenlight's SQL columns whose LDAP attribute is present, but
+	// without any value. In contrast, absent attributes are neither in attrs nor
+	// in empty.
+	empty map[string]bool
+
+	// optOut is set for users excluded by the configured EnvOptOutAttribute.
+	optOut bool
+
+	// locked is set for temporarily locked accounts, see ldapEntryLocked.
+	locked bool
+
+	// disabled is set for expired or disabled accounts, see ldapEntryDisabled.
+	disabled bool
+
+	// groups are the DNs of the groups this user is a member of, based on the
+	// memberOf attribute. Only requested if withGroups is set.
+	groups []string
+
+	// ambiguous are the DNs of all entries matching this user, if there were
+	// multiple ones, see ldapDisambiguate.
+	ambiguous []string
+}
+
+// ldapSearchBase is a base DN to search users in, with an additional filter.
+type ldapSearchBase struct {
+	dn     string
+	filter string
+}
+
+// parseLdapBases parses an EnvLdapBases value.
+//
+// Its semicolon separated entries are a base DN, optionally followed by an
+// LDAP filter, e.g., "ou=staff,dc=example,dc=org (employeeType=staff)". As the
+// filter starts at the first opening parenthesis, parentheses within a DN
+// must be escaped as \28 and \29.
+func parseLdapBases(basesStr string) (bases []ldapSearchBase, err error) {
+	for _, entry := range strings.Split(basesStr, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		var base ldapSearchBase
+		if i := strings.Index(entry, "("); i >= 0 {
+			base.dn, base.filter = entry[:i], strings.TrimSpace(entry[i:])
+			if _, err = ldap.CompileFilter(base.filter); err != nil {
+				err = fmt.Errorf("invalid filter of base %q: %w", entry, err)
+				return
+			}
+		} else {
+			base.dn = entry
+		}
+
+		base.dn = strings.TrimSpace(base.dn)
+		if _, err = ldap.ParseDN(base.dn); err != nil {
+			err = fmt.Errorf("invalid base DN %q: %w", base.dn, err)
+			return
+		}
+		bases = append(bases, base)
+	}
+	return
+}
+
+// ldapUserFilterVerb is substituted by the escaped LDAP_UID value within an
+// EnvLdapUserFilter.
+const ldapUserFilterVerb = "%s"
+
+// parseLdapUserFilter validates an EnvLdapUserFilter template, e.g.,
+// "(&(objectClass=person)(uid=%s))", which must contain the
+// ldapUserFilterVerb exactly once.
+func parseLdapUserFilter(template string) (string, error) {
+	if template == "" {
+		return "", nil
+	}
+	if n := strings.Count(template, ldapUserFilterVerb); n != 1 {
+		return "", fmt.Errorf("filter %q must contain %s exactly once, not %d times", template, ldapUserFilterVerb, n)
+	}
+	if _, err := ldap.CompileFilter(strings.Replace(template, ldapUserFilterVerb, "user", 1)); err != nil {
+		return "", fmt.Errorf("invalid filter %q: %w", template, err)
+	}
+	return template, nil
+}
+
+// ldapFilter returns the filters restricting all user searches, being
+// LDAP_FILTER followed by the EnvLdapExtraFilter.
+func ldapFilter() string {
+	return os.Getenv("LDAP_FILTER") + cfg.ldapExtraFilter
+}
+
+// ldapBases returns the EnvLdapBases, defaulting to LDAP_BASE.
+func ldapBases() []ldapSearchBase {
+	if len(cfg.ldapBases) > 0 {
+		return cfg.ldapBases
+	}
+	return []ldapSearchBase{{dn: os.Getenv("LDAP_BASE")}}
+}
+
+// ldapSearcher is the subset of an LDAP connection used for user searches.
+//
+// Besides *ldap.Conn for a live LDAP server, ldifDirectory implements it for
+// LDIF files and other identity sources, e.g., for SourceKeycloak.
+type ldapSearcher interface {
+	Search(*ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// ldapPagingSearcher is an ldapSearcher supporting the Simple Paged Results
+// control, e.g., *ldap.Conn.
+type ldapPagingSearcher interface {
+	SearchWithPaging(*ldap.SearchRequest, uint32) (*ldap.SearchResult, error)
+}
+
+// ldapContextSearcher is an ldapSearcher supporting the cancellation of
+// searches, e.g., ldapRetryConn.
+type ldapContextSearcher interface {
+	SearchContext(context.Context, *ldap.SearchRequest) (*ldap.SearchResult, error)
+}
+
+// ldapSearchContext performs an ldapSearch, aborted once ctx is done if the
+// connection is an ldapContextSearcher.
+func ldapSearchContext(ctx context.Context, conn ldapSearcher, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if ctxConn, ok := conn.(ldapContextSearcher); ok {
+		return ctxConn.SearchContext(ctx, req)
+	}
+	return ldapSearch(conn, req)
+}
+
+// ldapSearch performs a search, paged by the configured EnvLdapPageSize if the
+// connection supports it. Thus, a server's size limit, e.g., Active
+// Directory's 1000 entries, does not truncate the result. Requests without a
+// time limit are limited by the EnvLdapTimeLimit.
+func ldapSearch(conn ldapSearcher, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	defer func(start time.Time) { metrics.observeLdapSearch(time.Since(start)) }(time.Now())
+
+	if req.TimeLimit == 0 && cfg.ldapTimeLimit > 0 {
+		req.TimeLimit = int((cfg.ldapTimeLimit + time.Second - 1) / time.Second)
+	}
+	if pagingConn, ok := conn.(ldapPagingSearcher); ok && cfg.ldapPageSize > 0 {
+		return pagingConn.SearchWithPaging(req, uint32(cfg.ldapPageSize))
+	}
+	return conn.Search(req)
+}
+
+// ldapOpen opens the configured LDAP source, either the import command's CSV
+// file, the users of a SourceKeycloak realm, an LDIF file, or a server.
+func ldapOpen() (ldapSearcher, error) {
+	if ldapImport != nil {
+		// A copy is returned, as closing it releases its entries.
+		return &ldifDirectory{entries: ldapImport.entries}, nil
+	}
+	if cfg.source == SourceKeycloak {
+		return keycloakLoad()
+	}
+	if cfg.ldapLdif != "" {
+		dir, err := ldifLoad(cfg.ldapLdif)
+		if err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+
+	conn, err := ldapDial()
+	if err != nil {
+		return nil, err
+	}
+	return &ldapRetryConn{conn: conn}, nil
+}
+
+// errLdapReconnect is returned by ldapRetryConn if a lost connection cannot be
+// redialed, which would fail each further search as well.
+var errLdapReconnect = errors.New("cannot reconnect to LDAP")
+
+// ldapRetryConn is an ldapSearcher retrying searches failing transiently, see
+// ldapRetriable, by opRetry. After network errors, the connection is redialed.
+type ldapRetryConn struct {
+	conn *ldap.Conn
+
+	// used is the end of the last search, for EnvLdapIdleTimeout.
+	used time.Time
+}
+
+// Search performs an ldapSearch, retried on transient errors.
+func (c *ldapRetryConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return c.SearchContext(context.Background(), req)
+}
+
+// SearchContext performs a Search, aborted once ctx is done.
+//
+// As go-ldap does not support cancelling a single request, the connection is
+// closed to abort it and redialed by the next search.
+//
+// Connections closed by the server, e.g., after its idle timeout or a restart,
+// or idle for EnvLdapIdleTimeout are redialed and bound again by ldapDial
+// before searching. If this fails, errLdapReconnect is returned.
+func (c *ldapRetryConn) SearchContext(ctx context.Context, req *ldap.SearchRequest) (res *ldap.SearchResult, err error) {
+	err = opRetry("LDAP", func() (err error) {
+		if err = ctx.Err(); err != nil {
+			return permanentError{err}
+		}
+		if c.conn != nil && (c.conn.IsClosing() || cfg.ldapIdleTimeout > 0 && time.Since(c.used) >= cfg.ldapIdleTimeout) {
+			log.WithField("idle", time.Since(c.used).Round(time.Second)).Debug("LDAP connection was closed or is idle, reconnecting")
+			_ = c.conn.Close()
+			c.conn = nil
+		}
+		if c.conn == nil {
+			if c.conn, err = ldapDial(); err != nil {
+				return permanentError{fmt.Errorf("%w: %w", errLdapReconnect, err)}
+			}
+		}
+
+		conn := c.conn
+		stop := context.AfterFunc(ctx, func() { _ = conn.Close() })
+		res, err = ldapSearch(conn, req)
+		c.used = time.Now()
+		if !stop() {
+			c.conn = nil
+			res, err = nil, permanentError{ctx.Err()}
+		} else if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			_ = c.conn.Close()
+			c.conn = nil
+		} else if err != nil && !ldapRetriable(err) {
+			err = permanentError{err}
+		}
+		return
+	})
+
+	var permErr permanentError
+	if errors.As(err, &permErr) {
+		err = permErr.error
+	}
+	return
+}
+
+// Close closes the current connection, if any.
+func (c *ldapRetryConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// ldapOpenPool opens n connections to the configured LDAP source.
+//
+// As an LDIF file is only read, its single ldifDirectory is shared n times.
+func ldapOpenPool(n int) (conns []ldapSearcher, err error) {
+	conn, err := ldapOpen()
+	if err != nil {
+		return
+	}
+	conns = append(conns, conn)
+
+	for len(conns) < n {
+		if _, ok := conn.(*ldifDirectory); ok {
+			conns = append(conns, conn)
+			continue
+		}
+
+		if conn, err = ldapOpen(); err != nil {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+			conns = nil
+			return
+		}
+		conns = append(conns, conn)
+	}
+	return
+}
+
+// ldapSearchResult is the outcome of an ldapUserSearch by ldapUserSearchAll.
+type ldapSearchResult struct {
+	usr ldapUser
+	err error
+}
+
+// ldapUserSearchAll performs ldapUserSearch for all users concurrently, one
+// worker per connection. The results are ordered like the users. Once ctx is
+// done, the remaining searches fail with its error.
+//
+// For an EnvLdapSearchBatch, each worker performs an ldapUserSearchBatch for
+// this many users at once instead.
+func ldapUserSearchAll(ctx context.Context, conns []ldapSearcher, users []string, withGroups bool) []ldapSearchResult {
+	results := make([]ldapSearchResult, len(users))
+	indexes := make(chan int)
+	batchSize := max(cfg.ldapSearchBatch, 1)
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn ldapSearcher) {
+			defer wg.Done()
+			for i := range indexes {
+				if batchSize > 1 {
+					end := min(i+batchSize, len(users))
+					copy(results[i:end], ldapUserSearchBatch(ctx, conn, users[i:end], withGroups))
+					continue
+				}
+				results[i].usr, results[i].err = ldapUserSearch(ctx, conn, users[i], withGroups)
+			}
+		}(conn)
+	}
+
+	for i := 0; i < len(users); i += batchSize {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// ldapDial establishes a connection to the configured LDAP server, retried by dialRetry.
+func ldapDial() (conn *ldap.Conn, err error) {
+	err = dialRetry("LDAP", func() (err error) {
+		conn, err = ldapDialOnce()
+		return
+	})
+	return
+}
+
+// ldapRetryCodesDefault are the LDAP result codes retried by default: those
+// indicating a transient server condition.
+var ldapRetryCodesDefault = []uint16{
+	ldap.LDAPResultTimeLimitExceeded,
+	ldap.LDAPResultBusy,
+	ldap.LDAPResultUnavailable,
+	ldap.LDAPResultTimeout,
+}
+
+// ldapRetryCodesDenied are LDAP result codes which cannot be configured as
+// retriable, as retrying them would not help and might lock the bind DN.
+var ldapRetryCodesDenied = []uint16{
+	ldap.LDAPResultInappropriateAuthentication,
+	ldap.LDAPResultInvalidCredentials,
+	ldap.LDAPResultInsufficientAccessRights,
+}
+
+// parseLdapRetryCodes parses the comma separated EnvLdapRetryCodes values.
+func parseLdapRetryCodes(values []string) (codes []uint16, err error) {
+	for _, v := range values {
+		code, parseErr := strconv.ParseUint(v, 10, 16)
+		if parseErr != nil {
+			err = fmt.Errorf("invalid LDAP result code %q", v)
+			return
+		}
+		if slices.Contains(ldapRetryCodesDenied, uint16(code)) {
+			err = fmt.Errorf("LDAP result code %d (%s) cannot be retried",
+				code, ldap.LDAPResultCodeMap[uint16(code)])
+			return
+		}
+		codes = append(codes, uint16(code))
+	}
+	return
+}
+
+// ldapRetriable checks if an LDAP error is transient, based on the configured
+// EnvLdapRetryCodes. Network errors and non-LDAP errors are always retriable.
+func ldapRetriable(err error) bool {
+	var ldapErr *ldap.Error
+	if !errors.As(err, &ldapErr) || ldapErr.ResultCode == ldap.ErrorNetwork {
+		return true
+	}
+	return slices.Contains(cfg.ldapRetryCodes, ldapErr.ResultCode)
+}
+
+// ldapServerAddr is an LDAP server to connect to, as returned by ldapServers.
+type ldapServerAddr struct {
+	method string
+	host   string
+	addr   string
+
+	// credentials override LDAP_AUTH if set, e.g., for a referral.
+	credentials *ldapCredentials
+}
+
+// ldapServers returns the LDAP servers in the order to try them.
+//
+// These are either the EnvLdapServers or Greenlight's single LDAP_SERVER, each
+// parsed by ldapParseServer. A dns-srv:// entry is resolved by ldapLookupSRV.
+// Unparsable servers are reported as permanentError.
+func ldapServers() (servers []ldapServerAddr, err error) {
+	entries := cfg.ldapServers
+	if len(entries) == 0 {
+		entries = []string{os.Getenv("LDAP_SERVER")}
+	}
+
+	for _, entry := range entries {
+		if domain, ok := strings.CutPrefix(entry, "dns-srv://"); ok {
+			var srvServers []ldapServerAddr
+			if srvServers, err = ldapLookupSRV(domain); err != nil {
+				return
+			}
+			servers = append(servers, srvServers...)
+			continue
+		}
+
+		var server ldapServerAddr
+		if server, err = ldapParseServer(entry); err != nil {
+			err = permanentError{err}
+			return
+		}
+		servers = append(servers, server)
+	}
+	return
+}
+
+// ldapParseServer parses a server in the format of LDAP_SERVER.
+//
+// Besides Greenlight's host name, LDAP_SERVER might be an ldap:// or ldaps://
+// URL. An ldaps:// URL implies the ssl LDAP_METHOD, while its port takes
+// precedence over LDAP_PORT and EnvLdapGlobalCatalog.
+func ldapParseServer(server string) (s ldapServerAddr, err error) {
+	method, host, port := os.Getenv("LDAP_METHOD"), server, os.Getenv("LDAP_PORT")
+	if cfg.ldapGlobalCatalog {
+		port = adGlobalCatalogPort
+		if method == "ssl" {
+			port = adGlobalCatalogPortSsl
+		}
+	}
+
+	if strings.Contains(host, "://") {
+		u, parseErr := url.Parse(host)
+		if parseErr != nil {
+			err = fmt.Errorf("cannot parse LDAP server %q: %w", server, parseErr)
+			return
+		}
+
+		switch u.Scheme {
+		case "ldaps":
+			method = "ssl"
+		case "ldap":
+		default:
+			err = fmt.Errorf("unsupported LDAP server scheme %q", u.Scheme)
+			return
+		}
+
+		host = u.Hostname()
+		if u.Port() != "" {
+			port = u.Port()
+		} else if cfg.ldapGlobalCatalog && method == "ssl" {
+			port = adGlobalCatalogPortSsl
+		}
+	}
+
+	s = ldapServerAddr{method: method, host: host, addr: net.JoinHostPort(host, port)}
+	return
+}
+
+// ldapLookupSRV discovers the LDAP servers of a domain by its DNS SRV records,
+// _ldaps._tcp for the ssl LDAP_METHOD and _ldap._tcp otherwise, ordered by
+// their priority and weight.
+func ldapLookupSRV(domain string) (servers []ldapServerAddr, err error) {
+	method, service := os.Getenv("LDAP_METHOD"), "ldap"
+	if method == "ssl" {
+		service = "ldaps"
+	}
+
+	_, records, err := net.LookupSRV(service, "tcp", domain)
+	if err != nil {
+		err = fmt.Errorf("cannot discover LDAP servers of %s: %w", domain, err)
+		return
+	}
+
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		servers = append(servers, ldapServerAddr{
+			method: method,
+			host:   host,
+			addr:   net.JoinHostPort(host, strconv.Itoa(int(record.Port))),
+		})
+	}
+	return
+}
+
+// ldapTLSConfig creates the tls.Config for both ldaps and StartTLS.
+//
+// The certificate is verified against EnvLdapTLSServerName if set, e.g., behind
+// an SNI routing load balancer, and against the host otherwise. Certificates
+// are verified against the EnvLdapTLSCAFile in addition to the system's CAs
+// and a client certificate is presented for EnvLdapTLSCertFile.
+func ldapTLSConfig(host string, insecureSkipVerify bool) (tlsConfig *tls.Config, err error) {
+	serverName := cfg.ldapTLSServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	tlsConfig = &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if cfg.ldapTLSCAFile != "" {
+		var caPem []byte
+		if caPem, err = os.ReadFile(cfg.ldapTLSCAFile); err != nil {
+			return
+		}
+
+		if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			err = fmt.Errorf("cannot parse any certificate of %s", cfg.ldapTLSCAFile)
+			return
+		}
+	}
+
+	if cfg.ldapTLSCertFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cfg.ldapTLSCertFile, cfg.ldapTLSKeyFile); err != nil {
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	tlsApply(tlsConfig, "LDAP", serverName)
+	err = nil
+	return
+}
+
+// ldapDialOnce performs a single connection attempt for ldapDial.
+//
+// The ldapServers are tried in order until one accepts the connection and the
+// bind. Thus, each connection prefers the first server, failing back to it once
+// available again. Permanent errors are returned immediately.
+func ldapDialOnce() (conn *ldap.Conn, err error) {
+	servers, err := ldapServers()
+	if err != nil {
+		return
+	}
+
+	for i, server := range servers {
+		conn, err = ldapDialServer(server)
+
+		var permErr permanentError
+		if err == nil || errors.As(err, &permErr) {
+			return
+		}
+		if i < len(servers)-1 {
+			log.WithField("server", server.addr).WithError(err).Warn("Cannot connect to LDAP server, trying the next one")
+		}
+	}
+	return
+}
+
+// ldapAnonymousWarning logs the warning of ldapAnonymousBind only once, not on
+// each connection.
+var ldapAnonymousWarning sync.Once
+
+// ldapAnonymousBind binds without a password following EnvLdapAnonymous.
+//
+// An unauthenticated bind by dn, being an anonymous bind for an empty dn, is
+// performed unless LdapAnonymousSkip skips the bind altogether.
+func ldapAnonymousBind(conn *ldap.Conn, dn string) error {
+	ldapAnonymousWarning.Do(func() {
+		log.WithFields(log.Fields{
+			"bind_dn": dn,
+			"mode":    cfg.ldapAnonymous,
+		}).Warn("Binding to LDAP without credentials, only anonymously readable attributes are synced")
+	})
+
+	if cfg.ldapAnonymous == LdapAnonymousSkip {
+		return nil
+	}
+	return conn.UnauthenticatedBind(dn)
+}
+
+// ldapDialTCP connects to an LDAP server's address within the
+// EnvLdapDialTimeout, performing a TLS handshake for a tlsConfig within the
+// EnvLdapTLSHandshakeTimeout. The connection is returned together with its
+// underlying network connection, e.g., for a StartTLS by ldapHandshake.
+func ldapDialTCP(addr string, tlsConfig *tls.Config) (conn *ldap.Conn, netConn net.Conn, err error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.ldapDialTimeout,
+		KeepAlive: cfg.keepAlive,
+	}
+	if netConn, err = dialer.Dial("tcp", addr); err != nil {
+		err = ldap.NewError(ldap.ErrorNetwork, err)
+		return
+	}
+
+	ldapNetConn := netConn
+	if tlsConfig != nil {
+		tlsConn := tls.Client(netConn, tlsConfig)
+		if err = ldapHandshake(netConn, tlsConn.Handshake); err != nil {
+			_ = netConn.Close()
+			return
+		}
+		ldapNetConn = tlsConn
+	}
+
+	conn = ldap.NewConn(ldapNetConn, tlsConfig != nil)
+	conn.Start()
+	return
+}
+
+// ldapHandshake performs a TLS handshake on the network connection, e.g., by a
+// StartTLS, within the EnvLdapTLSHandshakeTimeout.
+//
+// As the handshake only reads and writes within a deadline of the connection,
+// a server silently dropping its packets fails instead of hanging.
+func ldapHandshake(netConn net.Conn, handshake func() error) error {
+	if cfg.ldapTLSHandshakeTimeout > 0 {
+		_ = netConn.SetDeadline(time.Now().Add(cfg.ldapTLSHandshakeTimeout))
+		defer func() { _ = netConn.SetDeadline(time.Time{}) }()
+	}
+
+	err := handshake()
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		err = ldap.NewError(ldap.ErrorNetwork, fmt.Errorf("TLS handshake timed out after %v: %w", cfg.ldapTLSHandshakeTimeout, err))
+	}
+	return err
+}
+
+// ldapDialServer connects and binds to a single server for ldapDialOnce.
+//
+// LDAP errors which are not ldapRetriable are marked as permanentError.
+func ldapDialServer(server ldapServerAddr) (conn *ldap.Conn, err error) {
+	defer func() {
+		var permErr permanentError
+		if err != nil && !errors.As(err, &permErr) && !ldapRetriable(err) {
+			err = permanentError{err}
+		}
+	}()
+
+	method, host, addr := server.method, server.host, server.addr
+
+	// https://github.com/bigbluebutton/greenlight/blob/release-2.8.5/app/controllers/sessions_controller.rb#L135-L140
+	switch method {
+	case "ssl":
+		// TLS
+		tls_no_verify := false
+		tls_no_verify, err = strconv.ParseBool(os.Getenv("LDAP_TLS_NO_VERIFY"))
+		if err != nil {
+			err = permanentError{err}
+			return
+		}
+		var tlsConfig *tls.Config
+		if tlsConfig, err = ldapTLSConfig(host, tls_no_verify); err != nil {
+			err = permanentError{err}
+			return
+		}
+		conn, _, err = ldapDialTCP(addr, tlsConfig)
+		if err != nil {
+			return
+		}
+
+	case "tls":
+		// STARTTLS
+		var tlsConfig *tls.Config
+		if tlsConfig, err = ldapTLSConfig(host, false); err != nil {
+			err = permanentError{err}
+			return
+		}
+		var netConn net.Conn
+		conn, netConn, err = ldapDialTCP(addr, nil)
+		if err != nil {
+			return
+		}
+		conn.SetTimeout(cfg.ldapBindTimeout)
+		err = ldapHandshake(netConn, func() error { return conn.StartTLS(tlsConfig) })
+		if err != nil && cfg.ldapStartTLS == StartTLSOpportunistic {
+			log.WithError(err).Warn("StartTLS failed, falling back to an unencrypted LDAP connection")
+			_ = conn.Close()
+			conn, _, err = ldapDialTCP(addr, nil)
+		}
+		if err != nil {
+			if conn != nil {
+				_ = conn.Close()
+				conn = nil
+			}
+			return
+		}
+
+	default:
+		// No Encryption
+		conn, _, err = ldapDialTCP(addr, nil)
+	}
+	if err != nil {
+		return
+	}
+	conn.SetTimeout(cfg.ldapBindTimeout)
+
+	// https://github.com/blindsidenetworks/bn-ldap-authentication/blob/0.1.4/lib/bn-ldap-authentication.rb#L15-L32
+	switch auth := os.Getenv("LDAP_AUTH"); {
+	case server.credentials != nil:
+		// Simple Authentication, EnvLdapReferralCredentials
+		err = conn.Bind(server.credentials.dn, server.credentials.password)
+
+	case cfg.ldapSasl == LdapSaslGssapi:
+		// SASL GSSAPI, EnvLdapSasl
+		err = ldapGssapiBind(conn, host)
+
+	case cfg.ldapSasl == LdapSaslExternal:
+		// SASL EXTERNAL, EnvLdapSasl, authenticated by EnvLdapTLSCertFile
+		if method != "ssl" && method != "tls" {
+			err = permanentError{fmt.Errorf("%s %s requires the LDAP_METHOD ssl or tls", EnvLdapSasl, LdapSaslExternal)}
+		} else {
+			err = conn.ExternalBind()
+		}
+
+	case auth == "simple":
+		// Simple Authentication, Bind DN
+		var dn, password string
+		if dn, password, err = ldapBindCredentials(); err != nil {
+			err = permanentError{err}
+		} else if password == "" && cfg.ldapAnonymous != LdapAnonymousNone {
+			err = ldapAnonymousBind(conn, dn)
+		} else {
+			err = conn.Bind(dn, password)
+		}
+
+	case auth == "user":
+		// Simple Authentication
+		err = permanentError{fmt.Errorf("user LDAP_AUTH is unsupported as no connection details are configured in the .env file")}
+
+	case auth == "anonymous":
+		// Anonymous Authentication
+		// https://github.com/ruby-ldap/ruby-net-ldap/blob/v0.17.0/lib/net/ldap/auth_adapter/simple.rb#L8-L12
+		err = ldapAnonymousBind(conn, "")
+
+	default:
+		err = permanentError{fmt.Errorf("%s is an unsupported LDAP_AUTH", os.Getenv("LDAP_AUTH"))}
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		conn = nil
+		return
+	}
+	conn.SetTimeout(cfg.ldapSearchTimeout)
+	return
+}
+
+// ldapAttrMapping creates a LDAP attribute map.
+//
+// This logic is usually hidden from a Greenlight administrator. Internally a
+// map of predefined values merged with LDAP_ATTRIBUTE_MAPPING is used to map
+// LDAP attributes to an intermediate form before being mapped to Greenlight's
+// SQL columns.
+//
+// If EnvAttributeMap is set, it replaces this logic. Its columns are used as
+// intermediate attributes, mapped to themselves by ldapColumn.
+func ldapAttrMapping() (attrMap map[string][]string, err error) {
+	if cfg.attributeMap != nil {
+		attrMap = make(map[string][]string, len(cfg.attributeMap))
+		for col, sources := range cfg.attributeMap {
+			attrMap[col] = slices.Clone(sources)
+		}
+		return
+	}
+
+	// https://github.com/blindsidenetworks/bn-ldap-authentication/blob/0.1.4/lib/bn-ldap-authentication.rb#L4-L12
+	attrMap = map[string][]string{
+		"uid":        []string{"dn"},
+		"name":       []string{"cn", "displayName"},
+		"first_name": []string{"givenName"},
+		"last_name":  []string{"sn"},
+		"email":      []string{"mail", "email", "userPrincipalName"},
+		"nickname":   []string{"uid", "userid", "sAMAccountName"},
+		"image":      []string{"jpegPhoto"},
+	}
+
+	// https://github.com/blindsidenetworks/bn-ldap-authentication/blob/0.1.4/lib/bn-ldap-authentication.rb#L80-L96
+	mappings := strings.Split(os.Getenv("LDAP_ATTRIBUTE_MAPPING"), ";")
+	for _, mapping := range mappings {
+		if mapping == "" {
+			continue
+		}
+
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("mapping %s cannot be split", mapping)
+			return
+		}
+
+		// A value might be a comma separated list of fallback sources, e.g.,
+		// email=mail,userPrincipalName, being prepended in their given order.
+		k, vs := kv[0], strings.Split(kv[1], ",")
+
+		attr, ok := attrMap[k]
+		if ok {
+			attr = append(vs, attr...)
+		} else {
+			attr = vs
+		}
+
+		attrMap[k] = attr
+
+		log.WithFields(log.Fields{
+			"key":    k,
+			"values": attr,
+		}).Debug("Updated attribute map based on LDAP_ATTRIBUTE_MAPPING")
+	}
+
+	return
+}
+
+// ldapGreenlightMap maps intermediate attributes to Greenlight's SQL columns.
+//
+// https://docs.bigbluebutton.org/greenlight/gl-config.html#ldap-auth LDAP_ATTRIBUTE_MAPPING table
+var ldapGreenlightMap = map[string]string{
+	"uid":      "social_uid",
+	"name":     "name",
+	"email":    "email",
+	"nickname": "username",
+	"image":    "image",
+}
+
+// ldapColumn maps an intermediate attribute of ldapAttrMapping to its SQL
+// column, based on either EnvAttributeMap or ldapGreenlightMap.
+func ldapColumn(intermediate string) (col string, ok bool) {
+	if cfg.attributeMap != nil {
+		_, ok = cfg.attributeMap[intermediate]
+		return intermediate, ok
+	}
+	col, ok = ldapGreenlightMap[intermediate]
+	return
+}
+
+// parseAttributeMap parses SYNC_ATTRIBUTE_MAP's COLUMN=ATTRIBUTE pairs.
+//
+// Multiple LDAP attributes for one column might be listed by commas as
+// fallbacks, e.g., "email=mail,userPrincipalName". Columns identifying or
+// managing a user cannot be mapped.
+func parseAttributeMap(mapStr string) (attrMap map[string][]string, err error) {
+	for _, mapping := range strings.Split(mapStr, ";") {
+		if mapping == "" {
+			continue
+		}
+
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("mapping %s cannot be split", mapping)
+			return
+		}
+
+		col := strings.TrimSpace(kv[0])
+		if col == "" || strings.ContainsAny(col, "{}.?") {
+			err = fmt.Errorf("mapping %s has an invalid column", mapping)
+			return
+		}
+		if slices.Contains(ldapUnmappableColumns, col) {
+			err = fmt.Errorf("mapping %s targets the column %s, which cannot be synced", mapping, col)
+			return
+		}
+
+		if attrMap == nil {
+			attrMap = make(map[string][]string)
+		}
+		for _, attr := range strings.Split(kv[1], ",") {
+			if attr = strings.TrimSpace(attr); attr != "" {
+				attrMap[col] = append(attrMap[col], attr)
+			}
+		}
+		if len(attrMap[col]) == 0 {
+			err = fmt.Errorf("mapping %s has no LDAP attribute", mapping)
+			return
+		}
+	}
+	return
+}
+
+// ldapUnmappableColumns are the users columns rejected by parseAttributeMap.
+var ldapUnmappableColumns = []string{"id", "social_uid", "provider", "role_id", "deleted", "created_at", "updated_at"}
+
+// ldapAttrFlatten reduces the ldapAttrMapping map to a value slice.
+func ldapAttrFlatten(attrMap map[string][]string) (ldapAttrs []string) {
+	for _, vs := range attrMap {
+		ldapAttrs = append(ldapAttrs, vs...)
+	}
+	return
+}
+
+// ldapLockAttrs are the LDAP attributes used to detect temporarily locked accounts.
+//
+// OpenLDAP's ppolicy overlay sets pwdAccountLockedTime for locked accounts,
+// while Active Directory sets lockoutTime to a non-zero timestamp and computes
+// the UF_LOCKOUT flag. All are operational attributes and need to be requested
+// explicitly.
+var ldapLockAttrs = []string{"pwdAccountLockedTime", "lockoutTime", "msDS-User-Account-Control-Computed"}
+
+// ldapUfLockout is Active Directory's UF_LOCKOUT flag of the constructed
+// msDS-User-Account-Control-Computed attribute.
+const ldapUfLockout = 0x10
+
+// ldapEntryLocked checks if an LDAP entry is temporarily locked.
+//
+// Active Directory keeps the lockoutTime after the domain's lockoutDuration
+// expired until the next logon, thus its UF_LOCKOUT flag is preferred. Only if
+// it is absent, e.g., for Samba, a non-zero lockoutTime marks a locked entry.
+func ldapEntryLocked(entry *ldap.Entry) bool {
+	if entry.GetAttributeValue("pwdAccountLockedTime") != "" {
+		return true
+	}
+
+	if v := entry.GetAttributeValue("msDS-User-Account-Control-Computed"); v != "" {
+		flags, err := strconv.ParseInt(v, 10, 64)
+		return err == nil && flags&ldapUfLockout != 0
+	}
+	lockoutTime := entry.GetAttributeValue("lockoutTime")
+	return lockoutTime != "" && lockoutTime != "0"
+}
+
+// ldapExpiryAttrs are the LDAP attributes used to detect expired or disabled
+// accounts, see ldapEntryDisabled.
+var ldapExpiryAttrs = []string{"shadowExpire", "accountExpires", "userAccountControl"}
+
+// ldapAccountDisable is Active Directory's ACCOUNTDISABLE userAccountControl
+// flag.
+const ldapAccountDisable = 0x2
+
+// ldapFiletimeUnixOffset are the seconds between the 1601 start of Active
+// Directory's FILETIME, counting intervals of 100 nanoseconds, and the Unix
+// epoch.
+const ldapFiletimeUnixOffset = 11644473600
+
+// ldapEntryDisabled checks if an LDAP entry is expired or disabled at now.
+//
+// The shadowAccount's shadowExpire counts days since the Unix epoch, while
+// Active Directory's accountExpires is a FILETIME, with both zero and the
+// maximum int64 value meaning never. Active Directory disables accounts by
+// the userAccountControl's ACCOUNTDISABLE flag. Unparsable values are ignored.
+func ldapEntryDisabled(entry *ldap.Entry, now time.Time) bool {
+	if v := entry.GetAttributeValue("shadowExpire"); v != "" {
+		if days, err := strconv.ParseInt(v, 10, 64); err == nil && days >= 0 && now.Unix() >= days*86400 {
+			return true
+		}
+	}
+
+	if v := entry.GetAttributeValue("accountExpires"); v != "" {
+		intervals, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && intervals > 0 && intervals != math.MaxInt64 {
+			if now.Unix() >= intervals/1e7-ldapFiletimeUnixOffset {
+				return true
+			}
+		}
+	}
+
+	if v := entry.GetAttributeValue("userAccountControl"); v != "" {
+		if flags, err := strconv.ParseInt(v, 10, 64); err == nil && flags&ldapAccountDisable != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ldapTruthy checks if an attribute value is true, either as an LDAP Boolean
+// (TRUE) or a common alternative like 1, yes, or on.
+func ldapTruthy(v string) bool {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "true", "1", "yes", "on":
+		return true
+	default:
+		return false
+	}
+}
+
+// errLdapUserMissing is returned by ldapUserSearch if no LDAP entry exists.
+var errLdapUserMissing = errors.New("user does not exist in LDAP")
+
+// errLdapUserAmbiguous is returned by ldapUserSearch if multiple LDAP entries
+// match a user.
+var errLdapUserAmbiguous = errors.New("expected exactly one LDAP response")
+
+// ldapIsAccessDenied checks if err is an LDAP insufficientAccessRights (50) result.
+func ldapIsAccessDenied(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.LDAPResultInsufficientAccessRights)
+}
+
+// ldapUserSearch returns this user's attributes based on the .env file.
+//
+// If withGroups is set, the user's group memberships are fetched as well,
+// including nested ones for EnvNestedGroups. Each call is subject to the
+// EnvLdapRate. Once ctx is done, the search is aborted.
+func ldapUserSearch(ctx context.Context, conn ldapSearcher, user string, withGroups bool) (ldapUsr ldapUser, err error) {
+	if err = ldapRateWait(ctx); err != nil {
+		return
+	}
+
+	// Started after the EnvLdapRate wait, the span covers the LDAP server only.
+	ctx, span := traceStart(ctx, "ldap.search", otlpSpanKindClient)
+	span.set("user", user)
+	defer func() {
+		if errors.Is(err, errLdapUserMissing) {
+			span.set("found", false)
+			span.finish(nil)
+		} else {
+			span.finish(err)
+		}
+	}()
+
+	attrMap, searchAttrs, err := ldapUserSearchAttrs(withGroups)
+	if err != nil {
+		return
+	}
+
+	// The bases are searched in order, the first one with a match wins.
+	var entry *ldap.Entry
+	var ambiguous []string
+	for _, base := range ldapBases() {
+		searchReq := ldap.NewSearchRequest(
+			base.dn,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+			false,
+			fmt.Sprintf("(&%s%s%s)", ldapUidFilter(user), ldapFilter(), base.filter),
+			searchAttrs,
+			nil)
+
+		var searchResp *ldap.SearchResult
+		if searchResp, err = ldapSearchContext(ctx, conn, searchReq); err != nil {
+			return
+		}
+		if len(searchResp.Entries) == 0 && len(searchResp.Referrals) > 0 && cfg.ldapReferralHops > 0 {
+			if searchResp.Entries, err = ldapChaseReferrals(ctx, searchReq, searchResp.Referrals, cfg.ldapReferralHops); err != nil {
+				return
+			}
+		}
+
+		if l := len(searchResp.Entries); l == 1 {
+			entry = searchResp.Entries[0]
+			break
+		} else if l > 1 {
+			for _, e := range searchResp.Entries {
+				ambiguous = append(ambiguous, e.DN)
+			}
+			if entry, err = ldapDisambiguate(ctx, conn, user, searchReq, searchResp.Entries); err != nil {
+				ldapUsr.ambiguous = ambiguous
+				return
+			}
+			break
+		}
+	}
+	if entry == nil {
+		err = errLdapUserMissing
+		return
+	}
+
+	ldapUsr = ldapEntryUser(user, entry, attrMap, withGroups)
+	ldapUsr.ambiguous = ambiguous
+	if withGroups {
+		ldapUsr.groups, err = ldapNestedGroups(ctx, conn, ldapUsr)
+	}
+	return
+}
+
+// ldapWithGroups checks if the users' groups are needed, being the case for
+// the EnvRoleMap, EnvSharedRooms, EnvIncludeGroups, EnvExcludeGroups, and
+// EnvAdminGroup.
+func ldapWithGroups() bool {
+	return len(cfg.roleMap)+len(cfg.sharedRooms) > 0 || len(cfg.includeGroups)+len(cfg.excludeGroups) > 0 || cfg.adminGroup != ""
+}
+
+// ldapUserSearchAttrs returns the attribute mapping and all attributes to be
+// requested for an ldapUserSearch.
+func ldapUserSearchAttrs(withGroups bool) (attrMap map[string][]string, searchAttrs []string, err error) {
+	if attrMap, err = ldapAttrMapping(); err != nil {
+		return
+	}
+
+	searchAttrs = append(ldapAttrFlatten(attrMap), ldapLockAttrs...)
+	searchAttrs = append(searchAttrs, ldapExpiryAttrs...)
+	if withGroups {
+		searchAttrs = append(searchAttrs, "memberOf")
+	}
+	if cfg.optOutAttribute != "" {
+		searchAttrs = append(searchAttrs, cfg.optOutAttribute)
+	}
+	if cfg.ambiguousPolicy == AmbiguousPolicyTieBreaker {
+		attr, _ := ldapTieBreakerAttr()
+		searchAttrs = append(searchAttrs, attr)
+	}
+	if cfg.departmentColumn != "" && cfg.departmentSource != DepartmentSourceDN {
+		searchAttrs = append(searchAttrs, cfg.departmentSource)
+	}
+	searchAttrs = append(searchAttrs, cfg.avatarAttributes...)
+	for _, tmpl := range cfg.attributeTemplate {
+		searchAttrs = append(searchAttrs, tmpl.attrs...)
+	}
+	return
+}
+
+// ldapEntryUser maps a user's LDAP entry, as requested by ldapUserSearchAttrs,
+// to its ldapUser.
+func ldapEntryUser(user string, entry *ldap.Entry, attrMap map[string][]string, withGroups bool) (ldapUsr ldapUser) {
+	ldapUsr.dn = entry.DN
+	if cfg.optOutAttribute != "" {
+		ldapUsr.optOut = ldapTruthy(entry.GetAttributeValue(cfg.optOutAttribute))
+	}
+
+	ldapUsr.locked = ldapEntryLocked(entry)
+	ldapUsr.disabled = ldapEntryDisabled(entry, time.Now())
+	if withGroups {
+		ldapUsr.groups = entry.GetAttributeValues("memberOf")
+	}
+
+	log.WithFields(log.Fields{
+		"user":     user,
+		"locked":   ldapUsr.locked,
+		"disabled": ldapUsr.disabled,
+	}).Debug("Checked LDAP account lock state")
+
+	// Create map with key: LDAP key -> intermediate key -> Greenlight key
+	ldapAttrs := make(map[string]string)
+	ldapUsr.empty = make(map[string]bool)
+	for attrMapK, attrMapVs := range attrMap {
+		// Find an intermediate key for each attrMap key.
+		// The sources are tried in order and the first non-empty one is used.
+		var attrValue string
+		var attrPresent bool
+	LoopAttrMapVs:
+		for i, attrMapV := range attrMapVs {
+			for _, attr := range entry.Attributes {
+				if attrMapV != attr.Name {
+					continue
+				}
+
+				attrPresent = true
+				if attrValue = strings.Join(attr.Values, " "); attrValue == "" {
+					continue
+				}
+
+				if i > 0 {
+					log.WithFields(log.Fields{
+						"user":                   user,
+						"intermediate attribute": attrMapK,
+						"source":                 attrMapV,
+						"skipped sources":        attrMapVs[:i],
+					}).Debug("Using fallback LDAP attribute for intermediate attribute mapping")
+				}
+				break LoopAttrMapVs
+			}
+		}
+
+		// Present attributes without a value are recorded to be cleared on demand.
+		if attrPresent && attrValue == "" {
+			if dbKey, ok := ldapColumn(attrMapK); ok {
+				ldapUsr.empty[dbKey] = true
+			}
+		}
+
+		// Ignore unset attrMap keys, e.g., image resp. jpegPhoto
+		if attrValue == "" {
+			log.WithFields(log.Fields{
+				"user":                   user,
+				"intermediate attribute": attrMapK,
+			}).Debug("Cannot find LDAP attribute for intermediate attribute mapping")
+			continue
+		}
+
+		// Map intermediate key to a Greenlight database key, only if existent
+		if dbKey, ok := ldapColumn(attrMapK); ok {
+			ldapAttrs[dbKey] = attrValue
+		} else {
+			log.WithFields(log.Fields{
+				"user":                   user,
+				"intermediate attribute": attrMapK,
+			}).Debug("Cannot map intermediate attribute to Greenlight attribute")
+		}
+	}
+
+	if cfg.departmentColumn != "" {
+		department, depErr := ldapDepartment(entry)
+		if depErr != nil {
+			log.WithField("user", user).WithError(depErr).Warn("Cannot extract LDAP user's department")
+		} else if department != "" {
+			ldapAttrs[cfg.departmentColumn] = department
+		}
+	}
+
+	for col, tmpl := range cfg.attributeTemplate {
+		delete(ldapAttrs, col)
+		value, tmplErr := tmpl.execute(entry)
+		if tmplErr != nil {
+			log.WithFields(log.Fields{
+				"user":      user,
+				"attribute": col,
+			}).WithError(tmplErr).Warn("Cannot execute attribute template")
+			continue
+		} else if value != "" {
+			ldapAttrs[col] = value
+		}
+	}
+
+	if len(cfg.avatarAttributes) > 0 {
+		delete(ldapAttrs, "image")
+		for _, avatarAttr := range cfg.avatarAttributes {
+			photo := entry.GetRawAttributeValue(avatarAttr)
+			if len(photo) == 0 {
+				continue
+			}
+
+			uri, avatarErr := avatarDataUri(photo, cfg.avatarSize)
+			if avatarErr != nil {
+				log.WithFields(log.Fields{
+					"user":      user,
+					"attribute": avatarAttr,
+				}).WithError(avatarErr).Warn("Cannot convert LDAP photo to an avatar")
+				continue
+			}
+			ldapAttrs["image"] = uri
+			break
+		}
+	}
+
+	// The avatar's data URI is no text to be normalized.
+	if len(cfg.normalize) > 0 {
+		for col, value := range ldapAttrs {
+			if col != "image" {
+				ldapAttrs[col] = normalizeText(value)
+			}
+		}
+	}
+
+	ldapUsr.attrs = ldapAttrs
+	return
+}
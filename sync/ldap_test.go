@@ -0,0 +1,328 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLdap is an ldapSearcher answering each search by its handler.
+type fakeLdap struct {
+	handler func(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+}
+
+func (conn fakeLdap) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return conn.handler(req)
+}
+
+func (conn fakeLdap) Close() error {
+	return nil
+}
+
+// testEntry creates an LDAP entry of single-valued attributes.
+func testEntry(dn string, attrs map[string]string) *ldap.Entry {
+	values := make(map[string][]string, len(attrs))
+	for name, value := range attrs {
+		values[name] = []string{value}
+	}
+	return ldap.NewEntry(dn, values)
+}
+
+func TestLdapEntryLocked(t *testing.T) {
+	tests := []struct {
+		name   string
+		attrs  map[string]string
+		locked bool
+	}{
+		{"no lock attribute", map[string]string{"uid": "alice"}, false},
+		{"ppolicy locked", map[string]string{"pwdAccountLockedTime": "20240101000000Z"}, true},
+		{"ppolicy permanently locked", map[string]string{"pwdAccountLockedTime": "000001010000Z"}, true},
+		{"lockoutTime unset", map[string]string{"lockoutTime": "0"}, false},
+		{"lockoutTime set", map[string]string{"lockoutTime": "133500000000000000"}, true},
+		{"UF_LOCKOUT set", map[string]string{"msDS-User-Account-Control-Computed": "16"}, true},
+		{"UF_LOCKOUT with other flags", map[string]string{"msDS-User-Account-Control-Computed": "8388624"}, true},
+		{"UF_LOCKOUT cleared", map[string]string{"msDS-User-Account-Control-Computed": "0"}, false},
+		{"UF_LOCKOUT cleared with expired lockoutTime", map[string]string{
+			"msDS-User-Account-Control-Computed": "0",
+			"lockoutTime":                        "133500000000000000",
+		}, false},
+		{"UF_LOCKOUT unparsable", map[string]string{"msDS-User-Account-Control-Computed": "locked"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := testEntry("uid=alice,ou=people,dc=example,dc=org", test.attrs)
+			if locked := ldapEntryLocked(entry); locked != test.locked {
+				t.Errorf("ldapEntryLocked() = %v, want %v", locked, test.locked)
+			}
+		})
+	}
+}
+
+func TestLdapIsAccessDenied(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		denied bool
+	}{
+		{"insufficient access rights", ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("simulated")), true},
+		{"wrapped", fmt.Errorf("search: %w", ldap.NewError(ldap.LDAPResultInsufficientAccessRights, errors.New("simulated"))), true},
+		{"other result", ldap.NewError(ldap.LDAPResultOperationsError, errors.New("simulated")), false},
+		{"no LDAP error", errors.New("connection reset"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if denied := ldapIsAccessDenied(test.err); denied != test.denied {
+				t.Errorf("ldapIsAccessDenied() = %v, want %v", denied, test.denied)
+			}
+		})
+	}
+}
+
+func TestLdapUserSearchEmpty(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string][]string
+		attrs  map[string]string
+		empty  map[string]bool
+	}{
+		{"present", map[string][]string{"cn": {"Alice"}, "mail": {"alice@example.org"}},
+			map[string]string{"name": "Alice", "email": "alice@example.org"}, map[string]bool{}},
+		{"present but empty", map[string][]string{"cn": {}, "mail": {"alice@example.org"}},
+			map[string]string{"email": "alice@example.org"}, map[string]bool{"name": true}},
+		{"absent", map[string][]string{"mail": {"alice@example.org"}},
+			map[string]string{"email": "alice@example.org"}, map[string]bool{}},
+		{"empty with fallback", map[string][]string{"cn": {"Alice"}, "mail": {}, "userPrincipalName": {"alice@example.org"}},
+			map[string]string{"name": "Alice", "email": "alice@example.org"}, map[string]bool{}},
+		{"all sources empty", map[string][]string{"cn": {"Alice"}, "mail": {}, "email": {}, "userPrincipalName": {}},
+			map[string]string{"name": "Alice"}, map[string]bool{"email": true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", "")
+			conn := fakeLdap{func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+				entry := ldap.NewEntry("uid=alice,ou=people,dc=example,dc=org", test.values)
+				return &ldap.SearchResult{Entries: []*ldap.Entry{entry}}, nil
+			}}
+
+			ldapUsr, err := ldapUserSearch(context.Background(), conn, "alice", false)
+			if err != nil {
+				t.Fatalf("ldapUserSearch() failed: %v", err)
+			}
+			if !maps.Equal(ldapUsr.attrs, test.attrs) {
+				t.Errorf("attrs = %v, want %v", ldapUsr.attrs, test.attrs)
+			}
+			if !maps.Equal(ldapUsr.empty, test.empty) {
+				t.Errorf("empty = %v, want %v", ldapUsr.empty, test.empty)
+			}
+		})
+	}
+}
+
+func TestParseLdapRetryCodes(t *testing.T) {
+	tests := []struct {
+		values  []string
+		codes   []uint16
+		wantErr bool
+	}{
+		{[]string{"51", "52"}, []uint16{ldap.LDAPResultBusy, ldap.LDAPResultUnavailable}, false},
+		{nil, nil, false},
+		{[]string{"busy"}, nil, true},
+		{[]string{"70000"}, nil, true},
+		{[]string{"51", "49"}, nil, true},
+		{[]string{"48"}, nil, true},
+		{[]string{"50"}, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.values, ","), func(t *testing.T) {
+			codes, err := parseLdapRetryCodes(test.values)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseLdapRetryCodes() error = %v, want failure %v", err, test.wantErr)
+			}
+			if !test.wantErr && !slices.Equal(codes, test.codes) {
+				t.Errorf("parseLdapRetryCodes() = %v, want %v", codes, test.codes)
+			}
+		})
+	}
+}
+
+func TestLdapRetriable(t *testing.T) {
+	tests := []struct {
+		name      string
+		codes     []uint16
+		err       error
+		retriable bool
+	}{
+		{"busy by default", ldapRetryCodesDefault, ldap.NewError(ldap.LDAPResultBusy, errors.New("busy")), true},
+		{"unavailable by default", ldapRetryCodesDefault, ldap.NewError(ldap.LDAPResultUnavailable, errors.New("unavailable")), true},
+		{"invalid credentials", ldapRetryCodesDefault, ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("denied")), false},
+		{"busy not configured", []uint16{ldap.LDAPResultUnavailable}, ldap.NewError(ldap.LDAPResultBusy, errors.New("busy")), false},
+		{"configured code", []uint16{ldap.LDAPResultOther}, ldap.NewError(ldap.LDAPResultOther, errors.New("other")), true},
+		{"wrapped code", ldapRetryCodesDefault, fmt.Errorf("search: %w", ldap.NewError(ldap.LDAPResultBusy, errors.New("busy"))), true},
+		{"network error", nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset")), true},
+		{"non-LDAP error", nil, errors.New("i/o timeout"), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.ldapRetryCodes = test.codes })
+			if retriable := ldapRetriable(test.err); retriable != test.retriable {
+				t.Errorf("ldapRetriable(%v) = %v, want %v", test.err, retriable, test.retriable)
+			}
+		})
+	}
+}
+
+func TestLdapAttrMappingFallback(t *testing.T) {
+	tests := []struct {
+		mapping string
+		email   []string
+	}{
+		{"", []string{"mail", "email", "userPrincipalName"}},
+		{"email=userPrincipalName", []string{"userPrincipalName", "mail", "email", "userPrincipalName"}},
+		{"email=proxyAddresses,userPrincipalName", []string{"proxyAddresses", "userPrincipalName", "mail", "email", "userPrincipalName"}},
+	}
+	for _, test := range tests {
+		t.Run(test.mapping, func(t *testing.T) {
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", test.mapping)
+
+			attrMap, err := ldapAttrMapping()
+			if err != nil {
+				t.Fatalf("ldapAttrMapping() failed: %v", err)
+			}
+			if !slices.Equal(attrMap["email"], test.email) {
+				t.Errorf("ldapAttrMapping()[email] = %v, want %v", attrMap["email"], test.email)
+			}
+		})
+	}
+}
+
+func TestLdapUserSearchFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string][]string
+		email  string
+	}{
+		{"both present", map[string][]string{"mail": {"alice@example.org"}, "userPrincipalName": {"alice@corp.example.org"}}, "alice@example.org"},
+		{"primary present", map[string][]string{"mail": {"alice@example.org"}}, "alice@example.org"},
+		{"fallback present", map[string][]string{"userPrincipalName": {"alice@corp.example.org"}}, "alice@corp.example.org"},
+		{"primary empty", map[string][]string{"mail": {}, "userPrincipalName": {"alice@corp.example.org"}}, "alice@corp.example.org"},
+		{"both absent", map[string][]string{"cn": {"Alice"}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", "email=mail,userPrincipalName")
+			conn := fakeLdap{func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+				entry := ldap.NewEntry("uid=alice,ou=people,dc=example,dc=org", test.values)
+				return &ldap.SearchResult{Entries: []*ldap.Entry{entry}}, nil
+			}}
+
+			ldapUsr, err := ldapUserSearch(context.Background(), conn, "alice", false)
+			if err != nil {
+				t.Fatalf("ldapUserSearch() failed: %v", err)
+			}
+			if email, ok := ldapUsr.attrs["email"]; email != test.email || ok != (test.email != "") {
+				t.Errorf("email = %q, want %q", email, test.email)
+			}
+		})
+	}
+}
+
+func TestLdapUserSearchMovedEntry(t *testing.T) {
+	const uuid = "5f1d7ba2-2bd6-4a2c-9c6e-0f3c1b1e8a11"
+	tests := []struct {
+		name      string
+		matchAttr string
+		user      string
+		filter    string
+		dns       []string
+	}{
+		{"moved to another OU", "uid", "alice", "(&(uid=alice))", []string{
+			"uid=alice,ou=people,dc=example,dc=org",
+			"uid=alice,ou=staff,dc=example,dc=org",
+			"uid=alice,ou=people,dc=example,dc=org",
+		}},
+		{"renamed with a stable identifier", "entryUUID", uuid, "(&(entryUUID=" + uuid + "))", []string{
+			"uid=alice,ou=people,dc=example,dc=org",
+			"uid=asmith,ou=staff,dc=example,dc=org",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", "")
+			t.Setenv("LDAP_FILTER", "")
+			testConfig(t, func(c *config) { c.matchAttribute = test.matchAttr })
+
+			var first map[string]string
+			for run, dn := range test.dns {
+				conn := fakeLdap{func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+					if req.Filter != test.filter {
+						return nil, fmt.Errorf("filter = %s, want %s", req.Filter, test.filter)
+					}
+					entry := testEntry(dn, map[string]string{"cn": "Alice", "mail": "alice@example.org"})
+					return &ldap.SearchResult{Entries: []*ldap.Entry{entry}}, nil
+				}}
+
+				ldapUsr, err := ldapUserSearch(context.Background(), conn, test.user, false)
+				if err != nil {
+					t.Fatalf("run %d: ldapUserSearch() failed: %v", run, err)
+				}
+				// A moved entry's attributes are unchanged, thus no update is derived.
+				if first == nil {
+					first = ldapUsr.attrs
+				} else if !maps.Equal(ldapUsr.attrs, first) {
+					t.Errorf("run %d: attrs = %v, want %v", run, ldapUsr.attrs, first)
+				}
+			}
+		})
+	}
+}
+
+func TestLdapUserSearchOptOut(t *testing.T) {
+	tests := []struct {
+		name   string
+		attrs  map[string]string
+		optOut bool
+	}{
+		{"absent", map[string]string{"cn": "Alice"}, false},
+		{"TRUE", map[string]string{"glSyncOptOut": "TRUE"}, true},
+		{"yes", map[string]string{"glSyncOptOut": " yes "}, true},
+		{"1", map[string]string{"glSyncOptOut": "1"}, true},
+		{"FALSE", map[string]string{"glSyncOptOut": "FALSE"}, false},
+		{"other value", map[string]string{"glSyncOptOut": "maybe"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", "")
+			t.Setenv("LDAP_FILTER", "")
+			testConfig(t, func(c *config) {
+				c.matchAttribute = "uid"
+				c.optOutAttribute = "glSyncOptOut"
+			})
+
+			conn := fakeLdap{func(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+				if !slices.Contains(req.Attributes, "glSyncOptOut") {
+					return nil, fmt.Errorf("attributes %v miss the opt-out attribute", req.Attributes)
+				}
+				entry := testEntry("uid=alice,ou=people,dc=example,dc=org", test.attrs)
+				return &ldap.SearchResult{Entries: []*ldap.Entry{entry}}, nil
+			}}
+
+			ldapUsr, err := ldapUserSearch(context.Background(), conn, "alice", false)
+			if err != nil {
+				t.Fatalf("ldapUserSearch() failed: %v", err)
+			}
+			if ldapUsr.optOut != test.optOut {
+				t.Errorf("optOut = %v, want %v", ldapUsr.optOut, test.optOut)
+			}
+		})
+	}
+}
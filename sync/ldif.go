@@ -0,0 +1,322 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldifDirectory is an in-memory LDAP directory loaded from an LDIF file.
+//
+// It implements ldapSearcher, allowing syncs against a previously dumped
+// directory without any LDAP server.
+type ldifDirectory struct {
+	entries []*ldap.Entry
+}
+
+// ldifLoad parses all entries of an RFC 2849 LDIF file.
+//
+// Attribute values might be plain or base64 encoded and span multiple folded
+// lines. Change records and URL references are not supported.
+func ldifLoad(path string) (dir *ldifDirectory, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	dir = &ldifDirectory{}
+
+	var lines []string
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		entry, err := ldifParseEntry(lines)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			dir.entries = append(dir.entries, entry)
+		}
+		lines = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+
+		switch {
+		case line == "":
+			if err = flush(); err != nil {
+				err = fmt.Errorf("entry ending at line %d: %w", lineNo, err)
+				return
+			}
+
+		case strings.HasPrefix(line, "#"):
+			continue
+
+		case strings.HasPrefix(line, " "):
+			if len(lines) == 0 {
+				err = fmt.Errorf("line %d: continuation without preceding line", lineNo)
+				return
+			}
+			lines[len(lines)-1] += line[1:]
+
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if err = flush(); err != nil {
+		err = fmt.Errorf("last entry: %w", err)
+	}
+	return
+}
+
+// ldifParseEntry creates an LDAP entry from an LDIF record's unfolded lines.
+//
+// A nil entry is returned for records without a DN, e.g., the version line.
+func ldifParseEntry(lines []string) (*ldap.Entry, error) {
+	var dn string
+	var attrNames []string
+	attrs := make(map[string][]string)
+
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %q is not an attribute", line)
+		}
+
+		name, value := line[:i], line[i+1:]
+		switch {
+		case strings.HasPrefix(value, ":"):
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("attribute %s: %w", name, err)
+			}
+			value = string(decoded)
+
+		case strings.HasPrefix(value, "<"):
+			return nil, fmt.Errorf("attribute %s: URL values are unsupported", name)
+
+		default:
+			value = strings.TrimLeft(value, " ")
+		}
+
+		switch strings.ToLower(name) {
+		case "dn":
+			dn = value
+		case "version":
+			continue
+		case "changetype":
+			return nil, fmt.Errorf("change records are unsupported")
+		default:
+			if _, ok := attrs[name]; !ok {
+				attrNames = append(attrNames, name)
+			}
+			attrs[name] = append(attrs[name], value)
+		}
+	}
+
+	if dn == "" {
+		return nil, nil
+	}
+
+	entry := &ldap.Entry{DN: dn}
+	for _, name := range attrNames {
+		entry.Attributes = append(entry.Attributes, ldap.NewEntryAttribute(name, attrs[name]))
+	}
+	return entry, nil
+}
+
+// Search evaluates a search request against the loaded entries.
+func (dir *ldifDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	filter, err := ldap.CompileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseDn *ldap.DN
+	if req.BaseDN != "" {
+		if baseDn, err = ldap.ParseDN(req.BaseDN); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ldap.SearchResult{}
+	for _, entry := range dir.entries {
+		if baseDn != nil {
+			entryDn, err := ldap.ParseDN(entry.DN)
+			if err != nil {
+				return nil, err
+			}
+			if !ldifInScope(baseDn, entryDn, req.Scope) {
+				continue
+			}
+		}
+
+		match, err := ldifFilterMatch(filter, entry)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+
+		result.Entries = append(result.Entries, ldifSelectAttrs(entry, req.Attributes))
+		if req.SizeLimit > 0 && len(result.Entries) >= req.SizeLimit {
+			return result, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, fmt.Errorf("size limit exceeded"))
+		}
+	}
+	return result, nil
+}
+
+// Close releases the loaded entries.
+func (dir *ldifDirectory) Close() error {
+	dir.entries = nil
+	return nil
+}
+
+// ldifInScope checks if an entry's DN is within the search scope of a base DN.
+func ldifInScope(baseDn, entryDn *ldap.DN, scope int) bool {
+	switch scope {
+	case ldap.ScopeBaseObject:
+		return baseDn.EqualFold(entryDn)
+	case ldap.ScopeSingleLevel:
+		return len(entryDn.RDNs) == len(baseDn.RDNs)+1 && baseDn.AncestorOfFold(entryDn)
+	default:
+		return baseDn.EqualFold(entryDn) || baseDn.AncestorOfFold(entryDn)
+	}
+}
+
+// ldifSelectAttrs copies an entry, limited to the requested attributes.
+func ldifSelectAttrs(entry *ldap.Entry, attrs []string) *ldap.Entry {
+	selected := &ldap.Entry{DN: entry.DN}
+	for _, attr := range entry.Attributes {
+		if len(attrs) == 0 || ldifContainsFold(attrs, attr.Name) || ldifContainsFold(attrs, "*") {
+			selected.Attributes = append(selected.Attributes, attr)
+		}
+	}
+	return selected
+}
+
+// ldifContainsFold checks case insensitively if a string slice contains v.
+func ldifContainsFold(vs []string, v string) bool {
+	for _, vv := range vs {
+		if strings.EqualFold(vv, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ldifEntryValues returns an entry's values for an attribute, matched case insensitively.
+func ldifEntryValues(entry *ldap.Entry, name string) (values []string, ok bool) {
+	for _, attr := range entry.Attributes {
+		if strings.EqualFold(attr.Name, name) {
+			return attr.Values, true
+		}
+	}
+	return nil, false
+}
+
+// ldifFilterMatch evaluates a compiled LDAP filter against an entry.
+//
+// Values are compared case insensitively, mimicking the caseIgnoreMatch rule
+// most user attributes are defined with. Extensible matches are unsupported.
+func ldifFilterMatch(filter *ber.Packet, entry *ldap.Entry) (bool, error) {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if match, err := ldifFilterMatch(child, entry); err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if match, err := ldifFilterMatch(child, entry); err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+
+	case ldap.FilterNot:
+		match, err := ldifFilterMatch(filter.Children[0], entry)
+		return !match, err
+
+	case ldap.FilterPresent:
+		_, ok := ldifEntryValues(entry, ber.DecodeString(filter.Data.Bytes()))
+		return ok, nil
+
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch, ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		values, _ := ldifEntryValues(entry, ber.DecodeString(filter.Children[0].Data.Bytes()))
+		assertion := strings.ToLower(ber.DecodeString(filter.Children[1].Data.Bytes()))
+		for _, value := range values {
+			value = strings.ToLower(value)
+			switch {
+			case filter.Tag == ldap.FilterGreaterOrEqual && value >= assertion,
+				filter.Tag == ldap.FilterLessOrEqual && value <= assertion,
+				value == assertion:
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case ldap.FilterSubstrings:
+		values, _ := ldifEntryValues(entry, ber.DecodeString(filter.Children[0].Data.Bytes()))
+		for _, value := range values {
+			if ldifSubstringsMatch(filter.Children[1].Children, strings.ToLower(value)) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	default:
+		return false, fmt.Errorf("unsupported LDIF filter type %s", ldap.FilterMap[uint64(filter.Tag)])
+	}
+}
+
+// ldifSubstringsMatch checks a lowercased value against substring filter parts.
+func ldifSubstringsMatch(parts []*ber.Packet, value string) bool {
+	for _, part := range parts {
+		sub := strings.ToLower(ber.DecodeString(part.Data.Bytes()))
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, sub) {
+				return false
+			}
+			value = value[len(sub):]
+
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, sub)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(sub):]
+
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, sub) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// leaderRetry is the interval of a standby instance trying to become the leader
+// and of the leader verifying its lock's connection.
+const leaderRetry = 10 * time.Second
+
+// leaderElected is set while this instance is the EnvLeaderElection leader.
+var leaderElected atomic.Bool
+
+// leaderLockName is the database lock's name held by the leader, distinct from
+// the EnvRunLockName held during each sync.
+func leaderLockName() string {
+	return cfg.runLockName + "-leader"
+}
+
+// leaderElect performs the EnvLeaderElection until ctx is done.
+//
+// The leader holds a database lock on a dedicated connection, being
+// PostgreSQL's advisory lock or MySQL's GET_LOCK. Other instances stand by,
+// trying to acquire the lock every leaderRetry. If the leader exits or its
+// connection breaks, its session and thus the lock ends, letting a standby
+// take over. Each time this instance becomes the leader, elected is notified.
+func leaderElect(ctx context.Context, elected chan<- struct{}) {
+	for {
+		if leaderHold(ctx, elected) {
+			log.WithField("lock", leaderLockName()).Warn("Lost leadership, standing by")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderRetry):
+		}
+	}
+}
+
+// leaderHold tries to acquire the leader's lock for leaderElect, holding it
+// until its connection fails or ctx is done. It reports if it was the leader.
+func leaderHold(ctx context.Context, elected chan<- struct{}) (leading bool) {
+	db, err := sqlOpen(false)
+	if err != nil {
+		log.WithError(err).Warn("Cannot establish database connection for the leader election")
+		return
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	if err = conn.QueryRowContext(ctx, db.query(db.dialect.tryLock()), leaderLockName()).Scan(&leading); err != nil {
+		log.WithError(err).Warn("Cannot acquire the leader lock")
+		return
+	} else if !leading {
+		log.WithField("lock", leaderLockName()).Debug("Another instance is the leader, standing by")
+		return
+	}
+
+	log.WithField("lock", leaderLockName()).Info("Became the leader, performing the scheduled syncs")
+	leaderElected.Store(true)
+	defer leaderElected.Store(false)
+	select {
+	case elected <- struct{}{}:
+	default:
+	}
+
+	ticker := time.NewTicker(leaderRetry)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Closing the dedicated database ends the session, releasing the lock.
+			return
+
+		case <-ticker.C:
+			if err = conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+				log.WithError(err).Error("Leader lock connection failed")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// greenlightLocales are the default EnvLocales, being the locale identifiers
+// shipped by each Greenlight version.
+//
+// https://github.com/bigbluebutton/greenlight/blob/release-2.8.5/config/application.rb
+// https://github.com/bigbluebutton/greenlight/tree/v3.0.0/app/assets/locales
+var greenlightLocales = map[string][]string{
+	SchemaV2: {
+		"ar", "bg-BG", "ca", "cs-CZ", "da-DK", "de", "el-GR", "en", "es", "et",
+		"eu", "fa-IR", "fr", "gl", "he", "hr", "hu-HU", "id", "it-IT", "ja",
+		"ko-KR", "lt", "nb-NO", "nl", "pl-PL", "pt", "pt-BR", "ro-RO", "ru",
+		"sk-SK", "sl", "sr", "sv-SE", "th", "tr", "uk-UA", "vi", "zh-CN", "zh-TW",
+	},
+	SchemaV3: {
+		"ar", "ca", "de", "el", "en", "es", "fa_IR", "fr", "gl", "he", "hr",
+		"hu_HU", "id", "it", "ja", "ko", "nl", "pl", "pt", "pt_BR", "ru", "sv",
+		"tr", "uk", "vi", "zh_CN", "zh_TW",
+	},
+}
+
+// greenlightLocaleFallback is the locale of users whose languages match none
+// of the EnvLocales. For Greenlight 2.x, "default" follows the browser.
+var greenlightLocaleFallback = map[string]string{
+	SchemaV2: "default",
+	SchemaV3: "en",
+}
+
+// parseLocales parses locale identifiers, either separated by hyphens or by
+// underscores, into their language tags for canonicalizeLocale.
+func parseLocales(locales []string) (tags []language.Tag, err error) {
+	for _, locale := range locales {
+		var tag language.Tag
+		if tag, err = language.Parse(strings.ReplaceAll(locale, "_", "-")); err != nil {
+			err = fmt.Errorf("invalid locale %q: %w", locale, err)
+			return
+		}
+		tags = append(tags, tag)
+	}
+	return
+}
+
+// canonicalizeLocale translates RFC 5646 language tags, e.g., "de-AT", into
+// the closest of the EnvLocales, e.g., "de".
+//
+// The value might be a weighted list as for RFC 2798's preferredLanguage or
+// HTTP's Accept-Language, e.g., "de-AT, en;q=0.8". If no language matches or
+// the value is invalid, the EnvSchema's greenlightLocaleFallback is returned.
+func canonicalizeLocale(value string) (string, error) {
+	tags, err := parseLocales(cfg.locales)
+	if err != nil {
+		return "", err
+	}
+
+	wanted, _, err := language.ParseAcceptLanguage(value)
+	if err != nil {
+		return greenlightLocaleFallback[cfg.schema], nil
+	}
+
+	_, i, confidence := language.NewMatcher(tags).Match(wanted...)
+	if confidence == language.No {
+		return greenlightLocaleFallback[cfg.schema], nil
+	}
+	return cfg.locales[i], nil
+}
@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// runLockNameDefault is the default EnvRunLockName.
+	runLockNameDefault = "greenlight-ldap-sync"
+
+	// runLockPoll is the interval of retrying to acquire the lock for the
+	// RunLockWait EnvRunLock.
+	runLockPoll = 5 * time.Second
+)
+
+// syncLock acquires the database lock of the EnvRunLockName for a sync,
+// preventing concurrent syncs of multiple instances, e.g., a CronJob next to a
+// daemon. It is PostgreSQL's advisory lock or MySQL's GET_LOCK.
+//
+// The lock is held by a dedicated connection until unlock is called. If
+// another instance holds it, acquired is false for the RunLockSkip EnvRunLock.
+// For RunLockWait, the lock is retried until it is released or ctx is done.
+func syncLock(ctx context.Context) (unlock func(), acquired bool, err error) {
+	db, release, err := syncSqlOpen(false)
+	if err != nil {
+		return
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		release()
+		return
+	}
+
+	waiting := false
+	for {
+		err = conn.QueryRowContext(ctx, db.query(db.dialect.tryLock()), cfg.runLockName).Scan(&acquired)
+		if err != nil || acquired || cfg.runLock != RunLockWait {
+			break
+		}
+
+		if !waiting {
+			log.WithField("lock", cfg.runLockName).Info("Waiting for another instance's sync to finish")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(runLockPoll):
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err != nil || !acquired {
+		_ = conn.Close()
+		release()
+		return
+	}
+
+	unlock = func() {
+		if _, unlockErr := conn.ExecContext(context.Background(), db.query(db.dialect.unlock()), cfg.runLockName); unlockErr != nil {
+			log.WithError(unlockErr).WithField("lock", cfg.runLockName).Warn("Cannot release the sync lock, closing its connection")
+			// Discarding the connection ends its session, releasing the lock.
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		_ = conn.Close()
+		release()
+	}
+	return
+}
@@ -0,0 +1,121 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logFileTimeLayout suffixes the name of a rotated EnvLogFile.
+const logFileTimeLayout = "20060102T150405.000000"
+
+// logFile is the EnvLogFile, rotated by size and age.
+//
+// Once a write would exceed the EnvLogFileMaxSize or the file is older than
+// the EnvLogFileRotate, it is renamed by appending its rotation time, e.g.,
+// "sync.log.20240102T030405.000000", and a new file is started. Only the
+// EnvLogFileKeep latest rotated files are kept.
+type logFile struct {
+	mu sync.Mutex
+
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// logFileOpen opens or continues the log file at path for appending.
+func logFileOpen(path string, maxSize int64, maxAge time.Duration, keep int) (*logFile, error) {
+	f := &logFile{path: path, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open the file at its path, continuing an existing one.
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file, f.size, f.opened = file, info.Size(), info.ModTime()
+	if f.size == 0 {
+		f.opened = time.Now()
+	}
+	return nil
+}
+
+func (f *logFile) Write(p []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize ||
+		f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		if err = f.rotate(); err != nil {
+			// Writing to the full file beats losing the entry.
+			fmt.Fprintf(os.Stderr, "Cannot rotate log file %s: %v\n", f.path, err)
+		}
+	}
+
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+	return
+}
+
+// rotate renames the current file and opens a new one, pruning old files.
+func (f *logFile) rotate() error {
+	rotated := f.path + "." + time.Now().UTC().Format(logFileTimeLayout)
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+	_ = f.file.Close()
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.prune()
+}
+
+// prune removes all but the keep latest rotated files.
+func (f *logFile) prune() error {
+	rotated, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	// As the suffix is a fixed-width timestamp, the names sort chronologically.
+	var names []string
+	for _, name := range rotated {
+		suffix := strings.TrimPrefix(name, f.path+".")
+		if _, err := time.Parse(logFileTimeLayout, suffix); err == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for len(names) > f.keep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
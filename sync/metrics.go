@@ -0,0 +1,270 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MetricSourceLdap labels errors of the LDAP directory.
+	MetricSourceLdap = "ldap"
+
+	// MetricSourceSql labels errors of the SQL database.
+	MetricSourceSql = "sql"
+)
+
+// pushgatewayTimeout bounds pushing the metrics to the EnvPushgatewayUrl.
+const pushgatewayTimeout = 10 * time.Second
+
+// metricLatencyBuckets are the upper bounds in seconds of the latency
+// histograms, ranging from fast single entry searches to large transactions.
+var metricLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metrics collects the sync metrics, exposed by EnvMetricsAddr.
+var metrics = &syncMetrics{
+	errors:           make(map[string]uint64),
+	attributeChanges: make(map[string]uint64),
+	ldapSearch:       newMetricHistogram(metricLatencyBuckets),
+	sqlUpdate:        newMetricHistogram(metricLatencyBuckets),
+}
+
+// metricHistogram is a Prometheus histogram with fixed buckets.
+type metricHistogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// newMetricHistogram creates a histogram of the ascending bucket bounds.
+func newMetricHistogram(buckets []float64) *metricHistogram {
+	return &metricHistogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// observe records a single duration.
+func (h *metricHistogram) observe(d time.Duration) {
+	v := d.Seconds()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write formats the histogram's cumulative buckets, sum, and count.
+func (h *metricHistogram) write(w io.Writer, name string) {
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// syncMetrics are the metrics of all syncs, written in Prometheus' text format.
+//
+// Instead of depending on the Prometheus client library, the few metrics are
+// formatted directly.
+type syncMetrics struct {
+	mu sync.Mutex
+
+	runsSuccess uint64
+	runsFailure uint64
+	lastRun     time.Time
+	lastSuccess time.Time
+
+	usersFetched int
+	usersChanged int
+	usersFailed  int
+
+	lastDuration  time.Duration
+	durationSum   time.Duration
+	durationCount uint64
+
+	errors map[string]uint64
+
+	// attributeChanges counts the applied changes by their attribute.
+	attributeChanges map[string]uint64
+
+	ldapSearch *metricHistogram
+	sqlUpdate  *metricHistogram
+}
+
+// observeRun records a finished sync.
+func (m *syncMetrics) observeRun(finished time.Time, duration time.Duration, fetched, changed, failed int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.runsFailure++
+	} else {
+		m.runsSuccess++
+		m.lastSuccess = finished
+	}
+	m.lastRun = finished
+
+	m.usersFetched = fetched
+	m.usersChanged = changed
+	m.usersFailed = failed
+
+	m.lastDuration = duration
+	m.durationSum += duration
+	m.durationCount++
+}
+
+// countError counts an error of the source, e.g., MetricSourceLdap.
+func (m *syncMetrics) countError(source string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.errors[source]++
+}
+
+// countChanges counts applied changes by their attribute.
+func (m *syncMetrics) countChanges(changes []attrChange) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, change := range changes {
+		m.attributeChanges[change.attribute]++
+	}
+}
+
+// observeLdapSearch records the latency of a single LDAP search attempt,
+// including all its pages.
+func (m *syncMetrics) observeLdapSearch(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ldapSearch.observe(d)
+}
+
+// observeSqlUpdate records the latency of a single SQL update transaction.
+func (m *syncMetrics) observeSqlUpdate(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sqlUpdate.observe(d)
+}
+
+// write formats all metrics in Prometheus' text exposition format.
+func (m *syncMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+
+	metric("greenlight_ldap_sync_runs_total", "counter", "Number of performed syncs by their result.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_runs_total{result=\"success\"} %d\n", m.runsSuccess)
+	fmt.Fprintf(w, "greenlight_ldap_sync_runs_total{result=\"failure\"} %d\n", m.runsFailure)
+
+	metric("greenlight_ldap_sync_last_run_timestamp_seconds", "gauge", "Unix time of the last finished sync.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_last_run_timestamp_seconds %g\n", timestamp(m.lastRun))
+
+	metric("greenlight_ldap_sync_last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_last_success_timestamp_seconds %g\n", timestamp(m.lastSuccess))
+
+	metric("greenlight_ldap_sync_users_fetched", "gauge", "Number of SQL users fetched by the last sync.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_users_fetched %d\n", m.usersFetched)
+
+	metric("greenlight_ldap_sync_users_changed", "gauge", "Number of SQL users changed by the last sync.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_users_changed %d\n", m.usersChanged)
+
+	metric("greenlight_ldap_sync_users_failed", "gauge", "Number of users skipped due to errors by the last sync.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_users_failed %d\n", m.usersFailed)
+
+	metric("greenlight_ldap_sync_last_duration_seconds", "gauge", "Duration of the last sync.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_last_duration_seconds %g\n", m.lastDuration.Seconds())
+
+	paused := 0
+	if syncIsPaused() {
+		paused = 1
+	}
+	metric("greenlight_ldap_sync_paused", "gauge", "Whether scheduled syncs are paused.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_paused %d\n", paused)
+
+	metric("greenlight_ldap_sync_duration_seconds", "summary", "Duration of all syncs.")
+	fmt.Fprintf(w, "greenlight_ldap_sync_duration_seconds_sum %g\n", m.durationSum.Seconds())
+	fmt.Fprintf(w, "greenlight_ldap_sync_duration_seconds_count %d\n", m.durationCount)
+
+	metric("greenlight_ldap_sync_errors_total", "counter", "Number of errors by their source.")
+	sources := []string{MetricSourceLdap, MetricSourceSql}
+	for source := range m.errors {
+		if source != MetricSourceLdap && source != MetricSourceSql {
+			sources = append(sources, source)
+		}
+	}
+	sort.Strings(sources[2:])
+	for _, source := range sources {
+		fmt.Fprintf(w, "greenlight_ldap_sync_errors_total{source=%q} %d\n", source, m.errors[source])
+	}
+
+	metric("greenlight_ldap_sync_attribute_changes_total", "counter", "Number of applied changes by their attribute.")
+	attributes := make([]string, 0, len(m.attributeChanges))
+	for attribute := range m.attributeChanges {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+	for _, attribute := range attributes {
+		fmt.Fprintf(w, "greenlight_ldap_sync_attribute_changes_total{attribute=%q} %d\n", attribute, m.attributeChanges[attribute])
+	}
+
+	metric("greenlight_ldap_sync_ldap_search_duration_seconds", "histogram", "Latency of LDAP search attempts, including all pages.")
+	m.ldapSearch.write(w, "greenlight_ldap_sync_ldap_search_duration_seconds")
+
+	metric("greenlight_ldap_sync_sql_update_duration_seconds", "histogram", "Latency of SQL user update transactions.")
+	m.sqlUpdate.write(w, "greenlight_ldap_sync_sql_update_duration_seconds")
+}
+
+// ServeHTTP serves the metrics for Prometheus.
+func (m *syncMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+// push replaces the metrics of the job group on a Prometheus Pushgateway,
+// e.g., for one-shot runs without a long-lived process to scrape.
+func (m *syncMetrics) push(gatewayUrl, job string) error {
+	var buf bytes.Buffer
+	m.write(&buf)
+
+	pushUrl := strings.TrimSuffix(gatewayUrl, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest(http.MethodPut, pushUrl, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	client := &http.Client{Timeout: pushgatewayTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build mysql
+
+package sync
+
+// The MySQL driver for the DbDriverMysql is only included in builds with the
+// mysql build tag, keeping the default binary free of an unused dependency.
+import _ "github.com/go-sql-driver/mysql"
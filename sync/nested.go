@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ldapMatchingRuleInChain is Active Directory's LDAP_MATCHING_RULE_IN_CHAIN,
+// matching transitive group memberships for NestedGroupsChain.
+const ldapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+// ldapGroupParents caches the memberOf values of groups by their normalized DN
+// for NestedGroupsRecursive. It is reset at the start of each sync, picking up
+// changed group nestings.
+var ldapGroupParents struct {
+	sync.Mutex
+	parents map[string][]string
+}
+
+// ldapGroupParentsReset clears the ldapGroupParents cache.
+func ldapGroupParentsReset() {
+	ldapGroupParents.Lock()
+	defer ldapGroupParents.Unlock()
+
+	ldapGroupParents.parents = nil
+}
+
+// ldapNestedGroups returns all groups a user is a member of following the
+// EnvNestedGroups, including those only containing one of its direct groups.
+func ldapNestedGroups(ctx context.Context, conn ldapSearcher, usr ldapUser) ([]string, error) {
+	switch cfg.nestedGroups {
+	case NestedGroupsRecursive:
+		return ldapNestedGroupsRecursive(ctx, conn, usr.groups)
+	case NestedGroupsChain:
+		return ldapNestedGroupsChain(ctx, conn, usr.dn)
+	default:
+		return usr.groups, nil
+	}
+}
+
+// ldapNestedGroupsRecursive follows the memberOf values of the groups up to
+// the EnvNestedGroupsDepth, as for NestedGroupsRecursive. Cyclic nestings are
+// only visited once.
+func ldapNestedGroupsRecursive(ctx context.Context, conn ldapSearcher, direct []string) (groups []string, err error) {
+	seen := make(map[string]bool)
+	for _, group := range direct {
+		seen[ldapNormalizeDN(group)] = true
+	}
+	groups = append(groups, direct...)
+
+	frontier := direct
+	for depth := 0; depth < cfg.nestedGroupsDepth && len(frontier) > 0; depth++ {
+		var next []string
+		for _, group := range frontier {
+			var parents []string
+			if parents, err = ldapGroupParentsOf(ctx, conn, group); err != nil {
+				return
+			}
+			for _, parent := range parents {
+				if key := ldapNormalizeDN(parent); !seen[key] {
+					seen[key] = true
+					next = append(next, parent)
+				}
+			}
+		}
+		groups = append(groups, next...)
+		frontier = next
+	}
+	return
+}
+
+// ldapGroupParentsOf returns the memberOf values of a group, cached by
+// ldapGroupParents. A group without an entry, e.g., outside the bind DN's
+// permissions, has no parents.
+func ldapGroupParentsOf(ctx context.Context, conn ldapSearcher, group string) (parents []string, err error) {
+	key := ldapNormalizeDN(group)
+
+	ldapGroupParents.Lock()
+	parents, ok := ldapGroupParents.parents[key]
+	ldapGroupParents.Unlock()
+	if ok {
+		return
+	}
+
+	searchReq := ldap.NewSearchRequest(
+		group,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0,
+		false,
+		"(objectClass=*)",
+		[]string{"memberOf"},
+		nil)
+
+	searchResp, err := ldapSearchContext(ctx, conn, searchReq)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		log.WithField("group", group).Debug("Cannot find LDAP group for its nested groups")
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("cannot fetch nested groups of %s: %w", group, err)
+		return
+	} else if len(searchResp.Entries) == 1 {
+		parents = searchResp.Entries[0].GetAttributeValues("memberOf")
+	}
+
+	ldapGroupParents.Lock()
+	if ldapGroupParents.parents == nil {
+		ldapGroupParents.parents = make(map[string][]string)
+	}
+	ldapGroupParents.parents[key] = parents
+	ldapGroupParents.Unlock()
+	return
+}
+
+// ldapNestedGroupsChain searches all groups within the EnvGroupBase having the
+// user as a transitive member by LDAP_MATCHING_RULE_IN_CHAIN, as for
+// NestedGroupsChain.
+func ldapNestedGroupsChain(ctx context.Context, conn ldapSearcher, dn string) (groups []string, err error) {
+	base := cfg.groupBase
+	if base == "" {
+		base = os.Getenv("LDAP_BASE")
+	}
+
+	searchReq := ldap.NewSearchRequest(
+		base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+		false,
+		fmt.Sprintf("(member:%s:=%s)", ldapMatchingRuleInChain, ldap.EscapeFilter(dn)),
+		[]string{"1.1"},
+		nil)
+
+	searchResp, err := ldapSearchContext(ctx, conn, searchReq)
+	if err != nil {
+		err = fmt.Errorf("cannot fetch nested groups of %s: %w", dn, err)
+		return
+	}
+	for _, entry := range searchResp.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return
+}
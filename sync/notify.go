@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// notifySignatureHeader carries the payload's hex encoded HMAC-SHA256, prefixed
+// by "sha256=", following GitHub's webhook signatures.
+const notifySignatureHeader = "X-Hub-Signature-256"
+
+// notifyQueueSize limits the pending notifications before new ones are dropped.
+const notifyQueueSize = 16
+
+// webhookNotifier delivers EnvWebhookUrl notifications, if configured.
+var webhookNotifier *notifier
+
+// notifyJob is a single pending notification delivery.
+type notifyJob struct {
+	method  string
+	url     string
+	header  http.Header
+	payload []byte
+
+	// fn replaces the HTTP request for other deliveries, e.g., an email.
+	fn func() error
+}
+
+// notifier delivers JSON notifications in the background.
+//
+// Deliveries are queued and performed by a single worker, so a slow or hung
+// endpoint never blocks a sync. Each delivery is bounded by the HTTP client's
+// timeout and retried with an exponential backoff.
+type notifier struct {
+	client  *http.Client
+	retries int
+	secret  string
+	queue   chan notifyJob
+	done    chan struct{}
+
+	// failures counts deliveries which failed after all retries.
+	failures atomic.Uint64
+}
+
+// newNotifier creates a notifier and starts its delivery worker.
+//
+// If secret is not empty, each delivery is signed by notifySignatureHeader.
+func newNotifier(timeout time.Duration, retries int, secret string) *notifier {
+	n := &notifier{
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+		secret:  secret,
+		queue:   make(chan notifyJob, notifyQueueSize),
+		done:    make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// run is the delivery worker, processing the queue until it is closed.
+func (n *notifier) run() {
+	defer close(n.done)
+
+	for job := range n.queue {
+		if err := n.deliver(job); err != nil {
+			n.failures.Add(1)
+			log.WithField("url", job.url).WithError(err).Error("Failed to deliver notification")
+		}
+	}
+}
+
+// deliver POSTs a job's payload or calls its fn, retrying failed attempts with a backoff.
+func (n *notifier) deliver(job notifyJob) (err error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if job.fn != nil {
+			err = job.fn()
+		} else {
+			err = n.post(job)
+		}
+		if err == nil || attempt >= n.retries {
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"url":     job.url,
+			"attempt": attempt + 1,
+			"backoff": backoff,
+		}).WithError(err).Debug("Notification delivery failed, retrying")
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post performs a single delivery attempt.
+func (n *notifier) post(job notifyJob) error {
+	req, err := http.NewRequest(job.method, job.url, bytes.NewReader(job.payload))
+	if err != nil {
+		return err
+	}
+	for key, values := range job.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(job.payload)
+		req.Header.Set(notifySignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// send enqueues a JSON notification POSTed without blocking.
+//
+// If the queue is full, e.g., because the endpoint is unreachable for some
+// time, the notification is dropped and counted as a failure.
+func (n *notifier) send(url string, payload any) {
+	n.sendRequest(http.MethodPost, url, nil, payload)
+}
+
+// sendRequest enqueues a JSON notification like send, but with another HTTP
+// method and additional headers, e.g., for authentication.
+func (n *notifier) sendRequest(method, url string, header http.Header, payload any) {
+	payloadJson, err := json.Marshal(payload)
+	if err != nil {
+		n.failures.Add(1)
+		log.WithError(err).Error("Cannot encode notification")
+		return
+	}
+
+	select {
+	case n.queue <- notifyJob{method: method, url: url, header: header, payload: payloadJson}:
+	default:
+		n.failures.Add(1)
+		log.WithField("url", url).Error("Notification queue is full, dropping notification")
+	}
+}
+
+// sendFunc enqueues a delivery performed by fn instead of an HTTP request, but
+// queued and retried like send. The url only identifies the delivery in logs.
+func (n *notifier) sendFunc(url string, fn func() error) {
+	select {
+	case n.queue <- notifyJob{url: url, fn: fn}:
+	default:
+		n.failures.Add(1)
+		log.WithField("url", url).Error("Notification queue is full, dropping notification")
+	}
+}
+
+// flush stops accepting notifications and waits for pending deliveries.
+//
+// The wait is bounded by timeout; remaining notifications are dropped and
+// counted as failures. The notifier must not be used afterwards.
+func (n *notifier) flush(timeout time.Duration) {
+	close(n.queue)
+
+	select {
+	case <-n.done:
+		log.Debug("Flushed pending notifications")
+
+	case <-time.After(timeout):
+		pending := len(n.queue)
+		n.failures.Add(uint64(pending))
+		log.WithField("pending", pending).Warn("Timed out flushing notifications")
+	}
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestShutdownFlushesNotifications(t *testing.T) {
+	tests := []struct {
+		name      string
+		hung      bool
+		timeout   time.Duration
+		delivered int64
+		failures  uint64
+	}{
+		{"slow endpoint", false, 5 * time.Second, 3, 0},
+		// The first notification is in flight, the others are dropped.
+		{"hung endpoint", true, 50 * time.Millisecond, 0, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var delivered atomic.Int64
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.hung {
+					<-release
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+				delivered.Add(1)
+			}))
+			t.Cleanup(server.Close)
+			t.Cleanup(func() { close(release) })
+
+			testConfig(t, func(c *config) { c.shutdownTimeout = test.timeout })
+			common := webhookNotifier
+			webhookNotifier = newNotifier(time.Minute, 0, "")
+			t.Cleanup(func() { webhookNotifier = common })
+
+			for range 3 {
+				webhookNotifier.send(server.URL, map[string]string{"event": "sync"})
+			}
+			shutdown()
+
+			if n := delivered.Load(); n != test.delivered {
+				t.Errorf("delivered %d notifications, want %d", n, test.delivered)
+			}
+			if n := webhookNotifier.failures.Load(); n != test.failures {
+				t.Errorf("failures = %d, want %d", n, test.failures)
+			}
+		})
+	}
+}
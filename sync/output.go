@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// outputFile is an atomically written file, created by createOutputFile.
+//
+// All writes go to a temporary file next to the destination, which is renamed
+// to the destination on Close. Thus, readers either see the previous or the
+// complete new file, but never a partial one.
+type outputFile struct {
+	tmp  *os.File
+	gz   *gzip.Writer
+	dest string
+}
+
+// createOutputFile creates an outputFile for the destination path.
+//
+// Paths ending in .gz are gzip compressed, as are all paths if compress is set.
+func createOutputFile(dest string, compress bool) (f *outputFile, err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return
+	}
+
+	f = &outputFile{tmp: tmp, dest: dest}
+	if compress || strings.HasSuffix(dest, ".gz") {
+		f.gz = gzip.NewWriter(tmp)
+	}
+	return
+}
+
+// Write writes to the temporary file, compressed if configured.
+func (f *outputFile) Write(p []byte) (int, error) {
+	if f.gz != nil {
+		return f.gz.Write(p)
+	}
+	return f.tmp.Write(p)
+}
+
+// Close flushes and syncs the temporary file and renames it to its destination.
+//
+// On failure, the temporary file is removed and the destination is untouched.
+func (f *outputFile) Close() (err error) {
+	defer func() {
+		if err != nil {
+			_ = os.Remove(f.tmp.Name())
+		}
+	}()
+
+	if f.gz != nil {
+		err = f.gz.Close()
+	}
+	err = errors.Join(err, f.tmp.Sync(), f.tmp.Close())
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(f.tmp.Name(), f.dest)
+	return
+}
+
+// Abort discards the temporary file, leaving the destination untouched.
+func (f *outputFile) Abort() error {
+	_ = f.tmp.Close()
+	return os.Remove(f.tmp.Name())
+}
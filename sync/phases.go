@@ -0,0 +1,767 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncPass is the state of a single syncAction, shared by its phases. Each
+// batch of SQL users is passed through fetch, compare, and apply.
+type syncPass struct {
+	runId     string
+	readOnly  bool
+	startTime time.Time
+
+	db          *sqlDB
+	ldapConns   []ldapSearcher
+	scope       syncScope
+	withGroups  bool
+	sharedRooms sharedRoomState
+	duplicates  duplicateAccounts
+
+	// An incremental sync only compares the modifiedUids.
+	incremental  bool
+	modifiedUids map[string]bool
+
+	// knownUsers maps the social_uids of all fetched users to their ids, e.g.,
+	// to detect duplicates across batches.
+	knownUsers map[string]string
+	userCount  int
+
+	// failed collects the failed users, summarized at the end of the sync.
+	failed       failureSummary
+	userFailures int
+
+	// searchSucceeded is set once a user was found in LDAP.
+	searchSucceeded bool
+
+	// changes are the changes of all batches so far.
+	changes []attrChange
+
+	updatedUsers, roleUpdatedUsers, deactivatedUsers, reactivatedUsers []string
+	provisionedUsers, sharedUpdatedUsers, duplicateResolvedUsers       []string
+
+	// failures are the failed SQL statements, joined into the sync's error.
+	failures []error
+
+	// reported are the changes written by writeReport, used for EnvEmailTo.
+	reported []reportRow
+
+	// backupRows cover the users of all batches so far, as the backup is
+	// replaced for each batch.
+	backupRows []backupRow
+}
+
+// syncBatch is a set of SQL users and their pending updates, being detected by
+// syncPass.compare and written by syncPass.apply.
+type syncBatch struct {
+	// users are keyed by their social_uid, and userIds maps their ids back.
+	users   map[string]map[string]string
+	userIds map[string]string
+
+	updateUserAttrs                  []map[string]string
+	updateUserRoles                  map[string]string
+	updateSharedAccess               []sharedAccessChange
+	resolveDuplicates                []accountDuplicate
+	deactivateUsers, reactivateUsers []string
+	renameConflicts                  []uniqueConflict
+}
+
+// newSyncBatch creates an empty syncBatch of the fetched users.
+func newSyncBatch(users map[string]map[string]string) *syncBatch {
+	return &syncBatch{
+		users:           users,
+		userIds:         make(map[string]string),
+		updateUserRoles: make(map[string]string),
+	}
+}
+
+// fetch registers the batch's users and searches the LDAP entries of those to
+// be compared. The results are ordered like the returned userNames. An error
+// is returned if ctx is done.
+func (s *syncPass) fetch(ctx context.Context, b *syncBatch) (userNames []string, searchResults []ldapSearchResult, err error) {
+	// Duplicates were left out by sqlFetchStream, except for users of a
+	// previous batch created since.
+	for user, userAttrSql := range b.users {
+		if id, ok := s.knownUsers[user]; ok {
+			log.WithFields(log.Fields{
+				"user": user,
+				"ids":  []string{id, userAttrSql["id"]},
+			}).Error("Multiple SQL users share the same social_uid, skipping the later one")
+			delete(b.users, user)
+			continue
+		}
+		s.knownUsers[user] = userAttrSql["id"]
+	}
+	s.userCount += len(b.users)
+	log.WithField("amount", len(b.users)).Debug("Fetched users from SQL")
+
+	// The LDAP searches are performed concurrently, but their results are
+	// processed in the users' order to keep the changes deterministic.
+	userNames = make([]string, 0, len(b.users))
+	for user := range b.users {
+		if s.incremental && !s.modifiedUids[user] {
+			continue
+		}
+		userNames = append(userNames, user)
+	}
+	sort.Strings(userNames)
+	searchResults = ldapUserSearchAll(ctx, s.ldapConns, userNames, s.withGroups)
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+		log.WithError(err).Error("LDAP sync was canceled")
+	}
+	return
+}
+
+// compare detects the changes of the batch's users by their LDAP entries,
+// recording them in s.changes and the batch's pending updates.
+//
+// An error is returned if the sync must be aborted, e.g., if searching the LDAP
+// server is denied.
+func (s *syncPass) compare(ctx context.Context, b *syncBatch, userNames []string, searchResults []ldapSearchResult) (err error) {
+	var missingUsers []string
+	for i, user := range userNames {
+		userAttrSql := b.users[user]
+		b.userIds[userAttrSql["id"]] = user
+
+		ldapUsr, err := searchResults[i].usr, searchResults[i].err
+		if err != nil && !s.searchSucceeded && ldapIsAccessDenied(err) {
+			// A denied first search indicates missing read permissions of the bind
+			// DN, which would fail each further search as well.
+			err = fmt.Errorf("LDAP bind succeeded, but searching is denied; "+
+				"grant %q read permissions on %q: %w",
+				os.Getenv("LDAP_BIND_DN"), os.Getenv("LDAP_BASE"), err)
+			log.WithError(err).Error("Aborting LDAP sync")
+			metrics.countError(MetricSourceLdap)
+			return fmt.Errorf("%w: %w", errSyncConnection, err)
+		} else if errors.Is(err, errLdapReconnect) || errors.Is(err, errRetryBudgetExhausted) {
+			// The LDAP server became unreachable or the EnvRetryBudget is used,
+			// failing all remaining users.
+			log.WithError(err).Error("Aborting LDAP sync")
+			metrics.countError(MetricSourceLdap)
+			return fmt.Errorf("%w: %w", errSyncConnection, err)
+		} else if errors.Is(err, errLdapUserMissing) {
+			missingUsers = append(missingUsers, user)
+			continue
+		} else if errors.Is(err, errLdapUserAmbiguous) {
+			s.failed.addAmbiguous(user, ldapUsr, err)
+			metrics.countError(MetricSourceLdap)
+			s.userFailures++
+			continue
+		} else if err != nil {
+			s.failed.add(FailureLdapSearch, user, err)
+			metrics.countError(MetricSourceLdap)
+			s.userFailures++
+			continue
+		}
+		s.searchSucceeded = true
+		if len(ldapUsr.ambiguous) > 0 {
+			s.failed.addAmbiguous(user, ldapUsr, nil)
+		}
+
+		if ldapUsr.optOut {
+			log.WithField("user", user).Debug("User opted out of the LDAP sync, skipping")
+			continue
+		}
+		if !s.scope.allows(user, ldapUsr) {
+			log.WithField("user", user).Debug("User is not within the synced LDAP groups, skipping")
+			continue
+		}
+
+		userAttrLdap := ldapUsr.attrs
+		canonicalizeAttrs(user, userAttrLdap)
+
+		// Users are matched by their stable EnvMatchAttribute value, searched
+		// within the whole subtrees of the LDAP bases. The social_uid, being the
+		// DN in Greenlight's default mapping, is not compared. Otherwise, entries
+		// moved to another OU would be reported as changed on each sync.
+		delete(userAttrLdap, "social_uid")
+		if cfg.clearOnEmpty {
+			for col := range ldapUsr.empty {
+				userAttrLdap[col] = ""
+			}
+		}
+		attrApplyCleared(userAttrLdap)
+		userAttrLdap["id"] = userAttrSql["id"]
+
+		// Greenlight 3.x's soft deletion is already its banned status.
+		banned := false
+		if ldapUsr.disabled && cfg.disabledPolicy == DisabledPolicyBan && cfg.schema == SchemaV2 {
+			banned = true
+			if userAttrSql["role"] != sqlSchemaV2RoleDenied {
+				b.updateUserRoles[userAttrSql["id"]] = sqlSchemaV2RoleDenied
+				s.changes = append(s.changes, attrChange{user, "role", userAttrSql["role"], sqlSchemaV2RoleDenied})
+				log.WithField("user", user).Info("User is expired or disabled and will be banned")
+			}
+		} else if ldapUsr.disabled && cfg.disabledPolicy != DisabledPolicyIgnore && userAttrSql["deleted"] != "true" {
+			b.deactivateUsers = append(b.deactivateUsers, userAttrSql["id"])
+			s.changes = append(s.changes, attrChange{user, "deleted", userAttrSql["deleted"], "true"})
+			log.WithField("user", user).Info("User is expired or disabled and will be deactivated")
+		} else if ldapUsr.locked && cfg.lockPolicy == LockPolicyDeactivate && userAttrSql["deleted"] != "true" {
+			b.deactivateUsers = append(b.deactivateUsers, userAttrSql["id"])
+			s.changes = append(s.changes, attrChange{user, "deleted", userAttrSql["deleted"], "true"})
+			log.WithField("user", user).Info("User is locked and will be deactivated")
+		} else if !ldapUsr.locked && !ldapUsr.disabled && cfg.lockPolicy == LockPolicyDeactivate && userAttrSql["deleted"] == "true" {
+			b.reactivateUsers = append(b.reactivateUsers, userAttrSql["id"])
+			s.changes = append(s.changes, attrChange{user, "deleted", userAttrSql["deleted"], "false"})
+			log.WithField("user", user).Info("User is no longer locked and will be reactivated")
+		}
+
+		// The denied role of banned users is not overwritten by their mapped role.
+		if (len(cfg.roleMap) > 0 || cfg.adminGroup != "") && !banned {
+			var role string
+			if len(cfg.roleMap) > 0 {
+				role = resolveRole(cfg.roleMap, cfg.roleDefault, ldapUsr.groups)
+			}
+			if cfg.adminGroup != "" {
+				role = adminGroupRole(ldapUsr.groups, userAttrSql["role"], role)
+			}
+			if role != "" && role != userAttrSql["role"] {
+				b.updateUserRoles[userAttrSql["id"]] = role
+				s.changes = append(s.changes, attrChange{user, "role", userAttrSql["role"], role})
+				log.WithFields(log.Fields{
+					"user": user,
+					"old":  userAttrSql["role"],
+					"new":  role,
+				}).Info("User role has changed")
+			}
+		}
+
+		if len(cfg.sharedRooms) > 0 {
+			for _, change := range s.sharedRooms.diff(userAttrSql["id"], ldapUsr.groups) {
+				b.updateSharedAccess = append(b.updateSharedAccess, change)
+				room := s.sharedRooms.roomUid(change.roomId)
+				if change.add {
+					s.changes = append(s.changes, attrChange{user, "shared_access", "", room})
+					log.WithFields(log.Fields{"user": user, "room": room}).Info("Room will be shared with the user")
+				} else {
+					s.changes = append(s.changes, attrChange{user, "shared_access", room, ""})
+					log.WithFields(log.Fields{"user": user, "room": room}).Info("Room will no longer be shared with the user")
+				}
+			}
+		}
+
+		for _, id := range s.duplicates.find(userAttrSql["email"], userAttrLdap["email"]) {
+			logger := log.WithFields(log.Fields{
+				"user":   user,
+				"ids":    []string{userAttrSql["id"], id},
+				"policy": cfg.duplicateAccounts,
+			})
+			if cfg.duplicateAccounts == DuplicateAccountsReport {
+				logger.Warn("Another Greenlight account shares the email address of the LDAP user")
+				continue
+			}
+			b.resolveDuplicates = append(b.resolveDuplicates, accountDuplicate{userAttrSql["id"], id})
+			s.changes = append(s.changes, attrChange{user, "duplicate_account", id, ""})
+			logger.Info("Another Greenlight account shares the email address of the LDAP user and will be resolved")
+		}
+
+		log.WithFields(log.Fields{
+			"user":      user,
+			"SQL data":  userAttrSql,
+			"LDAP data": userAttrLdap,
+		}).Debug("Fetched user data")
+
+		changed := false
+		for attr, ldapV := range userAttrLdap {
+			// Only writable columns are compared, as others, e.g., username for
+			// Greenlight 3.x, might not exist in the schema.
+			if !slices.Contains(sqlWritableColumns, attr) {
+				continue
+			}
+
+			sqlV := userAttrSql[attr]
+			if cfg.forceResync && attrPolicyAllows(attr, sqlV, ldapV) {
+				// The LDAP value is written regardless of any difference, but only
+				// reported as a change if it is not the stored value.
+				if sqlV != ldapV {
+					s.changes = append(s.changes, attrChange{user, attr, sqlV, ldapV})
+				}
+				changed = true
+			} else if attrEqual(attr, sqlV, ldapV) {
+				// Keep the stored value for equivalent values, e.g., differing
+				// only in the diacritics, in case other attributes are written.
+				userAttrLdap[attr] = sqlV
+			} else if !attrPolicyAllows(attr, sqlV, ldapV) {
+				log.WithFields(log.Fields{
+					"user":      user,
+					"attribute": attr,
+					"policy":    cfg.attributePolicy[attr],
+				}).Debug("User attribute differs, but its policy keeps the stored value")
+				userAttrLdap[attr] = sqlV
+			} else {
+				log.WithFields(log.Fields{
+					"user":      user,
+					"attribute": attr,
+					"old":       sqlV,
+					"new":       ldapV,
+				}).Debug("User attribute has changed")
+				s.changes = append(s.changes, attrChange{user, attr, sqlV, ldapV})
+				changed = true
+			}
+		}
+
+		if changed {
+			// Absent LDAP attributes keep their stored value, as sqlUpdateUser
+			// writes all sqlWritableColumns.
+			for _, col := range sqlWritableColumns {
+				if _, ok := userAttrLdap[col]; !ok {
+					userAttrLdap[col] = userAttrSql[col]
+				}
+			}
+			b.updateUserAttrs = append(b.updateUserAttrs, userAttrLdap)
+			log.WithField("user", user).Info("User has changed")
+		}
+	}
+
+	// Acting on missing users requires at least one found user. Otherwise, a
+	// misconfigured LDAP_BASE or LDAP_FILTER would lock out everyone.
+	if len(missingUsers) > 0 && !s.searchSucceeded && cfg.missingPolicy != MissingPolicyIgnore {
+		log.WithField("missing", len(missingUsers)).Error("No user exists in LDAP, check LDAP_BASE and LDAP_FILTER")
+		metrics.countError(MetricSourceLdap)
+		missingUsers = nil
+	}
+	for _, user := range missingUsers {
+		userAttrSql := b.users[user]
+		logger := log.WithField("user", user)
+
+		switch {
+		case cfg.missingPolicy == MissingPolicyIgnore:
+			logger.Debug("User does not exist in LDAP")
+
+		case cfg.missingPolicy == MissingPolicyWarn:
+			logger.Warn("User does not exist in LDAP")
+
+		case cfg.missingPolicy == MissingPolicyBan && cfg.schema == SchemaV2:
+			if userAttrSql["role"] != sqlSchemaV2RoleDenied {
+				b.updateUserRoles[userAttrSql["id"]] = sqlSchemaV2RoleDenied
+				s.changes = append(s.changes, attrChange{user, "role", userAttrSql["role"], sqlSchemaV2RoleDenied})
+				logger.Info("User does not exist in LDAP and will be banned")
+			}
+
+		default:
+			// Greenlight 3.x's soft deletion is already its banned status.
+			if userAttrSql["deleted"] != "true" {
+				b.deactivateUsers = append(b.deactivateUsers, userAttrSql["id"])
+				s.changes = append(s.changes, attrChange{user, "deleted", userAttrSql["deleted"], "true"})
+				logger.Info("User does not exist in LDAP and will be deactivated")
+			}
+		}
+	}
+
+	if cfg.conflictPolicy != ConflictPolicyFail && len(b.updateUserAttrs) > 0 {
+		stored := make(map[string]map[string]string, len(b.updateUserAttrs))
+		for _, userAttr := range b.updateUserAttrs {
+			stored[userAttr["id"]] = b.users[b.userIds[userAttr["id"]]]
+		}
+		skipped, renamed, err := resolveConflicts(ctx, s.db, b.updateUserAttrs, stored)
+		if err != nil {
+			s.failures = append(s.failures, err)
+			log.WithError(err).Error("Failed to check unique columns for conflicts")
+		}
+
+		skippedUsers := make(map[string]bool, len(skipped))
+		for _, conflict := range skipped {
+			user := b.userIds[conflict.userId]
+			skippedUsers[user] = true
+			s.failed.add(FailureUniqueConflict, user,
+				fmt.Errorf("%s is already held by account %s", conflict.column, conflict.otherId))
+			log.WithFields(log.Fields{
+				"user":      user,
+				"attribute": conflict.column,
+				"account":   conflict.otherId,
+				"new":       conflict.value,
+			}).Warn("Another Greenlight account holds the new value, skipping the update of the user")
+		}
+		b.updateUserAttrs = slices.DeleteFunc(b.updateUserAttrs, func(userAttr map[string]string) bool {
+			return skippedUsers[b.userIds[userAttr["id"]]]
+		})
+		s.changes = slices.DeleteFunc(s.changes, func(change attrChange) bool {
+			return skippedUsers[change.user] && slices.Contains(sqlWritableColumns, change.attribute)
+		})
+
+		for _, conflict := range renamed {
+			user := b.userIds[conflict.userId]
+			logger := log.WithFields(log.Fields{
+				"user":      user,
+				"attribute": conflict.column,
+				"account":   conflict.otherId,
+				"new":       conflict.renamed,
+			})
+			if cfg.conflictPolicy == ConflictPolicySuffix {
+				for i := range s.changes {
+					if s.changes[i].user == user && s.changes[i].attribute == conflict.column {
+						s.changes[i].new = conflict.renamed
+					}
+				}
+				// A suffix written by a previous sync is kept.
+				s.changes = slices.DeleteFunc(s.changes, func(change attrChange) bool {
+					return change.user == user && change.attribute == conflict.column && change.old == change.new
+				})
+				logger.Warn("Another Greenlight account holds the new value, which will be written with a suffix")
+			} else {
+				b.renameConflicts = append(b.renameConflicts, conflict)
+				s.changes = append(s.changes, attrChange{user, "conflicting_account", conflict.otherId, ""})
+				logger.Warn("Another Greenlight account holds the new value and will be renamed, review the account")
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+		log.WithError(err).Error("LDAP sync was canceled")
+		return
+	}
+	return
+}
+
+// checkThreshold enforces the EnvMaxChanges before applying changes, failing
+// unless EnvForce is set. The detected changes are reported nonetheless.
+func (s *syncPass) checkThreshold() error {
+	thresholdErr := cfg.maxChanges.check(s.changes, s.userCount)
+	if thresholdErr == nil {
+		return nil
+	} else if cfg.force {
+		log.WithError(thresholdErr).Warnf("Applying changes nonetheless, as %s is set", EnvForce)
+		return nil
+	}
+
+	log.WithError(thresholdErr).Errorf("Aborting LDAP sync, set %s to apply the changes", EnvForce)
+	sortChanges(s.changes)
+	s.reported = writeReport(s.runId, s.startTime, s.changes, nil, false, s.failed.ambiguous)
+	return thresholdErr
+}
+
+// apply writes the batch's pending updates. Failed updates are collected in
+// s.failures, while an error is only returned if the sync must be aborted,
+// e.g., for a failed backup or canary update.
+func (s *syncPass) apply(ctx context.Context, b *syncBatch) (err error) {
+	// committedAttrs are the written users, read back for EnvVerifyUpdates.
+	var committedAttrs []map[string]string
+
+	// The backup covers the users of all batches so far, as it is replaced.
+	if cfg.backup != "" && len(b.updateUserAttrs) > 0 {
+		s.backupRows = append(s.backupRows, newBackupRows(b.users, b.userIds, b.updateUserAttrs)...)
+		if err = writeBackup(s.db, s.runId, s.startTime, s.backupRows); err != nil {
+			err = fmt.Errorf("%w: cannot write backup, skipping the updates: %w", errSyncUpdate, err)
+			log.WithError(err).WithField("backup", backupPath(s.runId, s.startTime)).Error("Aborting LDAP sync")
+			sortChanges(s.changes)
+			s.reported = writeReport(s.runId, s.startTime, s.changes, nil, false, s.failed.ambiguous)
+			return
+		}
+	}
+
+	// Conflicting accounts are renamed first, as the updates would fail on
+	// their unique constraints otherwise.
+	if len(b.renameConflicts) > 0 {
+		if err := sqlRetry(ctx, func() error { return sqlRenameConflicts(ctx, s.db, b.renameConflicts) }); err != nil {
+			s.failures = append(s.failures, err)
+			skippedIds := make(map[string]bool, len(b.renameConflicts))
+			for _, conflict := range b.renameConflicts {
+				skippedIds[conflict.userId] = true
+			}
+			var skippedAttrs []map[string]string
+			b.updateUserAttrs = slices.DeleteFunc(b.updateUserAttrs, func(userAttr map[string]string) bool {
+				if skippedIds[userAttr["id"]] {
+					skippedAttrs = append(skippedAttrs, userAttr)
+					return true
+				}
+				return false
+			})
+			s.failed.addUpdates(skippedAttrs, nil, b.userIds, err)
+			log.WithError(err).WithField("skipped", len(skippedAttrs)).Error("Failed to rename conflicting Greenlight accounts, skipping their users' updates")
+		} else {
+			log.WithField("renamed", len(b.renameConflicts)).Warn("Renamed conflicting Greenlight accounts, review them")
+		}
+	}
+
+	if cfg.canary.enabled() && len(b.updateUserAttrs) > 0 {
+		var canaryAttrs, otherAttrs []map[string]string
+		for _, userAttr := range b.updateUserAttrs {
+			if cfg.canary.contains(b.userIds[userAttr["id"]]) {
+				canaryAttrs = append(canaryAttrs, userAttr)
+			} else {
+				otherAttrs = append(otherAttrs, userAttr)
+			}
+		}
+
+		if len(canaryAttrs) > 0 {
+			if err = sqlRetry(ctx, func() error { return writerUpdateUser(ctx, s.db, canaryAttrs) }); err != nil {
+				err = fmt.Errorf("%w: canary update failed, skipping the remaining users: %w", errSyncUpdate, err)
+				log.WithError(err).WithField("canaries", len(canaryAttrs)).Error("Aborting LDAP sync")
+				metrics.countError(MetricSourceSql)
+				sortChanges(s.changes)
+				s.reported = writeReport(s.runId, s.startTime, s.changes, nil, false, s.failed.ambiguous)
+				return
+			}
+			log.WithField("updates", len(canaryAttrs)).Info("Updated SQL canary users")
+			committedAttrs = append(committedAttrs, canaryAttrs...)
+			for _, userAttr := range canaryAttrs {
+				s.updatedUsers = append(s.updatedUsers, b.userIds[userAttr["id"]])
+			}
+		}
+		b.updateUserAttrs = otherAttrs
+	}
+
+	if len(b.updateUserAttrs) > 0 && cfg.sqlParallel > 1 {
+		committed, err := sqlUpdateUserParallel(ctx, s.db, b.updateUserAttrs, cfg.sqlParallel)
+		if err != nil {
+			s.failures = append(s.failures, err)
+			s.failed.addUpdates(b.updateUserAttrs, committed, b.userIds, err)
+			log.WithError(err).WithField("committed", len(committed)).Error("Failed to perform parts of the parallel SQL update")
+		}
+		if len(committed) > 0 {
+			log.WithField("updates", len(committed)).Info("Updated SQL users")
+		}
+		committedAttrs = append(committedAttrs, committed...)
+		for _, userAttr := range committed {
+			s.updatedUsers = append(s.updatedUsers, b.userIds[userAttr["id"]])
+		}
+	} else if len(b.updateUserAttrs) > 0 && cfg.sqlChunkSize > 0 {
+		committed, err := sqlUpdateUserChunked(ctx, s.db, b.updateUserAttrs, cfg.sqlChunkSize)
+		if err != nil {
+			s.failures = append(s.failures, err)
+			s.failed.addUpdates(b.updateUserAttrs, committed, b.userIds, err)
+			committedUsers := make([]string, 0, len(committed))
+			for _, userAttr := range committed {
+				committedUsers = append(committedUsers, b.userIds[userAttr["id"]])
+			}
+			log.WithError(err).WithFields(log.Fields{
+				"committed":       len(committed),
+				"committed users": committedUsers,
+				"skipped":         len(b.updateUserAttrs) - len(committed),
+			}).Error("Failed to perform parts of the chunked SQL update")
+		}
+		if len(committed) > 0 {
+			log.WithField("updates", len(committed)).Info("Updated SQL users")
+		}
+		committedAttrs = append(committedAttrs, committed...)
+		for _, userAttr := range committed {
+			s.updatedUsers = append(s.updatedUsers, b.userIds[userAttr["id"]])
+		}
+	} else if len(b.updateUserAttrs) > 0 {
+		if err := sqlRetry(ctx, func() error { return writerUpdateUser(ctx, s.db, b.updateUserAttrs) }); err != nil {
+			s.failures = append(s.failures, err)
+			s.failed.addUpdates(b.updateUserAttrs, nil, b.userIds, err)
+			log.WithError(err).WithField("skipped", len(b.updateUserAttrs)).Error("Failed to perform SQL update, rolled back all updates")
+		} else {
+			log.WithField("updates", len(b.updateUserAttrs)).Info("Updated SQL users")
+			committedAttrs = append(committedAttrs, b.updateUserAttrs...)
+			for _, userAttr := range b.updateUserAttrs {
+				s.updatedUsers = append(s.updatedUsers, b.userIds[userAttr["id"]])
+			}
+		}
+	}
+
+	if cfg.verifyUpdates && len(committedAttrs) > 0 {
+		mismatches, err := sqlVerifyUsers(ctx, s.db, committedAttrs)
+		if err != nil {
+			s.failures = append(s.failures, err)
+			log.WithError(err).Error("Failed to read back updated SQL users")
+		}
+		for _, mismatch := range mismatches {
+			log.WithFields(log.Fields{
+				"user":      b.userIds[mismatch.user],
+				"attribute": mismatch.attribute,
+				"intended":  mismatch.old,
+				"stored":    mismatch.new,
+			}).Error("Stored SQL value differs from the written one")
+		}
+		if len(mismatches) > 0 {
+			s.failures = append(s.failures, fmt.Errorf("%d stored SQL values differ from the written ones", len(mismatches)))
+		}
+	}
+
+	if len(b.updateUserRoles) > 0 {
+		var unknownRoles map[string]string
+		err := sqlRetry(ctx, func() (err error) {
+			unknownRoles, err = writerUpdateUserRoles(ctx, s.db, b.updateUserRoles)
+			return
+		})
+		if err != nil {
+			s.failures = append(s.failures, err)
+			for id := range b.updateUserRoles {
+				s.failed.add(FailureSqlUpdate, b.userIds[id], err)
+			}
+			log.WithError(err).Error("Failed to update SQL user roles")
+		} else {
+			for id, role := range unknownRoles {
+				log.WithFields(log.Fields{
+					"user": b.userIds[id],
+					"role": role,
+				}).Error("Mapped role does not exist in Greenlight")
+			}
+			log.WithField("updates", len(b.updateUserRoles)-len(unknownRoles)).Info("Updated SQL user roles")
+			for id := range b.updateUserRoles {
+				if _, unknown := unknownRoles[id]; !unknown {
+					s.roleUpdatedUsers = append(s.roleUpdatedUsers, b.userIds[id])
+				}
+			}
+		}
+	}
+
+	if len(b.updateSharedAccess) > 0 {
+		if err := sqlRetry(ctx, func() error { return sqlUpdateSharedAccess(ctx, s.db, b.updateSharedAccess) }); err != nil {
+			s.failures = append(s.failures, err)
+			for _, change := range b.updateSharedAccess {
+				s.failed.add(FailureSqlUpdate, b.userIds[change.userId], err)
+			}
+			log.WithError(err).Error("Failed to update SQL shared room accesses")
+		} else {
+			log.WithField("updates", len(b.updateSharedAccess)).Info("Updated SQL shared room accesses")
+			for _, change := range b.updateSharedAccess {
+				if !slices.Contains(s.sharedUpdatedUsers, b.userIds[change.userId]) {
+					s.sharedUpdatedUsers = append(s.sharedUpdatedUsers, b.userIds[change.userId])
+				}
+			}
+		}
+	}
+
+	if len(b.resolveDuplicates) > 0 {
+		if err := sqlRetry(ctx, func() error { return sqlResolveDuplicates(ctx, s.db, b.resolveDuplicates) }); err != nil {
+			s.failures = append(s.failures, err)
+			for _, duplicate := range b.resolveDuplicates {
+				s.failed.add(FailureSqlUpdate, b.userIds[duplicate.userId], err)
+			}
+			log.WithError(err).Error("Failed to resolve duplicate Greenlight accounts")
+		} else {
+			log.WithFields(log.Fields{
+				"duplicates": len(b.resolveDuplicates),
+				"policy":     cfg.duplicateAccounts,
+			}).Info("Resolved duplicate Greenlight accounts")
+			for _, duplicate := range b.resolveDuplicates {
+				s.duplicateResolvedUsers = append(s.duplicateResolvedUsers, b.userIds[duplicate.userId])
+			}
+		}
+	}
+
+	if len(b.deactivateUsers) > 0 {
+		var rooms int64
+		err := sqlRetry(ctx, func() (err error) {
+			rooms, err = sqlDeactivateUsers(ctx, s.db, b.deactivateUsers)
+			return
+		})
+		if err != nil {
+			s.failures = append(s.failures, err)
+			for _, id := range b.deactivateUsers {
+				s.failed.add(FailureSqlUpdate, b.userIds[id], err)
+			}
+			log.WithError(err).Error("Failed to deactivate SQL users")
+		} else {
+			log.WithFields(log.Fields{
+				"deactivations": len(b.deactivateUsers),
+				"rooms":         rooms,
+				"room_policy":   cfg.roomPolicy,
+			}).Info("Deactivated SQL users")
+			for _, id := range b.deactivateUsers {
+				s.deactivatedUsers = append(s.deactivatedUsers, b.userIds[id])
+			}
+		}
+	}
+
+	if len(b.reactivateUsers) > 0 {
+		if err := sqlRetry(ctx, func() error { return sqlReactivateUsers(ctx, s.db, b.reactivateUsers) }); err != nil {
+			s.failures = append(s.failures, err)
+			for _, id := range b.reactivateUsers {
+				s.failed.add(FailureSqlUpdate, b.userIds[id], err)
+			}
+			log.WithError(err).Error("Failed to reactivate unlocked SQL users")
+		} else {
+			log.WithField("reactivations", len(b.reactivateUsers)).Info("Reactivated unlocked SQL users")
+			for _, id := range b.reactivateUsers {
+				s.reactivatedUsers = append(s.reactivatedUsers, b.userIds[id])
+			}
+		}
+	}
+
+	// Once the EnvRetryBudget is used, the remaining steps are not attempted.
+	if slices.ContainsFunc(s.failures, func(err error) bool { return errors.Is(err, errRetryBudgetExhausted) }) {
+		err = fmt.Errorf("%w: %w", errSyncUpdate, errors.Join(s.failures...))
+		log.WithError(err).Error("Aborting LDAP sync")
+	}
+	return
+}
+
+// compareProvision lists the LDAP users missing in the s.knownUsers to be
+// provisioned, recording them in s.changes.
+func (s *syncPass) compareProvision(ctx context.Context) (provisionUsers []provisionUser) {
+	uids, err := ldapProvisionCandidates(s.ldapConns[0])
+	if err != nil {
+		log.WithError(err).Error("Failed to list LDAP users to provision")
+		metrics.countError(MetricSourceLdap)
+		s.userFailures++
+	}
+	for _, uid := range uids {
+		if _, ok := s.knownUsers[uid]; ok {
+			continue
+		}
+
+		ldapUsr, err := ldapUserSearch(ctx, s.ldapConns[0], uid, s.withGroups)
+		if errors.Is(err, errLdapUserAmbiguous) {
+			s.failed.addAmbiguous(uid, ldapUsr, err)
+			metrics.countError(MetricSourceLdap)
+			s.userFailures++
+			continue
+		} else if err != nil {
+			s.failed.add(FailureLdapSearch, uid, err)
+			metrics.countError(MetricSourceLdap)
+			s.userFailures++
+			continue
+		}
+		if len(ldapUsr.ambiguous) > 0 {
+			s.failed.addAmbiguous(uid, ldapUsr, nil)
+		}
+		if ldapUsr.optOut || ldapUsr.locked || ldapUsr.disabled || !s.scope.allows(uid, ldapUsr) {
+			log.WithField("user", uid).Debug("Skipping opted out, locked, disabled, or out of scope LDAP user for provisioning")
+			continue
+		}
+		canonicalizeAttrs(uid, ldapUsr.attrs)
+
+		role := cfg.provisionRole
+		if len(cfg.roleMap) > 0 {
+			if mappedRole := resolveRole(cfg.roleMap, cfg.roleDefault, ldapUsr.groups); mappedRole != "" {
+				role = mappedRole
+			}
+		}
+		if cfg.adminGroup != "" {
+			role = adminGroupRole(ldapUsr.groups, role, role)
+		}
+
+		provisionUsers = append(provisionUsers, provisionUser{uid, ldapUsr.attrs, role})
+		s.changes = append(s.changes, attrChange{uid, "provisioned", "", role})
+		log.WithFields(log.Fields{
+			"user": uid,
+			"role": role,
+		}).Info("User is missing in Greenlight and will be provisioned")
+	}
+	return
+}
+
+// applyProvision creates the users listed by compareProvision. Failures are
+// collected in s.failures.
+func (s *syncPass) applyProvision(ctx context.Context, users []provisionUser) {
+	for _, user := range users {
+		err := sqlProvisionUser(ctx, s.db, user)
+		if errors.Is(err, errProvisionExists) {
+			log.WithField("user", user.socialUid).Warn("User to be provisioned already exists in Greenlight")
+		} else if err != nil {
+			s.failures = append(s.failures, err)
+			s.failed.add(FailureSqlProvision, user.socialUid, err)
+		} else {
+			log.WithField("user", user.socialUid).Info("Provisioned SQL user")
+			s.provisionedUsers = append(s.provisionedUsers, user.socialUid)
+		}
+	}
+}
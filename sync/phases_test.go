@@ -0,0 +1,391 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/lib/pq"
+)
+
+// testConfig replaces the active configuration for the duration of a test by
+// a copy of the current one, modified by set.
+func testConfig(t testing.TB, set func(c *config)) {
+	t.Helper()
+	common := cfg
+	c := *common
+	set(&c)
+	cfg = &c
+	t.Cleanup(func() { cfg = common })
+}
+
+// testCompare performs syncPass.compare for SQL users keyed by their social_uid
+// and the LDAP search results of these users.
+func testCompare(t *testing.T, users map[string]map[string]string, results map[string]ldapSearchResult) (*syncPass, *syncBatch) {
+	t.Helper()
+	s := &syncPass{}
+	b := newSyncBatch(users)
+
+	userNames := slices.Sorted(maps.Keys(users))
+	searchResults := make([]ldapSearchResult, 0, len(userNames))
+	for _, user := range userNames {
+		searchResults = append(searchResults, results[user])
+	}
+	if err := s.compare(context.Background(), b, userNames, searchResults); err != nil {
+		t.Fatalf("compare() failed: %v", err)
+	}
+	sort.Strings(b.deactivateUsers)
+	sort.Strings(b.reactivateUsers)
+	return s, b
+}
+
+// testSqlUser is a Greenlight user with the attributes of testLdapUser.
+func testSqlUser(id, deleted string) map[string]string {
+	return map[string]string{
+		"id":       id,
+		"name":     "Alice",
+		"username": "alice",
+		"email":    "alice@example.org",
+		"image":    "",
+		"deleted":  deleted,
+		"role":     "user",
+	}
+}
+
+// testLdapUser is the LDAP user matching testSqlUser.
+func testLdapUser() ldapUser {
+	return ldapUser{
+		attrs: map[string]string{
+			"name":     "Alice",
+			"username": "alice",
+			"email":    "alice@example.org",
+		},
+	}
+}
+
+func TestCompareLocked(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		locked      bool
+		deleted     string
+		deactivate  bool
+		reactivate  bool
+		wantChanges []attrChange
+	}{
+		{"ignored lock", LockPolicyIgnore, true, "false", false, false, nil},
+		{"ignored unlock", LockPolicyIgnore, false, "true", false, false, nil},
+		{"locked user", LockPolicyDeactivate, true, "false", true, false,
+			[]attrChange{{"alice", "deleted", "false", "true"}}},
+		{"locked deactivated user", LockPolicyDeactivate, true, "true", false, false, nil},
+		{"unlocked user", LockPolicyDeactivate, false, "true", false, true,
+			[]attrChange{{"alice", "deleted", "true", "false"}}},
+		{"active user", LockPolicyDeactivate, false, "false", false, false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.lockPolicy = test.policy })
+
+			ldapUsr := testLdapUser()
+			ldapUsr.locked = test.locked
+			s, b := testCompare(t,
+				map[string]map[string]string{"alice": testSqlUser("1", test.deleted)},
+				map[string]ldapSearchResult{"alice": {usr: ldapUsr}})
+
+			if !slices.Equal(s.changes, test.wantChanges) {
+				t.Errorf("changes = %v, want %v", s.changes, test.wantChanges)
+			}
+			if deactivate := len(b.deactivateUsers) > 0; deactivate != test.deactivate {
+				t.Errorf("deactivateUsers = %v, want deactivation %v", b.deactivateUsers, test.deactivate)
+			}
+			if reactivate := len(b.reactivateUsers) > 0; reactivate != test.reactivate {
+				t.Errorf("reactivateUsers = %v, want reactivation %v", b.reactivateUsers, test.reactivate)
+			}
+		})
+	}
+}
+
+func TestCompareAccessDenied(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      uint16
+		succeeded bool
+		abort     bool
+	}{
+		{"first search denied", ldap.LDAPResultInsufficientAccessRights, false, true},
+		{"denied after a succeeded search", ldap.LDAPResultInsufficientAccessRights, true, false},
+		{"other failure", ldap.LDAPResultOperationsError, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", "")
+			conn := fakeLdap{func(*ldap.SearchRequest) (*ldap.SearchResult, error) {
+				return nil, ldap.NewError(test.code, errors.New("simulated"))
+			}}
+
+			s := &syncPass{ldapConns: []ldapSearcher{conn}, knownUsers: make(map[string]string), searchSucceeded: test.succeeded}
+			b := newSyncBatch(map[string]map[string]string{
+				"alice": testSqlUser("1", "false"),
+				"bob":   testSqlUser("2", "false"),
+			})
+			userNames, searchResults, _ := s.fetch(context.Background(), b)
+			err := s.compare(context.Background(), b, userNames, searchResults)
+
+			if abort := err != nil; abort != test.abort {
+				t.Fatalf("compare() error = %v, want abort %v", err, test.abort)
+			}
+			if test.abort && !strings.Contains(err.Error(), "read permissions") {
+				t.Errorf("compare() error = %v, want an error about read permissions", err)
+			}
+			if len(s.changes) > 0 {
+				t.Errorf("changes = %v, want none", s.changes)
+			}
+		})
+	}
+}
+
+func TestCompareClearOnEmpty(t *testing.T) {
+	tests := []struct {
+		name         string
+		clearOnEmpty bool
+		empty        bool
+		wantChanges  []attrChange
+	}{
+		{"absent", false, false, nil},
+		{"absent with clear on empty", true, false, nil},
+		{"present but empty", false, true, nil},
+		{"present but empty with clear on empty", true, true,
+			[]attrChange{{"alice", "name", "Alice", ""}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.clearOnEmpty = test.clearOnEmpty })
+
+			ldapUsr := testLdapUser()
+			delete(ldapUsr.attrs, "name")
+			if test.empty {
+				ldapUsr.empty = map[string]bool{"name": true}
+			}
+			s, b := testCompare(t,
+				map[string]map[string]string{"alice": testSqlUser("1", "false")},
+				map[string]ldapSearchResult{"alice": {usr: ldapUsr}})
+
+			if !slices.Equal(s.changes, test.wantChanges) {
+				t.Errorf("changes = %v, want %v", s.changes, test.wantChanges)
+			}
+			if updated := len(b.updateUserAttrs) > 0; updated != (test.wantChanges != nil) {
+				t.Errorf("updateUserAttrs = %v, want update %v", b.updateUserAttrs, test.wantChanges != nil)
+			}
+		})
+	}
+}
+
+func TestCompareMovedEntry(t *testing.T) {
+	entry := func(dn, uid string) *ldap.Entry {
+		return testEntry(dn, map[string]string{
+			"uid":       uid,
+			"entryUUID": "5f1d7ba2-2bd6-4a2c-9c6e-0f3c1b1e8a11",
+			"cn":        "Alice",
+			"mail":      "alice@example.org",
+		})
+	}
+	tests := []struct {
+		name      string
+		matchAttr string
+		user      string
+		runs      []*ldap.Entry
+	}{
+		{"moved to another OU", "uid", "alice", []*ldap.Entry{
+			entry("uid=alice,ou=people,dc=example,dc=org", "alice"),
+			entry("uid=alice,ou=staff,dc=example,dc=org", "alice"),
+			entry("uid=alice,ou=people,dc=example,dc=org", "alice"),
+		}},
+		{"renamed with a stable identifier", "entryUUID", "5f1d7ba2-2bd6-4a2c-9c6e-0f3c1b1e8a11", []*ldap.Entry{
+			entry("uid=alice,ou=people,dc=example,dc=org", "alice"),
+			entry("uid=asmith,ou=staff,dc=example,dc=org", "asmith"),
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LDAP_BASE", "dc=example,dc=org")
+			t.Setenv("LDAP_FILTER", "")
+			t.Setenv("LDAP_ATTRIBUTE_MAPPING", "")
+			testConfig(t, func(c *config) {
+				c.matchAttribute = test.matchAttr
+				c.lockPolicy = LockPolicyDeactivate
+			})
+
+			for run, ldapEntry := range test.runs {
+				// As the username is mapped from the uid, the stored one is the
+				// entry's current uid.
+				userAttrSql := testSqlUser("1", "false")
+				userAttrSql["username"] = ldapEntry.GetAttributeValue("uid")
+				userAttrSql["social_uid"] = test.user
+
+				s := &syncPass{ldapConns: []ldapSearcher{&ldifDirectory{entries: []*ldap.Entry{ldapEntry}}}, knownUsers: make(map[string]string)}
+				b := newSyncBatch(map[string]map[string]string{test.user: userAttrSql})
+				userNames, searchResults, _ := s.fetch(context.Background(), b)
+				if err := searchResults[0].err; err != nil {
+					t.Fatalf("run %d: ldapUserSearch() failed: %v", run, err)
+				}
+				if err := s.compare(context.Background(), b, userNames, searchResults); err != nil {
+					t.Fatalf("run %d: compare() failed: %v", run, err)
+				}
+				if len(s.changes) > 0 || len(b.deactivateUsers)+len(b.reactivateUsers) > 0 {
+					t.Errorf("run %d: changes = %v, want none", run, s.changes)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareOptOut(t *testing.T) {
+	tests := []struct {
+		name        string
+		optOut      bool
+		wantChanges []attrChange
+	}{
+		{"opted out", true, nil},
+		{"opted in", false, []attrChange{
+			{"alice", "name", "Alice", "Alice Smith"},
+			{"alice", "deleted", "false", "true"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) { c.lockPolicy = LockPolicyDeactivate })
+
+			// The locked user with a changed name is neither updated nor deactivated
+			// once opted out.
+			ldapUsr := testLdapUser()
+			ldapUsr.attrs["name"] = "Alice Smith"
+			ldapUsr.locked = true
+			ldapUsr.optOut = test.optOut
+			s, b := testCompare(t,
+				map[string]map[string]string{"alice": testSqlUser("1", "false")},
+				map[string]ldapSearchResult{"alice": {usr: ldapUsr}})
+
+			sortChanges(s.changes)
+			sortChanges(test.wantChanges)
+			if !slices.Equal(s.changes, test.wantChanges) {
+				t.Errorf("changes = %v, want %v", s.changes, test.wantChanges)
+			}
+			if test.optOut && (len(b.updateUserAttrs) > 0 || len(b.deactivateUsers) > 0) {
+				t.Errorf("opted out user is updated %v or deactivated %v", b.updateUserAttrs, b.deactivateUsers)
+			}
+		})
+	}
+}
+
+func TestApplyCanary(t *testing.T) {
+	tests := []struct {
+		name    string
+		failId  string
+		updated []string
+		abort   bool
+	}{
+		{"canary succeeds", "", []string{"alice", "bob", "carol"}, false},
+		{"canary fails", "1", nil, true},
+		// The remaining users are rolled back together.
+		{"other user fails", "2", []string{"alice"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testConfig(t, func(c *config) {
+				c.canary = canarySelection{users: []string{"alice"}}
+				c.updatedAtPolicy = UpdatedAtNever
+			})
+			db, fake := newTestDB(t, postgresDialect{}, func(_ string, args []driver.Value) (fakeRows, error) {
+				if len(args) > 0 && args[len(args)-1] == test.failId {
+					return fakeRows{}, errors.New("relation \"users\" does not exist")
+				}
+				return fakeRows{}, nil
+			})
+
+			s := &syncPass{db: db}
+			b := newSyncBatch(nil)
+			for i, user := range []string{"alice", "bob", "carol"} {
+				id := fmt.Sprint(i + 1)
+				b.userIds[id] = user
+				b.updateUserAttrs = append(b.updateUserAttrs, map[string]string{"id": id, "name": user})
+			}
+			err := s.apply(context.Background(), b)
+
+			if abort := err != nil; abort != test.abort {
+				t.Fatalf("apply() error = %v, want abort %v", err, test.abort)
+			}
+			sort.Strings(s.updatedUsers)
+			if !slices.Equal(s.updatedUsers, test.updated) {
+				t.Errorf("updatedUsers = %v, want %v", s.updatedUsers, test.updated)
+			}
+			if test.abort && len(fake.executed()) != 1 {
+				t.Errorf("executed %d statements, want only the canary's", len(fake.executed()))
+			}
+		})
+	}
+}
+
+func TestRetryBudgetAborts(t *testing.T) {
+	errBusy := ldap.NewError(ldap.LDAPResultBusy, errors.New("server is busy"))
+	tests := []struct {
+		name  string
+		err   error
+		abort bool
+	}{
+		{"transient failure", errBusy, false},
+		{"exhausted budget", errors.Join(errRetryBudgetExhausted, errBusy), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name+"/compare", func(t *testing.T) {
+			s := &syncPass{searchSucceeded: true}
+			b := newSyncBatch(map[string]map[string]string{"alice": testSqlUser("1", "false")})
+			err := s.compare(context.Background(), b, []string{"alice"}, []ldapSearchResult{{err: test.err}})
+			if abort := errors.Is(err, errSyncConnection); abort != test.abort {
+				t.Errorf("compare() error = %v, want abort %v", err, test.abort)
+			}
+		})
+	}
+
+	// A transient SQL error is retried until the budget is used.
+	for _, budget := range []int{0, 2} {
+		t.Run(fmt.Sprintf("apply with budget %d", budget), func(t *testing.T) {
+			testConfig(t, func(c *config) {
+				c.opRetries = 3
+				c.retryBudget = budget
+				c.dialBackoffBase = time.Microsecond
+				c.dialBackoffMax = time.Millisecond
+				c.updatedAtPolicy = UpdatedAtNever
+			})
+			retriesUsed.Store(0)
+			t.Cleanup(func() { retriesUsed.Store(0) })
+			db, _ := newTestDB(t, postgresDialect{}, func(string, []driver.Value) (fakeRows, error) {
+				return fakeRows{}, &pq.Error{Code: "40001", Message: "could not serialize access"}
+			})
+
+			s := &syncPass{db: db}
+			b := newSyncBatch(nil)
+			b.userIds["1"] = "alice"
+			b.updateUserAttrs = []map[string]string{{"id": "1", "name": "Alice"}}
+			err := s.apply(context.Background(), b)
+
+			if abort := err != nil; abort != (budget > 0) {
+				t.Errorf("apply() error = %v, want abort %v", err, budget > 0)
+			}
+			if len(s.failures) != 1 {
+				t.Errorf("failures = %v, want the update", s.failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// connPool keeps the connections of a sync for the following ones if
+// EnvReuseConnections is set. As syncAction never runs concurrently, it is not
+// guarded by a mutex.
+var connPool struct {
+	db        *sqlDB
+	ldapConns []ldapSearcher
+}
+
+// syncSqlOpen returns the database connection for a sync together with its
+// release function, to be called at the end of the sync.
+//
+// With EnvReuseConnections, a kept connection is reused if it still responds
+// and was opened for the same readOnly mode. Otherwise, a new one replaces it.
+func syncSqlOpen(readOnly bool) (db *sqlDB, release func(), err error) {
+	if !cfg.reuseConnections {
+		if db, err = sqlOpen(readOnly); err != nil {
+			return
+		}
+		release = func() { _ = db.Close() }
+		return
+	}
+
+	release = func() {}
+	if connPool.db != nil && connPool.db.readOnly == readOnly {
+		pingErr := connPool.db.Ping()
+		if pingErr == nil {
+			db = connPool.db
+			return
+		}
+		log.WithError(pingErr).Warn("Kept database connection is unhealthy, reconnecting")
+	}
+
+	if connPool.db != nil {
+		_ = connPool.db.Close()
+		connPool.db = nil
+	}
+	if db, err = sqlOpen(readOnly); err != nil {
+		return
+	}
+	connPool.db = db
+	return
+}
+
+// syncLdapOpenPool returns n LDAP connections for a sync together with their
+// release function, similar to syncSqlOpen.
+//
+// Kept connections failing a Root DSE search are replaced individually. An
+// LDIF file is read anew for each sync, picking up its changes.
+func syncLdapOpenPool(n int) (conns []ldapSearcher, release func(), err error) {
+	if !cfg.reuseConnections || cfg.ldapLdif != "" {
+		if conns, err = ldapOpenPool(n); err != nil {
+			return
+		}
+		release = func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}
+		return
+	}
+
+	release = func() {}
+	for i := len(connPool.ldapConns); i < n; i++ {
+		connPool.ldapConns = append(connPool.ldapConns, &ldapRetryConn{})
+	}
+	for _, conn := range connPool.ldapConns[n:] {
+		_ = conn.Close()
+	}
+	connPool.ldapConns = connPool.ldapConns[:n]
+
+	for i, conn := range connPool.ldapConns {
+		retryConn := conn.(*ldapRetryConn)
+		if retryConn.healthy() {
+			continue
+		}
+
+		_ = retryConn.Close()
+		if retryConn.conn, err = ldapDial(); err != nil {
+			retryConn.conn = nil
+			return
+		}
+		log.WithField("connection", i).Debug("Established kept LDAP connection")
+	}
+	conns = connPool.ldapConns
+	return
+}
+
+// syncPoolClose closes all kept connections of EnvReuseConnections.
+func syncPoolClose() {
+	if connPool.db != nil {
+		_ = connPool.db.Close()
+		connPool.db = nil
+	}
+	for _, conn := range connPool.ldapConns {
+		_ = conn.Close()
+	}
+	connPool.ldapConns = nil
+}
+
+// healthy checks if the connection is established and responds to a search of
+// the Root DSE, being readable without special permissions.
+func (c *ldapRetryConn) healthy() bool {
+	if c.conn == nil || c.conn.IsClosing() {
+		return false
+	}
+
+	searchReq := ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0,
+		false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil)
+	if _, err := c.conn.Search(searchReq); err != nil {
+		log.WithError(err).Warn("Kept LDAP connection is unhealthy, reconnecting")
+		return false
+	}
+	return true
+}
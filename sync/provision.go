@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// provisionUser is an LDAP user missing in Greenlight, to be created by sqlProvisionUser.
+type provisionUser struct {
+	socialUid string
+	attrs     map[string]string
+	role      string
+}
+
+// ldapProvisionCandidates lists the EnvMatchAttribute values of all users
+// within the configured EnvProvisionBase, matching both LDAP_FILTER and
+// EnvProvisionFilter.
+func ldapProvisionCandidates(conn ldapSearcher) (uids []string, err error) {
+	uidAttr := cfg.matchAttribute
+
+	searchReq := ldap.NewSearchRequest(
+		cfg.provisionBase,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+		false,
+		fmt.Sprintf("(&%s%s%s)", ldapUidPresentFilter(), ldapFilter(), cfg.provisionFilter),
+		[]string{uidAttr},
+		nil)
+
+	searchResp, err := ldapSearch(conn, searchReq)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range searchResp.Entries {
+		if entryUids := ldapEntryUids(entry); len(entryUids) > 0 && entryUids[0] != "" {
+			uids = append(uids, entryUids[0])
+		}
+	}
+	return
+}
+
+// provisionRandom returns n random characters of the alphabet.
+func provisionRandom(alphabet string, n int) (string, error) {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(alphabet[j.Int64()])
+	}
+	return b.String(), nil
+}
+
+// provisionRoomUid creates a room uid like Greenlight, e.g., "ali-x3d-9kq".
+//
+// https://github.com/bigbluebutton/greenlight/blob/release-2.8.5/app/models/room.rb#L115-L125
+func provisionRoomUid(name string) (string, error) {
+	var chunk []rune
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) && r < unicode.MaxASCII {
+			chunk = append(chunk, r)
+		}
+		if len(chunk) == 3 {
+			break
+		}
+	}
+
+	random, err := provisionRandom("abcdefghijklmnopqrstuvwxyz0123456789", 6)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%s", string(chunk), random[:3], random[3:]), nil
+}
+
+// errProvisionExists reports that a user to be provisioned already exists.
+var errProvisionExists = errors.New("user to be provisioned already exists")
+
+// sqlProvisionUser creates a Greenlight 2.x user together with its home room.
+//
+// If the user already exists, errProvisionExists is returned.
+//
+// The rows are populated as Greenlight does for a first LDAP login: the user
+// gets a random uid, a verified email, the first of the EnvProviders, and the
+// role's id, and the home room with random credentials becomes the user's main
+// room.
+//
+// https://github.com/bigbluebutton/greenlight/blob/release-2.8.5/app/models/user.rb#L234-L252
+func sqlProvisionUser(ctx context.Context, db *sqlDB, user provisionUser) (err error) {
+	roleIds, err := sqlRoleIds(ctx, db)
+	if err != nil {
+		return
+	}
+	roleId, ok := roleIds[user.role]
+	if !ok {
+		err = fmt.Errorf("role %q does not exist in Greenlight", user.role)
+		return
+	}
+
+	const lower = "abcdefghijklmnopqrstuvwxyz"
+	const alnum = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	userUid, err := provisionRandom(lower, 12)
+	if err != nil {
+		return
+	}
+	roomUid, err := provisionRoomUid(user.attrs["name"])
+	if err != nil {
+		return
+	}
+	bbbSeed, err := provisionRandom(alnum, 32)
+	if err != nil {
+		return
+	}
+	bbbId := sha1.Sum([]byte(bbbSeed))
+	moderatorPw, err := provisionRandom(alnum, 12)
+	if err != nil {
+		return
+	}
+	attendeePw, err := provisionRandom(alnum, 12)
+	if err != nil {
+		return
+	}
+
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	provider := sqlActiveSchema.providers[0]
+
+	// The user is only inserted if still missing, e.g., not being skipped as
+	// one of multiple users sharing its social_uid or created concurrently.
+	var userId string
+	err = tx.QueryRowContext(ctx, db.query(`
+		INSERT INTO {users} (
+			{provider}, {uid}, {social_uid}, {name}, {username}, {email}, {image},
+			{role_id}, {email_verified}, {accepted_terms}, {activated_at},
+			{deleted}, {created_at}, {updated_at}
+		)
+		SELECT
+			?, ?, ?, ?, ?, ?, ?,
+			?, true, true, NOW(),
+			false, NOW(), NOW()
+		WHERE NOT EXISTS (
+			SELECT 1 FROM {users} WHERE {provider} = ? AND {social_uid} = ?
+		)
+		RETURNING {id}
+	`), provider, "gl-"+userUid, user.socialUid, user.attrs["name"], user.attrs["username"],
+		user.attrs["email"], user.attrs["image"], roleId, provider, user.socialUid).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = errProvisionExists
+		return
+	} else if err != nil {
+		return
+	}
+
+	var roomId string
+	err = tx.QueryRowContext(ctx, db.query(`
+		INSERT INTO {rooms} (
+			{user_id}, {name}, {uid}, {bbb_id}, {sessions}, {room_settings},
+			{moderator_pw}, {attendee_pw}, {deleted}, {created_at}, {updated_at}
+		) VALUES (
+			?, ?, ?, ?, 0, ?,
+			?, ?, false, NOW(), NOW()
+		)
+		RETURNING {id}
+	`), userId, cfg.provisionRoomName, roomUid, hex.EncodeToString(bbbId[:]), "{ }",
+		moderatorPw, attendeePw).Scan(&roomId)
+	if err != nil {
+		return
+	}
+
+	_, err = tx.ExecContext(ctx, db.query(`
+		UPDATE
+			{users}
+		SET
+			{room_id} = ?
+		WHERE
+			{id} = ?
+	`), roomId, userId)
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+	return
+}
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sqlFetchQueryAlias is the alias of an EnvSqlFetchQuery, being wrapped as a
+// subquery by sqlFetchUserBatch.
+const sqlFetchQueryAlias = "fetch"
+
+// sqlNamedQuery replaces the :name parameters of an operator-defined query,
+// e.g., of EnvSqlFetchQuery or EnvSqlUpdateQuery, by ? placeholders for
+// sqlQuery and returns the according arguments.
+//
+// A []string parameter expands to a comma separated placeholder list, e.g.,
+// for an IN condition. PostgreSQL's :: type casts are kept as they are.
+// Unknown parameters are an error.
+func sqlNamedQuery(query string, params map[string]any) (string, []any, error) {
+	var b strings.Builder
+	var args []any
+	for i := 0; i < len(query); i++ {
+		if query[i] != ':' {
+			b.WriteByte(query[i])
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == ':' {
+			b.WriteString("::")
+			i++
+			continue
+		}
+
+		end := i + 1
+		for end < len(query) && sqlNamedParamChar(query[end], end == i+1) {
+			end++
+		}
+		if end == i+1 {
+			b.WriteByte(':')
+			continue
+		}
+
+		name := query[i+1 : end]
+		value, ok := params[name]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown query parameter :%s", name)
+		}
+		if values, ok := value.([]string); ok {
+			for j, v := range values {
+				if j > 0 {
+					b.WriteString(", ")
+				}
+				b.WriteByte('?')
+				args = append(args, v)
+			}
+		} else {
+			b.WriteByte('?')
+			args = append(args, value)
+		}
+		i = end - 1
+	}
+	return b.String(), args, nil
+}
+
+// sqlNamedParamChar checks if c is allowed within a parameter name for
+// sqlNamedQuery, being a letter, an underscore, or a digit after the first.
+func sqlNamedParamChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+// sqlFetchQueryParams are the parameters available to an EnvSqlFetchQuery.
+func sqlFetchQueryParams() map[string]any {
+	return map[string]any{"providers": sqlActiveSchema.providers}
+}
+
+// sqlUpdateQueryParams are the parameters available to an EnvSqlUpdateQuery
+// for a user's attribute map, being its id and all sqlWritableColumns.
+func sqlUpdateQueryParams(userAttr map[string]string) map[string]any {
+	params := make(map[string]any, len(sqlWritableColumns)+1)
+	for _, col := range sqlWritableColumns {
+		params[col] = userAttr[col]
+	}
+	params["id"] = userAttr["id"]
+	return params
+}
@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// railsResultPrefix marks the script's result line within the runner's output,
+// as Rails might log to stdout as well.
+const railsResultPrefix = "SYNC_RESULT "
+
+// railsScript is the Ruby script of WriterRails, formatted with its JSON input.
+//
+// All changes are applied in one transaction by the models' update!, thus a
+// failing validation rolls back all of them. Roles are looked up by name, the
+// lowest id first, as by sqlRoleIds.
+const railsScript = `require "json"
+
+input = JSON.parse(<<~'SYNC_INPUT')
+%s
+SYNC_INPUT
+
+unknown_roles = {}
+ActiveRecord::Base.transaction do
+  input.fetch("users", {}).each do |id, attrs|
+    User.find(id).update!(attrs)
+  rescue => e
+    raise e.class, "cannot update user #{id}: #{e.message}"
+  end
+
+  input.fetch("roles", {}).each do |id, name|
+    role = Role.where(name: name).order(:id).first
+    if role.nil?
+      unknown_roles[id] = name
+      next
+    end
+    User.find(id).update!(role: role)
+  rescue => e
+    raise e.class, "cannot update role of user #{id}: #{e.message}"
+  end
+end
+
+puts "` + railsResultPrefix + `" + JSON.generate({"unknown_roles" => unknown_roles})
+`
+
+// railsInput is the JSON input of the railsScript, mapping user ids to their
+// changed attributes or role names.
+type railsInput struct {
+	Users map[string]map[string]string `json:"users,omitempty"`
+	Roles map[string]string            `json:"roles,omitempty"`
+}
+
+// railsResult is the JSON result of the railsScript.
+type railsResult struct {
+	UnknownRoles map[string]string `json:"unknown_roles"`
+}
+
+// railsRun applies the input by the railsScript within the EnvRailsRunner,
+// bounded by the EnvRailsTimeout.
+//
+// As with hooks, the command is split by whitespace without any quoting. The
+// script is passed on stdin, thus the runner has to read it from there, e.g.,
+// by "bin/rails runner -". Other than SQL updates, Greenlight's validations,
+// callbacks, and cache invalidations are applied.
+func railsRun(ctx context.Context, input railsInput) (result railsResult, err error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.railsTimeout)
+	defer cancel()
+
+	args := strings.Fields(cfg.railsRunner)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf(railsScript, data))
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	start := time.Now()
+	if err = cmd.Run(); err != nil {
+		out := strings.TrimSpace(stderr.String())
+		if len(out) > hookOutputLimit {
+			out = out[len(out)-hookOutputLimit:]
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %v", cfg.railsTimeout)
+		}
+		err = fmt.Errorf("rails runner %s failed: %w: %s", args[0], err, out)
+		return
+	}
+
+	found := false
+	scanner := bufio.NewScanner(&stdout)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		if line, ok := strings.CutPrefix(scanner.Text(), railsResultPrefix); ok {
+			if err = json.Unmarshal([]byte(line), &result); err != nil {
+				return
+			}
+			found = true
+		}
+	}
+	if !found {
+		err = fmt.Errorf("rails runner %s returned no result", args[0])
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"users":    len(input.Users),
+		"roles":    len(input.Roles),
+		"duration": time.Since(start),
+	}).Debug("Executed rails runner")
+	return
+}
+
+// railsUpdateUser updates the users' sqlWritableColumns like sqlUpdateUser,
+// but by WriterRails. Only changed attributes are written by Rails, which also
+// maintains the updated_at column itself.
+func railsUpdateUser(ctx context.Context, userAttrs []map[string]string) (err error) {
+	defer func(start time.Time) { metrics.observeSqlUpdate(time.Since(start)) }(time.Now())
+
+	ctx, span := traceStart(ctx, "rails.update", otlpSpanKindClient)
+	span.set("users", len(userAttrs))
+	defer func() { span.finish(err) }()
+
+	input := railsInput{Users: make(map[string]map[string]string, len(userAttrs))}
+	for _, userAttr := range userAttrs {
+		attrs := make(map[string]string, len(sqlWritableColumns))
+		for _, col := range sqlWritableColumns {
+			attrs[col] = userAttr[col]
+		}
+		input.Users[userAttr["id"]] = attrs
+	}
+
+	_, err = railsRun(ctx, input)
+	return
+}
+
+// railsUpdateUserRoles updates the users' roles like sqlUpdateUserRoles, but
+// by WriterRails.
+func railsUpdateUserRoles(ctx context.Context, userRoles map[string]string) (unknownRoles map[string]string, err error) {
+	result, err := railsRun(ctx, railsInput{Roles: userRoles})
+	if err != nil {
+		return
+	}
+	if len(result.UnknownRoles) > 0 {
+		unknownRoles = result.UnknownRoles
+	}
+	return
+}
+
+// writerUpdateUser updates the users by the configured EnvWriter.
+func writerUpdateUser(ctx context.Context, db *sqlDB, userAttrs []map[string]string) error {
+	if cfg.writer == WriterRails {
+		return railsUpdateUser(ctx, userAttrs)
+	}
+	return sqlUpdateUser(ctx, db, userAttrs)
+}
+
+// writerUpdateUserRoles updates the users' roles by the configured EnvWriter.
+func writerUpdateUserRoles(ctx context.Context, db *sqlDB, userRoles map[string]string) (map[string]string, error) {
+	if cfg.writer == WriterRails {
+		return railsUpdateUserRoles(ctx, userRoles)
+	}
+	return sqlUpdateUserRoles(ctx, db, userRoles)
+}
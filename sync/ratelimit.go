@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of operations to rate per second, allowing
+// bursts of up to burst operations. It is safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket creates a full tokenBucket.
+func newTokenBucket(rate, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a token is available and takes it, or until ctx is done.
+func (bucket *tokenBucket) wait(ctx context.Context) error {
+	bucket.mu.Lock()
+	now := time.Now()
+	bucket.tokens = min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+
+	// Taking the token in advance lets concurrent callers queue up behind
+	// each other instead of all waking up for the same token.
+	bucket.tokens--
+	delay := time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	bucket.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ldapRateLimit limits ldapUserSearch calls by EnvLdapRate, if configured. It
+// is shared by all connections of the EnvConcurrency pool.
+var ldapRateLimit struct {
+	once   sync.Once
+	bucket *tokenBucket
+}
+
+// ldapRateWait blocks until the next LDAP user search is allowed, or until
+// ctx is done.
+func ldapRateWait(ctx context.Context) error {
+	if cfg.ldapRate <= 0 {
+		return nil
+	}
+
+	ldapRateLimit.once.Do(func() {
+		ldapRateLimit.bucket = newTokenBucket(cfg.ldapRate, cfg.ldapBurst)
+	})
+	return ldapRateLimit.bucket.wait(ctx)
+}
+
+// ldapRateLimitReset drops the ldapRateLimit, being recreated by the next
+// ldapRateWait, e.g., after a configReload.
+func ldapRateLimitReset() {
+	ldapRateLimit.once = sync.Once{}
+	ldapRateLimit.bucket = nil
+}
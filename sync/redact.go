@@ -0,0 +1,86 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logRedactFields are the log fields holding SQL or LDAP values, being
+// redacted by logRedactData.
+var logRedactFields = []string{"old", "new", "intended", "stored", "email", "SQL data", "LDAP data"}
+
+// logRedactMode is the EnvLogRedact, set by Main.
+var logRedactMode = LogRedactOff
+
+// logRedactFormatter formats entries after logRedactData.
+type logRedactFormatter struct {
+	log.Formatter
+}
+
+func (f *logRedactFormatter) Format(entry *log.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Data = logRedactData(entry.Data)
+	return f.Formatter.Format(&redacted)
+}
+
+// logRedactData returns a copy of a log entry's data whose logRedactFields'
+// values are redacted by the logRedactMode, either LogRedactMask or
+// LogRedactHash. For LogRedactOff, data is returned as it is.
+//
+// Field names, e.g., of changed attributes, and empty values are kept. Thus, a
+// debug log still shows which attributes differ and which are cleared.
+func logRedactData(data log.Fields) log.Fields {
+	if logRedactMode == LogRedactOff {
+		return data
+	}
+
+	redacted := make(log.Fields, len(data))
+	for k, v := range data {
+		if slices.Contains(logRedactFields, k) {
+			v = logRedactValue(v)
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// logRedactValue redacts a single field's value, being a string or a map of
+// attribute values.
+func logRedactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]string:
+		values := make(map[string]string, len(v))
+		for k, value := range v {
+			values[k] = logRedactString(value)
+		}
+		return values
+	case string:
+		return logRedactString(v)
+	default:
+		return logRedactString(fmt.Sprint(v))
+	}
+}
+
+// logRedactString masks or hashes a non-empty value.
+//
+// A hash is the truncated SHA-256 of the value, thus equal values have equal
+// hashes, e.g., for comparing an SQL and an LDAP value. As short values like
+// names might be guessed, a hash is a pseudonym rather than an anonymization.
+func logRedactString(s string) string {
+	if s == "" {
+		return s
+	}
+	if logRedactMode == LogRedactHash {
+		sum := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(sum[:6])
+	}
+	return "***"
+}
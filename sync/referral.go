@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// ldapCredentials are the bind DN and password of a simple bind, overriding
+// LDAP_AUTH, e.g., for a server of EnvLdapReferralCredentials.
+type ldapCredentials struct {
+	dn       string
+	password string
+}
+
+// parseReferralCredentials parses SYNC_LDAP_REFERRAL_CREDENTIALS's semicolon
+// separated HOST=BIND_DN|PASSWORD entries.
+func parseReferralCredentials(credStr string) (creds map[string]ldapCredentials, err error) {
+	creds = make(map[string]ldapCredentials)
+	for _, entry := range strings.Split(credStr, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		host, cred, ok := strings.Cut(entry, "=")
+		if !ok {
+			err = fmt.Errorf("entry for %s cannot be split", strings.TrimSpace(host))
+			return
+		}
+		dn, password, ok := strings.Cut(cred, "|")
+		if !ok {
+			err = fmt.Errorf("entry for %s lacks a password", strings.TrimSpace(host))
+			return
+		}
+		creds[strings.ToLower(strings.TrimSpace(host))] = ldapCredentials{dn: strings.TrimSpace(dn), password: password}
+	}
+	return
+}
+
+// ldapReferralConns are the connections to referral servers by their URL's
+// scheme and host, kept for the following referrals of a sync and closed by
+// ldapReferralClose.
+var ldapReferralConns = struct {
+	sync.Mutex
+	conns map[string]*ldap.Conn
+}{conns: make(map[string]*ldap.Conn)}
+
+// ldapReferralConn returns a connection bound to a referral's server.
+//
+// An ldaps:// referral uses TLS, while an ldap:// one follows LDAP_METHOD,
+// both with the configured TLS settings. The server binds with its
+// EnvLdapReferralCredentials, if configured, and by LDAP_AUTH otherwise.
+func ldapReferralConn(u *url.URL) (conn *ldap.Conn, err error) {
+	key := u.Scheme + "://" + strings.ToLower(u.Host)
+
+	ldapReferralConns.Lock()
+	defer ldapReferralConns.Unlock()
+
+	if conn, ok := ldapReferralConns.conns[key]; ok && !conn.IsClosing() {
+		return conn, nil
+	}
+
+	server, err := ldapParseServer(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return
+	}
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		server.addr = net.JoinHostPort(server.host, port)
+	}
+	if cred, ok := cfg.ldapReferralCredentials[strings.ToLower(server.host)]; ok {
+		server.credentials = &cred
+	}
+
+	if conn, err = ldapDialServer(server); err != nil {
+		return
+	}
+	ldapReferralConns.conns[key] = conn
+	return
+}
+
+// ldapReferralClose closes all ldapReferralConns at the end of a sync.
+func ldapReferralClose() {
+	ldapReferralConns.Lock()
+	defer ldapReferralConns.Unlock()
+
+	for key, conn := range ldapReferralConns.conns {
+		_ = conn.Close()
+		delete(ldapReferralConns.conns, key)
+	}
+}
+
+// ldapChaseReferrals repeats a search without any entry at its referrals, up
+// to hops referrals deep, see EnvLdapReferralHops.
+//
+// A referral's DN replaces the search base, while its scope and filter are
+// kept. Unreachable referrals are logged and skipped, as they might point to
+// servers being irrelevant for the search, e.g., Active Directory's
+// DomainDnsZones. Only a done ctx fails the search.
+func ldapChaseReferrals(ctx context.Context, req *ldap.SearchRequest, referrals []string, hops int) (entries []*ldap.Entry, err error) {
+	for _, referral := range referrals {
+		logger := log.WithField("referral", referral)
+
+		u, parseErr := url.Parse(referral)
+		if parseErr != nil {
+			logger.WithError(parseErr).Warn("Cannot parse LDAP referral, skipping it")
+			continue
+		}
+
+		refReq := *req
+		if dn := strings.TrimPrefix(u.Path, "/"); dn != "" {
+			refReq.BaseDN = dn
+		}
+
+		var searchResp *ldap.SearchResult
+		conn, searchErr := ldapReferralConn(u)
+		if searchErr == nil {
+			searchResp, searchErr = ldapSearchContext(ctx, conn, &refReq)
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		} else if searchErr != nil {
+			logger.WithError(searchErr).Warn("Cannot follow LDAP referral, skipping it")
+			continue
+		}
+
+		logger.WithField("entries", len(searchResp.Entries)).Debug("Followed LDAP referral")
+		entries = append(entries, searchResp.Entries...)
+		if len(searchResp.Entries) == 0 && len(searchResp.Referrals) > 0 && hops > 1 {
+			var chased []*ldap.Entry
+			if chased, err = ldapChaseReferrals(ctx, &refReq, searchResp.Referrals, hops-1); err != nil {
+				return
+			}
+			entries = append(entries, chased...)
+		}
+	}
+	return
+}
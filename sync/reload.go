@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configSources are the sources of the configuration, kept by Main to be read
+// again by configReload.
+var configSources struct {
+	// environ is the process environment before applying the configuration
+	// file and the flags.
+	environ []string
+
+	path string
+	args []string
+
+	// digest is the SHA-256 of the configuration file read last, compared by
+	// configWatch.
+	digest [sha256.Size]byte
+}
+
+// configSourcesKeep records the configuration sources before they are applied.
+func configSourcesKeep(path string, args []string) {
+	configSources.environ = os.Environ()
+	configSources.path = path
+	configSources.args = args
+}
+
+// configEnvironRestore replaces the process environment.
+func configEnvironRestore(environ []string) {
+	os.Clearenv()
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			_ = os.Setenv(k, v)
+		}
+	}
+}
+
+// configReload reads the configuration again, e.g., on a SIGHUP, and applies it
+// for the following syncs.
+//
+// The environment is restored to its state at startup before the configuration
+// file and the flags are applied again, thus removed file values are unset. An
+// invalid configuration is rejected, keeping the current one.
+//
+// Connections kept by EnvReuseConnections are closed, e.g., to use rotated
+// credentials. HTTP endpoints and outputs opened by setup stay as they are.
+func configReload() (err error) {
+	current := os.Environ()
+	defer func() {
+		if err != nil {
+			configEnvironRestore(current)
+		}
+	}()
+
+	configEnvironRestore(configSources.environ)
+	var jobs []configJob
+	if configSources.path != "" {
+		if jobs, err = configFileLoad(configSources.path); err != nil {
+			return
+		}
+	}
+	if _, err = configFlagArgs(configSources.args); err != nil {
+		return
+	}
+
+	cfgShadow, err := configLoadDetect()
+	if err != nil {
+		return
+	} else if !cfgShadow.scheduled() {
+		err = fmt.Errorf("neither %s nor %s is set", EnvInterval, EnvSchedule)
+		return
+	} else if err = jobsCheck(cfgShadow, jobs); err != nil {
+		return
+	}
+
+	syncPoolClose()
+	ldapRateLimitReset()
+
+	cfg, configJobs = cfgShadow, jobs
+	configApply(cfg)
+	return
+}
+
+// configReloadSignal handles a SIGHUP for syncInterval by configReload.
+func configReloadSignal() bool {
+	if err := configReload(); err != nil {
+		log.WithError(err).Error("Cannot reload configuration, keeping the current one")
+		return false
+	}
+	log.Info("Reloaded configuration")
+	return true
+}
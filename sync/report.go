@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ReportActionApplied marks a change written to the database.
+	ReportActionApplied = "applied"
+
+	// ReportActionDryRun marks a change not written due to a read-only sync,
+	// e.g., EnvDryRun or the maintenance mode.
+	ReportActionDryRun = "dry-run"
+
+	// ReportActionNotApplied marks a change not written due to a failure or
+	// being held back, e.g., by EnvCanary.
+	ReportActionNotApplied = "not-applied"
+
+	// ReportActionAmbiguous marks a user matched by multiple LDAP entries, see
+	// EnvAmbiguousPolicy. Its old value lists all entries' DNs, while the new
+	// one is the picked DN, being empty if the user was skipped.
+	ReportActionAmbiguous = "ambiguous"
+)
+
+// reportRow is a single change of an EnvReport.
+type reportRow struct {
+	Time      time.Time `json:"time"`
+	RunId     string    `json:"run_id"`
+	User      string    `json:"user"`
+	Attribute string    `json:"attribute"`
+	Old       string    `json:"old"`
+	New       string    `json:"new"`
+	Action    string    `json:"action"`
+}
+
+// reportCsvHeader is the header line of a ReportFormatCsv report.
+var reportCsvHeader = []string{"time", "run_id", "user", "attribute", "old", "new", "action"}
+
+// reportPath resolves the placeholders "{run}" and "{time}" of the EnvReport
+// path for a run started at start.
+func reportPath(runId string, start time.Time) string {
+	return strings.NewReplacer(
+		"{run}", runId,
+		"{time}", start.UTC().Format("20060102T150405Z"),
+	).Replace(cfg.report)
+}
+
+// writeReport writes the changes of a run to the EnvReport in the configured
+// EnvReportFormat, if set, and returns them as rows, e.g., for EnvEmailTo.
+//
+// Changes within applied are ReportActionApplied. All others are
+// ReportActionDryRun for a readOnly sync and ReportActionNotApplied otherwise.
+// The ambiguous users follow as ReportActionAmbiguous rows of their "dn".
+// Failures are logged, but do not fail the sync.
+func writeReport(runId string, start time.Time, changes, applied []attrChange, readOnly bool, ambiguous []ambiguousUser) (rows []reportRow) {
+	appliedSet := make(map[attrChange]bool, len(applied))
+	for _, change := range applied {
+		appliedSet[change] = true
+	}
+
+	now := time.Now().UTC()
+	rows = make([]reportRow, 0, len(changes)+len(ambiguous))
+	for _, change := range changes {
+		action := ReportActionNotApplied
+		switch {
+		case appliedSet[change]:
+			action = ReportActionApplied
+		case readOnly:
+			action = ReportActionDryRun
+		}
+
+		rows = append(rows, reportRow{
+			Time:      now,
+			RunId:     runId,
+			User:      change.user,
+			Attribute: change.attribute,
+			Old:       change.old,
+			New:       change.new,
+			Action:    action,
+		})
+	}
+	for _, user := range ambiguous {
+		rows = append(rows, reportRow{
+			Time:      now,
+			RunId:     runId,
+			User:      user.user,
+			Attribute: "dn",
+			Old:       strings.Join(user.dns, "; "),
+			New:       user.dn,
+			Action:    ReportActionAmbiguous,
+		})
+	}
+
+	if cfg.report == "" {
+		return
+	}
+
+	path := reportPath(runId, start)
+	logger := log.WithField("report", path)
+
+	f, err := createOutputFile(path, false)
+	if err != nil {
+		logger.WithError(err).Error("Cannot create change report")
+		return
+	}
+
+	if cfg.reportFormat == ReportFormatCsv {
+		err = writeReportCsv(f, rows)
+	} else {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rows)
+	}
+	if err != nil {
+		_ = f.Abort()
+		logger.WithError(err).Error("Cannot write change report")
+		return
+	}
+
+	if err = f.Close(); err != nil {
+		logger.WithError(err).Error("Cannot write change report")
+		return
+	}
+	logger.WithField("changes", len(rows)).Debug("Wrote change report")
+	return
+}
+
+// writeReportCsv writes the rows as CSV with a reportCsvHeader.
+func writeReportCsv(w io.Writer, rows []reportRow) error {
+	csvW := csv.NewWriter(w)
+	if err := csvW.Write(reportCsvHeader); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := []string{row.Time.Format(time.RFC3339), row.RunId, row.User, row.Attribute, row.Old, row.New, row.Action}
+		if err := csvW.Write(record); err != nil {
+			return err
+		}
+	}
+	csvW.Flush()
+	return csvW.Error()
+}
@@ -0,0 +1,102 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// greenlightRoles are the default administrator and user role names of each
+// EnvSchema, as seeded by Greenlight, for EnvAdminGroup.
+var greenlightRoles = map[string]struct{ admin, user string }{
+	SchemaV2: {"admin", "user"},
+	SchemaV3: {"Administrator", "User"},
+}
+
+// roleMapping maps members of an LDAP group to a Greenlight role name.
+type roleMapping struct {
+	group string
+	role  string
+}
+
+// parseRoleMap parses a SYNC_ROLE_MAP value into a prioritized roleMapping list.
+//
+// The format follows LDAP_ATTRIBUTE_MAPPING: semicolon separated GROUP=ROLE
+// pairs. Earlier pairs take precedence over later ones. As a group DN contains
+// equal signs itself, a pair is split at its last equal sign.
+func parseRoleMap(roleMapStr string) (roleMap []roleMapping, err error) {
+	for _, mapping := range strings.Split(roleMapStr, ";") {
+		if mapping == "" {
+			continue
+		}
+
+		i := strings.LastIndex(mapping, "=")
+		if i <= 0 || i == len(mapping)-1 {
+			err = fmt.Errorf("role mapping %s cannot be split", mapping)
+			return
+		}
+
+		roleMap = append(roleMap, roleMapping{
+			group: strings.TrimSpace(mapping[:i]),
+			role:  strings.TrimSpace(mapping[i+1:]),
+		})
+	}
+	return
+}
+
+// groupEqual checks if two group DNs are equal, falling back to a case
+// insensitive string comparison for unparsable DNs.
+//
+// A single RDN as a, e.g., "cn=bbb-admins", matches the leading RDN of b,
+// allowing to map groups without their full DN.
+func groupEqual(a, b string) bool {
+	dnA, errA := ldap.ParseDN(a)
+	dnB, errB := ldap.ParseDN(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	if len(dnA.RDNs) == 1 && len(dnB.RDNs) > 1 {
+		return dnA.RDNs[0].EqualFold(dnB.RDNs[0])
+	}
+	return dnA.EqualFold(dnB)
+}
+
+// resolveRole returns the highest priority role for the given group DNs.
+//
+// If no group matches, the default role is returned. An empty role signals to
+// leave the user's role unchanged.
+func resolveRole(roleMap []roleMapping, defaultRole string, groups []string) string {
+	for _, mapping := range roleMap {
+		for _, group := range groups {
+			if groupEqual(mapping.group, group) {
+				return mapping.role
+			}
+		}
+	}
+	return defaultRole
+}
+
+// adminGroupRole returns the role for the EnvAdminGroup membership, based on
+// the current role and the role resolved by EnvRoleMap, if any.
+//
+// Members get the EnvAdminRole. Other users having this role, either currently
+// or by the role map, are demoted to the schema's user role for EnvAdminDemote.
+// Otherwise, the mapped role is returned.
+func adminGroupRole(groups []string, current, mapped string) string {
+	for _, group := range groups {
+		if groupEqual(cfg.adminGroup, group) {
+			return cfg.adminRole
+		}
+	}
+
+	if effective := cmp.Or(mapped, current); cfg.adminDemote && effective == cfg.adminRole {
+		return greenlightRoles[cfg.schema].user
+	}
+	return mapped
+}
@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RollbackRunLast is the --run value of the rollback command selecting the
+// latest run of the EnvAuditTable.
+const RollbackRunLast = "last"
+
+// auditRow is a change of a run recorded by sqlWriteAudit.
+type auditRow struct {
+	userId sql.NullString
+	attrChange
+}
+
+// sqlLastAuditRun returns the run id of the latest change within the
+// EnvAuditTable.
+func sqlLastAuditRun(ctx context.Context, db *sqlDB) (runId string, err error) {
+	err = db.QueryRowContext(ctx, sqlAuditQuery(db, `
+		SELECT {run_id}
+		FROM {table}
+		ORDER BY {id} DESC
+		LIMIT 1
+	`)).Scan(&runId)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = fmt.Errorf("%s contains no changes", cfg.auditTable)
+	}
+	return
+}
+
+// sqlReadAudit reads the changes of a run from the EnvAuditTable.
+func sqlReadAudit(ctx context.Context, db *sqlDB, runId string) (rows []auditRow, err error) {
+	result, err := db.QueryContext(ctx, sqlAuditQuery(db, `
+		SELECT {user_id}, {social_uid}, {attribute}, COALESCE({old_value}, ''), COALESCE({new_value}, '')
+		FROM {table}
+		WHERE {run_id} = ?
+		ORDER BY {id}
+	`), runId)
+	if err != nil {
+		return
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var row auditRow
+		if err = result.Scan(&row.userId, &row.user, &row.attribute, &row.old, &row.new); err != nil {
+			return
+		}
+		rows = append(rows, row)
+	}
+	err = result.Err()
+	return
+}
+
+// rollbackPlan computes the changes restoring the old values of the rows, based
+// on the current SQL users keyed by their social_uid. The users' updated
+// attribute maps for writerUpdateUser and their roles for writerUpdateUserRoles
+// are returned as well.
+//
+// Only the sqlWritableColumns and roles are restored. A change is skipped if
+// its user no longer exists or its value was changed since, e.g., by a later
+// sync, as that one is not overwritten.
+func rollbackPlan(rows []auditRow, users map[string]map[string]string) (changes []attrChange, updates []map[string]string, roles map[string]string) {
+	updated := make(map[string]map[string]string)
+	roles = make(map[string]string)
+
+	for _, row := range rows {
+		fields := log.Fields{
+			"user":      row.user,
+			"attribute": row.attribute,
+		}
+		userAttrSql, ok := users[row.user]
+		if !ok || !row.userId.Valid || userAttrSql["id"] != row.userId.String {
+			log.WithFields(fields).Warn("Skipping change of a user no longer synced")
+			continue
+		} else if row.attribute != "role" && !slices.Contains(sqlWritableColumns, row.attribute) {
+			log.WithFields(fields).Warn("Skipping change which cannot be rolled back")
+			continue
+		} else if userAttrSql[row.attribute] != row.new {
+			log.WithFields(fields).WithField("current", userAttrSql[row.attribute]).Warn("Skipping change overwritten since the run")
+			continue
+		}
+
+		changes = append(changes, attrChange{row.user, row.attribute, row.new, row.old})
+		if row.attribute == "role" {
+			roles[userAttrSql["id"]] = row.old
+			continue
+		}
+		if updated[row.user] == nil {
+			updated[row.user] = maps.Clone(userAttrSql)
+			updates = append(updates, updated[row.user])
+		}
+		updated[row.user][row.attribute] = row.old
+	}
+	sortChanges(changes)
+	return
+}
+
+// rollbackRun performs the rollback command, restoring the values written over
+// by the run, being its id or RollbackRunLast, as recorded in the EnvAuditTable.
+//
+// The rollback is bound by the EnvMaxChanges, unless EnvForce is set, and only
+// reports its changes for EnvDryRun or EnvMaintenance. Applied changes are
+// recorded in the EnvAuditTable as a run of their own, thus a rollback might be
+// rolled back as well.
+func rollbackRun(ctx context.Context, runId string) (err error) {
+	readOnly := cfg.dryRun || cfg.maintenance
+
+	if cfg.runLock != RunLockOff && !readOnly {
+		unlock, acquired, lockErr := syncLock(ctx)
+		if lockErr != nil {
+			return fmt.Errorf("%w: cannot acquire the sync lock: %w", errSyncConnection, lockErr)
+		} else if !acquired {
+			return fmt.Errorf("another instance holds the sync lock %s", cfg.runLockName)
+		}
+		defer unlock()
+	}
+
+	db, err := sqlOpen(readOnly)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errSyncConnection, err)
+	}
+	defer db.Close()
+
+	if runId == RollbackRunLast {
+		if runId, err = sqlLastAuditRun(ctx, db); err != nil {
+			return
+		}
+	}
+	rows, err := sqlReadAudit(ctx, db, runId)
+	if err != nil {
+		return fmt.Errorf("cannot read changes of run %s: %w", runId, err)
+	} else if len(rows) == 0 {
+		return fmt.Errorf("run %s has no changes within %s", runId, cfg.auditTable)
+	}
+
+	users, err := sqlFetchUsers(ctx, db)
+	if err != nil {
+		return fmt.Errorf("cannot fetch users from SQL: %w", err)
+	}
+
+	changes, updates, roles := rollbackPlan(rows, users)
+	log.WithFields(log.Fields{
+		"run":      runId,
+		"recorded": len(rows),
+		"changes":  len(changes),
+	}).Info("Rolling back run")
+	if len(changes) == 0 {
+		return
+	}
+
+	if thresholdErr := cfg.maxChanges.check(changes, len(users)); thresholdErr != nil {
+		switch {
+		case readOnly:
+			log.WithError(thresholdErr).Warn("Dry run: rollback would be aborted")
+		case cfg.force:
+			log.WithError(thresholdErr).Warnf("Rolling back nonetheless, as %s is set", EnvForce)
+		default:
+			log.WithError(thresholdErr).Errorf("Aborting rollback, set %s to apply the changes", EnvForce)
+			return thresholdErr
+		}
+	}
+	if readOnly {
+		dryRunReport(changes)
+		return
+	}
+
+	if len(updates) > 0 {
+		if err = writerUpdateUser(ctx, db, updates); err != nil {
+			return fmt.Errorf("%w: %w", errSyncUpdate, err)
+		}
+	}
+	if len(roles) > 0 {
+		unknownRoles, roleErr := writerUpdateUserRoles(ctx, db, roles)
+		if roleErr != nil {
+			// The attributes were committed already, thus the rollback is partial.
+			return fmt.Errorf("%w: %w", errSyncUpdate, roleErr)
+		}
+		for id, role := range unknownRoles {
+			log.WithFields(log.Fields{"id": id, "role": role}).Warn("Cannot restore unknown role")
+		}
+		changes = slices.DeleteFunc(changes, func(change attrChange) bool {
+			_, unknown := unknownRoles[users[change.user]["id"]]
+			return change.attribute == "role" && unknown
+		})
+	}
+
+	ids := make(map[string]string, len(users))
+	for uid, userAttrSql := range users {
+		ids[uid] = userAttrSql["id"]
+	}
+	rollbackId := newRunId()
+	if auditErr := sqlWriteAudit(ctx, db, rollbackId, changes, ids); auditErr != nil {
+		log.WithError(auditErr).WithField("table", cfg.auditTable).Error("Failed to write audit log")
+	}
+
+	log.WithFields(log.Fields{
+		"run":      runId,
+		"rollback": rollbackId,
+		"changes":  len(changes),
+	}).Info("Rolled back run")
+	return
+}
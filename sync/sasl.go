@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/go-ldap/ldap/v3/gssapi"
+)
+
+// krb5CcacheDefault returns the default Kerberos credential cache, being the
+// file of KRB5CCNAME or MIT Kerberos' default /tmp/krb5cc_UID.
+func krb5CcacheDefault() string {
+	if ccname, ok := os.LookupEnv("KRB5CCNAME"); ok {
+		return strings.TrimPrefix(ccname, "FILE:")
+	}
+	return fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+}
+
+// ldapGssapiBind performs a SASL GSSAPI bind, authenticating by Kerberos with
+// either the EnvKrb5Keytab or the EnvKrb5Ccache, see EnvLdapSasl.
+//
+// The service principal defaults to ldap/HOST, thus host must be the LDAP
+// server's name as registered in the Kerberos realm, not an IP address.
+func ldapGssapiBind(conn *ldap.Conn, host string) (err error) {
+	var client *gssapi.Client
+	if cfg.krb5Keytab != "" {
+		username, realm, _ := strings.Cut(cfg.krb5Principal, "@")
+		client, err = gssapi.NewClientWithKeytab(username, realm, cfg.krb5Keytab, cfg.krb5Config)
+	} else {
+		client, err = gssapi.NewClientFromCCache(cfg.krb5Ccache, cfg.krb5Config)
+	}
+	if err != nil {
+		err = permanentError{fmt.Errorf("cannot create Kerberos client: %w", err)}
+		return
+	}
+	defer client.Close()
+
+	spn := cfg.ldapSpn
+	if spn == "" {
+		spn = "ldap/" + host
+	}
+	return conn.GSSAPIBind(client, spn, "")
+}
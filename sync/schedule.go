@@ -0,0 +1,205 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	// Embedded for the CRON_TZ of EnvSchedule, as the container image lacks
+	// a time zone database.
+	_ "time/tzdata"
+)
+
+// cronField is the set of allowed values of a single cron expression field.
+type cronField map[int]bool
+
+// cronExpr is a single standard five field cron expression.
+type cronExpr struct {
+	minute, hour, dom, month, dow cronField
+
+	// domAny and dowAny are set for a "*" day of month resp. week. Following
+	// cron, a day matches either restricted field if both are restricted.
+	domAny, dowAny bool
+}
+
+// cronSchedule is a parsed EnvSchedule, being multiple cronExprs in a location.
+type cronSchedule struct {
+	exprs    []cronExpr
+	location *time.Location
+}
+
+// cronFieldBounds are the inclusive value ranges of the five fields.
+var cronFieldBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// parseCronSchedule parses an EnvSchedule value.
+//
+// It consists of semicolon separated standard cron expressions with five
+// fields: minute, hour, day of month, month, and day of week. Each field
+// supports "*", single values, ranges like "8-18", steps like "*/15" or
+// "8-18/2", and comma separated lists thereof. An optional "CRON_TZ=ZONE"
+// prefix selects the time zone, defaulting to the local one.
+func parseCronSchedule(scheduleStr string) (schedule *cronSchedule, err error) {
+	schedule = &cronSchedule{location: time.Local}
+
+	scheduleStr = strings.TrimSpace(scheduleStr)
+	if tz, ok := strings.CutPrefix(scheduleStr, "CRON_TZ="); ok {
+		zone, rest, _ := strings.Cut(tz, " ")
+		if schedule.location, err = time.LoadLocation(zone); err != nil {
+			return
+		}
+		scheduleStr = rest
+	}
+
+	for _, exprStr := range strings.Split(scheduleStr, ";") {
+		if strings.TrimSpace(exprStr) == "" {
+			continue
+		}
+
+		var expr cronExpr
+		if expr, err = parseCronExpr(exprStr); err != nil {
+			err = fmt.Errorf("cannot parse cron expression %q: %w", strings.TrimSpace(exprStr), err)
+			return
+		}
+		schedule.exprs = append(schedule.exprs, expr)
+	}
+	if len(schedule.exprs) == 0 {
+		err = fmt.Errorf("no cron expression")
+	} else if schedule.next(time.Now()).IsZero() {
+		err = fmt.Errorf("cron expressions never match")
+	}
+	return
+}
+
+// parseCronExpr parses a single five field cron expression.
+func parseCronExpr(exprStr string) (expr cronExpr, err error) {
+	fieldStrs := strings.Fields(exprStr)
+	if len(fieldStrs) != 5 {
+		err = fmt.Errorf("expected five fields, got %d", len(fieldStrs))
+		return
+	}
+
+	fields := make([]cronField, 5)
+	for i, fieldStr := range fieldStrs {
+		if fields[i], err = parseCronField(fieldStr, cronFieldBounds[i][0], cronFieldBounds[i][1]); err != nil {
+			return
+		}
+	}
+
+	// Both 0 and 7 are Sunday.
+	if fields[4][7] {
+		fields[4][0] = true
+	}
+
+	expr = cronExpr{
+		minute: fields[0],
+		hour:   fields[1],
+		dom:    fields[2],
+		month:  fields[3],
+		dow:    fields[4],
+		domAny: fieldStrs[2] == "*",
+		dowAny: fieldStrs[4] == "*",
+	}
+	return
+}
+
+// parseCronField parses a single field within the inclusive bounds.
+func parseCronField(fieldStr string, lower, upper int) (field cronField, err error) {
+	field = make(cronField)
+	for _, part := range strings.Split(fieldStr, ",") {
+		rangeStr, stepStr, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				err = fmt.Errorf("invalid step %q", stepStr)
+				return
+			}
+		}
+
+		from, to := lower, upper
+		if rangeStr != "*" {
+			fromStr, toStr, isRange := strings.Cut(rangeStr, "-")
+			if from, err = strconv.Atoi(fromStr); err != nil {
+				err = fmt.Errorf("invalid value %q", fromStr)
+				return
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(toStr); err != nil {
+					err = fmt.Errorf("invalid value %q", toStr)
+					return
+				}
+			} else if hasStep {
+				to = upper
+			}
+		}
+		if from < lower || to > upper || from > to {
+			err = fmt.Errorf("%q exceeds the range %d-%d", part, lower, upper)
+			return
+		}
+
+		for v := from; v <= to; v += step {
+			field[v] = true
+		}
+	}
+	return
+}
+
+// matches checks if the expression matches a time's minute.
+func (expr cronExpr) matches(t time.Time) bool {
+	if !expr.minute[t.Minute()] || !expr.hour[t.Hour()] || !expr.month[int(t.Month())] {
+		return false
+	}
+
+	domMatch, dowMatch := expr.dom[t.Day()], expr.dow[int(t.Weekday())]
+	switch {
+	case expr.domAny && expr.dowAny:
+		return true
+	case expr.domAny:
+		return dowMatch
+	case expr.dowAny:
+		return domMatch
+	default:
+		return domMatch || dowMatch
+	}
+}
+
+// next returns the first time after t matched by any of the expressions.
+//
+// Minutes are checked one by one, bounded to five years ahead. A schedule
+// without any match in this time, e.g., for February 30, returns a zero time.
+func (schedule *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(schedule.location).Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		for _, expr := range schedule.exprs {
+			if expr.matches(t) {
+				return t
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// scheduleJitter returns a random delay up to the EnvJitter for a scheduled
+// sync, or zero if unset.
+func scheduleJitter() time.Duration {
+	if cfg.jitter <= 0 {
+		return 0
+	}
+	return rand.N(cfg.jitter)
+}
+
+// scheduleDelay returns the regular delay until the next scheduled sync,
+// being the EnvInterval or the time until the EnvSchedule's next run.
+func scheduleDelay() time.Duration {
+	if cfg.schedule != nil {
+		return time.Until(cfg.schedule.next(time.Now()))
+	}
+	return cfg.interval
+}
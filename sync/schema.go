@@ -0,0 +1,244 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SchemaV2 targets Greenlight 2.x, identifying LDAP users by their ldap
+	// provider and social_uid.
+	SchemaV2 = "v2"
+
+	// SchemaV3 targets Greenlight 3.x, identifying external users by their
+	// external_id. Their primary keys are UUIDs.
+	SchemaV3 = "v3"
+
+	// SchemaAuto detects either SchemaV2 or SchemaV3 from the database at
+	// startup, see configLoadDetect.
+	SchemaAuto = "auto"
+)
+
+// sqlSchemaV2RoleDenied is Greenlight 2.x's role of banned users.
+const sqlSchemaV2RoleDenied = "denied"
+
+// sqlSchemaV3StatusBanned is Greenlight 3.x's banned users status.
+//
+// https://github.com/bigbluebutton/greenlight/blob/v3.0.0/app/models/user.rb
+const sqlSchemaV3StatusBanned = "2"
+
+// sqlSchemaV3StatusActive is Greenlight 3.x's active users status.
+const sqlSchemaV3StatusActive = "0"
+
+// sqlSchema describes the users table of a Greenlight version.
+//
+// Queries use logical column names, based on Greenlight 2.x. Columns named
+// differently or derived from others are mapped to SQL expressions by exprs.
+type sqlSchema struct {
+	// readColumns are the defaults for sqlReadColumns.
+	readColumns []string
+
+	// writableColumns are the defaults for sqlWritableColumns.
+	writableColumns []string
+
+	// exprs maps logical columns to SQL expressions, defaulting to the column.
+	exprs map[string]string
+
+	// filter is the WHERE condition selecting users synced from LDAP, combined
+	// with their providers by sqlUseSchema.
+	filter string
+
+	// providers are the defaults for EnvProviders.
+	providers []string
+
+	// deactivate is the assignment to soft delete a user for sqlDeactivateUsers.
+	deactivate [2]string
+
+	// reactivate is the assignment reverting deactivate for sqlReactivateUsers.
+	reactivate [2]string
+
+	// requiredColumns are columns used besides the readColumns.
+	requiredColumns []string
+
+	// matchColumns are the columns allowed for EnvMatchColumn, the first one
+	// being the default.
+	matchColumns []string
+
+	// roomUidColumn is the rooms column of the uid used in room URLs, e.g.,
+	// for EnvSharedRooms.
+	roomUidColumn string
+}
+
+// sqlSchemas are the supported sqlSchema targets by EnvSchema.
+var sqlSchemas = map[string]sqlSchema{
+	// https://github.com/bigbluebutton/greenlight/blob/release-2.8.5/db/schema.rb#L125-L154
+	SchemaV2: {
+		readColumns: []string{
+			"id", "name", "username", "email", "social_uid", "image",
+			"deleted", "last_login", "created_at",
+		},
+		writableColumns: []string{"name", "username", "email", "image"},
+		providers:       []string{"ldap"},
+		deactivate:      [2]string{"deleted", "true"},
+		reactivate:      [2]string{"deleted", "false"},
+		requiredColumns: []string{"provider", "role_id"},
+		matchColumns:    []string{"social_uid", "username", "email"},
+		roomUidColumn:   "uid",
+	},
+
+	// https://github.com/bigbluebutton/greenlight/blob/v3.0.0/db/schema.rb
+	SchemaV3: {
+		readColumns: []string{
+			"id", "name", "email", "social_uid", "deleted", "verified",
+			"last_login", "created_at",
+		},
+		writableColumns: []string{"name", "email"},
+		exprs: map[string]string{
+			"social_uid": "{users.external_id}",
+			"deleted":    "({users.status} = " + sqlSchemaV3StatusBanned + ")",
+		},
+		filter:          "{users.external_id} IS NOT NULL AND {users.external_id} <> ''",
+		providers:       []string{"greenlight"},
+		deactivate:      [2]string{"status", sqlSchemaV3StatusBanned},
+		reactivate:      [2]string{"status", sqlSchemaV3StatusActive},
+		requiredColumns: []string{"external_id", "status", "role_id", "provider"},
+		matchColumns:    []string{"external_id", "email"},
+		roomUidColumn:   "friendly_id",
+	},
+}
+
+// sqlSchemaDetectColumns are users columns distinguishing the Greenlight
+// versions, see sqlDetectSchemas.
+var sqlSchemaDetectColumns = map[string][]string{
+	SchemaV2: {"provider", "social_uid", "username", "deleted"},
+	SchemaV3: {"external_id", "status", "verified"},
+}
+
+// sqlDetectSchemas lists the EnvSchema values whose sqlSchemaDetectColumns all
+// exist in the users table.
+func sqlDetectSchemas(ctx context.Context, db *sqlDB) (detected []string, err error) {
+	for _, schema := range []string{SchemaV2, SchemaV3} {
+		var missing []string
+		if missing, err = sqlMissingColumns(ctx, db, "users", sqlSchemaDetectColumns[schema]); err != nil {
+			return
+		}
+		if len(missing) == 0 {
+			detected = append(detected, schema)
+		}
+	}
+	return
+}
+
+// sqlActiveSchema is the sqlSchema selected by EnvSchema, set by configApply.
+var sqlActiveSchema = sqlSchemas[SchemaV2]
+
+// sqlUseSchema selects the sqlSchema for all queries and resets the
+// sqlReadColumns and sqlWritableColumns to its defaults.
+//
+// Only users of the providers are synced, e.g., skipping local or OmniAuth
+// accounts. If empty, the schema's default providers are used.
+func sqlUseSchema(name string, providers []string) {
+	sqlActiveSchema = sqlSchemas[name]
+	if len(providers) > 0 {
+		sqlActiveSchema.providers = providers
+	}
+
+	literals := make([]string, 0, len(sqlActiveSchema.providers))
+	for _, provider := range sqlActiveSchema.providers {
+		literals = append(literals, "'"+strings.ReplaceAll(provider, "'", "''")+"'")
+	}
+	providerFilter := "{users.provider} IN (" + strings.Join(literals, ", ") + ")"
+	if sqlActiveSchema.filter != "" {
+		providerFilter += " AND " + sqlActiveSchema.filter
+	}
+	sqlActiveSchema.filter = providerFilter
+
+	sqlReadColumns = append([]string(nil), sqlActiveSchema.readColumns...)
+	sqlWritableColumns = append([]string(nil), sqlActiveSchema.writableColumns...)
+}
+
+// sqlUseMatchColumn maps the logical social_uid column, identifying users for
+// the LDAP lookup, to another users column of the active sqlSchema, e.g., for
+// EnvMatchColumn. Users with an empty match column are not synced.
+func sqlUseMatchColumn(col string) {
+	if col == sqlActiveSchema.matchColumns[0] {
+		return
+	}
+
+	sqlActiveSchema.exprs = maps.Clone(sqlActiveSchema.exprs)
+	if sqlActiveSchema.exprs == nil {
+		sqlActiveSchema.exprs = make(map[string]string)
+	}
+	sqlActiveSchema.exprs["social_uid"] = "{users." + col + "}"
+	sqlActiveSchema.filter += " AND {users." + col + "} IS NOT NULL AND {users." + col + "} <> ''"
+	sqlActiveSchema.requiredColumns = append(slices.Clone(sqlActiveSchema.requiredColumns), col)
+}
+
+// sqlColumnExpr returns the SQL expression for a logical users column.
+func sqlColumnExpr(col string) string {
+	if expr, ok := sqlActiveSchema.exprs[col]; ok {
+		return expr
+	}
+	return "{users." + col + "}"
+}
+
+// configLoadDetect creates a config like configLoad, detecting the EnvSchema
+// from the database for SchemaAuto.
+//
+// As other settings might depend on the schema, e.g., the EnvMatchColumn, the
+// configuration is first loaded for any schema to connect to the database and
+// loaded again for the detected one afterwards.
+func configLoadDetect() (c *config, err error) {
+	if os.Getenv(EnvSchema) != SchemaAuto {
+		return configLoad()
+	}
+	defer os.Setenv(EnvSchema, SchemaAuto)
+
+	for _, schema := range []string{SchemaV2, SchemaV3} {
+		_ = os.Setenv(EnvSchema, schema)
+		if c, err = configLoad(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	// sqlOpen connects by the global configuration.
+	current := cfg
+	cfg = c
+	db, err := sqlOpen(true)
+	cfg = current
+	if err != nil {
+		err = fmt.Errorf("cannot detect %s: %w", EnvSchema, err)
+		return
+	}
+	detected, err := sqlDetectSchemas(context.Background(), db)
+	db.Close()
+	if err != nil {
+		err = fmt.Errorf("cannot detect %s: %w", EnvSchema, err)
+		return
+	} else if len(detected) != 1 {
+		err = fmt.Errorf("cannot detect %s, the users table matches %d Greenlight versions; set %s to %s or %s",
+			EnvSchema, len(detected), EnvSchema, SchemaV2, SchemaV3)
+		return
+	}
+
+	_ = os.Setenv(EnvSchema, detected[0])
+	if c, err = configLoad(); err != nil {
+		return
+	}
+	c.schemaAuto, c.schemaDetected = true, true
+	log.WithField("schema", c.schema).Info("Detected Greenlight database schema")
+	return
+}
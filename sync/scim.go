@@ -0,0 +1,498 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// scimPath is the SCIM 2.0 Users endpoint served on the EnvScimAddr.
+	scimPath = "/scim/v2/Users"
+
+	// scimContentType is the SCIM media type of RFC 7644, section 3.1.
+	scimContentType = "application/scim+json"
+
+	scimSchemaUser  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaList  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError = "urn:ietf:params:scim:api:messages:2.0:Error"
+)
+
+// scimUserNameFilterRe matches the only supported filter, being an equality
+// match of the userName, as used by identity providers to look up a user.
+var scimUserNameFilterRe = regexp.MustCompile(`(?i)^\s*userName\s+eq\s+"((?:[^"\\]|\\.)*)"\s*$`)
+
+// scimUser is the subset of a SCIM 2.0 User resource mapped to Greenlight.
+//
+// Its id and userName are both the user's social_uid. The displayName, or
+// else the formatted or combined name, becomes the name column, the primary
+// or first email the email column. An inactive user is deactivated.
+type scimUser struct {
+	Schemas     []string    `json:"schemas"`
+	Id          string      `json:"id,omitempty"`
+	ExternalId  string      `json:"externalId,omitempty"`
+	UserName    string      `json:"userName"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Name        *scimName   `json:"name,omitempty"`
+	Emails      []scimEmail `json:"emails,omitempty"`
+	Active      *bool       `json:"active,omitempty"`
+	Meta        *scimMeta   `json:"meta,omitempty"`
+}
+
+type scimName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	Location     string `json:"location,omitempty"`
+}
+
+// scimPatch is a SCIM 2.0 PatchOp request.
+type scimPatch struct {
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// scimError is an HTTP error response of RFC 7644, section 3.12.
+type scimError struct {
+	status int
+	detail string
+}
+
+func (err scimError) Error() string {
+	return err.detail
+}
+
+// errScimReadOnly rejects writes in a dry run or the maintenanceMode.
+var errScimReadOnly = scimError{http.StatusServiceUnavailable, "writes are disabled by the dry run or maintenance mode"}
+
+// columns returns the Greenlight columns of a SCIM user, limited to the
+// sqlWritableColumns.
+func (user scimUser) columns() map[string]string {
+	name := user.DisplayName
+	if name == "" && user.Name != nil {
+		name = cmp.Or(strings.TrimSpace(user.Name.Formatted), strings.TrimSpace(user.Name.GivenName+" "+user.Name.FamilyName))
+	}
+
+	var email string
+	for _, e := range user.Emails {
+		if email == "" || e.Primary {
+			email = e.Value
+		}
+	}
+
+	cols := map[string]string{"name": name, "email": email, "username": user.UserName}
+	for col := range cols {
+		if !slices.Contains(sqlWritableColumns, col) || cols[col] == "" {
+			delete(cols, col)
+		}
+	}
+	return cols
+}
+
+// scimUserOf converts a fetched Greenlight user to a SCIM user.
+func scimUserOf(socialUid string, userMap map[string]string) scimUser {
+	active := userMap["deleted"] != "true" && userMap["deleted"] != "1"
+	user := scimUser{
+		Schemas:     []string{scimSchemaUser},
+		Id:          socialUid,
+		UserName:    socialUid,
+		DisplayName: userMap["name"],
+		Active:      &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      userMap["created_at"],
+			Location:     scimPath + "/" + url.PathEscape(socialUid),
+		},
+	}
+	if userMap["email"] != "" {
+		user.Emails = []scimEmail{{Value: userMap["email"], Type: "work", Primary: true}}
+	}
+	return user
+}
+
+// scimAuthorized checks the request's bearer token against EnvScimToken.
+func scimAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.scimToken)) == 1
+}
+
+// scimHandler serves the SCIM 2.0 Users endpoint of EnvScimAddr.
+//
+// Users are created by sqlProvisionUser, updated by sqlUpdateUser, and
+// deactivated by sqlDeactivateUsers, as by a sync. Thus, a DELETE deactivates
+// a user as well. GET lists a single user, supporting a userName filter only.
+func scimHandler(w http.ResponseWriter, r *http.Request) {
+	if !scimAuthorized(r) {
+		scimRespond(w, http.StatusUnauthorized, scimErrorBody(scimError{http.StatusUnauthorized, "unauthorized"}))
+		return
+	}
+
+	id, err := url.PathUnescape(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, scimPath), "/"))
+	if err != nil {
+		scimRespond(w, http.StatusNotFound, scimErrorBody(scimError{http.StatusNotFound, "invalid user id"}))
+		return
+	}
+
+	status, body := http.StatusOK, any(nil)
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		body, err = scimList(r.Context(), r.URL.Query().Get("filter"))
+	case r.Method == http.MethodGet:
+		body, err = scimGet(r.Context(), id)
+	case r.Method == http.MethodPost && id == "":
+		status = http.StatusCreated
+		body, err = scimCreate(r.Context(), r)
+	case r.Method == http.MethodPut && id != "":
+		body, err = scimReplace(r.Context(), id, r)
+	case r.Method == http.MethodPatch && id != "":
+		body, err = scimModify(r.Context(), id, r)
+	case r.Method == http.MethodDelete && id != "":
+		status = http.StatusNoContent
+		err = scimDeactivate(r.Context(), id)
+	default:
+		err = scimError{http.StatusMethodNotAllowed, "method not allowed"}
+	}
+
+	if err != nil {
+		var scimErr scimError
+		if !errors.As(err, &scimErr) {
+			log.WithError(err).WithField("user", id).Error("SCIM request failed")
+			scimErr = scimError{http.StatusInternalServerError, "internal error"}
+		}
+		scimRespond(w, scimErr.status, scimErrorBody(scimErr))
+		return
+	}
+	scimRespond(w, status, body)
+}
+
+// scimRespond writes a SCIM JSON response, omitting a nil body.
+func scimRespond(w http.ResponseWriter, status int, body any) {
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", scimContentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// scimErrorBody is the response body of a scimError.
+func scimErrorBody(err scimError) map[string]any {
+	return map[string]any{
+		"schemas": []string{scimSchemaError},
+		"status":  fmt.Sprint(err.status),
+		"detail":  err.detail,
+	}
+}
+
+// scimDB is the database connection of the SCIM endpoint, opened by scimOpen.
+//
+// Unlike the connPool, it is shared by concurrent requests, as an sql.DB is.
+var scimDB struct {
+	sync.Mutex
+	db *sqlDB
+}
+
+// scimOpen returns the scimDB, opening it on first use.
+func scimOpen() (*sqlDB, error) {
+	scimDB.Lock()
+	defer scimDB.Unlock()
+
+	if scimDB.db == nil {
+		db, err := sqlOpen(false)
+		if err != nil {
+			return nil, err
+		}
+		scimDB.db = db
+	}
+	return scimDB.db, nil
+}
+
+// scimFetch fetches a single Greenlight user by its social_uid, returning a
+// nil user map if missing.
+func scimFetch(ctx context.Context, db *sqlDB, socialUid string) (map[string]string, error) {
+	users, _, err := sqlFetchUserBatch(ctx, db, []string{socialUid}, "", 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	return users[socialUid], nil
+}
+
+// scimGet serves GET /Users/{id}.
+func scimGet(ctx context.Context, id string) (any, error) {
+	db, err := scimOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	userMap, err := scimFetch(ctx, db, id)
+	if err != nil {
+		return nil, err
+	} else if userMap == nil {
+		return nil, scimError{http.StatusNotFound, "user not found"}
+	}
+	return scimUserOf(id, userMap), nil
+}
+
+// scimList serves GET /Users, being a user's lookup by a userName filter.
+func scimList(ctx context.Context, filter string) (any, error) {
+	match := scimUserNameFilterRe.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, scimError{http.StatusBadRequest, `only the filter userName eq "..." is supported`}
+	}
+	userName := strings.ReplaceAll(strings.ReplaceAll(match[1], `\"`, `"`), `\\`, `\`)
+
+	resources := []scimUser{}
+	user, err := scimGet(ctx, userName)
+	var scimErr scimError
+	if errors.As(err, &scimErr) && scimErr.status == http.StatusNotFound {
+		err = nil
+	} else if err == nil {
+		resources = append(resources, user.(scimUser))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]any{
+		"schemas":      []string{scimSchemaList},
+		"totalResults": len(resources),
+		"itemsPerPage": len(resources),
+		"startIndex":   1,
+		"Resources":    resources,
+	}, nil
+}
+
+// scimDecode decodes a request's JSON body into v.
+func scimDecode(r *http.Request, v any) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return scimError{http.StatusBadRequest, "invalid JSON: " + err.Error()}
+	}
+	return nil
+}
+
+// scimCreate serves POST /Users, provisioning a Greenlight user with the
+// EnvProvisionRole.
+func scimCreate(ctx context.Context, r *http.Request) (any, error) {
+	var user scimUser
+	if err := scimDecode(r, &user); err != nil {
+		return nil, err
+	} else if user.UserName == "" {
+		return nil, scimError{http.StatusBadRequest, "userName is required"}
+	}
+	if syncReadOnly() {
+		return nil, errScimReadOnly
+	}
+	if cfg.schema != SchemaV2 {
+		return nil, scimError{http.StatusNotImplemented, "creating users requires the " + EnvSchema + " " + SchemaV2}
+	}
+
+	db, err := scimOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	err = sqlProvisionUser(ctx, db, provisionUser{user.UserName, user.columns(), cfg.provisionRole})
+	if errors.Is(err, errProvisionExists) {
+		return nil, scimError{http.StatusConflict, "user already exists"}
+	} else if err != nil {
+		return nil, err
+	}
+	log.WithField("user", user.UserName).Info("Provisioned SQL user by SCIM")
+
+	if user.Active != nil && !*user.Active {
+		if err = scimDeactivate(ctx, user.UserName); err != nil {
+			return nil, err
+		}
+	}
+	return scimGet(ctx, user.UserName)
+}
+
+// scimReplace serves PUT /Users/{id}.
+func scimReplace(ctx context.Context, id string, r *http.Request) (any, error) {
+	var user scimUser
+	if err := scimDecode(r, &user); err != nil {
+		return nil, err
+	}
+	return scimApply(ctx, id, func(scimUser) (scimUser, error) { return user, nil })
+}
+
+// scimModify serves PATCH /Users/{id}, applying add and replace operations of
+// the active, displayName, name, and emails attributes.
+func scimModify(ctx context.Context, id string, r *http.Request) (any, error) {
+	var patch scimPatch
+	if err := scimDecode(r, &patch); err != nil {
+		return nil, err
+	}
+
+	return scimApply(ctx, id, func(user scimUser) (scimUser, error) {
+		for _, op := range patch.Operations {
+			if !strings.EqualFold(op.Op, "replace") && !strings.EqualFold(op.Op, "add") {
+				return user, scimError{http.StatusBadRequest, "unsupported operation " + op.Op}
+			}
+
+			raw := op.Value
+			if op.Path != "" {
+				// A path is turned into a partial resource, merged below.
+				var value any
+				if err := json.Unmarshal(op.Value, &value); err != nil {
+					return user, scimError{http.StatusBadRequest, "invalid value: " + err.Error()}
+				}
+				partial, err := scimPatchPartial(op.Path, value)
+				if err != nil {
+					return user, err
+				}
+				raw, _ = json.Marshal(partial)
+			}
+			if err := json.Unmarshal(raw, &user); err != nil {
+				return user, scimError{http.StatusBadRequest, "invalid value: " + err.Error()}
+			}
+		}
+		return user, nil
+	})
+}
+
+// scimPatchPartial converts a PATCH operation's path and value to a partial
+// User resource, e.g., {"name": {"givenName": value}} for name.givenName.
+// Emails are replaced by a single primary one.
+func scimPatchPartial(path string, value any) (map[string]any, error) {
+	switch lower := strings.ToLower(path); {
+	case lower == "active":
+		// Some identity providers, e.g., Azure AD, send the boolean as a string.
+		if s, ok := value.(string); ok {
+			value = strings.EqualFold(s, "true")
+		}
+		return map[string]any{"active": value}, nil
+	case lower == "displayname":
+		return map[string]any{"displayName": value}, nil
+	case strings.HasPrefix(lower, "name."):
+		return map[string]any{"name": map[string]any{path[len("name."):]: value}}, nil
+	case strings.HasPrefix(lower, "emails"):
+		if values, ok := value.([]any); ok {
+			return map[string]any{"emails": values}, nil
+		}
+		return map[string]any{"emails": []any{map[string]any{"value": value, "primary": true}}}, nil
+	default:
+		return nil, scimError{http.StatusBadRequest, "unsupported path " + path}
+	}
+}
+
+// scimApply updates a Greenlight user by the SCIM user returned by modify,
+// being passed the current one, and responds with the updated user.
+//
+// Only changed columns are written, see sqlUpdateUser. An inactive user is
+// deactivated, while a deactivated user is not reactivated.
+func scimApply(ctx context.Context, id string, modify func(scimUser) (scimUser, error)) (any, error) {
+	if syncReadOnly() {
+		return nil, errScimReadOnly
+	}
+
+	db, err := scimOpen()
+	if err != nil {
+		return nil, err
+	}
+
+	userMap, err := scimFetch(ctx, db, id)
+	if err != nil {
+		return nil, err
+	} else if userMap == nil {
+		return nil, scimError{http.StatusNotFound, "user not found"}
+	}
+
+	current := scimUserOf(id, userMap)
+	user, err := modify(current)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := make(map[string]string, len(userMap))
+	for col, value := range userMap {
+		updated[col] = value
+	}
+	changed := false
+	for col, value := range user.columns() {
+		if col == "username" {
+			// The userName is the immutable id.
+			continue
+		}
+		if updated[col] != value {
+			log.WithFields(log.Fields{
+				"user":   id,
+				"column": col,
+				"old":    updated[col],
+				"new":    value,
+			}).Info("Updating SQL user by SCIM")
+			updated[col], changed = value, true
+		}
+	}
+	if changed {
+		if err = sqlRetry(ctx, func() error { return writerUpdateUser(ctx, db, []map[string]string{updated}) }); err != nil {
+			return nil, err
+		}
+	}
+
+	if user.Active != nil && !*user.Active && *current.Active {
+		if err = scimDeactivate(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return scimGet(ctx, id)
+}
+
+// scimDeactivate serves DELETE /Users/{id}, deactivating the user following
+// the EnvRoomPolicy.
+func scimDeactivate(ctx context.Context, id string) error {
+	if syncReadOnly() {
+		return errScimReadOnly
+	}
+
+	db, err := scimOpen()
+	if err != nil {
+		return err
+	}
+
+	userMap, err := scimFetch(ctx, db, id)
+	if err != nil {
+		return err
+	} else if userMap == nil {
+		return scimError{http.StatusNotFound, "user not found"}
+	}
+
+	err = sqlRetry(ctx, func() (err error) {
+		_, err = sqlDeactivateUsers(ctx, db, []string{userMap["id"]})
+		return
+	})
+	if err == nil {
+		log.WithField("user", id).Info("Deactivated SQL user by SCIM")
+	}
+	return err
+}
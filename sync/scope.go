@@ -0,0 +1,136 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapGroupMemberAttrs are the attributes listing a group's members, either by
+// their DN or, for posixGroup's memberUid, by their uid. The latter only
+// matches if the EnvMatchAttribute is the uid attribute as well.
+var ldapGroupMemberAttrs = []string{"member", "uniqueMember", "memberUid"}
+
+// scopeGroup is a group of EnvIncludeGroups or EnvExcludeGroups with its
+// members, as fetched by ldapLoadScope.
+type scopeGroup struct {
+	dn string
+
+	// members are the normalized DNs and EnvMatchAttribute values of all
+	// members.
+	members map[string]bool
+}
+
+// syncScope limits the synced users by their group memberships.
+type syncScope struct {
+	include []scopeGroup
+	exclude []scopeGroup
+}
+
+// allows checks if a user is within the scope: a member of any included group,
+// if configured, and of no excluded group.
+func (scope syncScope) allows(uid string, usr ldapUser) bool {
+	if len(scope.include) > 0 && !scopeMemberOfAny(scope.include, uid, usr) {
+		return false
+	}
+	return !scopeMemberOfAny(scope.exclude, uid, usr)
+}
+
+// scopeMemberOfAny checks if a user is a member of any of the groups, either
+// by the user's memberOf attribute or by the group's member lists.
+func scopeMemberOfAny(groups []scopeGroup, uid string, usr ldapUser) bool {
+	dn := ldapNormalizeDN(usr.dn)
+	for _, group := range groups {
+		if group.members[dn] || group.members[uid] {
+			return true
+		}
+		for _, memberOf := range usr.groups {
+			if groupEqual(group.dn, memberOf) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseGroupList reads the environment variable key as a semicolon separated
+// list of group DNs.
+func parseGroupList(key string) (dns []string, err error) {
+	for _, dn := range strings.Split(os.Getenv(key), ";") {
+		if dn = strings.TrimSpace(dn); dn == "" {
+			continue
+		}
+		if _, err = ldap.ParseDN(dn); err != nil {
+			err = fmt.Errorf("invalid %s group DN %q: %w", key, dn, err)
+			return
+		}
+		dns = append(dns, dn)
+	}
+	return
+}
+
+// ldapNormalizeDN returns a DN's canonical, lowercase string representation,
+// falling back to the lowercase input for unparsable DNs.
+func ldapNormalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn)
+	}
+	return strings.ToLower(parsed.String())
+}
+
+// ldapLoadScope fetches the member lists of the configured EnvIncludeGroups
+// and EnvExcludeGroups. Groups are expected to exist.
+func ldapLoadScope(conn ldapSearcher) (scope syncScope, err error) {
+	if scope.include, err = ldapLoadScopeGroups(conn, cfg.includeGroups); err != nil {
+		return
+	}
+	scope.exclude, err = ldapLoadScopeGroups(conn, cfg.excludeGroups)
+	return
+}
+
+// ldapLoadScopeGroups fetches the member lists of the groups for ldapLoadScope.
+func ldapLoadScopeGroups(conn ldapSearcher, dns []string) (groups []scopeGroup, err error) {
+	for _, dn := range dns {
+		searchReq := ldap.NewSearchRequest(
+			dn,
+			ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0,
+			false,
+			"(objectClass=*)",
+			ldapGroupMemberAttrs,
+			nil)
+
+		var searchResp *ldap.SearchResult
+		if searchResp, err = ldapSearch(conn, searchReq); err != nil {
+			err = fmt.Errorf("cannot fetch group %s: %w", dn, err)
+			return
+		} else if len(searchResp.Entries) != 1 {
+			err = fmt.Errorf("cannot find group %s", dn)
+			return
+		}
+
+		group := scopeGroup{dn: dn, members: make(map[string]bool)}
+		for _, attr := range ldapGroupMemberAttrs {
+			var members []string
+			if members, err = ldapRangedValues(conn, searchResp.Entries[0], attr); err != nil {
+				err = fmt.Errorf("cannot fetch members of group %s: %w", dn, err)
+				return
+			}
+			for _, member := range members {
+				if attr == "memberUid" {
+					group.members[member] = true
+				} else {
+					group.members[ldapNormalizeDN(member)] = true
+				}
+			}
+		}
+		groups = append(groups, group)
+	}
+	return
+}
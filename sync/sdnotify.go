@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sdReady is set once READY=1 was sent to systemd after the first successful sync.
+var sdReady atomic.Bool
+
+// sdNotify sends a state to systemd's service manager for Type=notify units.
+//
+// Without a NOTIFY_SOCKET, e.g., not being started by systemd, this is a no-op.
+// https://www.freedesktop.org/software/systemd/man/latest/sd_notify.html
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.WithError(err).Debug("Cannot connect to systemd's notify socket")
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.WithError(err).Debug("Cannot notify systemd")
+	}
+}
+
+// sdNotifySync reports a finished sync by a STATUS= line. The first successful
+// sync additionally sends READY=1.
+func sdNotifySync(err error) {
+	now := time.Now().Format(time.RFC3339)
+	if err != nil {
+		sdNotify("STATUS=Last sync at " + now + " failed: " + err.Error())
+		return
+	}
+
+	state := "STATUS=Last sync at " + now + " succeeded"
+	if !sdReady.Swap(true) {
+		state = "READY=1\n" + state
+	}
+	sdNotify(state)
+}
+
+// sdWatchdogInterval returns the interval for WATCHDOG=1 pings, being half of
+// systemd's WatchdogSec, if the watchdog is enabled for this process.
+func sdWatchdogInterval() (interval time.Duration, ok bool) {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	return time.Duration(usec) * time.Microsecond / 2, true
+}
@@ -0,0 +1,140 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// configSecretKeys are the environment variables read by configSecret, whose
+// values are masked by configShow.
+var configSecretKeys = []string{"LDAP_PASSWORD", "DB_PASSWORD", EnvWebhookUrl, EnvWebhookSecret, EnvPushgatewayUrl, EnvAdminToken, EnvLdapReferralCredentials, EnvVaultToken, EnvOtlpHeaders, EnvSentryDsn, EnvChatWebhookUrl, EnvMatrixToken, EnvSmtpPassword, EnvDbUrl, EnvKeycloakClientSecret, EnvScimToken}
+
+// configSecretFileSuffix is appended to each of the configSecretKeys for its
+// variant naming a file containing the secret, e.g., LDAP_PASSWORD_FILE.
+const configSecretFileSuffix = "_FILE"
+
+// configSecret returns the value of the secret environment variable key.
+//
+// If key_FILE is set instead, e.g., for a mounted Docker or Kubernetes
+// secret, the file's content without a trailing line break is returned. The
+// file is read on each call, thus rotated secrets are picked up.
+//
+// The key must be one of the configSecretKeys, thus no secret is shown by
+// configShow.
+func configSecret(key string) (v string, err error) {
+	if !slices.Contains(configSecretKeys, key) {
+		err = fmt.Errorf("%s is not a secret setting", key)
+		return
+	}
+
+	path, ok := os.LookupEnv(key + configSecretFileSuffix)
+	if !ok {
+		return os.Getenv(key), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("cannot read %s: %w", key+configSecretFileSuffix, err)
+		return
+	}
+	v = strings.TrimRight(string(data), "\r\n")
+	return
+}
+
+// configSecretsCheck verifies that no secret is set both directly and by a
+// file and that all secret files are readable, failing early at start.
+func configSecretsCheck() error {
+	for _, key := range configSecretKeys {
+		_, direct := os.LookupEnv(key)
+		_, file := os.LookupEnv(key + configSecretFileSuffix)
+		if direct && file {
+			return fmt.Errorf("%s and %s cannot be set together", key, key+configSecretFileSuffix)
+		}
+		if _, err := configSecret(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlSecretConnector is a driver.Connector creating each connection by a
+// fresh connector, thus reading the sqlCredentials on each reconnect.
+type sqlSecretConnector struct {
+	driver driver.Driver
+
+	// connector creates a connector for the current sqlCredentials.
+	connector func(username, password string) (driver.Connector, error)
+}
+
+func (c *sqlSecretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	username, password, err := sqlCredentials()
+	if err != nil {
+		return nil, err
+	}
+	connector, err := c.connector(username, password)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
+
+func (c *sqlSecretConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sqlDsnConnector is a driver.Connector opening a DSN by a driver, for drivers
+// lacking a driver.DriverContext.
+type sqlDsnConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c sqlDsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c sqlDsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// ldapBindCredentials returns the bind DN and password of the simple
+// LDAP_AUTH, being those of EnvVaultLdapPath if configured.
+func ldapBindCredentials() (dn, password string, err error) {
+	vaultState.Lock()
+	creds := vaultState.ldap
+	vaultState.Unlock()
+	if cfg.vaultLdapPath != "" {
+		if creds == nil {
+			return "", "", fmt.Errorf("no LDAP credentials were fetched from Vault")
+		}
+		return creds.username, creds.password, nil
+	}
+
+	password, err = configSecret("LDAP_PASSWORD")
+	return os.Getenv("LDAP_BIND_DN"), password, err
+}
+
+// sqlCredentials returns the database username and password, being those of
+// EnvVaultDbPath if configured.
+func sqlCredentials() (username, password string, err error) {
+	vaultState.Lock()
+	creds := vaultState.db
+	vaultState.Unlock()
+	if cfg.vaultDbPath != "" {
+		if creds == nil {
+			return "", "", fmt.Errorf("no database credentials were fetched from Vault")
+		}
+		return creds.username, creds.password, nil
+	}
+
+	password, err = configSecret("DB_PASSWORD")
+	return os.Getenv("DB_USERNAME"), password, err
+}
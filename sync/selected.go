@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"io"
+)
+
+// selectedUsersReport prints the outcome of a sync limited to the EnvUser
+// users, e.g., for a helpdesk fixing a single account.
+//
+// Each user is listed with its changes and their report actions, as unchanged,
+// or as missing in Greenlight if not within known. The rows are the sync's
+// reported changes, see writeReport.
+func selectedUsersReport(w io.Writer, known map[string]string, rows []reportRow, syncErr error) {
+	changes := make(map[string][]reportRow)
+	for _, row := range rows {
+		changes[row.User] = append(changes[row.User], row)
+	}
+
+	for _, user := range cfg.users {
+		switch {
+		case len(changes[user]) > 0:
+			for _, row := range changes[user] {
+				fmt.Fprintf(w, "%s: %s: %q -> %q (%s)\n", user, row.Attribute, row.Old, row.New, row.Action)
+			}
+		case known[user] == "":
+			fmt.Fprintf(w, "%s: not found in Greenlight\n", user)
+		default:
+			fmt.Fprintf(w, "%s: unchanged\n", user)
+		}
+	}
+
+	if syncErr != nil {
+		fmt.Fprintf(w, "Sync failed: %v\n", syncErr)
+	}
+}
@@ -0,0 +1,237 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sentryTimeout bounds each event delivery to the EnvSentryDsn.
+	sentryTimeout = 10 * time.Second
+
+	// sentryQueueSize bounds the pending events. Further events are dropped,
+	// as reporting must never block the sync.
+	sentryQueueSize = 64
+)
+
+// sentryTagFields are log fields reported as Sentry tags, allowing to search
+// for them, while all other fields become extra data.
+var sentryTagFields = []string{"run", "user", "attribute", "table", "source"}
+
+// sentryReporter reports errors, if enabled by EnvSentryDsn.
+var sentryReporter *sentryHook
+
+// sentryHook is a logrus hook reporting errors and panics to Sentry or a
+// compatible service, e.g., GlitchTip.
+//
+// Instead of depending on the Sentry SDK, events are POSTed directly to the
+// project's store endpoint. Errors are delivered in the background, while
+// fatal errors are delivered before logrus exits.
+type sentryHook struct {
+	client   *http.Client
+	storeUrl string
+	auth     string
+	queue    chan []byte
+	done     chan struct{}
+}
+
+// newSentryHook creates a sentryHook for a DSN of the form
+// https://PUBLIC_KEY@HOST/PROJECT_ID and starts its delivery worker.
+func newSentryHook(dsn string) (*sentryHook, error) {
+	dsnUrl, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	project := strings.TrimPrefix(dsnUrl.Path, "/")
+	if dsnUrl.User == nil || dsnUrl.User.Username() == "" || project == "" {
+		return nil, fmt.Errorf("expected a DSN like https://KEY@HOST/PROJECT")
+	}
+
+	storeUrl := url.URL{Scheme: dsnUrl.Scheme, Host: dsnUrl.Host}
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		storeUrl.Path = "/" + project[:i]
+		project = project[i+1:]
+	}
+	storeUrl.Path += "/api/" + project + "/store/"
+
+	h := &sentryHook{
+		client:   &http.Client{Timeout: sentryTimeout},
+		storeUrl: storeUrl.String(),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_client=greenlight-ldap-sync/%s, sentry_key=%s",
+			Version, dsnUrl.User.Username()),
+		queue: make(chan []byte, sentryQueueSize),
+		done:  make(chan struct{}),
+	}
+	go h.run()
+	return h, nil
+}
+
+// Levels are the reported levels.
+func (h *sentryHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+// Fire reports a log entry. As logrus exits after fatal entries, those are
+// delivered directly.
+func (h *sentryHook) Fire(entry *log.Entry) error {
+	var errValue error
+	if err, ok := entry.Data[log.ErrorKey].(error); ok {
+		errValue = err
+	}
+
+	level := "error"
+	if entry.Level <= log.FatalLevel {
+		level = "fatal"
+	}
+
+	payload, err := h.event(level, entry.Message, errValue, logRedactData(entry.Data), "")
+	if err != nil {
+		return err
+	}
+
+	if entry.Level <= log.FatalLevel {
+		return h.send(payload)
+	}
+	select {
+	case h.queue <- payload:
+	default:
+	}
+	return nil
+}
+
+// event encodes a Sentry event with the run context, being the sync mode and
+// the log fields.
+func (h *sentryHook) event(level, message string, err error, fields log.Fields, stack string) ([]byte, error) {
+	var eventId [16]byte
+	_, _ = rand.Read(eventId[:])
+
+	mode := "once"
+	if cfg != nil && cfg.interval > 0 {
+		mode = "interval"
+	} else if cfg != nil && cfg.schedule != nil {
+		mode = "schedule"
+	}
+	tags := map[string]string{"mode": mode}
+	extra := make(map[string]string)
+	for key, v := range fields {
+		if key == log.ErrorKey {
+			continue
+		}
+		extra[key] = fmt.Sprint(v)
+	}
+	for _, key := range sentryTagFields {
+		if v, ok := extra[key]; ok {
+			tags[key] = v
+			delete(extra, key)
+		}
+	}
+	if stack != "" {
+		extra["stack"] = stack
+	}
+
+	event := map[string]any{
+		"event_id":  hex.EncodeToString(eventId[:]),
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"level":     level,
+		"logger":    "greenlight-ldap-sync",
+		"platform":  "go",
+		"release":   Version,
+		"message":   message,
+		"tags":      tags,
+		"extra":     extra,
+	}
+	if cfg != nil && cfg.sentryEnvironment != "" {
+		event["environment"] = cfg.sentryEnvironment
+	}
+	if hostname, hostErr := os.Hostname(); hostErr == nil {
+		event["server_name"] = hostname
+	}
+	if err != nil {
+		event["exception"] = map[string]any{
+			"values": []map[string]string{{"type": fmt.Sprintf("%T", err), "value": err.Error()}},
+		}
+	}
+	return json.Marshal(event)
+}
+
+// run is the delivery worker, processing the queue until it is closed.
+func (h *sentryHook) run() {
+	defer close(h.done)
+
+	for payload := range h.queue {
+		// Logging a failure would be reported again, thus it is printed only.
+		if err := h.send(payload); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to report error to Sentry: %v\n", err)
+		}
+	}
+}
+
+// send performs a single delivery attempt.
+func (h *sentryHook) send(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, h.storeUrl, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", h.auth)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// flush waits for pending events up to timeout. Afterwards, the hook is
+// removed, as no further events can be queued.
+func (h *sentryHook) flush(timeout time.Duration) {
+	log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	close(h.queue)
+
+	select {
+	case <-h.done:
+	case <-time.After(timeout):
+		log.WithField("pending", len(h.queue)).Warn("Timed out flushing Sentry events")
+	}
+}
+
+// sentryRecover reports a panic with its stack trace before continuing to
+// panic. It must be deferred directly.
+func sentryRecover() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	if sentryReporter != nil {
+		err, ok := r.(error)
+		if !ok {
+			err = fmt.Errorf("%v", r)
+		}
+		payload, encErr := sentryReporter.event("fatal", "Panic", err, nil, string(debug.Stack()))
+		if encErr == nil {
+			_ = sentryReporter.send(payload)
+		}
+	}
+	panic(r)
+}
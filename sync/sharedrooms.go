@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sharedRoomMapping shares a Greenlight room, identified by its uid, with the
+// members of an LDAP group.
+type sharedRoomMapping struct {
+	group string
+	room  string
+}
+
+// sharedAccessChange adds or removes a user's shared access on a room.
+type sharedAccessChange struct {
+	userId string
+	roomId string
+	add    bool
+}
+
+// sharedRoomState are the EnvSharedRooms mapped rooms and their shared
+// accesses, fetched by sqlLoadSharedRooms at the start of a sync.
+type sharedRoomState struct {
+	// ids maps the rooms' uids to their ids; missing rooms are absent.
+	ids map[string]string
+
+	// owners maps the rooms' ids to their owners' user ids.
+	owners map[string]string
+
+	// access maps the rooms' ids to the user ids they are shared with.
+	access map[string]map[string]bool
+}
+
+// parseSharedRoomMap parses a SYNC_SHARED_ROOMS value.
+//
+// Like SYNC_ROLE_MAP, it consists of semicolon separated GROUP=ROOM pairs,
+// split at their last equal sign. A room might be mapped from multiple groups.
+func parseSharedRoomMap(sharedRoomsStr string) (mappings []sharedRoomMapping, err error) {
+	for _, mapping := range strings.Split(sharedRoomsStr, ";") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+
+		i := strings.LastIndex(mapping, "=")
+		if i <= 0 || i == len(mapping)-1 {
+			err = fmt.Errorf("shared room mapping %s cannot be split", mapping)
+			return
+		}
+
+		mappings = append(mappings, sharedRoomMapping{
+			group: strings.TrimSpace(mapping[:i]),
+			room:  strings.TrimSpace(mapping[i+1:]),
+		})
+	}
+	return
+}
+
+// diff returns the shared access changes for a user of the given groups.
+//
+// Members of a mapped group get access to its room, unless they own it. If
+// EnvSharedRoomsPrune is set, others lose their access to the mapped rooms.
+func (state sharedRoomState) diff(userId string, groups []string) (changes []sharedAccessChange) {
+	wanted := make(map[string]bool)
+	for _, mapping := range cfg.sharedRooms {
+		if _, ok := state.ids[mapping.room]; !ok {
+			continue
+		}
+		if _, ok := wanted[mapping.room]; !ok {
+			wanted[mapping.room] = false
+		}
+		for _, group := range groups {
+			if groupEqual(mapping.group, group) {
+				wanted[mapping.room] = true
+			}
+		}
+	}
+
+	for room, want := range wanted {
+		roomId := state.ids[room]
+		has := state.access[roomId][userId]
+		switch {
+		case want && !has && state.owners[roomId] != userId:
+			changes = append(changes, sharedAccessChange{userId, roomId, true})
+		case !want && has && cfg.sharedRoomsPrune:
+			changes = append(changes, sharedAccessChange{userId, roomId, false})
+		}
+	}
+	return
+}
+
+// roomUid returns the uid of a room id as mapped by EnvSharedRooms.
+func (state sharedRoomState) roomUid(roomId string) string {
+	for uid, id := range state.ids {
+		if id == roomId {
+			return uid
+		}
+	}
+	return roomId
+}
+
+// sqlLoadSharedRooms fetches the EnvSharedRooms mapped rooms and their shared
+// accesses. Rooms which do not exist are logged and skipped.
+func sqlLoadSharedRooms(ctx context.Context, db *sqlDB) (state sharedRoomState, err error) {
+	state = sharedRoomState{
+		ids:    make(map[string]string),
+		owners: make(map[string]string),
+		access: make(map[string]map[string]bool),
+	}
+
+	uidCol := sqlActiveSchema.roomUidColumn
+	for _, mapping := range cfg.sharedRooms {
+		if _, ok := state.ids[mapping.room]; ok {
+			continue
+		}
+
+		var roomId, ownerId string
+		err = db.QueryRowContext(ctx, db.query(`
+			SELECT
+				{id}, {user_id}
+			FROM
+				{rooms}
+			WHERE
+				{`+uidCol+`} = ?
+		`), mapping.room).Scan(&roomId, &ownerId)
+		if errors.Is(err, sql.ErrNoRows) {
+			log.WithField("room", mapping.room).Error("Shared room does not exist in Greenlight, skipping")
+			err = nil
+			continue
+		} else if err != nil {
+			err = fmt.Errorf("cannot fetch shared room %s: %w", mapping.room, err)
+			return
+		}
+
+		state.ids[mapping.room] = roomId
+		state.owners[roomId] = ownerId
+		state.access[roomId] = make(map[string]bool)
+	}
+
+	for roomId, users := range state.access {
+		var rows *sql.Rows
+		rows, err = db.QueryContext(ctx, db.query(`
+			SELECT
+				{user_id}
+			FROM
+				{shared_accesses}
+			WHERE
+				{room_id} = ?
+		`), roomId)
+		if err != nil {
+			return
+		}
+
+		for rows.Next() {
+			var userId string
+			if err = rows.Scan(&userId); err != nil {
+				_ = rows.Close()
+				return
+			}
+			users[userId] = true
+		}
+		if err = errors.Join(rows.Err(), rows.Close()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// sqlUpdateSharedAccess adds and removes shared accesses in a single
+// transaction.
+func sqlUpdateSharedAccess(ctx context.Context, db *sqlDB, changes []sharedAccessChange) (err error) {
+	tx, err := db.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	addStmt, err := tx.PrepareContext(ctx, db.query(`
+		INSERT INTO {shared_accesses} (
+			{room_id}, {user_id}, {created_at}, {updated_at}
+		) VALUES (
+			?, ?, NOW(), NOW()
+		)
+	`))
+	if err != nil {
+		return
+	}
+	defer addStmt.Close()
+
+	removeStmt, err := tx.PrepareContext(ctx, db.query(`
+		DELETE FROM
+			{shared_accesses}
+		WHERE
+			{room_id} = ? AND {user_id} = ?
+	`))
+	if err != nil {
+		return
+	}
+	defer removeStmt.Close()
+
+	for _, change := range changes {
+		stmt := removeStmt
+		if change.add {
+			stmt = addStmt
+		}
+		if _, err = stmt.ExecContext(ctx, change.roomId, change.userId); err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
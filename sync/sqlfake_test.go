@@ -0,0 +1,194 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStatement is a statement executed on a fakeDB.
+type fakeStatement struct {
+	query string
+	args  []driver.Value
+}
+
+// fakeRows are the columns and rows answering a query of a fakeDB.
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// fakeDB is an in-memory database/sql driver recording all statements, while
+// queries are answered by its handler. Without a handler, queries return no
+// rows and statements affect no rows.
+//
+// Like PostgreSQL, writes within a read-only transaction fail.
+type fakeDB struct {
+	handler func(query string, args []driver.Value) (fakeRows, error)
+
+	// discard skips recording the statements, e.g., for benchmarks.
+	discard bool
+
+	mu         sync.Mutex
+	statements []fakeStatement
+	readOnly   []bool
+	commits    int
+	rollbacks  int
+}
+
+// newTestDB opens a sqlDB of the dialect on a fakeDB, being closed after the
+// test.
+func newTestDB(t testing.TB, dialect sqlDialect, handler func(query string, args []driver.Value) (fakeRows, error)) (*sqlDB, *fakeDB) {
+	t.Helper()
+	fake := &fakeDB{handler: handler}
+	db := &sqlDB{DB: sql.OpenDB(fake), dialect: dialect}
+	t.Cleanup(func() { _ = db.Close() })
+	return db, fake
+}
+
+// executed returns the queries of all statements executed so far.
+func (fake *fakeDB) executed() (queries []string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, statement := range fake.statements {
+		queries = append(queries, statement.query)
+	}
+	return
+}
+
+func (fake *fakeDB) run(query string, args []driver.Value, readOnly bool) (fakeRows, error) {
+	if command := strings.ToUpper(strings.Fields(query + " ")[0]); readOnly && slices.Contains([]string{"INSERT", "UPDATE", "DELETE"}, command) {
+		return fakeRows{}, fmt.Errorf("cannot execute %s in a read-only transaction", command)
+	}
+
+	if !fake.discard {
+		fake.mu.Lock()
+		fake.statements = append(fake.statements, fakeStatement{query, args})
+		fake.mu.Unlock()
+	}
+
+	if fake.handler == nil {
+		return fakeRows{}, nil
+	}
+	return fake.handler(query, args)
+}
+
+func (fake *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{fake: fake}, nil
+}
+
+func (fake *fakeDB) Driver() driver.Driver {
+	return fakeDriver{fake}
+}
+
+type fakeDriver struct{ fake *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return &fakeConn{fake: d.fake}, nil
+}
+
+type fakeConn struct {
+	fake *fakeDB
+
+	// readOnly is set during a read-only transaction.
+	readOnly bool
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c, query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(_ context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+	c.fake.readOnly = append(c.fake.readOnly, opts.ReadOnly)
+	c.readOnly = opts.ReadOnly
+	return &fakeTx{c}, nil
+}
+
+type fakeTx struct{ conn *fakeConn }
+
+func (tx *fakeTx) Commit() error {
+	tx.conn.fake.mu.Lock()
+	defer tx.conn.fake.mu.Unlock()
+	tx.conn.fake.commits++
+	tx.conn.readOnly = false
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.conn.fake.mu.Lock()
+	defer tx.conn.fake.mu.Unlock()
+	tx.conn.fake.rollbacks++
+	tx.conn.readOnly = false
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	rows, err := s.conn.fake.run(s.query, args, s.conn.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(rows.rows)), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows, err := s.conn.fake.run(s.query, args, s.conn.readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeResult{rows: rows}, nil
+}
+
+type fakeResult struct {
+	rows fakeRows
+	next int
+}
+
+func (r *fakeResult) Columns() []string {
+	return r.rows.columns
+}
+
+func (r *fakeResult) Close() error {
+	return nil
+}
+
+func (r *fakeResult) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,309 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncStatus summarizes a single sync run for EnvStatusTable.
+type syncStatus struct {
+	finished    time.Time
+	duration    time.Duration
+	users       int
+	updated     int
+	roles       int
+	deactivated int
+	err         error
+}
+
+// sqlStatusColumns are the columns of the EnvStatusTable, besides its id.
+var sqlStatusColumns = []string{
+	"finished_at", "duration_ms", "users", "updated", "roles", "deactivated", "success", "error",
+}
+
+// sqlWriteStatus upserts the single row of the configured EnvStatusTable.
+//
+// The table is created if missing. The status is written in its own committed
+// transaction, after the sync's updates were committed, thus it never reports
+// a success of uncommitted updates. Failed syncs are recorded as well.
+func sqlWriteStatus(ctx context.Context, db *sqlDB, status syncStatus) (err error) {
+	table := "{" + cfg.statusTable + "}"
+
+	_, err = db.ExecContext(ctx, db.query(`
+		CREATE TABLE IF NOT EXISTS `+table+` (
+			{id}          INTEGER PRIMARY KEY,
+			{finished_at} TIMESTAMP NOT NULL,
+			{duration_ms} BIGINT NOT NULL,
+			{users}       INTEGER NOT NULL,
+			{updated}     INTEGER NOT NULL,
+			{roles}       INTEGER NOT NULL,
+			{deactivated} INTEGER NOT NULL,
+			{success}     BOOLEAN NOT NULL,
+			{error}       TEXT
+		)
+	`))
+	if err != nil {
+		return
+	}
+
+	var errMsg *string
+	if status.err != nil {
+		msg := status.err.Error()
+		errMsg = &msg
+	}
+
+	_, err = db.ExecContext(ctx, db.query(`
+		INSERT INTO `+table+` ({id}, {finished_at}, {duration_ms}, {users}, {updated}, {roles}, {deactivated}, {success}, {error})
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?)
+		`+db.dialect.upsertClause("id", sqlStatusColumns)),
+		status.finished.UTC(), status.duration.Milliseconds(),
+		status.users, status.updated, status.roles, status.deactivated,
+		status.err == nil, errMsg)
+	return
+}
+
+// syncState is the JSON representation of a syncStatus within the EnvStateFile.
+type syncState struct {
+	Finished    time.Time `json:"finished_at"`
+	DurationMs  int64     `json:"duration_ms"`
+	Users       int       `json:"users"`
+	Updated     int       `json:"updated"`
+	Roles       int       `json:"roles"`
+	Deactivated int       `json:"deactivated"`
+	ReadOnly    bool      `json:"read_only"`
+	Success     bool      `json:"success"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// newSyncState converts a syncStatus of a possibly readOnly sync.
+func newSyncState(status syncStatus, readOnly bool) syncState {
+	state := syncState{
+		Finished:    status.finished.UTC(),
+		DurationMs:  status.duration.Milliseconds(),
+		Users:       status.users,
+		Updated:     status.updated,
+		Roles:       status.roles,
+		Deactivated: status.deactivated,
+		ReadOnly:    readOnly,
+		Success:     status.err == nil,
+	}
+	if status.err != nil {
+		state.Error = status.err.Error()
+	}
+	return state
+}
+
+// writeStateFile replaces the EnvStateFile by the state, atomically by
+// createOutputFile.
+func writeStateFile(state syncState) (err error) {
+	f, err := createOutputFile(cfg.stateFile, false)
+	if err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(state); err != nil {
+		_ = f.Abort()
+		return
+	}
+	return f.Close()
+}
+
+// readStateFile reads the EnvStateFile written by writeStateFile.
+func readStateFile() (state syncState, err error) {
+	data, err := os.ReadFile(cfg.stateFile)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &state)
+	return
+}
+
+// sqlReadStatus reads the row written by sqlWriteStatus.
+func sqlReadStatus(ctx context.Context, db *sqlDB) (state syncState, err error) {
+	var errMsg sql.NullString
+	err = db.QueryRowContext(ctx, db.query(`
+		SELECT {finished_at}, {duration_ms}, {users}, {updated}, {roles}, {deactivated}, {success}, {error}
+		FROM {`+cfg.statusTable+`}
+		WHERE {id} = 1
+	`)).Scan(&state.Finished, &state.DurationMs, &state.Users, &state.Updated,
+		&state.Roles, &state.Deactivated, &state.Success, &errMsg)
+	state.Error = errMsg.String
+	return
+}
+
+// statusShow prints the last sync's state, either from the EnvStateFile or
+// the EnvStatusTable, for the status command.
+//
+// False is returned if no state is available, the last sync failed, or it
+// finished longer than the EnvStatusMaxAge ago.
+func statusShow(w io.Writer) bool {
+	var state syncState
+	var err error
+	switch {
+	case cfg.stateFile != "":
+		state, err = readStateFile()
+
+	case cfg.statusTable != "":
+		var db *sqlDB
+		if db, err = sqlOpen(true); err == nil {
+			state, err = sqlReadStatus(context.Background(), db)
+			db.Close()
+		}
+
+	default:
+		err = fmt.Errorf("neither %s nor %s is set", EnvStateFile, EnvStatusTable)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "[FAIL] cannot read the last sync's state: %v\n", err)
+		return false
+	}
+
+	age := time.Since(state.Finished).Truncate(time.Second)
+	value := func(key string, v any) {
+		fmt.Fprintf(w, "%-12s %v\n", key, v)
+	}
+	value("finished_at", state.Finished.Format(time.RFC3339))
+	value("age", age)
+	value("duration", (time.Duration(state.DurationMs) * time.Millisecond).String())
+	value("users", state.Users)
+	value("updated", state.Updated)
+	value("roles", state.Roles)
+	value("deactivated", state.Deactivated)
+	value("read_only", state.ReadOnly)
+	value("success", state.Success)
+	if state.Error != "" {
+		value("error", state.Error)
+	}
+
+	switch {
+	case !state.Success:
+		fmt.Fprintf(w, "[FAIL] the last sync failed\n")
+		return false
+	case age > cfg.statusMaxAge:
+		fmt.Fprintf(w, "[FAIL] the last sync is older than %s %v\n", EnvStatusMaxAge, cfg.statusMaxAge)
+		return false
+	default:
+		fmt.Fprintf(w, "[ OK ] the last sync succeeded\n")
+		return true
+	}
+}
+
+// runStatus is the JSON response of statusHandler.
+type runStatus struct {
+	Running bool          `json:"running"`
+	Paused  bool          `json:"paused"`
+	Started *time.Time    `json:"started_at,omitempty"`
+	LastRun *lastRunState `json:"last_run,omitempty"`
+	Next    *time.Time    `json:"next_run,omitempty"`
+}
+
+// lastRunState are the details of the last finished sync within a runStatus.
+type lastRunState struct {
+	Started    time.Time `json:"started_at"`
+	Finished   time.Time `json:"finished_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Users      int       `json:"users"`
+	Changed    int       `json:"changed"`
+	Failed     int       `json:"failed"`
+	ReadOnly   bool      `json:"read_only"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// syncRunStatus is the in-memory runStatus of the daemon, updated by
+// syncAction and syncInterval.
+var syncRunStatus struct {
+	sync.Mutex
+	runStatus
+}
+
+// statusRunStarted records a started sync within the syncRunStatus.
+func statusRunStarted(started time.Time) {
+	syncRunStatus.Lock()
+	defer syncRunStatus.Unlock()
+
+	syncRunStatus.Running = true
+	syncRunStatus.Started = &started
+}
+
+// statusRunFinished records a finished sync within the syncRunStatus.
+func statusRunFinished(started time.Time, status syncStatus, changed, failed int, readOnly bool) {
+	syncRunStatus.Lock()
+	defer syncRunStatus.Unlock()
+
+	lastRun := &lastRunState{
+		Started:    started.UTC(),
+		Finished:   status.finished.UTC(),
+		DurationMs: status.duration.Milliseconds(),
+		Users:      status.users,
+		Changed:    changed,
+		Failed:     failed,
+		ReadOnly:   readOnly,
+		Success:    status.err == nil,
+	}
+	if status.err != nil {
+		lastRun.Error = status.err.Error()
+	}
+
+	syncRunStatus.Running = false
+	syncRunStatus.Started = nil
+	syncRunStatus.LastRun = lastRun
+}
+
+// statusLog logs the syncRunStatus, the maintenanceMode, syncIsPaused, and,
+// for the EnvLeaderElection, the leadership on SIGUSR2.
+func statusLog() {
+	syncRunStatus.Lock()
+	status := syncRunStatus.runStatus
+	syncRunStatus.Unlock()
+
+	fields := log.Fields{
+		"running":     status.Running,
+		"maintenance": maintenanceMode.Load(),
+		"paused":      syncIsPaused(),
+	}
+	if status.Started != nil {
+		fields["started_at"] = *status.Started
+	}
+	if status.Next != nil {
+		fields["next_run"] = *status.Next
+	}
+	if last := status.LastRun; last != nil {
+		fields["last_finished_at"] = last.Finished
+		fields["last_duration"] = time.Duration(last.DurationMs) * time.Millisecond
+		fields["last_users"] = last.Users
+		fields["last_changed"] = last.Changed
+		fields["last_failed"] = last.Failed
+		fields["last_success"] = last.Success
+		if last.Error != "" {
+			fields["last_error"] = last.Error
+		}
+	}
+	if cfg.leaderElection {
+		fields["leader"] = leaderElected.Load()
+	}
+	log.WithFields(fields).Info("Current status")
+}
+
+// statusNextRun records the next scheduled sync within the syncRunStatus.
+func statusNextRun(next time.Time) {
+	syncRunStatus.Lock()
+	defer syncRunStatus.Unlock()
+
+	next = next.UTC()
+	syncRunStatus.Next = &next
+}
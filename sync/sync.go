@@ -0,0 +1,565 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// attrChange is a single changed user attribute, detected by syncAction.
+type attrChange struct {
+	user      string
+	attribute string
+	old       string
+	new       string
+}
+
+// sortChanges orders changes by user and attribute for a deterministic output.
+func sortChanges(changes []attrChange) {
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].user != changes[j].user {
+			return changes[i].user < changes[j].user
+		}
+		return changes[i].attribute < changes[j].attribute
+	})
+}
+
+// dryRunReport logs all changes within the configured EnvDryRunColumns.
+func dryRunReport(changes []attrChange) {
+	reported := 0
+	users := make(map[string]bool)
+	for _, change := range changes {
+		if len(cfg.dryRunColumns) > 0 && !slices.Contains(cfg.dryRunColumns, change.attribute) {
+			continue
+		}
+		users[change.user] = true
+
+		log.WithFields(log.Fields{
+			"user":      change.user,
+			"attribute": change.attribute,
+			"old":       change.old,
+			"new":       change.new,
+		}).Info("Dry run: user attribute would change")
+		reported++
+	}
+
+	log.WithFields(log.Fields{
+		"changes":  len(changes),
+		"reported": reported,
+		"users":    len(users),
+	}).Info("Dry run: skipped SQL update")
+}
+
+// maintenanceMode disables all SQL writes at runtime, behaving like a dry run.
+//
+// It is initialized by EnvMaintenance and toggled by SIGUSR1, unless
+// EnvSignalUsr1 is SignalUsr1Sync.
+var maintenanceMode atomic.Bool
+
+// syncPaused skips the scheduled syncs at runtime, as set by the EnvAdminAddr
+// API's POST /pause and POST /resume.
+var syncPaused atomic.Bool
+
+// syncIsPaused checks if scheduled syncs are skipped, either by syncPaused or
+// an existing EnvPauseFile. Explicitly requested syncs are still performed.
+func syncIsPaused() bool {
+	if syncPaused.Load() {
+		return true
+	}
+	if cfg.pauseFile != "" {
+		if _, err := os.Stat(cfg.pauseFile); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// syncReadOnly checks if the next sync must not write, either for EnvDryRun or
+// the maintenanceMode.
+func syncReadOnly() bool {
+	return cfg.dryRun || maintenanceMode.Load()
+}
+
+// syncAction performs a single LDAP to PostgreSQL sync.
+//
+// An error is returned if the sync failed as a whole, any SQL update failed,
+// or lookups of individual users failed, see syncExitCode.
+//
+// Once ctx is done, in-flight LDAP searches and SQL statements are aborted and
+// no further changes are written.
+//
+// After connecting, each batch of SQL users is passed through the syncPass
+// phases, see syncPass.fetch, syncPass.compare, and syncPass.apply.
+func syncAction(ctx context.Context) (err error) {
+	runId := newRunId()
+	readOnly := syncReadOnly()
+	log.WithFields(log.Fields{
+		"run":         runId,
+		"maintenance": maintenanceMode.Load(),
+	}).Info("Starting LDAP sync")
+
+	// The EnvRunTimeout cancels the sync like a shutdown, including waiting
+	// for the EnvRunLock, while the deferred functions still report the
+	// changes applied until then.
+	if cfg.runTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, cfg.runTimeout, fmt.Errorf("%w after %v", errSyncTimeout, cfg.runTimeout))
+		defer cancel()
+	}
+
+	// The lock is taken before anything is recorded, thus a skipped sync leaves
+	// no trace besides its log. If the database is unreachable, the sync fails
+	// on its connection below, being recorded as such.
+	if cfg.runLock != RunLockOff && !readOnly {
+		unlock, acquired, lockErr := syncLock(ctx)
+		switch {
+		case lockErr != nil && ctx.Err() != nil:
+			err = context.Cause(ctx)
+			log.WithError(err).Error("LDAP sync was canceled while waiting for the sync lock")
+			return
+		case lockErr != nil:
+			log.WithError(lockErr).Warn("Cannot acquire the sync lock")
+		case !acquired:
+			log.WithFields(log.Fields{
+				"run":  runId,
+				"lock": cfg.runLockName,
+			}).Warn("Skipping LDAP sync, as another instance is syncing")
+			return
+		default:
+			defer unlock()
+		}
+	}
+
+	retriesUsed.Store(0)
+	ldapGroupParentsReset()
+
+	s := &syncPass{
+		runId:      runId,
+		readOnly:   readOnly,
+		knownUsers: make(map[string]string),
+	}
+
+	// historyMode is the sync's mode within the EnvHistoryTable.
+	historyMode := HistoryModeFull
+
+	// changesPayload lists the applied changes for EnvWebhookUrl and
+	// EnvHookSuccess.
+	var changesPayload map[string]any
+
+	// The trace is exported last, after all other deferred functions.
+	ctx, span := traceStartRun(ctx, "sync")
+	span.set("run", runId)
+	span.set("read_only", readOnly)
+	defer func() {
+		span.set("users", s.userCount)
+		span.set("changed_users", len(s.updatedUsers)+len(s.roleUpdatedUsers)+len(s.deactivatedUsers)+len(s.provisionedUsers)+len(s.sharedUpdatedUsers))
+		span.set("failed_users", s.failed.users())
+		span.finish(err)
+	}()
+
+	s.startTime = time.Now()
+	defer func() {
+		endTime := time.Now()
+		fields := log.Fields{
+			"run":            runId,
+			"time":           endTime.Sub(s.startTime),
+			"retries":        retriesUsed.Load(),
+			"users":          s.userCount,
+			"updated":        len(s.updatedUsers),
+			"role_updated":   len(s.roleUpdatedUsers),
+			"shared_updated": len(s.sharedUpdatedUsers),
+			"deactivated":    len(s.deactivatedUsers),
+			"reactivated":    len(s.reactivatedUsers),
+			"provisioned":    len(s.provisionedUsers),
+			"failed_users":   s.userFailures,
+			"exit_code":      syncExitCode(err),
+		}
+		if err != nil {
+			log.WithFields(fields).WithError(err).Error("Finished LDAP sync with failures")
+		} else {
+			log.WithFields(fields).Info("Finished LDAP sync")
+		}
+	}()
+
+	defer func() {
+		changedUsers := make(map[string]bool)
+		for _, user := range slices.Concat(s.updatedUsers, s.roleUpdatedUsers, s.deactivatedUsers, s.reactivatedUsers, s.provisionedUsers, s.sharedUpdatedUsers) {
+			changedUsers[user] = true
+		}
+		metrics.observeRun(time.Now(), time.Since(s.startTime), s.userCount, len(changedUsers), s.failed.users(), err)
+
+		if cfg.pushgatewayUrl != "" {
+			if pushErr := metrics.push(cfg.pushgatewayUrl, cfg.pushgatewayJob); pushErr != nil {
+				log.WithError(pushErr).Error("Failed to push metrics to the Pushgateway")
+			}
+		}
+	}()
+
+	// currentStatus summarizes the sync for the EnvStateFile, EnvStatusTable, and
+	// EnvHistoryTable, being called by deferred functions after the sync.
+	currentStatus := func() syncStatus {
+		return syncStatus{
+			finished:    time.Now(),
+			duration:    time.Since(s.startTime),
+			users:       s.userCount,
+			updated:     len(s.updatedUsers),
+			roles:       len(s.roleUpdatedUsers),
+			deactivated: len(s.deactivatedUsers),
+			err:         err,
+		}
+	}
+
+	if len(cfg.users) == 0 {
+		statusRunStarted(s.startTime)
+		defer func() {
+			changed := len(s.updatedUsers) + len(s.roleUpdatedUsers) + len(s.deactivatedUsers) + len(s.reactivatedUsers) +
+				len(s.provisionedUsers) + len(s.sharedUpdatedUsers) + len(s.duplicateResolvedUsers)
+			statusRunFinished(s.startTime, currentStatus(), changed, s.failed.users(), readOnly)
+		}()
+	}
+
+	// Registered before the database connection, its failures are recorded. A
+	// sync of the EnvUser users only is not recorded, as it is no regular one.
+	if cfg.stateFile != "" && len(cfg.users) == 0 {
+		defer func() {
+			if stateErr := writeStateFile(newSyncState(currentStatus(), readOnly)); stateErr != nil {
+				log.WithError(stateErr).WithField("file", cfg.stateFile).Error("Failed to write sync state file")
+			}
+		}()
+	}
+
+	if chatNotifier != nil {
+		defer func() { chatObserveRun(runId, currentStatus()) }()
+	}
+	if emailNotifier != nil {
+		defer func() { emailObserveRun(runId, currentStatus(), s.reported) }()
+	}
+	if syncObserver != nil {
+		defer func() { syncObserver.finished(runId, s.userCount, s.failed.users()) }()
+	}
+
+	if cfg.hookSuccess != "" || cfg.hookFailure != "" {
+		defer func() { hookRunFinished(ctx, runId, readOnly, changesPayload, err) }()
+	}
+	if err = hookRun(ctx, cfg.hookPre, runId, readOnly, nil); err != nil {
+		log.WithError(err).Error("Pre-sync hook failed, aborting the sync")
+		return
+	}
+
+	if cfg.vaultAddr != "" {
+		if err = vaultRefresh(); err != nil {
+			log.WithError(err).Error("Cannot fetch credentials from Vault")
+			err = fmt.Errorf("%w: %w", errSyncConnection, err)
+			return
+		}
+	}
+
+	db, dbRelease, err := syncSqlOpen(readOnly)
+	if err != nil {
+		log.WithError(err).Error("Cannot establish database connection")
+		metrics.countError(MetricSourceSql)
+		err = fmt.Errorf("%w: %w", errSyncConnection, err)
+		return
+	}
+	defer dbRelease()
+	s.db = db
+
+	// The users are fetched from the EnvDbReplicaHost, if set.
+	fetchDb := db
+	if cfg.dbReplicaHost != "" {
+		if fetchDb, err = sqlOpenReplica(); err != nil {
+			log.WithError(err).Error("Cannot establish database replica connection")
+			metrics.countError(MetricSourceSql)
+			err = fmt.Errorf("%w: %w", errSyncConnection, err)
+			return
+		}
+		defer fetchDb.Close()
+	}
+
+	// The status is written once, right after the last update was committed or,
+	// for a failed sync, by the deferred call. Like the history, it is written
+	// even for a canceled ctx.
+	statusWritten := cfg.statusTable == "" || readOnly || len(cfg.users) > 0
+	writeStatus := func() {
+		if statusWritten {
+			return
+		}
+		statusWritten = true
+		if statusErr := sqlWriteStatus(context.WithoutCancel(ctx), db, currentStatus()); statusErr != nil {
+			log.WithError(statusErr).WithField("table", cfg.statusTable).Error("Failed to write sync status")
+		}
+	}
+	defer writeStatus()
+	if cfg.historyTable != "" && !readOnly && len(cfg.users) == 0 {
+		defer func() {
+			run := syncHistory{
+				runId:   runId,
+				started: s.startTime,
+				mode:    historyMode,
+				status:  currentStatus(),
+				changed: len(s.updatedUsers) + len(s.roleUpdatedUsers) + len(s.deactivatedUsers) + len(s.reactivatedUsers) +
+					len(s.provisionedUsers) + len(s.sharedUpdatedUsers) + len(s.duplicateResolvedUsers),
+				failed: s.failed.users(),
+			}
+			if historyErr := sqlWriteHistory(context.WithoutCancel(ctx), db, run); historyErr != nil {
+				log.WithError(historyErr).WithField("table", cfg.historyTable).Error("Failed to write sync history")
+			}
+		}()
+	}
+
+	// Registered after the status, failed users are reported there as well.
+	partialErr := func() {
+		if err == nil && s.userFailures > 0 {
+			err = fmt.Errorf("%w: %d users", errSyncPartial, s.userFailures)
+		}
+	}
+	defer partialErr()
+
+	ldapConns, ldapRelease, err := syncLdapOpenPool(cfg.concurrency)
+	if err != nil {
+		log.WithError(err).Error("Cannot establish LDAP connection")
+		metrics.countError(MetricSourceLdap)
+		err = fmt.Errorf("%w: %w", errSyncConnection, err)
+		return
+	}
+	defer ldapRelease()
+	defer ldapReferralClose()
+	s.ldapConns = ldapConns
+
+	// The EnvCursorTable's progress is shared by all instances and restarts.
+	if cfg.cursorTable != "" {
+		if cursor, ok, cursorErr := sqlReadCursor(ctx, db, readOnly); cursorErr != nil {
+			log.WithError(cursorErr).WithField("table", cfg.cursorTable).Warn("Cannot read the sync cursor")
+		} else if ok {
+			incrementalRestore(cursor)
+			log.WithFields(log.Fields{
+				"run":       cursor.runId,
+				"last_sync": cursor.lastSync,
+			}).Debug("Restored the sync cursor")
+		}
+	}
+
+	// An incremental sync only compares users whose LDAP entries were modified.
+	since, incremental := incrementalSince(s.startTime)
+	var modifiedUids map[string]bool
+	var modifyTimestamp string
+	if incremental {
+		var modErr error
+		if modifiedUids, modifyTimestamp, modErr = ldapModifiedUids(ldapConns[0], since); modErr != nil {
+			log.WithError(modErr).Warn("Cannot list modified LDAP users, falling back to a full sync")
+			incremental = false
+		} else {
+			historyMode = HistoryModeIncremental
+			log.WithFields(log.Fields{
+				"since":    since,
+				"modified": len(modifiedUids),
+			}).Info("Performing incremental sync")
+		}
+	}
+	s.incremental, s.modifiedUids = incremental, modifiedUids
+	defer func() {
+		// A sync of the EnvUser users is neither a full nor an incremental one.
+		if err == nil && !readOnly && len(cfg.users) == 0 {
+			incrementalDone(s.startTime, !incremental)
+
+			if cfg.cursorTable != "" {
+				cursor := incrementalCursor()
+				cursor.runId, cursor.modifyTimestamp = runId, modifyTimestamp
+				if cursorErr := sqlWriteCursor(ctx, db, cursor); cursorErr != nil {
+					log.WithError(cursorErr).WithField("table", cfg.cursorTable).Error("Failed to write the sync cursor")
+				}
+			}
+		}
+	}()
+
+	if len(cfg.includeGroups)+len(cfg.excludeGroups) > 0 {
+		if s.scope, err = ldapLoadScope(ldapConns[0]); err != nil {
+			log.WithError(err).Error("Cannot fetch LDAP groups limiting the sync")
+			metrics.countError(MetricSourceLdap)
+			err = fmt.Errorf("%w: %w", errSyncConnection, err)
+			return
+		}
+	}
+	s.withGroups = ldapWithGroups()
+
+	if len(cfg.sharedRooms) > 0 {
+		if s.sharedRooms, err = sqlLoadSharedRooms(ctx, db); err != nil {
+			log.WithError(err).Error("Cannot fetch the shared rooms")
+			metrics.countError(MetricSourceSql)
+			err = fmt.Errorf("%w: %w", errSyncConnection, err)
+			return
+		}
+	}
+
+	if cfg.duplicateAccounts != DuplicateAccountsIgnore {
+		if s.duplicates, err = sqlFetchDuplicateAccounts(ctx, db); err != nil {
+			log.WithError(err).Error("Cannot fetch Greenlight accounts not synced from LDAP")
+			metrics.countError(MetricSourceSql)
+			err = fmt.Errorf("%w: %w", errSyncConnection, err)
+			return
+		}
+	}
+
+	if len(cfg.users) > 0 {
+		defer func() { selectedUsersReport(os.Stdout, s.knownUsers, s.reported, err) }()
+	}
+
+	defer s.failed.log(runId)
+
+	defer func() {
+		for range s.failures {
+			metrics.countError(MetricSourceSql)
+		}
+	}()
+	joinFailures := func() {
+		if err == nil && len(s.failures) > 0 {
+			err = fmt.Errorf("%w: %w", errSyncUpdate, errors.Join(s.failures...))
+		}
+	}
+	defer joinFailures()
+
+	// Users are fetched and synced in batches of EnvSqlBatchSize, if set, to
+	// bound the memory use. The SQL users are streamed, the next batch being
+	// fetched while the previous one is compared and updated.
+	fetchCtx, fetchCancel := context.WithCancel(ctx)
+	defer fetchCancel()
+	for batch := range sqlFetchStream(fetchCtx, fetchDb, cfg.users, cfg.sqlBatchSize) {
+		if err = batch.err; err != nil {
+			log.WithError(err).Error("Cannot fetch users from SQL")
+			metrics.countError(MetricSourceSql)
+			return
+		}
+
+		b := newSyncBatch(batch.users)
+		userNames, searchResults, fetchErr := s.fetch(ctx, b)
+		if err = fetchErr; err != nil {
+			return
+		}
+		if err = s.compare(ctx, b, userNames, searchResults); err != nil {
+			return
+		}
+		if readOnly {
+			continue
+		} else if err = s.checkThreshold(); err != nil {
+			return
+		}
+		if err = s.apply(ctx, b); err != nil {
+			return
+		}
+	}
+	// A canceled stream stops without sending a failed batch.
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+		log.WithError(err).Error("LDAP sync was canceled")
+		return
+	}
+
+	var provisionUsers []provisionUser
+	if cfg.provisionBase != "" && len(cfg.users) == 0 {
+		provisionUsers = s.compareProvision(ctx)
+	}
+
+	sortChanges(s.changes)
+	if eventStream != nil && cfg.eventDetected {
+		eventStream.write(runId, EventActionDetected, s.changes)
+	}
+	if syncObserver != nil {
+		syncObserver.detected(runId, s.changes)
+	}
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+		log.WithError(err).Error("LDAP sync was canceled")
+		return
+	}
+
+	if readOnly {
+		if thresholdErr := cfg.maxChanges.check(s.changes, s.userCount); thresholdErr != nil {
+			log.WithError(thresholdErr).Warn("Dry run: sync would be aborted")
+		}
+		dryRunReport(s.changes)
+		s.reported = writeReport(runId, s.startTime, s.changes, nil, true, s.failed.ambiguous)
+		return
+	}
+
+	if len(provisionUsers) > 0 {
+		if err = s.checkThreshold(); err != nil {
+			return
+		}
+	}
+	s.applyProvision(ctx, provisionUsers)
+	joinFailures()
+	partialErr()
+	writeStatus()
+
+	applied := appliedChanges(s.changes, s.updatedUsers, s.roleUpdatedUsers, slices.Concat(s.deactivatedUsers, s.reactivatedUsers), s.provisionedUsers, s.sharedUpdatedUsers, s.duplicateResolvedUsers)
+	metrics.countChanges(applied)
+	s.reported = writeReport(runId, s.startTime, s.changes, applied, false, s.failed.ambiguous)
+
+	if cfg.auditTable != "" {
+		if auditErr := sqlWriteAudit(ctx, db, runId, applied, s.knownUsers); auditErr != nil {
+			log.WithError(auditErr).WithField("table", cfg.auditTable).Error("Failed to write audit log")
+			metrics.countError(MetricSourceSql)
+		}
+	}
+
+	if eventStream != nil {
+		eventStream.write(runId, EventActionApplied, applied)
+	}
+	if syncObserver != nil {
+		syncObserver.applied(runId, applied)
+	}
+
+	if len(s.deactivatedUsers) > 0 {
+		chatPost(fmt.Sprintf("Greenlight LDAP sync %s deactivated %d users: %s",
+			runId, len(s.deactivatedUsers), chatUserList(s.deactivatedUsers)))
+	}
+
+	changesPayload = map[string]any{
+		"run_id":       runId,
+		"updated":      s.updatedUsers,
+		"role_updated": s.roleUpdatedUsers,
+		"deactivated":  s.deactivatedUsers,
+		"reactivated":  s.reactivatedUsers,
+		"provisioned":  s.provisionedUsers,
+		"changes":      changeEvents(runId, EventActionApplied, applied),
+	}
+	if webhookNotifier != nil && len(applied) > 0 {
+		webhookNotifier.send(cfg.webhookUrl, changesPayload)
+	}
+
+	return
+}
+
+// configApply applies a loaded configuration's global settings, being the log
+// level and the queried SQL columns.
+func configApply(c *config) {
+	log.SetLevel(c.logLevel)
+
+	sqlUseSchema(c.schema, c.providers)
+	sqlUseMatchColumn(c.matchColumn)
+	if c.attributeMap != nil {
+		cols := make([]string, 0, len(c.attributeMap))
+		for col := range c.attributeMap {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		sqlSetWritableColumns(cols)
+	}
+	if c.departmentColumn != "" {
+		sqlAddWritableColumn(c.departmentColumn)
+	}
+	for col := range c.attributeTemplate {
+		sqlAddWritableColumn(col)
+	}
+}
@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Config is the configuration of a Syncer, mapping the environment variables
+// of the command, e.g., LDAP_SERVER or EnvDryRun, to their values. Its values
+// take precedence over the process environment.
+type Config map[string]string
+
+// Change is a user's attribute changed by a sync.
+type Change struct {
+	User      string
+	Attribute string
+	Old       string
+	New       string
+}
+
+// Result summarizes a sync performed by Syncer.Run.
+type Result struct {
+	RunId string
+
+	// Users is the number of compared users, of which Failed failed.
+	Users  int
+	Failed int
+
+	// Detected are the changes found by the sync, of which Applied were
+	// written. Nothing is applied for EnvDryRun.
+	Detected []Change
+	Applied  []Change
+}
+
+// Hooks are called during a Syncer.Run, each being optional.
+type Hooks struct {
+	// Detected is called with the detected changes, after all users were
+	// compared.
+	Detected func(runId string, changes []Change)
+
+	// Applied is called with the applied changes, after the last update was
+	// committed.
+	Applied func(runId string, changes []Change)
+
+	// Finished is called with the Result of each sync, also of a failed one.
+	Finished func(result Result, err error)
+}
+
+// Syncer performs syncs with its own Config, e.g., for a tool embedding the
+// sync engine instead of running the command.
+type Syncer struct {
+	Config Config
+	Hooks  Hooks
+}
+
+// syncerMu serializes the Syncer.Run calls, as the sync engine keeps
+// process-wide state.
+var syncerMu sync.Mutex
+
+// Run performs a single sync with the Syncer's Config, like the sync command.
+// An invalid Config fails before connecting, otherwise the error is the one of
+// the sync, see ExitCode.
+//
+// While running, the Config is applied to the environment and the active
+// configuration, both being restored afterwards, as the connections and caches
+// are process-wide. Thus, runs of all Syncers are performed one after another,
+// like the command's jobs, and cannot be combined with the command within the
+// same process. The command's endpoints, notifications, and schedule are not
+// set up, being left to the embedding tool, e.g., by the Hooks.
+func (s *Syncer) Run(ctx context.Context) (result Result, err error) {
+	syncerMu.Lock()
+	defer syncerMu.Unlock()
+
+	environ, common := os.Environ(), cfg
+	defer func() {
+		syncObserver = nil
+		syncPoolClose()
+		configEnvironRestore(environ)
+		cfg = common
+		configApply(cfg)
+	}()
+
+	for key, value := range s.Config {
+		_ = os.Setenv(key, value)
+	}
+	runCfg, err := configLoadDetect()
+	if err != nil {
+		err = fmt.Errorf("invalid configuration: %w", err)
+		if s.Hooks.Finished != nil {
+			s.Hooks.Finished(result, err)
+		}
+		return
+	}
+	cfg = runCfg
+	configApply(cfg)
+
+	observer := &runObserver{hooks: s.Hooks}
+	syncObserver = observer
+	err = syncAction(ctx)
+	if s.Hooks.Finished != nil {
+		s.Hooks.Finished(observer.result, err)
+	}
+	return observer.result, err
+}
+
+// syncObserver collects the Result of a Syncer.Run from syncAction, being nil
+// for the command.
+var syncObserver *runObserver
+
+// runObserver builds a Result and calls the Hooks.
+type runObserver struct {
+	hooks  Hooks
+	result Result
+}
+
+// exportChanges converts changes to their exported Change.
+func exportChanges(changes []attrChange) []Change {
+	exported := make([]Change, 0, len(changes))
+	for _, change := range changes {
+		exported = append(exported, Change{change.user, change.attribute, change.old, change.new})
+	}
+	return exported
+}
+
+// detected records the detected changes.
+func (o *runObserver) detected(runId string, changes []attrChange) {
+	o.result.Detected = exportChanges(changes)
+	if o.hooks.Detected != nil {
+		o.hooks.Detected(runId, o.result.Detected)
+	}
+}
+
+// applied records the applied changes.
+func (o *runObserver) applied(runId string, changes []attrChange) {
+	o.result.Applied = exportChanges(changes)
+	if o.hooks.Applied != nil {
+		o.hooks.Applied(runId, o.result.Applied)
+	}
+}
+
+// finished records the counts of the sync with its run id.
+func (o *runObserver) finished(runId string, users, failed int) {
+	o.result.RunId, o.result.Users, o.result.Failed = runId, users, failed
+}
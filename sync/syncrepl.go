@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// syncreplDebounce delays a sync after a change notification, merging further
+// changes, e.g., of a bulk import, into the same sync.
+const syncreplDebounce = 5 * time.Second
+
+// errSyncreplUnsupported reports that the LDAP server rejected the RFC 4533
+// Sync Request control.
+var errSyncreplUnsupported = errors.New("LDAP server does not support the Sync Request control")
+
+// syncreplWatch notifies changes about modified user entries within base as
+// reported by an RFC 4533 refreshAndPersist search, see EnvSyncrepl.
+//
+// The search is reestablished after failures, resuming at the last received
+// cookie. It returns once ctx is done or the server does not support the
+// control, then returning errSyncreplUnsupported.
+func syncreplWatch(ctx context.Context, base ldapSearchBase, changes chan<- struct{}) error {
+	var cookie []byte
+	for attempt := 0; ; attempt++ {
+		var err error
+		cookie, err = syncreplSearch(ctx, base, cookie, changes)
+		if ctx.Err() != nil {
+			return nil
+		} else if ldap.IsErrorAnyOf(err, ldap.LDAPResultUnavailableCriticalExtension, ldap.LDAPResultProtocolError) {
+			return fmt.Errorf("%w: %w", errSyncreplUnsupported, err)
+		} else if err == nil {
+			attempt = 0
+		}
+
+		backoff := fullJitterBackoff(cfg.dialBackoffBase, cfg.dialBackoffMax, attempt)
+		log.WithError(err).WithFields(log.Fields{
+			"base":    base.dn,
+			"backoff": backoff,
+		}).Warn("LDAP sync replication ended, reconnecting")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// syncreplSearch performs a single refreshAndPersist search for syncreplWatch.
+//
+// Without a cookie, the initial refresh lists all entries, which are already
+// covered by regular syncs, and is thus ignored. The latest cookie is returned.
+func syncreplSearch(ctx context.Context, base ldapSearchBase, cookie []byte, changes chan<- struct{}) ([]byte, error) {
+	conn, err := ldapDial()
+	if err != nil {
+		return cookie, err
+	}
+	defer conn.Close()
+
+	// The persistent search lasts until canceled, unlike EnvLdapSearchTimeout.
+	conn.SetTimeout(0)
+
+	uidAttr := cfg.matchAttribute
+	searchReq := ldap.NewSearchRequest(
+		base.dn,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+		false,
+		fmt.Sprintf("(&%s%s%s)", ldapUidPresentFilter(), ldapFilter(), base.filter),
+		[]string{uidAttr},
+		nil)
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	refreshing := cookie == nil
+	resp := conn.Syncrepl(searchCtx, searchReq, 64, ldap.SyncRequestModeRefreshAndPersist, cookie, false)
+	for resp.Next() {
+		for _, control := range resp.Controls() {
+			switch control := control.(type) {
+			case *ldap.ControlSyncState:
+				if len(control.Cookie) > 0 {
+					cookie = control.Cookie
+				}
+
+			case *ldap.ControlSyncInfo:
+				var infoCookie []byte
+				refreshDone := false
+				switch {
+				case control.NewCookie != nil:
+					infoCookie = control.NewCookie.Cookie
+				case control.RefreshDelete != nil:
+					infoCookie, refreshDone = control.RefreshDelete.Cookie, control.RefreshDelete.RefreshDone
+				case control.RefreshPresent != nil:
+					infoCookie, refreshDone = control.RefreshPresent.Cookie, control.RefreshPresent.RefreshDone
+				}
+
+				if len(infoCookie) > 0 {
+					cookie = infoCookie
+				}
+				if refreshing && refreshDone {
+					refreshing = false
+					log.Debug("LDAP sync replication finished its refresh, waiting for changes")
+				}
+			}
+		}
+
+		if entry := resp.Entry(); entry != nil && !refreshing {
+			log.WithField("dn", entry.DN).Debug("LDAP sync replication reported a change")
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return cookie, resp.Err()
+}
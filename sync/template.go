@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// attrTemplateFuncs are the functions available to EnvAttributeTemplate
+// templates. The string argument comes last, allowing pipelines like
+// {{.uid | trimSuffix "@example.org"}}.
+var attrTemplateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"before": func(sep, s string) string {
+		before, _, _ := strings.Cut(s, sep)
+		return before
+	},
+}
+
+// attrTemplate is a parsed EnvAttributeTemplate value of a column.
+type attrTemplate struct {
+	tmpl *template.Template
+
+	// attrs are the LDAP attributes referenced by the template's fields.
+	attrs []string
+}
+
+// parseAttributeTemplateMap parses SYNC_ATTRIBUTE_TEMPLATE's COLUMN=TEMPLATE
+// pairs, each template being a text/template executed on the LDAP entry, e.g.,
+// "name={{.givenName}} {{.sn}}".
+func parseAttributeTemplateMap(mapStr string) (tmplMap map[string]attrTemplate, err error) {
+	tmplMap = make(map[string]attrTemplate)
+	for _, mapping := range strings.Split(mapStr, ";") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(mapping, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("mapping %s cannot be split", mapping)
+			return
+		}
+
+		col := strings.TrimSpace(kv[0])
+		if col == "" || strings.ContainsAny(col, "{}.?") {
+			err = fmt.Errorf("mapping %s has an invalid column", mapping)
+			return
+		}
+		if slices.Contains(ldapUnmappableColumns, col) {
+			err = fmt.Errorf("mapping %s targets the column %s, which cannot be synced", mapping, col)
+			return
+		}
+
+		var tmpl *template.Template
+		tmpl, err = template.New(col).Funcs(attrTemplateFuncs).Option("missingkey=zero").Parse(kv[1])
+		if err != nil {
+			err = fmt.Errorf("mapping %s has an invalid template: %w", mapping, err)
+			return
+		}
+		tmplMap[col] = attrTemplate{tmpl: tmpl, attrs: attrTemplateFields(tmpl.Root)}
+	}
+	return
+}
+
+// attrTemplateFields lists the top-level fields referenced within a template's
+// parse tree, e.g., givenName for {{.givenName}}.
+func attrTemplateFields(node parse.Node) (fields []string) {
+	add := func(nodes ...parse.Node) {
+		for _, n := range nodes {
+			for _, field := range attrTemplateFields(n) {
+				if !slices.Contains(fields, field) {
+					fields = append(fields, field)
+				}
+			}
+		}
+	}
+
+	switch node := node.(type) {
+	case *parse.FieldNode:
+		fields = append(fields, node.Ident[0])
+	case *parse.ListNode:
+		if node == nil {
+			return
+		}
+		for _, n := range node.Nodes {
+			add(n)
+		}
+	case *parse.ActionNode:
+		add(node.Pipe)
+	case *parse.PipeNode:
+		if node == nil {
+			return
+		}
+		for _, cmd := range node.Cmds {
+			add(cmd)
+		}
+	case *parse.CommandNode:
+		add(node.Args...)
+	case *parse.IfNode:
+		add(node.Pipe, node.List, node.ElseList)
+	case *parse.RangeNode:
+		add(node.Pipe, node.List, node.ElseList)
+	case *parse.WithNode:
+		add(node.Pipe, node.List, node.ElseList)
+	}
+	return
+}
+
+// execute renders the template for an LDAP entry. Each field is the entry's
+// attribute, multiple values being joined by spaces, and empty if absent.
+func (t attrTemplate) execute(entry *ldap.Entry) (string, error) {
+	data := make(map[string]string, len(t.attrs))
+	for _, attr := range t.attrs {
+		data[attr] = strings.Join(entry.GetAttributeValues(attr), " ")
+	}
+
+	var sb strings.Builder
+	if err := t.tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(sb.String()), nil
+}
@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// changeThreshold limits the users changed by a single sync, configured by
+// EnvMaxChanges, either as an absolute number or a percentage of all users.
+type changeThreshold struct {
+	users   int
+	percent int
+}
+
+// parseChangeThreshold parses a SYNC_MAX_CHANGES value, either a number of
+// users like 100 or a percentage like 10%.
+func parseChangeThreshold(thresholdStr string) (t changeThreshold, err error) {
+	thresholdStr = strings.TrimSpace(thresholdStr)
+	if thresholdStr == "" {
+		return
+	}
+
+	if percentStr, ok := strings.CutSuffix(thresholdStr, "%"); ok {
+		t.percent, err = strconv.Atoi(strings.TrimSpace(percentStr))
+		if err != nil || t.percent <= 0 || t.percent >= 100 {
+			err = fmt.Errorf("threshold percentage %q is not within 1%% and 99%%", thresholdStr)
+		}
+		return
+	}
+
+	t.users, err = strconv.Atoi(thresholdStr)
+	if err != nil || t.users <= 0 {
+		err = fmt.Errorf("threshold %q is not a positive number of users", thresholdStr)
+	}
+	return
+}
+
+// check returns an errSyncThreshold if the changes affect more users than
+// allowed, relative to the total number of SQL users for a percentage. Without
+// any SQL users, e.g., before an initial provisioning, a percentage is ignored.
+func (t changeThreshold) check(changes []attrChange, total int) error {
+	users := make(map[string]bool)
+	for _, change := range changes {
+		users[change.user] = true
+	}
+	changed := len(users)
+
+	switch {
+	case t.users > 0 && changed > t.users:
+		return fmt.Errorf("%w: %d users would change, allowed are %d", errSyncThreshold, changed, t.users)
+	case t.percent > 0 && total > 0 && changed*100 > t.percent*total:
+		return fmt.Errorf("%w: %d of %d users would change, allowed are %d%%", errSyncThreshold, changed, total, t.percent)
+	default:
+		return nil
+	}
+}
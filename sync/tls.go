@@ -0,0 +1,190 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tlsVersions are the EnvTLSMinVersion values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion parses an EnvTLSMinVersion value, e.g., "1.2".
+func parseTLSVersion(s string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(s, "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, expected 1.0, 1.1, 1.2, or 1.3", s)
+	}
+	return version, nil
+}
+
+// parseTLSCipherSuites parses EnvTLSCipherSuites' names, e.g.,
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Insecure suites are rejected.
+func parseTLSCipherSuites(names []string) (suites []uint16, err error) {
+	for _, name := range names {
+		var id uint16
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				id = suite.ID
+				break
+			}
+		}
+		if id == 0 {
+			return nil, fmt.Errorf("unsupported or insecure TLS cipher suite %s", name)
+		}
+		suites = append(suites, id)
+	}
+	return
+}
+
+// tlsApply restricts a client's tlsConfig for LDAP or PostgreSQL by the
+// EnvTLSMinVersion and EnvTLSCipherSuites. For the EnvTLSInsecureSkipVerify,
+// the server's certificate is no longer verified.
+//
+// Each connection not verifying its server's certificate is logged as a
+// warning, thus it shows up in an audit of the logs.
+func tlsApply(tlsConfig *tls.Config, service, host string) {
+	if cfg.tlsMinVersion != 0 {
+		tlsConfig.MinVersion = cfg.tlsMinVersion
+	}
+	if len(cfg.tlsCipherSuites) > 0 {
+		tlsConfig.CipherSuites = cfg.tlsCipherSuites
+	}
+
+	if cfg.tlsInsecureSkipVerify {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = nil
+	}
+	if tlsConfig.InsecureSkipVerify && tlsConfig.VerifyPeerCertificate == nil {
+		log.WithFields(log.Fields{
+			"service": service,
+			"host":    host,
+		}).Warn("INSECURE: TLS certificate verification is disabled, the connection is open to man-in-the-middle attacks")
+	}
+}
+
+// sqlTLSCustom checks if PostgreSQL's TLS is established by sqlStartTLS
+// instead of the driver, as only the former supports the EnvTLSMinVersion,
+// EnvTLSCipherSuites, and EnvTLSInsecureSkipVerify.
+func sqlTLSCustom() bool {
+	return cfg.dbSslMode != DbSslModeDisable &&
+		(cfg.tlsMinVersion != 0 || len(cfg.tlsCipherSuites) > 0 || cfg.tlsInsecureSkipVerify)
+}
+
+// sqlTLSConfig creates the TLS configuration of sqlStartTLS, following the
+// EnvDbSslMode's semantics.
+//
+// The require mode does not verify the certificate, unless EnvDbSslRootCert
+// is set, as for verify-ca. The verify-ca mode verifies the chain only, while
+// verify-full also verifies the name against the host, e.g., DB_HOST. Without
+// an EnvDbSslRootCert, the system's CA certificates are used.
+func sqlTLSConfig(host string) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{ServerName: host}
+
+	if cfg.dbSslRootCert != "" {
+		var caPem []byte
+		if caPem, err = os.ReadFile(cfg.dbSslRootCert); err != nil {
+			return
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			err = fmt.Errorf("cannot parse any certificate of %s", cfg.dbSslRootCert)
+			return
+		}
+	}
+
+	if cfg.dbSslCert != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cfg.dbSslCert, cfg.dbSslKey); err != nil {
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	switch {
+	case cfg.dbSslMode == DbSslModeRequire && cfg.dbSslRootCert == "":
+		tlsConfig.InsecureSkipVerify = true
+
+	case cfg.dbSslMode == DbSslModeRequire, cfg.dbSslMode == DbSslModeVerifyCa:
+		// The chain is verified without the name by VerifyPeerCertificate.
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return tlsVerifyChain(rawCerts, roots)
+		}
+	}
+
+	tlsApply(tlsConfig, "SQL", host)
+	return
+}
+
+// tlsVerifyChain verifies the server's raw certificates against the roots,
+// ignoring the server's name, for the DbSslModeVerifyCa.
+func tlsVerifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server presented no certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	var leaf *x509.Certificate
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			leaf = cert
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+// sqlSslRequest is PostgreSQL's SSLRequest message, being its length and the
+// request code 80877102.
+var sqlSslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// sqlStartTLS negotiates TLS on a new PostgreSQL connection by an SSLRequest,
+// performing the handshake within the timeout. The driver then speaks its
+// protocol unencrypted over the returned TLS connection.
+func sqlStartTLS(conn net.Conn, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	if _, err := conn.Write(sqlSslRequest); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	} else if resp[0] != 'S' {
+		return nil, errors.New("PostgreSQL server does not support SSL")
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
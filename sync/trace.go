@@ -0,0 +1,282 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// traceExportTimeout bounds each export request to the EnvOtlpEndpoint.
+	traceExportTimeout = 10 * time.Second
+
+	// traceExportBatch is the maximum number of spans per export request, as a
+	// sync of many users creates a span per LDAP search.
+	traceExportBatch = 1000
+
+	// traceServiceName is the service.name resource attribute of all spans.
+	traceServiceName = "greenlight-ldap-sync"
+)
+
+const (
+	// otlpSpanKindInternal is OTLP's SPAN_KIND_INTERNAL.
+	otlpSpanKindInternal = 1
+
+	// otlpSpanKindClient is OTLP's SPAN_KIND_CLIENT, used for requests to the
+	// LDAP server or the database.
+	otlpSpanKindClient = 3
+
+	// otlpStatusError is OTLP's STATUS_CODE_ERROR.
+	otlpStatusError = 2
+)
+
+// traceSpan is a single span of a sync's trace, exported by OTLP/HTTP.
+//
+// Instead of depending on the OpenTelemetry SDK, the few spans are encoded
+// directly in OTLP's JSON format. A nil span, as returned while tracing is
+// disabled, ignores all calls.
+type traceSpan struct {
+	tracer   *syncTracer
+	traceId  [16]byte
+	spanId   [8]byte
+	parentId [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]any
+	end   time.Time
+	err   error
+}
+
+// syncTracer collects the spans of a single sync.
+type syncTracer struct {
+	mu    sync.Mutex
+	spans []*traceSpan
+}
+
+// traceContextKey stores the current traceSpan within a context.Context.
+type traceContextKey struct{}
+
+// traceStartRun starts the root span of a sync if EnvOtlpEndpoint is set. Its
+// trace is exported once the span ends.
+func traceStartRun(ctx context.Context, name string) (context.Context, *traceSpan) {
+	if cfg.otlpEndpoint == "" {
+		return ctx, nil
+	}
+
+	span := &traceSpan{tracer: &syncTracer{}, name: name, kind: otlpSpanKindInternal, start: time.Now()}
+	_, _ = rand.Read(span.traceId[:])
+	_, _ = rand.Read(span.spanId[:])
+	span.tracer.add(span)
+	return context.WithValue(ctx, traceContextKey{}, span), span
+}
+
+// traceStart starts a span as a child of ctx's current span, being a no-op
+// outside of a traced sync.
+func traceStart(ctx context.Context, name string, kind int) (context.Context, *traceSpan) {
+	parent, _ := ctx.Value(traceContextKey{}).(*traceSpan)
+	if parent == nil {
+		return ctx, nil
+	}
+
+	span := &traceSpan{
+		tracer:   parent.tracer,
+		traceId:  parent.traceId,
+		parentId: parent.spanId,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	_, _ = rand.Read(span.spanId[:])
+	span.tracer.add(span)
+	return context.WithValue(ctx, traceContextKey{}, span), span
+}
+
+// set sets an attribute, being a string, bool, or int.
+func (s *traceSpan) set(key string, v any) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.attrs == nil {
+		s.attrs = make(map[string]any)
+	}
+	s.attrs[key] = v
+}
+
+// finish ends the span, marking it as failed for an error. Finishing the
+// root span of traceStartRun exports the trace.
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.end, s.err = time.Now(), err
+	s.mu.Unlock()
+
+	if s.parentId == [8]byte{} {
+		if exportErr := s.tracer.export(); exportErr != nil {
+			log.WithError(exportErr).Warn("Failed to export the sync's trace")
+		}
+	}
+}
+
+// add records a started span.
+func (t *syncTracer) add(span *traceSpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.spans = append(t.spans, span)
+}
+
+// export sends all finished spans to the EnvOtlpEndpoint in batches.
+func (t *syncTracer) export() error {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+
+	otlpSpans := make([]map[string]any, 0, len(spans))
+	for _, span := range spans {
+		if otlpSpan, ok := span.otlp(); ok {
+			otlpSpans = append(otlpSpans, otlpSpan)
+		}
+	}
+
+	for len(otlpSpans) > 0 {
+		batch := otlpSpans[:min(traceExportBatch, len(otlpSpans))]
+		otlpSpans = otlpSpans[len(batch):]
+		if err := otlpExport(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// otlp encodes a finished span in OTLP's JSON format.
+func (s *traceSpan) otlp() (otlpSpan map[string]any, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.end.IsZero() {
+		return
+	}
+
+	attrs := make([]map[string]any, 0, len(s.attrs))
+	for key, v := range s.attrs {
+		attrs = append(attrs, otlpAttribute(key, v))
+	}
+
+	otlpSpan = map[string]any{
+		"traceId":           hex.EncodeToString(s.traceId[:]),
+		"spanId":            hex.EncodeToString(s.spanId[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        attrs,
+	}
+	if s.parentId != [8]byte{} {
+		otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentId[:])
+	}
+	if s.err != nil {
+		otlpSpan["status"] = map[string]any{"code": otlpStatusError, "message": s.err.Error()}
+	}
+	return otlpSpan, true
+}
+
+// otlpAttribute encodes an attribute as OTLP's KeyValue.
+func otlpAttribute(key string, v any) map[string]any {
+	var value map[string]any
+	switch v := v.(type) {
+	case bool:
+		value = map[string]any{"boolValue": v}
+	case int:
+		value = map[string]any{"intValue": strconv.Itoa(v)}
+	default:
+		value = map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+	return map[string]any{"key": key, "value": value}
+}
+
+// otlpExport POSTs spans to the EnvOtlpEndpoint's /v1/traces, together with
+// the EnvOtlpHeaders, e.g., for authentication.
+func otlpExport(spans []map[string]any) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []map[string]any{{
+			"resource": map[string]any{
+				"attributes": []map[string]any{
+					otlpAttribute("service.name", traceServiceName),
+					otlpAttribute("service.version", Version),
+				},
+			},
+			"scopeSpans": []map[string]any{{
+				"scope": map[string]any{"name": traceServiceName, "version": Version},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.otlpEndpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, v := range cfg.otlpHeaders {
+		req.Header.Set(key, v)
+	}
+
+	client := &http.Client{Timeout: traceExportTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// parseOtlpHeaders parses comma separated KEY=VALUE pairs of EnvOtlpHeaders,
+// following OTEL_EXPORTER_OTLP_HEADERS.
+func parseOtlpHeaders(headersStr string) (headers map[string]string, err error) {
+	headers = make(map[string]string)
+	for _, pair := range strings.Split(headersStr, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		key, v, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			err = fmt.Errorf("header %q lacks a value", strings.TrimSpace(pair))
+			return
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(v)
+	}
+	return
+}
@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// validateCheck is a single named check of validateOnly.
+type validateCheck struct {
+	name string
+	run  func() (warning string, err error)
+}
+
+// validateOnly checks the configuration and connectivity, printing a report.
+//
+// Each check is reported on its own, allowing to spot multiple problems at
+// once. Checks depending on an unavailable connection fail as well. True is
+// returned if all checks passed.
+func validateOnly(w io.Writer, cfgErr error) bool {
+	var db *sqlDB
+	var conn ldapSearcher
+	defer func() {
+		if db != nil {
+			db.Close()
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	checks := []validateCheck{
+		{"configuration", func() (string, error) {
+			return "", cfgErr
+		}},
+		{"Vault credentials", func() (string, error) {
+			if cfgErr != nil || cfg.vaultAddr == "" {
+				return "not configured", nil
+			}
+			return "", vaultRefresh()
+		}},
+		{"LDAP connection and bind", func() (_ string, err error) {
+			conn, err = ldapOpen()
+			return
+		}},
+		{"database connection", func() (_ string, err error) {
+			db, err = sqlOpen(true)
+			return
+		}},
+		{"database columns", func() (string, error) {
+			if db == nil {
+				return "", fmt.Errorf("no database connection")
+			}
+
+			return "", sqlVerifyColumns(context.Background(), db)
+		}},
+		{"LDAP attributes of a sample user", func() (string, error) {
+			if db == nil || conn == nil {
+				return "", fmt.Errorf("no database or LDAP connection")
+			}
+
+			users, err := sqlFetchUsers(context.Background(), db)
+			if err != nil {
+				return "", err
+			}
+			samples := make([]string, 0, len(users))
+			for user := range users {
+				samples = append(samples, user)
+			}
+			if len(samples) == 0 {
+				return "no LDAP users in the database to sample", nil
+			}
+			sort.Strings(samples)
+
+			withGroups := len(cfg.roleMap)+len(cfg.sharedRooms) > 0 || len(cfg.includeGroups)+len(cfg.excludeGroups) > 0 || cfg.adminGroup != ""
+			ldapUsr, err := ldapUserSearch(context.Background(), conn, samples[0], withGroups)
+			if err != nil {
+				return "", fmt.Errorf("user %s: %w", samples[0], err)
+			}
+
+			var missing []string
+			for _, col := range sqlWritableColumns {
+				if _, ok := ldapUsr.attrs[col]; !ok {
+					missing = append(missing, col)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Sprintf("user %s has no LDAP value for: %s", samples[0], strings.Join(missing, ", ")), nil
+			}
+			return "", nil
+		}},
+		{"Greenlight rooms", func() (string, error) {
+			if len(cfg.sharedRooms) == 0 && cfg.roomPolicy != RoomPolicyTransfer {
+				return "not configured", nil
+			} else if db == nil {
+				return "", fmt.Errorf("no database connection")
+			}
+
+			if cfg.roomPolicy == RoomPolicyTransfer {
+				if _, err := sqlRoomOwnerId(context.Background(), db, db); err != nil {
+					return "", err
+				}
+			}
+
+			state, err := sqlLoadSharedRooms(context.Background(), db)
+			if err != nil {
+				return "", err
+			}
+			var missing []string
+			for _, mapping := range cfg.sharedRooms {
+				if _, ok := state.ids[mapping.room]; !ok && !slices.Contains(missing, mapping.room) {
+					missing = append(missing, mapping.room)
+				}
+			}
+			if len(missing) > 0 {
+				return fmt.Sprintf("%s rooms do not exist: %s", EnvSharedRooms, strings.Join(missing, ", ")), nil
+			}
+			return "", nil
+		}},
+	}
+
+	passed := validateReport(w, checks)
+	if passed {
+		fmt.Fprintln(w, "Validation passed")
+	} else {
+		fmt.Fprintln(w, "Validation failed")
+	}
+	return passed
+}
+
+// validateReport runs the checks in order, printing a line per check. True is
+// returned if no check failed.
+func validateReport(w io.Writer, checks []validateCheck) (passed bool) {
+	passed = true
+	for _, check := range checks {
+		warning, err := check.run()
+		switch {
+		case err != nil:
+			passed = false
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", check.name, err)
+		case warning != "":
+			fmt.Fprintf(w, "[WARN] %s: %s\n", check.name, warning)
+		default:
+			fmt.Fprintf(w, "[ OK ] %s\n", check.name)
+		}
+	}
+	return
+}
@@ -0,0 +1,255 @@
+// SPDX-FileCopyrightText: 2021 Alvar Penning
+//
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package sync
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// vaultTimeout bounds each request to the Vault API.
+	vaultTimeout = 10 * time.Second
+
+	// vaultLeaseMinRemaining is the lease time dynamic database credentials
+	// must have left before a run, otherwise new ones are requested. This
+	// prevents a lease from expiring within a long-running sync.
+	vaultLeaseMinRemaining = 15 * time.Minute
+)
+
+// vaultCredentials are credentials read from a Vault secret.
+type vaultCredentials struct {
+	path     string
+	username string
+	password string
+
+	// leaseId, renewable, and expires describe a dynamic secret's lease, e.g.,
+	// of Vault's database secrets engine. A static secret has no leaseId.
+	leaseId   string
+	renewable bool
+	expires   time.Time
+	duration  time.Duration
+}
+
+// vaultState holds the credentials fetched by vaultRefresh.
+var vaultState struct {
+	sync.Mutex
+	client *http.Client
+	ldap   *vaultCredentials
+	db     *vaultCredentials
+}
+
+// vaultSecretResponse is the Vault API's response for reading a secret or
+// renewing a lease.
+type vaultSecretResponse struct {
+	LeaseId       string         `json:"lease_id"`
+	LeaseDuration int            `json:"lease_duration"`
+	Renewable     bool           `json:"renewable"`
+	Data          map[string]any `json:"data"`
+	Errors        []string       `json:"errors"`
+}
+
+// vaultRefresh fetches the credentials of EnvVaultLdapPath and EnvVaultDbPath
+// at start and before each run.
+//
+// The LDAP secret is read on each call, picking up rotated values. Dynamic
+// database credentials are kept while their lease lasts, renewing it if
+// possible. Otherwise, new ones are requested and the kept database
+// connections of EnvReuseConnections are closed, as they use the old ones.
+func vaultRefresh() (err error) {
+	vaultState.Lock()
+	defer vaultState.Unlock()
+
+	if vaultState.client == nil {
+		if vaultState.client, err = vaultClient(); err != nil {
+			return
+		}
+	}
+
+	if cfg.vaultLdapPath != "" {
+		if vaultState.ldap, err = vaultRead(cfg.vaultLdapPath, "bind_dn", "password"); err != nil {
+			err = fmt.Errorf("cannot read %s: %w", EnvVaultLdapPath, err)
+			return
+		}
+	}
+
+	if cfg.vaultDbPath == "" {
+		return
+	}
+	if creds := vaultState.db; creds != nil && creds.path == cfg.vaultDbPath {
+		if creds.leaseId == "" {
+			return
+		}
+		if creds.renewable {
+			if renewErr := vaultRenew(creds); renewErr != nil {
+				log.WithError(renewErr).Warn("Cannot renew the Vault lease of the database credentials, requesting new ones")
+			}
+		}
+		if time.Until(creds.expires) >= vaultLeaseMinRemaining {
+			return
+		}
+	}
+
+	var creds *vaultCredentials
+	if creds, err = vaultRead(cfg.vaultDbPath, "username", "password"); err != nil {
+		err = fmt.Errorf("cannot read %s: %w", EnvVaultDbPath, err)
+		return
+	}
+	if vaultState.db != nil && connPool.db != nil {
+		_ = connPool.db.Close()
+		connPool.db = nil
+	}
+	vaultState.db = creds
+	log.WithFields(log.Fields{
+		"username": creds.username,
+		"expires":  creds.expires,
+	}).Debug("Fetched database credentials from Vault")
+	return
+}
+
+// vaultRevoke revokes the lease of the dynamic database credentials at
+// shutdown, instead of leaving the database role until the lease expires.
+func vaultRevoke() {
+	vaultState.Lock()
+	defer vaultState.Unlock()
+
+	if vaultState.db == nil || vaultState.db.leaseId == "" {
+		return
+	}
+	body := map[string]string{"lease_id": vaultState.db.leaseId}
+	if _, err := vaultRequest(http.MethodPut, "sys/leases/revoke", body); err != nil {
+		log.WithError(err).Warn("Cannot revoke the Vault lease of the database credentials")
+	}
+	vaultState.db = nil
+}
+
+// vaultClient creates the HTTP client for the Vault API, trusting the
+// EnvVaultCAFile in addition to the system's CAs.
+func vaultClient() (client *http.Client, err error) {
+	tlsConfig := &tls.Config{}
+	if cfg.vaultCAFile != "" {
+		var caPem []byte
+		if caPem, err = os.ReadFile(cfg.vaultCAFile); err != nil {
+			return
+		}
+
+		if tlsConfig.RootCAs, err = x509.SystemCertPool(); err != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			err = fmt.Errorf("cannot parse any certificate of %s", cfg.vaultCAFile)
+			return
+		}
+	}
+
+	client = &http.Client{
+		Timeout:   vaultTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return
+}
+
+// vaultRead reads the username and password fields of a secret.
+//
+// Both KV version 1 and 2 secrets are supported, the latter being detected by
+// its nested data and metadata.
+func vaultRead(path, usernameField, passwordField string) (creds *vaultCredentials, err error) {
+	resp, err := vaultRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return
+	}
+
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]any); ok && data["metadata"] != nil {
+		data = inner
+	}
+	username, _ := data[usernameField].(string)
+	password, _ := data[passwordField].(string)
+	if username == "" || password == "" {
+		err = fmt.Errorf("secret %s lacks the %s or %s field", path, usernameField, passwordField)
+		return
+	}
+
+	creds = &vaultCredentials{
+		path:      path,
+		username:  username,
+		password:  password,
+		leaseId:   resp.LeaseId,
+		renewable: resp.Renewable,
+		duration:  time.Duration(resp.LeaseDuration) * time.Second,
+	}
+	creds.expires = time.Now().Add(creds.duration)
+	return
+}
+
+// vaultRenew extends a lease by its initial duration, as far as its maximum
+// TTL allows.
+func vaultRenew(creds *vaultCredentials) error {
+	body := map[string]any{
+		"lease_id":  creds.leaseId,
+		"increment": int(creds.duration.Seconds()),
+	}
+	resp, err := vaultRequest(http.MethodPut, "sys/leases/renew", body)
+	if err != nil {
+		return err
+	}
+	creds.expires = time.Now().Add(time.Duration(resp.LeaseDuration) * time.Second)
+	return nil
+}
+
+// vaultRequest performs a request to the Vault API's path below /v1/,
+// authenticated by the EnvVaultToken.
+func vaultRequest(method, path string, body any) (resp *vaultSecretResponse, err error) {
+	token, err := configSecret(EnvVaultToken)
+	if err != nil {
+		return
+	}
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err = json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return
+		}
+	}
+
+	url := strings.TrimSuffix(cfg.vaultAddr, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequest(method, url, &reqBody)
+	if err != nil {
+		return
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResp, err := vaultState.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer httpResp.Body.Close()
+
+	resp = &vaultSecretResponse{}
+	if decodeErr := json.NewDecoder(httpResp.Body).Decode(resp); decodeErr != nil && httpResp.StatusCode == http.StatusOK {
+		err = fmt.Errorf("cannot decode Vault response: %w", decodeErr)
+		return
+	}
+	if httpResp.StatusCode != http.StatusOK && httpResp.StatusCode != http.StatusNoContent {
+		err = fmt.Errorf("unexpected HTTP status %s", httpResp.Status)
+		if len(resp.Errors) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.Join(resp.Errors, "; "))
+		}
+	}
+	return
+}